@@ -39,7 +39,15 @@ func newCmdAssumePrivileges() *cobra.Command {
 			the credentials have expired, the auth proxy is shut down and the gcloud config is restored.
 			
 			The reason flag is used to add additional metadata to audit logs.  The provided reason will
-			be in 'protoPayload.requestMetadata.requestAttributes.reason'.`),
+			be in 'protoPayload.requestMetadata.requestAttributes.reason'.
+			
+			Use --as and --as-group to make kubectl act as a narrower Kubernetes identity in the default
+			cluster than the service account. They are recorded in the session's kubeconfig, so RBAC is
+			checked for the impersonated user and groups while the service account's token still
+			authenticates the requests.
+			
+			The service account's access token is never refreshed. The privileged session ends, and the
+			auth proxy stops, when the token expires.`),
 		Example: dedent.Dedent(`
 				eiam assume-privileges \
 				  --service-account-email example@my-project.iam.gserviceaccount.com \
@@ -48,17 +56,22 @@ func newCmdAssumePrivileges() *cobra.Command {
 			if err := options.CheckRequired(cmd.Flags()); err != nil {
 				return err
 			}
+			if err := options.CheckKubeImpersonation(apCmdConfig.KubeAs, apCmdConfig.KubeAsGroups); err != nil {
+				return err
+			}
 
 			if err := util.FormatReason(&apCmdConfig.Reason); err != nil {
 				return err
 			}
 
 			if !options.YesOption {
-				util.Confirm(map[string]string{
+				confirmation := map[string]string{
 					"Project":         apCmdConfig.Project,
 					"Service Account": apCmdConfig.ServiceAccountEmail,
 					"Reason":          apCmdConfig.Reason,
-				})
+				}
+				addKubeImpersonation(confirmation, apCmdConfig.KubeAs, apCmdConfig.KubeAsGroups)
+				util.Confirm(confirmation)
 			}
 			return nil
 		},
@@ -70,6 +83,8 @@ func newCmdAssumePrivileges() *cobra.Command {
 	options.AddServiceAccountEmailFlag(cmd.Flags(), &apCmdConfig.ServiceAccountEmail, true)
 	options.AddReasonFlag(cmd.Flags(), &apCmdConfig.Reason, true)
 	options.AddProjectFlag(cmd.Flags(), &apCmdConfig.Project, false)
+	options.AddKubeAsFlag(cmd.Flags(), &apCmdConfig.KubeAs)
+	options.AddKubeAsGroupFlag(cmd.Flags(), &apCmdConfig.KubeAsGroups)
 
 	return cmd
 }
@@ -137,5 +152,6 @@ func startPrivilegedSession() error {
 		apCmdConfig.Project,
 		expirationDate,
 		defaultCluster,
+		proxy.KubeImpersonation{User: apCmdConfig.KubeAs, Groups: apCmdConfig.KubeAsGroups},
 	)
 }
@@ -15,103 +15,32 @@
 package eiam
 
 import (
-	"errors"
-	"fmt"
-	"os"
-	"os/exec"
-	"strings"
-
 	"github.com/lithammer/dedent"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
-
-	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
-	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
-	"github.com/rigup/ephemeral-iam/internal/gcpclient"
-	"github.com/rigup/ephemeral-iam/pkg/options"
-)
-
-var (
-	cloudSQLProxyCmdArgs []string
-	cspCmdConfig         options.CmdConfig
 
-	cloudSQLProxyPath string
+	"github.com/rigup/ephemeral-iam/internal/wrapper"
 )
 
 func newCmdCloudSQLProxy() *cobra.Command {
-	cmd := &cobra.Command{
-		Use:   "cloud_sql_proxy [GCLOUD_ARGS]",
-		Short: "Run cloud_sql_proxy with the permissions of the specified service account",
-		Long: dedent.Dedent(`
+	return newCmdWrapper(wrapper.CloudSQLProxy(), wrapperOptions{
+		long: dedent.Dedent(`
 			The "cloud_sql_proxy" command runs the provided cloud_sql_proxy command with the permissions of the specified
-			service account.`),
-		Example: dedent.Dedent(`
+			service account. Both cloud_sql_proxy (v1) and cloud-sql-proxy (v2) are supported.
+			
+			The proxy gets its access tokens from a local metadata server that refreshes them, so it keeps accepting
+			new connections for as long as it runs. After the duration in the "metadataserver.sessionlimit"
+			configuration field, the proxy is stopped gracefully and restarted with a new metadata server and new
+			tokens, so that it keeps running until it is interrupted or exits on its own. eiam then exits with the
+			proxy's exit status.
+			
+			To connect to Cloud SQL instances without installing the proxy, use "eiam sql proxy" instead.`),
+		example: dedent.Dedent(`
 			eiam cloud_sql_proxy -instances my-project:us-central1:example-instance=tcp:3306 \
 			--service-account-email example@my-project.iam.gserviceaccount.com \
-			--reason "Debugging for (JIRA-1234)"`),
-		Args:               cobra.ArbitraryArgs,
-		FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
-		PreRunE: func(cmd *cobra.Command, args []string) error {
-			if cloudSQLProxyPath = viper.GetString("binarypaths.cloudsqlproxy"); cloudSQLProxyPath == "" {
-				err := errors.New(`"cloud_sql_proxy": executable file not found in $PATH`)
-				return errorsutil.New("Failed to run cloud_sql_proxy command", err)
-			}
-
-			if err := options.CheckRequired(cmd.Flags()); err != nil {
-				return err
-			}
-
-			cloudSQLProxyCmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
-			if err := util.FormatReason(&cspCmdConfig.Reason); err != nil {
-				return err
-			}
-
-			if !options.YesOption {
-				util.Confirm(map[string]string{
-					"Project":         cspCmdConfig.Project,
-					"Service Account": cspCmdConfig.ServiceAccountEmail,
-					"Reason":          cspCmdConfig.Reason,
-					"Command":         fmt.Sprintf("cloud_sql_proxy %s", strings.Join(cloudSQLProxyCmdArgs, " ")),
-				})
-			}
-			return nil
-		},
-		RunE: func(cmd *cobra.Command, args []string) error {
-			return runCloudSQLProxyCommand()
-		},
-	}
-
-	options.AddServiceAccountEmailFlag(cmd.Flags(), &cspCmdConfig.ServiceAccountEmail, true)
-	options.AddReasonFlag(cmd.Flags(), &cspCmdConfig.Reason, true)
-	options.AddProjectFlag(cmd.Flags(), &cspCmdConfig.Project, false)
-
-	return cmd
-}
-
-func runCloudSQLProxyCommand() error {
-	hasAccess, err := gcpclient.CanImpersonate(cspCmdConfig.Project, cspCmdConfig.ServiceAccountEmail)
-	if err != nil {
-		return err
-	} else if !hasAccess {
-		util.Logger.Fatalln("You do not have access to impersonate this service account")
-	}
-
-	util.Logger.Infof("Fetching access token for %s", cspCmdConfig.ServiceAccountEmail)
-	accessToken, err := gcpclient.GenerateTemporaryAccessToken(cspCmdConfig.ServiceAccountEmail, cspCmdConfig.Reason)
-	if err != nil {
-		return err
-	}
-
-	util.Logger.Infof("Running: [cloud_sql_proxy %s]\n\n", strings.Join(cloudSQLProxyCmdArgs, " "))
-	cloudSQLProxyAuth := append(cloudSQLProxyCmdArgs, "-token", accessToken.GetAccessToken())
-	c := exec.Command(cloudSQLProxyPath, cloudSQLProxyAuth...)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	c.Stdin = os.Stdin
-
-	if err := c.Run(); err != nil {
-		fullCmd := fmt.Sprintf("cloud_sql_proxy %s", strings.Join(cloudSQLProxyCmdArgs, " "))
-		return errorsutil.New(fmt.Sprintf("Failed to run command [%s]", fullCmd), err)
-	}
-	return nil
+			--reason "Debugging for (JIRA-1234)"
+			
+			eiam cloud_sql_proxy my-project:us-central1:example-instance --port 3306 \
+			-s example@my-project.iam.gserviceaccount.com -R "Debugging for (JIRA-1234)"`),
+		restartOnSessionLimit: true,
+	})
 }
@@ -17,8 +17,13 @@ package eiam
 import (
 	"github.com/lithammer/dedent"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 
 	eiam "github.com/rigup/ephemeral-iam/internal"
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	"github.com/rigup/ephemeral-iam/internal/completion"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	queryiam "github.com/rigup/ephemeral-iam/internal/gcpclient/query_iam"
 	"github.com/rigup/ephemeral-iam/pkg/options"
 )
 
@@ -72,18 +77,34 @@ func NewEphemeralIamCommand() (*eiam.RootCommand, error) {
 
 	cmds.AddCommand(newCmdAssumePrivileges())
 	cmds.AddCommand(newCmdCloudSQLProxy())
+	cmds.AddCommand(newCmdCompletion())
 	cmds.AddCommand(newCmdConfig())
 	cmds.AddCommand(newCmdDefaultServiceAccounts())
+	cmds.AddCommand(newCmdExec())
+	cmds.AddCommand(newCmdFindServiceAccount())
 	cmds.AddCommand(newCmdGcloud())
 	cmds.AddCommand(newCmdKubectl())
 	cmds.AddCommand(newCmdListServiceAccounts())
+	cmds.AddCommand(newCmdMetadataServer())
 	cmds.AddCommand(newCmdPlugins())
 	cmds.AddCommand(newCmdQueryPermissions())
+	cmds.AddCommand(newCmdSession())
+	cmds.AddCommand(newCmdSQL())
+	cmds.AddCommand(newCmdTerraform())
 	cmds.AddCommand(newCmdVersion())
+	addConfiguredWrappers(cmds)
 	if err := cmds.LoadPlugins(); err != nil {
 		return nil, err
 	}
 	options.AddPersistentFlags(cmds.PersistentFlags())
+	registerFlagCompletions(&cmds.Command)
+	cobra.OnInitialize(func() {
+		queryiam.ConfigureCache(viper.GetString(appconfig.CacheDir), viper.GetDuration(appconfig.CacheTTL))
+		if options.RefreshOption {
+			errorsutil.CheckError(queryiam.ClearTestablePermissionsCache())
+			errorsutil.CheckError(completion.ClearCache())
+		}
+	})
 
 	RootCommand = cmds
 
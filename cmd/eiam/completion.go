@@ -0,0 +1,218 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	"github.com/rigup/ephemeral-iam/internal/completion"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+type completionFunc func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective)
+
+// flagCompletions are the completion functions of the flags that take the name of a
+// Google Cloud resource.
+var flagCompletions = map[string]completionFunc{
+	options.ClusterFlag.Name:             completeClusters,
+	options.ComputeInstanceFlag.Name:     completeInstances,
+	options.LocationFlag.Name:            completeClusterLocations,
+	options.ProjectFlag.Name:             completeProjects,
+	options.PubSubTopicFlag.Name:         completeTopics,
+	options.RegionFlag.Name:              completeRegions,
+	options.ServiceAccountEmailFlag.Name: completeServiceAccounts,
+	options.StorageBucketFlag.Name:       completeBuckets,
+	options.ZoneFlag.Name:                completeZones,
+}
+
+func newCmdCompletion() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "completion [bash|zsh|fish|powershell]",
+		Short: "Generate a shell completion script",
+		Long: dedent.Dedent(`
+			The "completion" command prints a script that enables tab-completion of eiam commands
+			and flags in your shell. Besides commands and flag names, it completes the service
+			accounts, projects, zones, regions, compute instances, Pub/Sub topics, storage buckets
+			and GKE clusters passed to flags, and the names of installed plugins.
+			
+			The resources are listed from the Google Cloud APIs the first time they are completed
+			and cached for the duration set in the 'cache.ttl' config field, so later completions
+			are fast. Pass the --refresh flag to any command to clear the cache.`),
+		Example: dedent.Dedent(`
+			# Load completions in the current bash session
+			source <(eiam completion bash)
+			
+			# Load completions for every new zsh session
+			eiam completion zsh > "${fpath[1]}/_eiam"
+			
+			# Load completions for every new fish session
+			eiam completion fish > ~/.config/fish/completions/eiam.fish`),
+		ValidArgs: []string{"bash", "zsh", "fish", "powershell"},
+		Args:      cobra.ExactValidArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			switch args[0] {
+			case "bash":
+				err = cmd.Root().GenBashCompletion(os.Stdout)
+			case "zsh":
+				err = cmd.Root().GenZshCompletion(os.Stdout)
+			case "fish":
+				err = cmd.Root().GenFishCompletion(os.Stdout, true)
+			case "powershell":
+				err = cmd.Root().GenPowerShellCompletion(os.Stdout)
+			}
+			if err != nil {
+				return errorsutil.New(fmt.Sprintf("Failed to generate %s completion script", args[0]), err)
+			}
+			return nil
+		},
+	}
+	return cmd
+}
+
+// registerFlagCompletions registers the completion functions in flagCompletions for
+// the flags of cmd and its subcommands, including the commands added by plugins.
+func registerFlagCompletions(cmd *cobra.Command) {
+	for name, complete := range flagCompletions {
+		if cmd.LocalFlags().Lookup(name) == nil {
+			continue
+		}
+		if err := cmd.RegisterFlagCompletionFunc(name, complete); err != nil {
+			util.Logger.Fatalf("failed to register completion for the --%s flag: %v", name, err)
+		}
+	}
+	for _, sub := range cmd.Commands() {
+		registerFlagCompletions(sub)
+	}
+}
+
+// completeFrom completes toComplete with the candidates returned by list. Candidates
+// that were listed before an error are still suggested.
+func completeFrom(list func() ([]string, error), toComplete string) ([]string, cobra.ShellCompDirective) {
+	candidates, err := list()
+	if err != nil {
+		cobra.CompDebugln(err.Error(), true)
+		if len(candidates) == 0 {
+			return nil, cobra.ShellCompDirectiveError
+		}
+	}
+
+	matches := []string{}
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, toComplete) {
+			matches = append(matches, candidate)
+		}
+	}
+	return matches, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completionProject returns the project passed to the --project flag, or the project
+// of the active gcloud config if the command has no --project flag.
+func completionProject(cmd *cobra.Command) string {
+	if project, _ := cmd.Flags().GetString(options.ProjectFlag.Name); project != "" {
+		return project
+	}
+	project, _ := gcpclient.GetCurrentProject()
+	return project
+}
+
+func completeServiceAccounts(
+	cmd *cobra.Command,
+	args []string,
+	toComplete string,
+) ([]string, cobra.ShellCompDirective) {
+	return completeFrom(func() ([]string, error) {
+		return completion.ServiceAccounts(completionProject(cmd))
+	}, toComplete)
+}
+
+func completeProjects(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return completeFrom(completion.Projects, toComplete)
+}
+
+func completeZones(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return completeFrom(func() ([]string, error) {
+		return completion.Zones(completionProject(cmd))
+	}, toComplete)
+}
+
+func completeRegions(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return completeFrom(func() ([]string, error) {
+		return completion.Regions(completionProject(cmd))
+	}, toComplete)
+}
+
+// completeInstances completes the --instance flag with the compute instances in the
+// zone passed to the --zone flag.
+func completeInstances(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	zone, _ := cmd.Flags().GetString(options.ZoneFlag.Name)
+	return completeFrom(func() ([]string, error) {
+		return completion.Instances(completionProject(cmd), zone)
+	}, toComplete)
+}
+
+func completeTopics(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return completeFrom(func() ([]string, error) {
+		return completion.Topics(completionProject(cmd))
+	}, toComplete)
+}
+
+func completeBuckets(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return completeFrom(func() ([]string, error) {
+		return completion.Buckets(completionProject(cmd))
+	}, toComplete)
+}
+
+// completeClusters completes the --cluster flag with the names of the GKE clusters in
+// the location passed to the --location flag.
+func completeClusters(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	location, _ := cmd.Flags().GetString(options.LocationFlag.Name)
+	return completeFrom(func() ([]string, error) {
+		return completion.Clusters(completionProject(cmd), location)
+	}, toComplete)
+}
+
+func completeClusterLocations(
+	cmd *cobra.Command,
+	args []string,
+	toComplete string,
+) ([]string, cobra.ShellCompDirective) {
+	return completeFrom(func() ([]string, error) {
+		return completion.ClusterLocations(completionProject(cmd))
+	}, toComplete)
+}
+
+// completePlugins completes the name of an installed plugin, followed by its
+// description in shells that show descriptions.
+func completePlugins(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	matches := []string{}
+	for _, plugin := range RootCommand.Plugins {
+		if strings.HasPrefix(plugin.Name, toComplete) {
+			matches = append(matches, plugin.Name+"\t"+plugin.Description)
+		}
+	}
+	return matches, cobra.ShellCompDirectiveNoFileComp
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"text/tabwriter"
 
+	"github.com/lithammer/dedent"
 	"github.com/manifoldco/promptui"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -13,11 +14,10 @@ import (
 	"github.com/rigup/ephemeral-iam/internal/appconfig"
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
-	"github.com/rigup/ephemeral-iam/internal/gcpclient"
 	"github.com/rigup/ephemeral-iam/pkg/options"
 )
 
-var project string
+var defaultSACmdConfig options.CmdConfig
 
 func newCmdDefaultServiceAccounts() *cobra.Command {
 	cmd := &cobra.Command{
@@ -34,33 +34,59 @@ func newCmdSetDefaultServiceAccount() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "set",
 		Short: "Set a default privileged service account to impersonate for a given GCP project",
+		Long: dedent.Dedent(`
+			The "default-service-accounts set" command prompts you to select the default service account
+			for a project from the service accounts that you can impersonate in it.
+			
+			To set the defaults for several projects at once, use --all-projects, --folder or
+			--organization. The projects are checked concurrently, and then you are prompted to select
+			the default for each project that has service accounts you can impersonate.`),
+		Example: dedent.Dedent(`
+			$ eiam default-service-accounts set
+			$ eiam default-service-accounts set --folder 123456789012`),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			_, _, err := projectScope(&defaultSACmdConfig)
+			return err
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			availableSAs, err := gcpclient.FetchAvailableServiceAccounts(project)
+			projects, availableSAs, err := fetchScopedServiceAccounts(&defaultSACmdConfig)
 			if err != nil {
 				return err
 			}
-			if len(availableSAs) == 0 {
-				util.Logger.Warnf("You cannot impersonate any service accounts in %s", project)
-				return nil
-			}
 
-			selected, err := selectServiceAccount(availableSAs)
-			if err != nil {
-				return errorsutil.New("Failed to get selected service account: %v", err)
+			defaultSAs := viper.GetStringMapString(appconfig.DefaultServiceAccounts)
+			allowSkip := len(projects) > 1
+			updated := 0
+			for _, project := range projects {
+				if len(availableSAs[project]) == 0 {
+					util.Logger.Warnf("You cannot impersonate any service accounts in %s", project)
+					continue
+				}
+
+				selected, err := selectServiceAccount(project, availableSAs[project], allowSkip)
+				if err != nil {
+					return errorsutil.New("Failed to get selected service account", err)
+				}
+				if selected == "" {
+					continue
+				}
+				defaultSAs[project] = selected
+				updated++
+				util.Logger.Infof("Set default service account for %s to %s", project, selected)
+			}
+			if updated == 0 {
+				return nil
 			}
 
-			defaultSAs := viper.GetStringMapString(appconfig.DefaultServiceAccounts)
-			defaultSAs[project] = selected
 			viper.Set(appconfig.DefaultServiceAccounts, defaultSAs)
 			if err := viper.WriteConfig(); err != nil {
 				return errorsutil.New("Failed to write updated configuration", err)
 			}
-
-			util.Logger.Infof("Set default service account for %s to %s", project, selected)
 			return nil
 		},
 	}
-	options.AddProjectFlag(cmd.Flags(), &project, false)
+	options.AddProjectFlag(cmd.Flags(), &defaultSACmdConfig.Project, false)
+	addProjectScopeFlags(cmd, &defaultSACmdConfig)
 	return cmd
 }
 
@@ -88,7 +114,13 @@ func newCmdListDefaultServiceAccounts() *cobra.Command {
 	return cmd
 }
 
-func selectServiceAccount(availableSAs []*iam.ServiceAccount) (string, error) {
+// skipServiceAccount is the prompt option that leaves a project's default unchanged.
+var skipServiceAccount = &iam.ServiceAccount{Email: "Skip this project"}
+
+// selectServiceAccount prompts the user to select one of the service accounts in the
+// project. If allowSkip is set, the user can skip the project, in which case an empty
+// string is returned.
+func selectServiceAccount(project string, availableSAs []*iam.ServiceAccount, allowSkip bool) (string, error) {
 	templates := &promptui.SelectTemplates{
 		Label:    "{{ . }}",
 		Active:   " ►  {{ .Email | blue }}",
@@ -96,9 +128,13 @@ func selectServiceAccount(availableSAs []*iam.ServiceAccount) (string, error) {
 		Selected: " ►  {{ .Email | green }}",
 	}
 
+	items := availableSAs
+	if allowSkip {
+		items = append(append([]*iam.ServiceAccount{}, availableSAs...), skipServiceAccount)
+	}
 	prompt := promptui.Select{
-		Label:        "Select Service Account",
-		Items:        availableSAs,
+		Label:        fmt.Sprintf("Select Service Account for %s", project),
+		Items:        items,
 		Templates:    templates,
 		HideSelected: true,
 	}
@@ -107,6 +143,9 @@ func selectServiceAccount(availableSAs []*iam.ServiceAccount) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if items[i] == skipServiceAccount {
+		return "", nil
+	}
 
-	return availableSAs[i].Email, nil
+	return items[i].Email, nil
 }
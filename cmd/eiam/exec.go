@@ -0,0 +1,102 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/wrapper"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+var (
+	execCmdArgs   []string
+	execCmdConfig options.CmdConfig
+)
+
+func newCmdExec() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "exec [flags] -- COMMAND [ARGS]",
+		Short: "Run any command with the permissions of the specified service account",
+		Long: dedent.Dedent(`
+			The "exec" command runs the provided command with the permissions of the specified service
+			account. The service account's credentials are exposed to the command through the
+			environment variables that Google Cloud tools read:
+			
+			  CLOUDSDK_AUTH_ACCESS_TOKEN_FILE  A file containing an access token (gcloud, gsutil, bq)
+			  GOOGLE_OAUTH_ACCESS_TOKEN        An access token (Terraform)
+			  GCE_METADATA_HOST                A local metadata server that serves refreshed access
+			                                   tokens (Google Cloud client libraries)
+			  GOOGLE_APPLICATION_CREDENTIALS   A credentials file that gets refreshed access tokens
+			                                   from the metadata server (Google Cloud client libraries)
+			
+			Your own application default credentials are hidden from the command, which runs with a
+			temporary gcloud configuration directory in CLOUDSDK_CONFIG. The temporary files
+			are removed and the metadata server is stopped when the command exits, and eiam exits with
+			the command's exit status.`),
+		Example: dedent.Dedent(`
+			eiam exec -s example@my-project.iam.gserviceaccount.com -R "Planning (JIRA-1234)" -- terraform plan
+			
+			eiam exec -s example@my-project.iam.gserviceaccount.com -R "Backfill (JIRA-1234)" -- \
+			  python backfill.py --dry-run`),
+		Args: cobra.MinimumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+
+			execCmdArgs = args
+			if err := util.FormatReason(&execCmdConfig.Reason); err != nil {
+				return err
+			}
+
+			if !options.YesOption {
+				util.Confirm(map[string]string{
+					"Project":         execCmdConfig.Project,
+					"Service Account": execCmdConfig.ServiceAccountEmail,
+					"Reason":          execCmdConfig.Reason,
+					"Command":         strings.Join(execCmdArgs, " "),
+				})
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runExecCommand()
+		},
+	}
+	// Leave the flags after the command name for the command.
+	cmd.Flags().SetInterspersed(false)
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &execCmdConfig.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &execCmdConfig.Reason, true)
+	options.AddProjectFlag(cmd.Flags(), &execCmdConfig.Project, false)
+
+	return cmd
+}
+
+func runExecCommand() error {
+	cmdPath, err := exec.LookPath(execCmdArgs[0])
+	if err != nil {
+		return errorsutil.New(fmt.Sprintf("Failed to run command [%s]", strings.Join(execCmdArgs, " ")), err)
+	}
+	return runWrappedTool(wrapper.Exec(execCmdArgs[0], cmdPath), execCmdConfig, execCmdArgs[1:], wrapperOptions{})
+}
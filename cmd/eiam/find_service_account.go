@@ -0,0 +1,99 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+var findSACmdConfig options.CmdConfig
+
+func newCmdFindServiceAccount() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "find-service-account",
+		Short: "Find the least privileged service account that grants a set of permissions",
+		Long: dedent.Dedent(`
+			The "find-service-account" command checks each of the service accounts in the current
+			project that you can impersonate, and lists the ones that are granted all of the
+			permissions passed to the --permission flag on a resource. The service accounts are
+			ordered by the total number of permissions they are granted on the resource, so the
+			first one listed is the least privileged service account that can do what you need.
+			
+			The resource is identified by its full resource name and defaults to the current
+			project. See 'eiam query-permissions resource --help' for the supported resource types.`),
+		Example: dedent.Dedent(`
+			  eiam find-service-account --permission compute.instances.delete
+			
+			  eiam find-service-account \
+			    --permission secretmanager.versions.access,secretmanager.versions.add \
+			    --resource //secretmanager.googleapis.com/projects/my-project/secrets/my-secret
+		`),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			return options.CheckPermissions(findSACmdConfig.Permissions)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			resource := findSACmdConfig.Resource
+			if resource == "" {
+				resource = fmt.Sprintf(projectsRes, findSACmdConfig.Project)
+			}
+
+			matches, err := gcpclient.FindServiceAccounts(
+				findSACmdConfig.Project,
+				resource,
+				util.Uniq(findSACmdConfig.Permissions),
+				findSACmdConfig.Reason,
+			)
+			if err != nil {
+				return err
+			}
+			if len(matches) == 0 {
+				util.Logger.Warning("None of the service accounts you can impersonate are granted these permissions")
+				return nil
+			}
+			printServiceAccountMatches(matches)
+			util.Logger.Infof("%s is the least privileged match", matches[0].ServiceAccount.Email)
+			return nil
+		},
+	}
+
+	options.AddPermissionFlag(cmd.Flags(), &findSACmdConfig.Permissions)
+	options.AddResourceFlag(cmd.Flags(), &findSACmdConfig.Resource)
+	options.AddProjectFlag(cmd.Flags(), &findSACmdConfig.Project, false)
+	options.AddReasonFlag(cmd.Flags(), &findSACmdConfig.Reason, false)
+
+	return cmd
+}
+
+func printServiceAccountMatches(matches []gcpclient.ServiceAccountMatch) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 4, ' ', 0)
+	fmt.Fprintln(w, "\nRANK\tEMAIL\tGRANTED PERMISSIONS")
+	for i, match := range matches {
+		fmt.Fprintf(w, "%d\t%s\t%d\n", i+1, match.ServiceAccount.Email, len(match.GrantedPermissions))
+	}
+	w.Flush()
+	fmt.Println()
+}
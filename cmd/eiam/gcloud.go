@@ -15,34 +15,18 @@
 package eiam
 
 import (
-	"fmt"
-	"os"
-	"os/exec"
-	"strings"
-
 	"github.com/lithammer/dedent"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
-
-	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
-	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
-	"github.com/rigup/ephemeral-iam/internal/gcpclient"
-	"github.com/rigup/ephemeral-iam/pkg/options"
-)
 
-var (
-	gcloudCmdArgs   []string
-	gcloudCmdConfig options.CmdConfig
+	"github.com/rigup/ephemeral-iam/internal/wrapper"
 )
 
 func newCmdGcloud() *cobra.Command {
-	cmd := &cobra.Command{
-		Use:   "gcloud [GCLOUD_ARGS]",
-		Short: "Run a gcloud command with the permissions of the specified service account",
-		Long: dedent.Dedent(`
+	return newCmdWrapper(wrapper.Gcloud(), wrapperOptions{
+		long: dedent.Dedent(`
 			The "gcloud" command runs the provided gcloud command with the permissions of the specified
 			service account. Output from the gcloud command is able to be piped into other commands.`),
-		Example: dedent.Dedent(`
+		example: dedent.Dedent(`
 			eiam gcloud compute instances list --format=json \
 			--service-account-email example@my-project.iam.gserviceaccount.com \
 			--reason "Debugging for (JIRA-1234)"
@@ -50,81 +34,5 @@ func newCmdGcloud() *cobra.Command {
 			eiam gcloud compute instances list --format=json \
 			-s example@my-project.iam.gserviceaccount.com -r "example" \
 			| jq`),
-		Args:               cobra.ArbitraryArgs,
-		FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
-		PreRunE: func(cmd *cobra.Command, args []string) error {
-			if err := options.CheckRequired(cmd.Flags()); err != nil {
-				return err
-			}
-
-			gcloudCmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
-			if err := util.FormatReason(&gcloudCmdConfig.Reason); err != nil {
-				return err
-			}
-
-
-
-			if !options.YesOption {
-				util.Confirm(map[string]string{
-					"Project":         gcloudCmdConfig.Project,
-					"Service Account": gcloudCmdConfig.ServiceAccountEmail,
-					"Reason":          gcloudCmdConfig.Reason,
-					"Command":         fmt.Sprintf("gcloud %s", strings.Join(gcloudCmdArgs, " ")),
-				})
-			}
-			return nil
-		},
-		RunE: func(cmd *cobra.Command, args []string) error {
-			return runGcloudCommand()
-		},
-	}
-
-	options.AddServiceAccountEmailFlag(cmd.Flags(), &gcloudCmdConfig.ServiceAccountEmail, true)
-	options.AddReasonFlag(cmd.Flags(), &gcloudCmdConfig.Reason, true)
-	options.AddProjectFlag(cmd.Flags(), &gcloudCmdConfig.Project, false)
-
-	return cmd
-}
-
-func runGcloudCommand() error {
-	hasAccess, err := gcpclient.CanImpersonate(gcloudCmdConfig.Project, gcloudCmdConfig.ServiceAccountEmail)
-	if err != nil {
-		return err
-	} else if !hasAccess {
-		util.Logger.Fatalln("You do not have access to impersonate this service account")
-	}
-
-	// gcloud reads the CLOUDSDK_CORE_REQUEST_REASON environment variable
-	// and sets the X-Goog-Request-Reason header in API requests to its value.
-	reasonHeader := fmt.Sprintf("CLOUDSDK_CORE_REQUEST_REASON=%s", gcloudCmdConfig.Reason)
-
-	// There has to be a better way to do this...
-	util.Logger.Infof("Running: [gcloud %s]\n\n", strings.Join(gcloudCmdArgs, " "))
-
-    gcloudOpts := gcloudCmdArgs
-    positionalArgs := []string{}
-    for i, v := range gcloudCmdArgs {
-        if v == "--" {
-            gcloudOpts = gcloudCmdArgs[:i]
-            positionalArgs = gcloudCmdArgs[i:]
-            break
-        }
-    }
-
-	cmdArgs := append([]string(nil), gcloudOpts...)
-	cmdArgs = append(cmdArgs, "--impersonate-service-account", gcloudCmdConfig.ServiceAccountEmail, "--verbosity=error")
-	cmdArgs = append(cmdArgs, positionalArgs...)
-
-	gcloud := viper.GetString("binarypaths.gcloud")
-	c := exec.Command(gcloud, cmdArgs...)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	c.Stdin = os.Stdin
-	c.Env = append(os.Environ(), reasonHeader)
-
-	if err := c.Run(); err != nil {
-		fullCmd := fmt.Sprintf("gcloud %s", strings.Join(gcloudCmdArgs, " "))
-		return errorsutil.New(fmt.Sprintf("Failed to run command [%s]", fullCmd), err)
-	}
-	return nil
+	})
 }
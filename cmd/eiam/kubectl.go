@@ -16,103 +16,92 @@ package eiam
 
 import (
 	"fmt"
-	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/lithammer/dedent"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 
-	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
 	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/wrapper"
 	"github.com/rigup/ephemeral-iam/pkg/options"
 )
 
-var (
-	kubectlCmdArgs   []string
-	kubectlCmdConfig options.CmdConfig
-)
-
 func newCmdKubectl() *cobra.Command {
-	cmd := &cobra.Command{
-		Use:   "kubectl [KUBECTL_ARGS]",
-		Short: "Run a kubectl command with the permissions of the specified service account",
-		Long: dedent.Dedent(`
+	return newCmdWrapper(wrapper.Kubectl(), wrapperOptions{
+		long: dedent.Dedent(`
 			The "kubectl" command runs the provided kubectl command with the permissions of the specified
-			service account. Output from the kubectl command is able to be piped into other commands.`),
-		Example: dedent.Dedent(`
+			service account. Output from the kubectl command is able to be piped into other commands.
+			
+			By default, kubectl connects to the cluster of the current context in your kubeconfig. Use
+			--cluster to connect to a GKE cluster in the project instead, whatever your kubeconfig
+			contains. A temporary kubeconfig for the cluster is created for the command and removed
+			when it exits. If clusters in several locations have the same name, use --location to
+			select one.
+			
+			When the service account has broad RBAC permissions in the cluster, use --as and --as-group
+			to act as a narrower Kubernetes identity. The service account's token still authenticates
+			the requests, but RBAC is checked for the impersonated user and groups, which are recorded
+			in the cluster's audit logs. The service account needs permission to impersonate them.
+			
+			kubectl can't send the reason with its requests to the cluster, since a kubeconfig has no
+			way to add the X-Goog-Request-Reason header and the cluster's audit logs don't record it.
+			The reason is recorded in the Cloud Audit Logs when the service account's access token is
+			generated.`),
+		example: dedent.Dedent(`
 			eiam kubectl pods -o json \
 			  --service-account-email example@my-project.iam.gserviceaccount.com \
 			  --reason "Debugging for (JIRA-1234)"
 				
 			eiam kubectl pods -o json \
 			  -s example@my-project.iam.gserviceaccount.com -r "example" \
-			  | jq`),
-		Args:               cobra.ArbitraryArgs,
-		FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
-		PreRunE: func(cmd *cobra.Command, args []string) error {
-			if err := options.CheckRequired(cmd.Flags()); err != nil {
-				return err
-			}
-
-			kubectlCmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
-			if err := util.FormatReason(&kubectlCmdConfig.Reason); err != nil {
-				return err
-			}
-
-			if !options.YesOption {
-				util.Confirm(map[string]string{
-					"Project":         kubectlCmdConfig.Project,
-					"Service Account": kubectlCmdConfig.ServiceAccountEmail,
-					"Reason":          kubectlCmdConfig.Reason,
-					"Command":         fmt.Sprintf("kubectl %s", strings.Join(kubectlCmdArgs, " ")),
-				})
-			}
-			return nil
-		},
-		RunE: func(cmd *cobra.Command, args []string) error {
-			return runKubectlCommand()
-		},
-	}
-
-	options.AddServiceAccountEmailFlag(cmd.Flags(), &kubectlCmdConfig.ServiceAccountEmail, true)
-	options.AddReasonFlag(cmd.Flags(), &kubectlCmdConfig.Reason, true)
-	options.AddProjectFlag(cmd.Flags(), &kubectlCmdConfig.Project, false)
-
-	return cmd
+			  | jq
+			
+			eiam kubectl get pods --cluster my-cluster --location us-central1 \
+			  -s example@my-project.iam.gserviceaccount.com -R "Debugging for (JIRA-1234)"
+			
+			eiam kubectl get pods --cluster my-cluster --as jane@example.com --as-group developers \
+			  -s example@my-project.iam.gserviceaccount.com -R "Debugging for (JIRA-1234)"`),
+		kubernetes: true,
+	})
 }
 
-func runKubectlCommand() error {
-	hasAccess, err := gcpclient.CanImpersonate(kubectlCmdConfig.Project, kubectlCmdConfig.ServiceAccountEmail)
+// findCluster returns the GKE cluster that was passed to the --cluster and --location
+// flags.
+func findCluster(cmdConfig options.CmdConfig) (*wrapper.Cluster, error) {
+	clusters, err := gcpclient.GetClusters(cmdConfig.Project, cmdConfig.Reason)
 	if err != nil {
-		return err
-	} else if !hasAccess {
-		util.Logger.Fatalln("You do not have access to impersonate this service account")
+		return nil, err
 	}
 
-	util.Logger.Infof("Fetching access token for %s", kubectlCmdConfig.ServiceAccountEmail)
-	accessToken, err := gcpclient.GenerateTemporaryAccessToken(
-		kubectlCmdConfig.ServiceAccountEmail,
-		kubectlCmdConfig.Reason,
-	)
-	if err != nil {
-		return err
+	var matches []map[string]string
+	for _, cl := range clusters {
+		if cl["name"] == cmdConfig.Cluster && (cmdConfig.Location == "" || cl["location"] == cmdConfig.Location) {
+			matches = append(matches, cl)
+		}
 	}
-
-	util.Logger.Infof("Running: [kubectl %s]\n\n", strings.Join(kubectlCmdArgs, " "))
-	kubectlAuth := append([]string{"--token", accessToken.GetAccessToken()}, kubectlCmdArgs...)
-	kubectl := viper.GetString("binarypaths.kubectl")
-	c := exec.Command(kubectl, kubectlAuth...)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-	c.Stdin = os.Stdin
-
-	if err := c.Run(); err != nil {
-		fullCmd := fmt.Sprintf("kubectl %s", strings.Join(kubectlCmdArgs, " "))
-		return errorsutil.New(fmt.Sprintf("Failed to run command [%s]", fullCmd), err)
+	switch len(matches) {
+	case 0:
+		err := fmt.Errorf("there is no cluster named %s in %s", cmdConfig.Cluster, cmdConfig.Project)
+		if cmdConfig.Location != "" {
+			err = fmt.Errorf("there is no cluster named %s in %s in %s",
+				cmdConfig.Cluster, cmdConfig.Location, cmdConfig.Project)
+		}
+		return nil, errorsutil.New("Failed to find the GKE cluster", err)
+	case 1:
+		return &wrapper.Cluster{
+			Name:          matches[0]["name"],
+			Location:      matches[0]["location"],
+			Endpoint:      matches[0]["endpoint"],
+			CACertificate: matches[0]["caCertificate"],
+		}, nil
+	default:
+		locations := make([]string, 0, len(matches))
+		for _, cl := range matches {
+			locations = append(locations, cl["location"])
+		}
+		err := fmt.Errorf("there are clusters named %s in %s, use --location to select one",
+			cmdConfig.Cluster, strings.Join(locations, ", "))
+		return nil, errorsutil.New("Failed to find the GKE cluster", err)
 	}
-
-	return nil
 }
@@ -15,7 +15,9 @@
 package eiam
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"text/tabwriter"
@@ -26,6 +28,7 @@ import (
 	"google.golang.org/api/iam/v1"
 
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
 	"github.com/rigup/ephemeral-iam/internal/gcpclient"
 	"github.com/rigup/ephemeral-iam/pkg/options"
 )
@@ -41,45 +44,219 @@ func newCmdListServiceAccounts() *cobra.Command {
 		Long: dedent.Dedent(`
 			The "list-service-accounts" command fetches all Cloud IAM Service Accounts in the current
 			GCP project (as determined by the activated gcloud config) and checks each of them to see
-			which ones the current user has access to impersonate.`),
+			which ones the current user has access to impersonate.
+			
+			To check several projects at once, use --all-projects to check every project that you can
+			see, or --folder or --organization to check the projects under a folder or organization.
+			The projects are checked concurrently and the results are grouped by project.`),
 		Example: dedent.Dedent(`
 			$ eiam list-service-accounts
-			$ eiam list`),
+			$ eiam list
+			$ eiam list --folder 123456789012 --output json`),
 		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.CheckOutputFormat(listCmdConfig.Output); err != nil {
+				return err
+			}
+			if _, multi, err := projectScope(&listCmdConfig); err != nil || multi {
+				return err
+			}
 			return options.CheckRequired(cmd.Flags())
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			availableSAs, err := gcpclient.FetchAvailableServiceAccounts(listCmdConfig.Project)
+			projects, availableSAs, err := fetchScopedServiceAccounts(&listCmdConfig)
 			if err != nil {
 				return err
 			}
-			if len(availableSAs) == 0 {
-				util.Logger.Warning("You do not have access to impersonate any accounts in this project")
+
+			if listCmdConfig.Output != util.OutputTable {
+				report := newServiceAccountsReport(projects, availableSAs)
+				if err := util.WriteOutput(os.Stdout, listCmdConfig.Output, report); err != nil {
+					return errorsutil.New("Failed to write service accounts", err)
+				}
+				return nil
+			}
+
+			if len(projects) == 1 {
+				if len(availableSAs[projects[0]]) == 0 {
+					util.Logger.Warning("You do not have access to impersonate any accounts in this project")
+					return nil
+				}
+				printColumns(availableSAs[projects[0]])
 				return nil
 			}
-			printColumns(availableSAs)
+			printProjectColumns(os.Stdout, projects, availableSAs)
 			return nil
 		},
 	}
 	options.AddProjectFlag(cmd.Flags(), &listCmdConfig.Project, false)
+	addProjectScopeFlags(cmd, &listCmdConfig)
+	options.AddOutputFlag(cmd.Flags(), &listCmdConfig.Output)
 
 	return cmd
 }
 
+// addProjectScopeFlags adds the flags that select several projects to the command.
+func addProjectScopeFlags(cmd *cobra.Command, cfg *options.CmdConfig) {
+	options.AddAllProjectsFlag(cmd.Flags(), &cfg.AllProjects)
+	options.AddFolderFlag(cmd.Flags(), &cfg.Folder, false)
+	options.AddOrganizationFlag(cmd.Flags(), &cfg.Organization, false)
+}
+
+// projectScope returns the parent to list projects under for the --all-projects,
+// --folder and --organization flags, and whether one of them is set. The parent
+// is empty for --all-projects.
+func projectScope(cfg *options.CmdConfig) (parent string, multi bool, err error) {
+	set := 0
+	if cfg.AllProjects {
+		set++
+	}
+	if cfg.Folder != "" {
+		set++
+		folderID, err := parseResourceID(cfg.Folder, "folders/")
+		if err != nil {
+			return "", false, err
+		}
+		parent = "folders/" + folderID
+	}
+	if cfg.Organization != "" {
+		set++
+		orgID, err := parseResourceID(cfg.Organization, "organizations/")
+		if err != nil {
+			return "", false, err
+		}
+		parent = "organizations/" + orgID
+	}
+	if set > 1 {
+		return "", false, argsError(errors.New("only one of --all-projects, --folder and --organization can be set"))
+	}
+	return parent, set == 1, nil
+}
+
+// fetchScopedServiceAccounts gets the service accounts that the user can impersonate
+// in the projects selected by cfg, and returns the projects in sorted order.
+func fetchScopedServiceAccounts(cfg *options.CmdConfig) ([]string, map[string][]*iam.ServiceAccount, error) {
+	parent, multi, err := projectScope(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !multi {
+		availableSAs, err := gcpclient.FetchAvailableServiceAccounts(cfg.Project)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{cfg.Project}, map[string][]*iam.ServiceAccount{cfg.Project: availableSAs}, nil
+	}
+
+	projects, err := gcpclient.ListProjects(parent)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(projects) == 0 {
+		return nil, nil, errorsutil.New("Failed to find projects", errors.New("you cannot see any projects"))
+	}
+	availableSAs, err := gcpclient.FetchAvailableServiceAccountsInProjects(projects)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Leave out the projects that could not be checked.
+	scanned := make([]string, 0, len(availableSAs))
+	for _, project := range projects {
+		if _, ok := availableSAs[project]; ok {
+			scanned = append(scanned, project)
+		}
+	}
+	return scanned, availableSAs, nil
+}
+
 func printColumns(serviceAccounts []*iam.ServiceAccount) {
 	w := tabwriter.NewWriter(os.Stdout, 0, 4, 4, ' ', 0)
 	fmt.Fprintln(w, "\nEMAIL\tDESCRIPTION")
 	for _, sa := range serviceAccounts {
-		desc := strings.Split(wordwrap.WrapString(sa.Description, 75), "\n")
-		if len(desc) == 1 {
-			fmt.Fprintf(w, "%s\t%s\n", sa.Email, desc[0])
-		} else {
-			firstLine, remaining := desc[0], desc[1:]
-			fmt.Fprintf(w, "%s\t%s\n", sa.Email, firstLine)
-			for _, line := range remaining {
-				fmt.Fprintf(w, "%s\t%s\n", " ", line)
+		printServiceAccountRow(w, "", sa)
+	}
+	w.Flush()
+}
+
+// printProjectColumns prints the service accounts grouped by project. Projects without
+// any service accounts that can be impersonated are left out.
+func printProjectColumns(out io.Writer, projects []string, availableSAs map[string][]*iam.ServiceAccount) {
+	w := tabwriter.NewWriter(out, 0, 4, 4, ' ', 0)
+	fmt.Fprintln(w, "\nPROJECT\tEMAIL\tDESCRIPTION")
+	total, withAccess := 0, 0
+	for _, project := range projects {
+		if len(availableSAs[project]) > 0 {
+			withAccess++
+		}
+		for i, sa := range availableSAs[project] {
+			label := project
+			if i > 0 {
+				label = " "
 			}
+			printServiceAccountRow(w, label+"\t", sa)
+			total++
 		}
 	}
 	w.Flush()
+	fmt.Fprintln(out)
+
+	if total == 0 {
+		util.Logger.Warnf("You do not have access to impersonate any accounts in the %d projects", len(projects))
+	} else {
+		util.Logger.Infof("You can impersonate %d service accounts in %d of %d projects", total, withAccess, len(projects))
+	}
+}
+
+// printServiceAccountRow prints the service account's email and wrapped description
+// after the cells in prefix.
+func printServiceAccountRow(w io.Writer, prefix string, sa *iam.ServiceAccount) {
+	desc := strings.Split(wordwrap.WrapString(sa.Description, 75), "\n")
+	fmt.Fprintf(w, "%s%s\t%s\n", prefix, sa.Email, desc[0])
+	// Continuation lines leave the other cells blank.
+	blank := strings.Repeat(" \t", strings.Count(prefix, "\t"))
+	for _, line := range desc[1:] {
+		fmt.Fprintf(w, "%s%s\t%s\n", blank, " ", line)
+	}
+}
+
+// serviceAccountsReport is the machine-readable output of list-service-accounts.
+type serviceAccountsReport []projectServiceAccounts
+
+// projectServiceAccounts are the service accounts that can be impersonated in a project.
+type projectServiceAccounts struct {
+	Project         string                `json:"project" yaml:"project"`
+	ServiceAccounts []serviceAccountEntry `json:"service_accounts" yaml:"service_accounts"`
+}
+
+type serviceAccountEntry struct {
+	Email       string `json:"email" yaml:"email"`
+	DisplayName string `json:"display_name,omitempty" yaml:"display_name,omitempty"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+func newServiceAccountsReport(projects []string, availableSAs map[string][]*iam.ServiceAccount) serviceAccountsReport {
+	report := make(serviceAccountsReport, 0, len(projects))
+	for _, project := range projects {
+		entries := []serviceAccountEntry{}
+		for _, sa := range availableSAs[project] {
+			entries = append(entries, serviceAccountEntry{
+				Email:       sa.Email,
+				DisplayName: sa.DisplayName,
+				Description: sa.Description,
+			})
+		}
+		report = append(report, projectServiceAccounts{Project: project, ServiceAccounts: entries})
+	}
+	return report
+}
+
+// CSVRecords writes one record per service account.
+func (r serviceAccountsReport) CSVRecords() [][]string {
+	records := [][]string{{"project", "email", "display_name", "description"}}
+	for _, project := range r {
+		for _, sa := range project.ServiceAccounts {
+			records = append(records, []string{project.Project, sa.Email, sa.DisplayName, sa.Description})
+		}
+	}
+	return records
 }
@@ -0,0 +1,193 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/metadata"
+	"github.com/rigup/ephemeral-iam/internal/wrapper"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+var (
+	msCmdArgs   []string
+	msCmdConfig options.CmdConfig
+)
+
+func newCmdMetadataServer() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "metadata-server [flags] [-- COMMAND [ARGS]]",
+		Short: "Serve credentials for the specified service account from a local metadata server",
+		Long: dedent.Dedent(`
+			The "metadata-server" command starts a local HTTP server that emulates the Compute
+			Engine metadata server. It serves access tokens, ID tokens, the email of the specified
+			service account, and the project ID.
+			
+			Google Cloud client libraries use the metadata server at the address in the
+			GCE_METADATA_HOST environment variable to find their credentials, so programs that use
+			them run with the permissions of the service account without being modified. Access
+			tokens are refreshed for as long as the server runs.
+			
+			If a command is provided, it is run with GCE_METADATA_HOST set and the server stops when
+			the command exits. Otherwise, the server runs until it is interrupted.
+			
+			The server listens on the address and port in the "metadataserver.address" and
+			"metadataserver.port" configuration fields. The server only answers requests whose path
+			starts with a random secret, which is part of GCE_METADATA_HOST, so other processes that
+			can reach the server can't get tokens unless they can read the command's environment or
+			the printed variables. Client libraries that expect GCE_METADATA_HOST to be a bare
+			host:port, such as the one for Node.js, can't use the server. The server and the
+			command are stopped, and not restarted, after the duration in the
+			"metadataserver.sessionlimit" configuration field. eiam then exits with the command's
+			exit status, or 124 if it exited cleanly.`),
+		Example: dedent.Dedent(`
+			eiam metadata-server -s example@my-project.iam.gserviceaccount.com -R "Debugging (JIRA-1234)"
+			
+			eiam metadata-server -s example@my-project.iam.gserviceaccount.com -R "Backfill (JIRA-1234)" -- \
+			  python backfill.py --dry-run`),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+
+			msCmdArgs = args
+			if err := util.FormatReason(&msCmdConfig.Reason); err != nil {
+				return err
+			}
+
+			if !options.YesOption {
+				confirmation := map[string]string{
+					"Project":         msCmdConfig.Project,
+					"Service Account": msCmdConfig.ServiceAccountEmail,
+					"Reason":          msCmdConfig.Reason,
+				}
+				if len(msCmdArgs) > 0 {
+					confirmation["Command"] = strings.Join(msCmdArgs, " ")
+				}
+				util.Confirm(confirmation)
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runMetadataServer()
+		},
+	}
+	// Leave the flags after the command name for the command.
+	cmd.Flags().SetInterspersed(false)
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &msCmdConfig.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &msCmdConfig.Reason, true)
+	options.AddProjectFlag(cmd.Flags(), &msCmdConfig.Project, false)
+
+	return cmd
+}
+
+func runMetadataServer() error {
+	var cmdPath string
+	if len(msCmdArgs) > 0 {
+		var err error
+		if cmdPath, err = exec.LookPath(msCmdArgs[0]); err != nil {
+			return errorsutil.New(fmt.Sprintf("Failed to run command [%s]", strings.Join(msCmdArgs, " ")), err)
+		}
+	}
+
+	hasAccess, err := gcpclient.CanImpersonate(msCmdConfig.Project, msCmdConfig.ServiceAccountEmail)
+	if err != nil {
+		return err
+	} else if !hasAccess {
+		return errorsutil.New(
+			"Failed to start the metadata server",
+			errors.New("you do not have access to impersonate this service account"),
+		)
+	}
+
+	svcAcct := msCmdConfig.ServiceAccountEmail
+	session := &wrapper.Session{
+		ServiceAccount: svcAcct,
+		Reason:         msCmdConfig.Reason,
+		Project:        msCmdConfig.Project,
+		SessionLimit:   viper.GetDuration(appconfig.MetadataSessionLimit),
+		MetadataPort:   viper.GetString(appconfig.MetadataServerPort),
+	}
+	defer func() {
+		if err := session.Close(); err != nil {
+			util.Logger.WithError(err).Error("Failed to shut down the metadata server")
+		}
+	}()
+	addr, err := session.MetadataHost()
+	if err != nil {
+		return errorsutil.New("Failed to start the metadata server", err)
+	}
+	env := []string{
+		fmt.Sprintf("%s=%s", metadata.HostEnv, addr),
+		fmt.Sprintf("%s=%s", metadata.IPEnv, addr),
+	}
+
+	if cmdPath != "" {
+		util.Logger.Infof("Serving credentials for %s at http://%s", svcAcct, addr)
+		err := runWithMetadataServer(cmdPath, env, session.Done())
+		if isClosed(session.Done()) {
+			return sessionLimitReached(session.SessionLimit, err)
+		}
+		return err
+	}
+
+	util.Logger.Infof("Serving credentials for %s at http://%s. Press Ctrl+C to stop the server", svcAcct, addr)
+	util.Logger.Info("Run the following in another shell to use the credentials:\n\n")
+	for _, v := range env {
+		fmt.Printf("  export %s\n", v)
+	}
+	fmt.Println()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	select {
+	case <-stop:
+		util.Logger.Info("Stopping the metadata server")
+	case <-session.Done():
+		return sessionLimitReached(session.SessionLimit, nil)
+	}
+	return nil
+}
+
+// runWithMetadataServer runs the command that was provided to the metadata-server
+// command with the environment variables that point it at the metadata server.
+func runWithMetadataServer(cmdPath string, env []string, stop <-chan struct{}) error {
+	fullCmd := strings.Join(msCmdArgs, " ")
+	util.Logger.Infof("Running: [%s]\n\n", fullCmd)
+	c := exec.Command(cmdPath, msCmdArgs[1:]...) //nolint:gosec // Runs the command the user asked for
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Stdin = os.Stdin
+	c.Env = append(os.Environ(), env...)
+
+	return runChildCommand(c, fullCmd, stop)
+}
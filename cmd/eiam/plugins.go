@@ -120,20 +120,29 @@ func newCmdPluginsInstall() *cobra.Command {
 
 func newCmdPluginsRemove() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "remove",
+		Use:   "remove [PLUGIN_NAME]",
 		Short: "Remove an installed eiam plugin",
 		Long: dedent.Dedent(`
 			The "plugins remove" command removes a currently installed plugin.
 			
-			You will be prompted to select the plugin to uninstall from the list of plugins loaded
-			by eiam. If no plugins are currently installed, a warning is shown.`),
+			If no plugin name is given, you will be prompted to select the plugin to uninstall from
+			the list of plugins loaded by eiam. If no plugins are currently installed, a warning is
+			shown.`),
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: completePlugins,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(RootCommand.Plugins) == 0 {
 				util.Logger.Warn("No plugins are currently installed")
 				return nil
 			}
 
-			plugin, err := selectPlugin()
+			var plugin *plugins.EphemeralIamPlugin
+			var err error
+			if len(args) == 1 {
+				plugin, err = findPlugin(args[0])
+			} else {
+				plugin, err = selectPlugin()
+			}
 			if err != nil {
 				return err
 			}
@@ -148,6 +157,15 @@ func newCmdPluginsRemove() *cobra.Command {
 	return cmd
 }
 
+func findPlugin(name string) (*plugins.EphemeralIamPlugin, error) {
+	for _, plugin := range RootCommand.Plugins {
+		if plugin.Name == name {
+			return plugin, nil
+		}
+	}
+	return nil, errorsutil.New("Failed to remove plugin", fmt.Errorf("no plugin named %s is installed", name))
+}
+
 func selectPlugin() (*plugins.EphemeralIamPlugin, error) {
 	templates := &promptui.SelectTemplates{
 		Label:    "{{ . }}",
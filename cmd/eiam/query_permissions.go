@@ -16,10 +16,14 @@ package eiam
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"text/tabwriter"
 
 	"github.com/fatih/color"
@@ -37,6 +41,8 @@ import (
 // Resource string templates.
 var (
 	computeInstanceRes = "//compute.googleapis.com/projects/%s/zones/%s/instances/%s"
+	foldersRes         = "//cloudresourcemanager.googleapis.com/folders/%s"
+	organizationsRes   = "//cloudresourcemanager.googleapis.com/organizations/%s"
 	projectsRes        = "//cloudresourcemanager.googleapis.com/projects/%s"
 	pubsubTopicsRes    = "//pubsub.googleapis.com/projects/%s/topics/%s"
 	serviceAccountsRes = "//iam.googleapis.com/projects/%s/serviceAccounts/%s"
@@ -104,9 +110,25 @@ func newCmdQueryPermissions() *cobra.Command {
 		`),
 	}
 
+	cmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if err := options.CheckOutputFormat(queryPermsCmdConfig.Output); err != nil {
+			return err
+		}
+		if queryPermsCmdConfig.Explain && len(queryPermsCmdConfig.Compare) > 0 {
+			return errorsutil.New("Invalid --explain flag", errors.New("--explain cannot be used with --compare"))
+		}
+		return checkComparePrincipals(queryPermsCmdConfig.Compare)
+	}
+	options.AddOutputFlag(cmd.PersistentFlags(), &queryPermsCmdConfig.Output)
+	options.AddCompareFlag(cmd.PersistentFlags(), &queryPermsCmdConfig.Compare)
+	options.AddExplainFlag(cmd.PersistentFlags(), &queryPermsCmdConfig.Explain)
+
 	cmd.AddCommand(newCmdQueryComputeInstancePermissions())
+	cmd.AddCommand(newCmdQueryFolderPermissions())
+	cmd.AddCommand(newCmdQueryOrganizationPermissions())
 	cmd.AddCommand(newCmdQueryProjectPermissions())
 	cmd.AddCommand(newCmdQueryPubSubPermissions())
+	cmd.AddCommand(newCmdQueryResourcePermissions())
 	cmd.AddCommand(newCmdQueryServiceAccountPermissions())
 	cmd.AddCommand(newCmdQueryStorageBucketPermissions())
 
@@ -140,36 +162,97 @@ func newCmdQueryComputeInstancePermissions() *cobra.Command {
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			util.Logger.Infof("Querying permissions granted on %s", resourceString)
-			testablePerms, err := queryiam.QueryTestablePermissionsOnResource(resourceString)
+			testablePerms, err := queryiam.QueryTestablePermissionsOnResource(cmd.Context(), resourceString)
 			if err != nil {
 				msg := fmt.Sprintf("gcloud is configured to use %s as the default zone", queryPermsCmdConfig.Zone)
 				return errorsutil.New(msg, err)
 			}
-			userPerms, err := queryiam.QueryComputeInstancePermissions(
-				testablePerms,
-				queryPermsCmdConfig.Project,
-				queryPermsCmdConfig.Zone,
-				queryPermsCmdConfig.ComputeInstance,
-				queryPermsCmdConfig.ServiceAccountEmail,
-				queryPermsCmdConfig.Reason,
+			return runPermissionsQuery(resourceString, testablePerms, queryPermsCmdConfig.ServiceAccountEmail,
+				func(permsToTest []string, svcAcct string) ([]string, error) {
+					return queryiam.QueryResourcePermissions(
+						cmd.Context(),
+						permsToTest,
+						resourceString,
+						svcAcct,
+						queryPermsCmdConfig.Reason,
+					)
+				},
 			)
+		},
+	}
+
+	options.AddProjectFlag(cmd.Flags(), &queryPermsCmdConfig.Project, false)
+	options.AddZoneFlag(cmd.Flags(), &queryPermsCmdConfig.Zone, true)
+	options.AddComputeInstanceFlag(cmd.Flags(), &queryPermsCmdConfig.ComputeInstance, true)
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &queryPermsCmdConfig.ServiceAccountEmail, false)
+	options.AddReasonFlag(cmd.Flags(), &queryPermsCmdConfig.Reason, false)
+
+	return cmd
+}
+
+func newCmdQueryFolderPermissions() *cobra.Command {
+	var resourceString string
+	cmd := &cobra.Command{
+		Use:   "folder",
+		Short: "Query the permissions you are granted at the folder level",
+		Example: dedent.Dedent(`
+			  eiam query-permissions folder --folder 123456789012
+			
+			  eiam query-permissions folder --folder 123456789012 \
+			    --service-account-email example@my-project.iam.gserviceaccount.com
+		`),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			folderID, err := parseResourceID(queryPermsCmdConfig.Folder, "folders/")
 			if err != nil {
 				return err
 			}
-			if queryPermsCmdConfig.ServiceAccountEmail != "" {
-				return printPermissions(util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
+			resourceString = fmt.Sprintf(foldersRes, folderID)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return queryResourcePermissions(cmd.Context(), resourceString)
+		},
+	}
+
+	options.AddFolderFlag(cmd.Flags(), &queryPermsCmdConfig.Folder, true)
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &queryPermsCmdConfig.ServiceAccountEmail, false)
+	options.AddReasonFlag(cmd.Flags(), &queryPermsCmdConfig.Reason, false)
+
+	return cmd
+}
+
+func newCmdQueryOrganizationPermissions() *cobra.Command {
+	var resourceString string
+	cmd := &cobra.Command{
+		Use:     "organization",
+		Aliases: []string{"org"},
+		Short:   "Query the permissions you are granted at the organization level [alias: org]",
+		Example: dedent.Dedent(`
+			  eiam query-permissions organization --organization 123456789012
+			
+			  eiam query-permissions organization --organization 123456789012 \
+			    --service-account-email example@my-project.iam.gserviceaccount.com
+		`),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
 			}
-			userAcct, err := gcpclient.CheckActiveAccountSet()
+			orgID, err := parseResourceID(queryPermsCmdConfig.Organization, "organizations/")
 			if err != nil {
 				return err
 			}
-			return printPermissions(util.Uniq(testablePerms), userPerms, userAcct)
+			resourceString = fmt.Sprintf(organizationsRes, orgID)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return queryResourcePermissions(cmd.Context(), resourceString)
 		},
 	}
 
-	options.AddProjectFlag(cmd.Flags(), &queryPermsCmdConfig.Project, false)
-	options.AddZoneFlag(cmd.Flags(), &queryPermsCmdConfig.Zone, true)
-	options.AddComputeInstanceFlag(cmd.Flags(), &queryPermsCmdConfig.ComputeInstance, true)
+	options.AddOrganizationFlag(cmd.Flags(), &queryPermsCmdConfig.Organization, true)
 	options.AddServiceAccountEmailFlag(cmd.Flags(), &queryPermsCmdConfig.ServiceAccountEmail, false)
 	options.AddReasonFlag(cmd.Flags(), &queryPermsCmdConfig.Reason, false)
 
@@ -186,28 +269,7 @@ func newCmdQueryProjectPermissions() *cobra.Command {
 			resourceString = fmt.Sprintf(projectsRes, queryPermsCmdConfig.Project)
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			util.Logger.Infof("Querying permissions granted on %s", resourceString)
-			testablePerms, err := queryiam.QueryTestablePermissionsOnResource(resourceString)
-			if err != nil {
-				return err
-			}
-			userPerms, err := queryiam.QueryProjectPermissions(
-				testablePerms,
-				queryPermsCmdConfig.Project,
-				queryPermsCmdConfig.ServiceAccountEmail,
-				queryPermsCmdConfig.Reason,
-			)
-			if err != nil {
-				return err
-			}
-			if queryPermsCmdConfig.ServiceAccountEmail != "" {
-				return printPermissions(util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
-			}
-			userAcct, err := gcpclient.CheckActiveAccountSet()
-			if err != nil {
-				return err
-			}
-			return printPermissions(util.Uniq(testablePerms), userPerms, userAcct)
+			return queryResourcePermissions(cmd.Context(), resourceString)
 		},
 	}
 
@@ -237,29 +299,7 @@ func newCmdQueryPubSubPermissions() *cobra.Command {
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			util.Logger.Infof("Querying permissions granted on %s", resourceString)
-			testablePerms, err := queryiam.QueryTestablePermissionsOnResource(resourceString)
-			if err != nil {
-				return err
-			}
-			userPerms, err := queryiam.QueryPubSubPermissions(
-				testablePerms,
-				queryPermsCmdConfig.Project,
-				queryPermsCmdConfig.PubSubTopic,
-				queryPermsCmdConfig.ServiceAccountEmail,
-				queryPermsCmdConfig.Reason,
-			)
-			if err != nil {
-				return err
-			}
-			if queryPermsCmdConfig.ServiceAccountEmail != "" {
-				return printPermissions(util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
-			}
-			userAcct, err := gcpclient.CheckActiveAccountSet()
-			if err != nil {
-				return err
-			}
-			return printPermissions(util.Uniq(testablePerms), userPerms, userAcct)
+			return queryResourcePermissions(cmd.Context(), resourceString)
 		},
 	}
 
@@ -271,6 +311,45 @@ func newCmdQueryPubSubPermissions() *cobra.Command {
 	return cmd
 }
 
+func newCmdQueryResourcePermissions() *cobra.Command {
+	var supported bytes.Buffer
+	w := tabwriter.NewWriter(&supported, 0, 4, 4, ' ', 0)
+	for _, resType := range queryiam.SupportedResourceTypes() {
+		fmt.Fprintf(w, "\t%s\t%s\n", resType.Name, resType.Example)
+	}
+	w.Flush()
+
+	cmd := &cobra.Command{
+		Use:   "resource [full resource name]",
+		Short: "Query the permissions you are granted on a resource by its full resource name",
+		Long: dedent.Dedent(`
+			The "query-permissions resource" command queries the permissions you are granted on any
+			supported resource, identified by its full resource name. See
+			https://cloud.google.com/iam/docs/full-resource-names for the format of each resource type.
+			
+			The following resource types are supported:
+			
+		`) + supported.String(),
+		Example: dedent.Dedent(`
+			  eiam query-permissions resource \
+			    //secretmanager.googleapis.com/projects/my-project/secrets/my-secret
+			
+			  eiam query-permissions resource \
+			    //cloudkms.googleapis.com/projects/my-project/locations/global/keyRings/my-keyring \
+			    --service-account-email example@my-project.iam.gserviceaccount.com
+		`),
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return queryResourcePermissions(cmd.Context(), args[0])
+		},
+	}
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &queryPermsCmdConfig.ServiceAccountEmail, false)
+	options.AddReasonFlag(cmd.Flags(), &queryPermsCmdConfig.Reason, false)
+
+	return cmd
+}
+
 func newCmdQueryServiceAccountPermissions() *cobra.Command {
 	var resourceString string
 	cmd := &cobra.Command{
@@ -293,31 +372,27 @@ func newCmdQueryServiceAccountPermissions() *cobra.Command {
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			util.Logger.Infof("Querying permissions granted on %s", resourceString)
-			testablePerms, err := queryiam.QueryTestablePermissionsOnResource(resourceString)
+			testablePerms, err := queryiam.QueryTestablePermissionsOnResource(cmd.Context(), resourceString)
 			if err != nil {
 				return err
 			}
-			userPerms, err := queryiam.QueryServiceAccountPermissions(
-				testablePerms,
-				queryPermsCmdConfig.Project,
-				queryPermsCmdConfig.ServiceAccountEmail,
+			return runPermissionsQuery(resourceString, testablePerms, "",
+				func(permsToTest []string, svcAcct string) ([]string, error) {
+					return queryiam.QueryResourcePermissions(
+						cmd.Context(),
+						permsToTest,
+						resourceString,
+						svcAcct,
+						queryPermsCmdConfig.Reason,
+					)
+				},
 			)
-			if err != nil {
-				return err
-			}
-			if queryPermsCmdConfig.ServiceAccountEmail != "" {
-				return printPermissions(util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
-			}
-			userAcct, err := gcpclient.CheckActiveAccountSet()
-			if err != nil {
-				return err
-			}
-			return printPermissions(util.Uniq(testablePerms), userPerms, userAcct)
 		},
 	}
 
 	options.AddServiceAccountEmailFlag(cmd.Flags(), &queryPermsCmdConfig.ServiceAccountEmail, true)
 	options.AddProjectFlag(cmd.Flags(), &queryPermsCmdConfig.Project, false)
+	options.AddReasonFlag(cmd.Flags(), &queryPermsCmdConfig.Reason, false)
 
 	return cmd
 }
@@ -341,28 +416,7 @@ func newCmdQueryStorageBucketPermissions() *cobra.Command {
 			return nil
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			util.Logger.Infof("Querying permissions granted on %s", resourceString)
-			testablePerms, err := queryiam.QueryTestablePermissionsOnResource(resourceString)
-			if err != nil {
-				return err
-			}
-			userPerms, err := queryiam.QueryStorageBucketPermissions(
-				testablePerms,
-				queryPermsCmdConfig.StorageBucket,
-				queryPermsCmdConfig.ServiceAccountEmail,
-				queryPermsCmdConfig.Reason,
-			)
-			if err != nil {
-				return err
-			}
-			if queryPermsCmdConfig.ServiceAccountEmail != "" {
-				return printPermissions(util.Uniq(testablePerms), userPerms, queryPermsCmdConfig.ServiceAccountEmail)
-			}
-			userAcct, err := gcpclient.CheckActiveAccountSet()
-			if err != nil {
-				return err
-			}
-			return printPermissions(util.Uniq(testablePerms), userPerms, userAcct)
+			return queryResourcePermissions(cmd.Context(), resourceString)
 		},
 	}
 
@@ -373,34 +427,111 @@ func newCmdQueryStorageBucketPermissions() *cobra.Command {
 	return cmd
 }
 
-func printPermissions(fullPerms, userPerms []string, acctEmail string) error {
-	userPermsMap := makePermsMap(userPerms)
-	if len(fullPerms) > 100 {
-		// If the list of permissions is really long and the user has the less command
-		// available, pipe the command to less to paginate the output.
-		lessPath, err := appconfig.CheckCommandExists("less")
-		if err != nil {
-			printPermissionsList(os.Stderr, fullPerms, userPermsMap, acctEmail, true)
-		}
+// permissionsQuery tests the permissions on a resource as a principal. If svcAcct
+// is empty, the permissions are tested as the authenticated user.
+type permissionsQuery func(permsToTest []string, svcAcct string) ([]string, error)
+
+// runPermissionsQuery prints the permissions granted to svcAcct on the resource. It
+// compares the permissions of each principal if the --compare flag is set, and
+// explains where each permission is granted if the --explain flag is set.
+func runPermissionsQuery(resource string, testablePerms []string, svcAcct string, query permissionsQuery) error {
+	fullPerms := util.Uniq(queryiam.FilterTestablePermissions(resource, testablePerms))
+	if len(queryPermsCmdConfig.Compare) > 0 {
+		return comparePermissions(resource, testablePerms, fullPerms, queryPermsCmdConfig.Compare, query)
+	}
 
-		// Create command for less with a stdin pipe that we can write to.
-		cmd := exec.Command(lessPath)
-		cmd.Stdout = os.Stdout
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			return errorsutil.New("Failed to create stdin pipe for less command", err)
+	userPerms, err := query(testablePerms, svcAcct)
+	if err != nil {
+		return err
+	}
+	acct := svcAcct
+	if acct == "" {
+		if acct, err = gcpclient.CheckActiveAccountSet(); err != nil {
+			return err
 		}
+	}
+	if queryPermsCmdConfig.Explain {
+		return explainPermissions(resource, fullPerms, userPerms, acct)
+	}
+	return printPermissions(resource, fullPerms, userPerms, acct)
+}
+
+// queryResourcePermissions prints the permissions granted on a resource that is
+// supported by queryiam.QueryResourcePermissions.
+func queryResourcePermissions(ctx context.Context, resourceString string) error {
+	util.Logger.Infof("Querying permissions granted on %s", resourceString)
+	testablePerms, err := queryiam.QueryTestablePermissionsOnResource(ctx, resourceString)
+	if err != nil {
+		return err
+	}
+	return runPermissionsQuery(resourceString, testablePerms, queryPermsCmdConfig.ServiceAccountEmail,
+		func(permsToTest []string, svcAcct string) ([]string, error) {
+			return queryiam.QueryResourcePermissions(
+				ctx,
+				permsToTest,
+				resourceString,
+				svcAcct,
+				queryPermsCmdConfig.Reason,
+			)
+		},
+	)
+}
+
+// parseResourceID accepts either a numeric folder or organization ID or the ID
+// with its resource name prefix, e.g. "folders/123456789012".
+func parseResourceID(id, prefix string) (string, error) {
+	id = strings.TrimPrefix(id, prefix)
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return "", argsError(fmt.Errorf("%s is not a valid numeric ID", id))
+	}
+	return id, nil
+}
 
-		// Write the output in a goroutine so less can be ready to read it.
-		go func() {
-			defer stdin.Close()
-			printPermissionsList(stdin, fullPerms, userPermsMap, acctEmail, false)
-		}()
-		if err := cmd.Run(); err != nil {
-			printPermissionsList(os.Stderr, fullPerms, userPermsMap, acctEmail, true)
+func printPermissions(resource string, fullPerms, userPerms []string, acctEmail string) error {
+	if queryPermsCmdConfig.Output != util.OutputTable {
+		report := newPermissionsReport(resource, acctEmail, fullPerms, userPerms)
+		if err := util.WriteOutput(os.Stdout, queryPermsCmdConfig.Output, report); err != nil {
+			return errorsutil.New("Failed to write permissions", err)
 		}
-	} else {
-		printPermissionsList(os.Stderr, fullPerms, userPermsMap, acctEmail, true)
+		return nil
+	}
+
+	userPermsMap := makePermsMap(userPerms)
+	return printPaged(len(fullPerms), func(out io.Writer, colorOutput bool) {
+		printPermissionsList(out, fullPerms, userPermsMap, acctEmail, colorOutput)
+	})
+}
+
+// printPaged calls print with stderr as the output. If the output has more than
+// 100 lines and the user has the less command available, the output is piped to
+// less to paginate it instead.
+func printPaged(lines int, print func(out io.Writer, colorOutput bool)) error {
+	if lines <= 100 {
+		print(os.Stderr, true)
+		return nil
+	}
+
+	lessPath, err := appconfig.CheckCommandExists("less")
+	if err != nil {
+		print(os.Stderr, true)
+		return nil
+	}
+
+	// Create command for less with a stdin pipe that we can write to.
+	cmd := exec.Command(lessPath)
+	cmd.Stdout = os.Stdout
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return errorsutil.New("Failed to create stdin pipe for less command", err)
+	}
+
+	// Write the output in a goroutine so less can be ready to read it.
+	go func() {
+		defer stdin.Close()
+		print(stdin, false)
+	}()
+	if err := cmd.Run(); err != nil {
+		print(os.Stderr, true)
 	}
 	return nil
 }
@@ -434,6 +565,49 @@ func printPermissionsList(out io.Writer, fullPerms []string, userPerms map[strin
 	}
 }
 
+// permissionsReport is the machine-readable output of the query-permissions commands.
+type permissionsReport struct {
+	Resource            string   `json:"resource" yaml:"resource"`
+	Principal           string   `json:"principal" yaml:"principal"`
+	TestablePermissions []string `json:"testable_permissions" yaml:"testable_permissions"`
+	GrantedPermissions  []string `json:"granted_permissions" yaml:"granted_permissions"`
+	FullAccess          bool     `json:"full_access" yaml:"full_access"`
+	// Grants are the role bindings that grant each permission. They are only set
+	// when the --explain flag is used.
+	Grants map[string][]queryiam.Grant `json:"grants,omitempty" yaml:"grants,omitempty"`
+}
+
+func newPermissionsReport(resource, principal string, fullPerms, userPerms []string) permissionsReport {
+	granted := util.Uniq(userPerms)
+	return permissionsReport{
+		Resource:            resource,
+		Principal:           principal,
+		TestablePermissions: fullPerms,
+		GrantedPermissions:  granted,
+		FullAccess:          len(fullPerms) > 0 && len(granted) == len(fullPerms),
+	}
+}
+
+// CSVRecords writes one record per testable permission. If the report has grants,
+// it writes one record per grant of each permission instead.
+func (r permissionsReport) CSVRecords() [][]string {
+	if r.Grants != nil {
+		return r.grantCSVRecords()
+	}
+	granted := makePermsMap(r.GrantedPermissions)
+	records := [][]string{{"resource", "principal", "permission", "granted", "full_access"}}
+	for _, perm := range r.TestablePermissions {
+		records = append(records, []string{
+			r.Resource,
+			r.Principal,
+			perm,
+			strconv.FormatBool(granted[perm]),
+			strconv.FormatBool(r.FullAccess),
+		})
+	}
+	return records
+}
+
 func makePermsMap(perms []string) map[string]bool {
 	m := make(map[string]bool, len(perms))
 	for _, perm := range perms {
@@ -0,0 +1,199 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+// compareSelf is the principal passed to --compare to refer to the authenticated user.
+const compareSelf = "me"
+
+// permissionsReports is the machine-readable output of a permissions comparison.
+type permissionsReports []permissionsReport
+
+// CSVRecords writes one record per testable permission for each principal.
+func (r permissionsReports) CSVRecords() [][]string {
+	var records [][]string
+	for i, report := range r {
+		reportRecords := report.CSVRecords()
+		if i > 0 {
+			// Only the first report keeps the header row.
+			reportRecords = reportRecords[1:]
+		}
+		records = append(records, reportRecords...)
+	}
+	return records
+}
+
+// checkComparePrincipals validates the principals passed to the --compare flag.
+func checkComparePrincipals(principals []string) error {
+	if len(principals) == 0 {
+		return nil
+	}
+	if len(principals) < 2 {
+		return errorsutil.New(
+			"Invalid --compare flag",
+			errors.New("at least two principals are required to compare permissions"),
+		)
+	}
+
+	seen := make(map[string]bool, len(principals))
+	for _, principal := range principals {
+		principal = strings.TrimSpace(principal)
+		if principal == "" {
+			return errorsutil.New("Invalid --compare flag", errors.New("principals cannot be empty"))
+		}
+		if principal != compareSelf && !strings.Contains(principal, "@") {
+			return errorsutil.New(
+				"Invalid --compare flag",
+				fmt.Errorf("%q is not a service account email or %q", principal, compareSelf),
+			)
+		}
+		if seen[principal] {
+			return errorsutil.New("Invalid --compare flag", fmt.Errorf("%s was provided more than once", principal))
+		}
+		seen[principal] = true
+	}
+	return nil
+}
+
+// comparePermissions queries the permissions of each principal on the resource
+// concurrently and prints them side by side.
+func comparePermissions(resource string, testablePerms, fullPerms, principals []string, query permissionsQuery) error {
+	labels := make([]string, len(principals))
+	for i, principal := range principals {
+		principal = strings.TrimSpace(principal)
+		labels[i] = principal
+		if principal == compareSelf {
+			userAcct, err := gcpclient.CheckActiveAccountSet()
+			if err != nil {
+				return err
+			}
+			labels[i] = userAcct
+		}
+	}
+
+	results := make([][]string, len(principals))
+	errs := make([]error, len(principals))
+	var wg sync.WaitGroup
+	for i, principal := range principals {
+		svcAcct := strings.TrimSpace(principal)
+		if svcAcct == compareSelf {
+			svcAcct = ""
+		}
+		wg.Add(1)
+		go func(i int, svcAcct string) {
+			defer wg.Done()
+			results[i], errs[i] = query(testablePerms, svcAcct)
+		}(i, svcAcct)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	if queryPermsCmdConfig.Output != util.OutputTable {
+		reports := make(permissionsReports, len(principals))
+		for i, perms := range results {
+			reports[i] = newPermissionsReport(resource, labels[i], fullPerms, perms)
+		}
+		if err := util.WriteOutput(os.Stdout, queryPermsCmdConfig.Output, reports); err != nil {
+			return errorsutil.New("Failed to write permissions", err)
+		}
+		return nil
+	}
+
+	permsMaps := make([]map[string]bool, len(results))
+	for i, perms := range results {
+		permsMaps[i] = makePermsMap(perms)
+	}
+	if err := printPaged(len(fullPerms), func(out io.Writer, colorOutput bool) {
+		printPermissionsMatrix(out, fullPerms, permsMaps, labels, colorOutput)
+	}); err != nil {
+		return err
+	}
+
+	for i, permsMap := range permsMaps {
+		if len(permsMap) == 0 {
+			util.Logger.Warnf("%s does not have any access to this resource", labels[i])
+		} else if len(permsMap) == len(fullPerms) {
+			util.Logger.Infof("%s has full access to this resource", labels[i])
+		}
+	}
+	return nil
+}
+
+// printPermissionsMatrix prints a row for each permission with a column for each
+// principal. Rows where the principals differ are marked with a "!".
+func printPermissionsMatrix(
+	out io.Writer,
+	fullPerms []string,
+	permsMaps []map[string]bool,
+	labels []string,
+	colorOutput bool,
+) {
+	yes, no, diff := "✔", "✖", "!"
+	if colorOutput {
+		yes, no, diff = green(yes), red(no), red(diff)
+	}
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 4, ' ', 0)
+
+	fmt.Fprintf(w, "  PERMISSION\t%s\n", strings.Join(labels, "\t"))
+
+	differences := 0
+	for _, perm := range fullPerms {
+		cells := make([]string, len(permsMaps))
+		granted := 0
+		for i, permsMap := range permsMaps {
+			if permsMap[perm] {
+				cells[i] = yes
+				granted++
+			} else {
+				cells[i] = no
+			}
+		}
+		marker := " "
+		if granted != 0 && granted != len(permsMaps) {
+			marker = diff
+			differences++
+		}
+		fmt.Fprintf(w, "%s %s\t%s\n", marker, perm, strings.Join(cells, "\t"))
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\n%s\n", buf.String())
+
+	if differences == 0 {
+		fmt.Fprintf(out, "The principals have the same permissions on this resource\n\n")
+	} else {
+		fmt.Fprintf(out, "The principals differ on %d of %d permissions\n\n", differences, len(fullPerms))
+	}
+}
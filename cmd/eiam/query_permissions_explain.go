@@ -0,0 +1,134 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	queryiam "github.com/rigup/ephemeral-iam/internal/gcpclient/query_iam"
+)
+
+// explainPermissions prints the role bindings that grant each of the permissions
+// granted to acct on the resource.
+func explainPermissions(resource string, fullPerms, userPerms []string, acct string) error {
+	granted := util.Uniq(userPerms)
+	util.Logger.Infof("Reading the IAM policies that apply to %s", resource)
+	grants, err := queryiam.ExplainPermissions(resource, acct, granted, queryPermsCmdConfig.Reason)
+	if err != nil {
+		return err
+	}
+
+	if queryPermsCmdConfig.Output != util.OutputTable {
+		report := newPermissionsReport(resource, acct, fullPerms, userPerms)
+		report.Grants = grants
+		if err := util.WriteOutput(os.Stdout, queryPermsCmdConfig.Output, report); err != nil {
+			return errorsutil.New("Failed to write permissions", err)
+		}
+		return nil
+	}
+
+	lines := 0
+	for _, perm := range granted {
+		lines += len(grants[perm]) + 1
+	}
+	if err := printPaged(lines, func(out io.Writer, colorOutput bool) {
+		printGrants(out, granted, grants, colorOutput)
+	}); err != nil {
+		return err
+	}
+
+	if len(granted) == 0 {
+		util.Logger.Warnf("%s does not have any access to this resource", acct)
+	} else if unexplained := len(granted) - len(grants); unexplained > 0 {
+		util.Logger.Warnf(
+			"No role binding was found for %d of the granted permissions. They may be granted by policies that you can't read",
+			unexplained,
+		)
+	}
+	return nil
+}
+
+// printGrants prints a row for each grant of each permission. Permissions that no
+// grant was found for are marked with a "?".
+func printGrants(out io.Writer, perms []string, grants map[string][]queryiam.Grant, colorOutput bool) {
+	unknown := "?"
+	if colorOutput {
+		unknown = red(unknown)
+	}
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 4, ' ', 0)
+
+	fmt.Fprintln(w, "PERMISSION\tRESOURCE\tROLE\tMEMBER\tCONDITION")
+
+	for _, perm := range perms {
+		if len(grants[perm]) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t\t\t\n", perm, unknown)
+			continue
+		}
+		for i, grant := range grants[perm] {
+			label := perm
+			if i > 0 {
+				label = ""
+			}
+			member := grant.Member
+			if grant.Unverified {
+				member += " (unverified)"
+			}
+			condition := grant.Condition
+			if condition == "" {
+				condition = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", label, grant.Resource, grant.Role, member, condition)
+		}
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\n%s\n", buf.String())
+}
+
+// grantCSVRecords writes one record per grant of each testable permission. Permissions
+// that aren't granted, or that no grant was found for, have a single record with
+// empty grant fields.
+func (r permissionsReport) grantCSVRecords() [][]string {
+	granted := makePermsMap(r.GrantedPermissions)
+	records := [][]string{{
+		"resource", "principal", "permission", "granted", "full_access",
+		"binding_resource", "role", "member", "condition", "unverified",
+	}}
+	for _, perm := range r.TestablePermissions {
+		record := []string{r.Resource, r.Principal, perm, strconv.FormatBool(granted[perm]), strconv.FormatBool(r.FullAccess)}
+		if len(r.Grants[perm]) == 0 {
+			records = append(records, append(record, "", "", "", "", ""))
+			continue
+		}
+		for _, grant := range r.Grants[perm] {
+			records = append(records, append(append([]string{}, record...),
+				grant.Resource,
+				grant.Role,
+				grant.Member,
+				grant.Condition,
+				strconv.FormatBool(grant.Unverified),
+			))
+		}
+	}
+	return records
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/recorder"
+)
+
+func newCmdSession() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "session",
+		Short: "Manage recordings of privileged sessions",
+		Long: dedent.Dedent(`
+			When the 'session.record' config field is set to 'true', the privileged sub-shell
+			started by the "assume-privileges" command is recorded in asciicast v2 format. Recordings
+			are written to the directory set in the 'session.recordingdir' config field and are
+			named after the session ID that is included in the reason for each API call.
+			
+			Recordings can be played back with the "session replay" command or with any asciicast
+			player, e.g. 'asciinema play'.`),
+	}
+
+	cmd.AddCommand(newCmdSessionList())
+	cmd.AddCommand(newCmdSessionReplay())
+	return cmd
+}
+
+func newCmdSessionList() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the recorded privileged sessions",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			headers, err := recorder.List(viper.GetString(appconfig.SessionRecordingDir))
+			if err != nil {
+				return err
+			}
+			if len(headers) == 0 {
+				util.Logger.Warn("No privileged sessions have been recorded")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 4, ' ', 0)
+			fmt.Fprintln(w, "\nSESSION ID\tSTARTED\tSERVICE ACCOUNT\tREASON")
+			for _, h := range headers {
+				started := time.Unix(h.Timestamp, 0).Format(time.RFC1123)
+				reason := strings.TrimPrefix(h.Reason, fmt.Sprintf("ephemeral-iam %s: ", h.SessionID))
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", h.SessionID, started, h.ServiceAccount, reason)
+			}
+			w.Flush()
+			return nil
+		},
+	}
+	return cmd
+}
+
+func newCmdSessionReplay() *cobra.Command {
+	var (
+		speed     float64
+		idleLimit time.Duration
+	)
+	cmd := &cobra.Command{
+		Use:   "replay [session ID]",
+		Short: "Play back the recording of a privileged session",
+		Example: dedent.Dedent(`
+			$ eiam session replay 0123456789abcdef
+			$ eiam session replay 0123456789abcdef --speed 2 --idle-time-limit 1s`),
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			rec, err := recorder.Open(viper.GetString(appconfig.SessionRecordingDir), args[0])
+			if err != nil {
+				return err
+			}
+			defer rec.Close()
+
+			util.Logger.Infof("Replaying session %s as %s", rec.Header.SessionID, rec.Header.ServiceAccount)
+			if err := rec.Replay(os.Stdout, speed, idleLimit); err != nil {
+				return err
+			}
+			fmt.Println()
+			util.Logger.Info("End of session recording")
+			return nil
+		},
+	}
+	cmd.Flags().Float64Var(&speed, "speed", 1, "Playback speed multiplier")
+	cmd.Flags().DurationVar(&idleLimit, "idle-time-limit", 0, "Shorten pauses in the recording to at most this duration")
+	return cmd
+}
@@ -0,0 +1,267 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	"github.com/rigup/ephemeral-iam/internal/cloudsql"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+var (
+	sqlCmdInstances []string
+	sqlCmdConfig    options.CmdConfig
+)
+
+func newCmdSQL() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sql",
+		Short: "Connect to Cloud SQL instances with the permissions of a service account",
+	}
+	cmd.AddCommand(newCmdSQLProxy())
+	return cmd
+}
+
+func newCmdSQLProxy() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proxy [flags] INSTANCE_CONNECTION_NAME...",
+		Short: "Open local listeners that connect to Cloud SQL instances as the specified service account",
+		Long: dedent.Dedent(`
+			The "sql proxy" command opens a local listener for each Cloud SQL instance and connects
+			the clients of each listener to the instance with the permissions of the specified
+			service account. Unlike the "cloud_sql_proxy" command, it does not need the Cloud SQL
+			Auth Proxy to be installed.
+			
+			Instances are identified by their connection name, project:region:instance. By default,
+			the first instance listens on the standard port of its database engine (3306 for MySQL,
+			5432 for PostgreSQL and 1433 for SQL Server) and each additional instance of the same
+			engine listens on the next port. Use --port to choose the first port, or --unix-socket to
+			create a Unix socket for each instance in a directory instead.
+			
+			With --auto-iam-authn, the service account logs in to the databases with IAM database
+			authentication, so no database password is needed.
+			
+			The proxy closes its listeners and connections, and is not restarted, after the duration
+			in the "metadataserver.sessionlimit" configuration field. eiam then exits with status 124.`),
+		Example: dedent.Dedent(`
+			eiam sql proxy my-project:us-central1:my-db \
+			  -s example@my-project.iam.gserviceaccount.com -R "Investigating (JIRA-1234)"
+			
+			eiam sql proxy my-project:us-central1:my-db my-project:us-central1:other-db --port 6000 \
+			  --auto-iam-authn -s example@my-project.iam.gserviceaccount.com -R "Investigating (JIRA-1234)"`),
+		Args: cobra.MinimumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			for _, name := range args {
+				if _, _, _, err := cloudsql.ParseConnectionName(name); err != nil {
+					return errorsutil.New("Invalid command arguments", err)
+				}
+			}
+
+			sqlCmdInstances = args
+			if err := util.FormatReason(&sqlCmdConfig.Reason); err != nil {
+				return err
+			}
+
+			if !options.YesOption {
+				util.Confirm(map[string]string{
+					"Project":         sqlCmdConfig.Project,
+					"Service Account": sqlCmdConfig.ServiceAccountEmail,
+					"Reason":          sqlCmdConfig.Reason,
+					"Instances":       strings.Join(sqlCmdInstances, ", "),
+				})
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSQLProxy()
+		},
+	}
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &sqlCmdConfig.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &sqlCmdConfig.Reason, true)
+	options.AddProjectFlag(cmd.Flags(), &sqlCmdConfig.Project, false)
+	options.AddAddressFlag(cmd.Flags(), &sqlCmdConfig.Address)
+	options.AddPortFlag(cmd.Flags(), &sqlCmdConfig.Port)
+	options.AddUnixSocketFlag(cmd.Flags(), &sqlCmdConfig.UnixSocket)
+	options.AddPrivateIPFlag(cmd.Flags(), &sqlCmdConfig.PrivateIP)
+	options.AddAutoIAMAuthnFlag(cmd.Flags(), &sqlCmdConfig.AutoIAMAuthn)
+
+	return cmd
+}
+
+func runSQLProxy() error {
+	hasAccess, err := gcpclient.CanImpersonate(sqlCmdConfig.Project, sqlCmdConfig.ServiceAccountEmail)
+	if err != nil {
+		return err
+	} else if !hasAccess {
+		return errorsutil.New(
+			"Failed to start the Cloud SQL proxy",
+			errors.New("you do not have access to impersonate this service account"),
+		)
+	}
+
+	dialer, err := cloudsql.New(sqlCmdConfig.ServiceAccountEmail, sqlCmdConfig.Reason, cloudsql.Options{
+		PrivateIP: sqlCmdConfig.PrivateIP,
+		IAMAuthn:  sqlCmdConfig.AutoIAMAuthn,
+	})
+	if err != nil {
+		return err
+	}
+	defer dialer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listeners, err := listenSQLInstances(ctx, dialer)
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+	if err != nil {
+		return errorsutil.New("Failed to start the Cloud SQL proxy", err)
+	}
+
+	if sqlCmdConfig.AutoIAMAuthn {
+		util.Logger.Infof("Log in to the databases as %s with IAM database authentication", sqlCmdConfig.ServiceAccountEmail)
+	}
+	util.Logger.Info("Press Ctrl+C to stop the proxy")
+
+	// Like the metadata server, the proxy stops once the session limit is reached so
+	// that it doesn't keep creating client certificates for the service account.
+	limit := viper.GetDuration(appconfig.MetadataSessionLimit)
+	limitReached := make(chan struct{})
+	if limit > 0 {
+		timer := time.AfterFunc(limit, func() { close(limitReached) })
+		defer timer.Stop()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	go func() {
+		select {
+		case <-stop:
+			util.Logger.Info("Stopping the Cloud SQL proxy")
+			cancel()
+		case <-limitReached:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(listeners))
+	for i, ln := range listeners {
+		wg.Add(1)
+		go func(ln net.Listener, connName string) {
+			defer wg.Done()
+			if err := dialer.Serve(ctx, ln, connName); err != nil {
+				errs <- fmt.Errorf("%s: %w", connName, err)
+				cancel()
+			}
+		}(ln, sqlCmdInstances[i])
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		err = errorsutil.New("The Cloud SQL proxy stopped unexpectedly", err)
+		if isClosed(limitReached) {
+			return sessionLimitReached(limit, err)
+		}
+		return err
+	}
+	if isClosed(limitReached) {
+		return sessionLimitReached(limit, nil)
+	}
+	return nil
+}
+
+// listenSQLInstances opens a listener for each instance that was provided to the
+// sql proxy command. The listeners that were opened are returned even if opening
+// one of them fails so that they can be closed.
+func listenSQLInstances(ctx context.Context, dialer *cloudsql.Dialer) ([]net.Listener, error) {
+	var listeners []net.Listener
+	nextPorts := make(map[int]int)
+	for i, connName := range sqlCmdInstances {
+		version, err := dialer.DatabaseVersion(ctx, connName)
+		if err != nil {
+			return listeners, err
+		}
+
+		network, addr := "tcp", ""
+		switch {
+		case sqlCmdConfig.UnixSocket != "":
+			network = "unix"
+			if addr, err = sqlUnixSocketPath(sqlCmdConfig.UnixSocket, connName, version); err != nil {
+				return listeners, err
+			}
+		case sqlCmdConfig.Port != 0:
+			addr = net.JoinHostPort(sqlCmdConfig.Address, strconv.Itoa(sqlCmdConfig.Port+i))
+		default:
+			// Instances of the same engine listen on consecutive ports starting from the
+			// engine's standard port.
+			defaultPort := cloudsql.DefaultPort(version)
+			addr = net.JoinHostPort(sqlCmdConfig.Address, strconv.Itoa(defaultPort+nextPorts[defaultPort]))
+			nextPorts[defaultPort]++
+		}
+
+		var lc net.ListenConfig
+		ln, err := lc.Listen(ctx, network, addr)
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, ln)
+		util.Logger.Infof("Listening on %s for %s", ln.Addr(), connName)
+	}
+	return listeners, nil
+}
+
+// sqlUnixSocketPath returns the path of the Unix socket for the instance in dir.
+// PostgreSQL clients connect to a socket named .s.PGSQL.5432 in the directory that
+// they are given, so a directory is created for each PostgreSQL instance.
+func sqlUnixSocketPath(dir, connName, databaseVersion string) (string, error) {
+	path := filepath.Join(dir, connName)
+	if !strings.HasPrefix(databaseVersion, "POSTGRES") {
+		return path, nil
+	}
+	if err := os.MkdirAll(path, 0o750); err != nil {
+		return "", err
+	}
+	return filepath.Join(path, ".s.PGSQL.5432"), nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/proxy"
+	"github.com/rigup/ephemeral-iam/internal/wrapper"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+var (
+	// tfTicketSubcommands are the terraform subcommands that change infrastructure or
+	// its state, which require the reason to reference a ticket.
+	tfTicketSubcommands = []string{
+		"apply",
+		"destroy",
+		"force-unlock",
+		"import",
+		"refresh",
+		"state mv",
+		"state push",
+		"state replace-provider",
+		"state rm",
+		"taint",
+		"untaint",
+		"workspace delete",
+	}
+
+	// tfLoggedSubcommands are the terraform subcommands that are written to the
+	// command log.
+	tfLoggedSubcommands = append([]string{"plan"}, tfTicketSubcommands...)
+)
+
+func newCmdTerraform() *cobra.Command {
+	return newCmdWrapper(wrapper.Terraform(), wrapperOptions{
+		long: dedent.Dedent(`
+			The "terraform" command runs the provided terraform command with the permissions of the
+			specified service account. The Google providers get access tokens from a local metadata
+			server that refreshes them, so long applies don't fail when a token expires, and they send
+			the reason as the request reason of each API call. Your own credentials are hidden from
+			terraform so that it can't fall back to them.
+			
+			Commands that change infrastructure or its state, such as "apply", "destroy", "import",
+			"state rm", "state mv", "state push", "taint", "untaint" and "force-unlock", are refused
+			unless the reason matches the regular expression in the "terraform.ticketpattern"
+			configuration field, which matches ticket IDs such as JIRA-1234 by default.
+			
+			Plans and the commands that require a ticket are written to the command log in the
+			"authproxy.logdir" directory with the session ID, the reason and their exit status, so
+			that they can be matched to the audit logs of the API calls that they made.`),
+		example: dedent.Dedent(`
+			eiam terraform -s terraform@my-project.iam.gserviceaccount.com -R "Planning (JIRA-1234)" -- \
+			  plan -out tfplan
+			
+			eiam terraform -s terraform@my-project.iam.gserviceaccount.com -R "Rollout (JIRA-1234)" -- \
+			  apply tfplan`),
+		positionalArgs: true,
+		checkArgs:      checkTerraformReason,
+		afterRun:       logTerraformRun,
+	})
+}
+
+// checkTerraformReason ensures that the reason for a terraform subcommand that changes
+// infrastructure matches the configured ticket pattern.
+func checkTerraformReason(args []string, reason string) error {
+	subcommand := wrapper.TerraformSubcommand(args)
+	pattern := viper.GetString(appconfig.TerraformTicketPattern)
+	if pattern == "" || !util.Contains(tfTicketSubcommands, subcommand) {
+		return nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return errorsutil.New(fmt.Sprintf("Invalid %s configuration", appconfig.TerraformTicketPattern), err)
+	}
+	if !re.MatchString(reason) {
+		err := fmt.Errorf("the reason for terraform %s must reference a ticket matching %q", subcommand, pattern)
+		return errorsutil.New("Invalid command arguments", err)
+	}
+	return nil
+}
+
+// logTerraformRun writes the terraform commands that plan or change infrastructure to
+// the command log.
+func logTerraformRun(cmdConfig options.CmdConfig, args []string, start time.Time, runErr error) {
+	if !util.Contains(tfLoggedSubcommands, wrapper.TerraformSubcommand(args)) {
+		return
+	}
+
+	exitCode := 0
+	if runErr != nil {
+		var exitErr errorsutil.ExitError
+		if errors.As(runErr, &exitErr) {
+			exitCode = exitErr.Code
+		} else {
+			// The command didn't run.
+			exitCode = -1
+		}
+	}
+
+	dir, _ := os.Getwd()
+	entry := proxy.CommandLogEntry{
+		Reason:         cmdConfig.Reason,
+		ServiceAccount: cmdConfig.ServiceAccountEmail,
+		Command:        "terraform " + strings.Join(args, " "),
+		Directory:      dir,
+		ExitCode:       exitCode,
+		StartTime:      start.UTC(),
+		EndTime:        time.Now().UTC(),
+	}
+	if err := proxy.LogCommand(entry); err != nil {
+		util.Logger.WithError(err).Error("Failed to write the terraform command to the command log")
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiam
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/lithammer/dedent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	eiam "github.com/rigup/ephemeral-iam/internal"
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/wrapper"
+	"github.com/rigup/ephemeral-iam/pkg/options"
+)
+
+// wrapperOptions customizes a command that runs a wrapped tool. Empty help text is
+// generated from the tool.
+type wrapperOptions struct {
+	long    string
+	example string
+	// kubernetes adds the flags that select the GKE cluster of the session and the
+	// Kubernetes identity to impersonate in it.
+	kubernetes bool
+	// positionalArgs passes the arguments after the flags of eiam to the tool, instead
+	// of the flags that eiam doesn't know, for tools whose flags can be mistaken for
+	// those of eiam. The tool's arguments then follow "--".
+	positionalArgs bool
+	// checkArgs, if set, validates the arguments of the tool against the reason before
+	// the command is confirmed.
+	checkArgs func(args []string, reason string) error
+	// afterRun, if set, is called with the result of the tool once it has run.
+	afterRun func(cmdConfig options.CmdConfig, args []string, start time.Time, err error)
+	// restartOnSessionLimit restarts the tool with a new session, instead of exiting,
+	// when it is stopped because the session limit was reached. It is meant for
+	// long-running tools such as proxies.
+	restartOnSessionLimit bool
+}
+
+// newCmdWrapper returns the command that runs the tool with the permissions of the
+// specified service account.
+func newCmdWrapper(tool wrapper.Tool, opts wrapperOptions) *cobra.Command {
+	var (
+		cmdArgs   []string
+		cmdConfig options.CmdConfig
+	)
+
+	if opts.long == "" {
+		opts.long = fmt.Sprintf(dedent.Dedent(`
+			The "%[1]s" command runs the provided %[1]s command with the permissions of the specified
+			service account.`), tool.Name)
+	}
+	if opts.example == "" {
+		opts.example = fmt.Sprintf(dedent.Dedent(`
+			eiam %s --version \
+			  -s example@my-project.iam.gserviceaccount.com \
+			  -R "Debugging for (JIRA-1234)"`), tool.Name)
+	}
+
+	cmd := &cobra.Command{
+		Use:                fmt.Sprintf("%s [%s_ARGS]", tool.Name, strings.ToUpper(tool.Name)),
+		Short:              tool.Description,
+		Long:               opts.long,
+		Example:            opts.example,
+		Args:               cobra.ArbitraryArgs,
+		FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if tool.Path == "" {
+				err := fmt.Errorf("%q: executable file not found in $PATH", tool.Name)
+				return errorsutil.New(fmt.Sprintf("Failed to run %s command", tool.Name), err)
+			}
+
+			if err := options.CheckRequired(cmd.Flags()); err != nil {
+				return err
+			}
+			if err := options.CheckKubeImpersonation(cmdConfig.KubeAs, cmdConfig.KubeAsGroups); err != nil {
+				return err
+			}
+
+			if opts.positionalArgs {
+				cmdArgs = args
+			} else {
+				cmdArgs = util.ExtractUnknownArgs(cmd.Flags(), os.Args)
+			}
+			if opts.checkArgs != nil {
+				if err := opts.checkArgs(cmdArgs, cmdConfig.Reason); err != nil {
+					return err
+				}
+			}
+			if err := util.FormatReason(&cmdConfig.Reason); err != nil {
+				return err
+			}
+
+			if !options.YesOption {
+				confirmation := map[string]string{
+					"Project":         cmdConfig.Project,
+					"Service Account": cmdConfig.ServiceAccountEmail,
+					"Reason":          cmdConfig.Reason,
+					"Command":         fmt.Sprintf("%s %s", tool.Name, strings.Join(cmdArgs, " ")),
+				}
+				if cmdConfig.Cluster != "" {
+					confirmation["Cluster"] = cmdConfig.Cluster
+				}
+				addKubeImpersonation(confirmation, cmdConfig.KubeAs, cmdConfig.KubeAsGroups)
+				util.Confirm(confirmation)
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runWrappedTool(tool, cmdConfig, cmdArgs, opts)
+		},
+	}
+	if opts.positionalArgs {
+		cmd.Use = fmt.Sprintf("%s [flags] -- %s_ARGS", tool.Name, strings.ToUpper(tool.Name))
+		cmd.Args = cobra.MinimumNArgs(1)
+		cmd.FParseErrWhitelist = cobra.FParseErrWhitelist{}
+		// Leave the flags after the command name for the tool.
+		cmd.Flags().SetInterspersed(false)
+	}
+
+	options.AddServiceAccountEmailFlag(cmd.Flags(), &cmdConfig.ServiceAccountEmail, true)
+	options.AddReasonFlag(cmd.Flags(), &cmdConfig.Reason, true)
+	options.AddProjectFlag(cmd.Flags(), &cmdConfig.Project, false)
+	if opts.kubernetes {
+		options.AddClusterFlag(cmd.Flags(), &cmdConfig.Cluster)
+		options.AddLocationFlag(cmd.Flags(), &cmdConfig.Location)
+		options.AddKubeAsFlag(cmd.Flags(), &cmdConfig.KubeAs)
+		options.AddKubeAsGroupFlag(cmd.Flags(), &cmdConfig.KubeAsGroups)
+	}
+
+	return cmd
+}
+
+// runWrappedTool runs the tool with the permissions of the service account. If
+// opts.restartOnSessionLimit is set, the tool is restarted with a new session each
+// time that the session limit is reached.
+func runWrappedTool(tool wrapper.Tool, cmdConfig options.CmdConfig, args []string, opts wrapperOptions) error {
+	fullCmd := fmt.Sprintf("%s %s", tool.Name, strings.Join(args, " "))
+
+	hasAccess, err := gcpclient.CanImpersonate(cmdConfig.Project, cmdConfig.ServiceAccountEmail)
+	if err != nil {
+		return err
+	} else if !hasAccess {
+		return errorsutil.New(
+			fmt.Sprintf("Failed to run command [%s]", fullCmd),
+			errors.New("you do not have access to impersonate this service account"),
+		)
+	}
+
+	limit := viper.GetDuration(appconfig.MetadataSessionLimit)
+	for {
+		limitReached, err := runToolSession(tool, cmdConfig, args, limit, opts.afterRun)
+		if !limitReached {
+			return err
+		}
+		if !opts.restartOnSessionLimit {
+			// The command was stopped because its tokens stopped being refreshed.
+			return sessionLimitReached(limit, err)
+		}
+		util.Logger.Infof("The session limit of %s was reached. Restarting %s with a new session", limit, tool.Name)
+	}
+}
+
+// runToolSession runs the tool once in a new session and reports whether it was
+// stopped because the session limit was reached. If afterRun is not nil, it is
+// called with the result of the tool once it has run.
+func runToolSession(
+	tool wrapper.Tool,
+	cmdConfig options.CmdConfig,
+	args []string,
+	limit time.Duration,
+	afterRun func(cmdConfig options.CmdConfig, args []string, start time.Time, err error),
+) (bool, error) {
+	fullCmd := fmt.Sprintf("%s %s", tool.Name, strings.Join(args, " "))
+	session := &wrapper.Session{
+		ServiceAccount: cmdConfig.ServiceAccountEmail,
+		Reason:         cmdConfig.Reason,
+		Project:        cmdConfig.Project,
+		SessionLimit:   limit,
+		KubeUser:       cmdConfig.KubeAs,
+		KubeGroups:     cmdConfig.KubeAsGroups,
+	}
+	defer func() {
+		if err := session.Close(); err != nil {
+			util.Logger.WithError(err).Error("Failed to remove temporary credentials")
+		}
+	}()
+	var err error
+	if cmdConfig.Cluster != "" {
+		if session.Cluster, err = findCluster(cmdConfig); err != nil {
+			return false, err
+		}
+	} else {
+		// Without a cluster there is no kubeconfig of the session to impersonate the
+		// Kubernetes identity in, so it is passed to kubectl instead.
+		args = wrapper.InsertArgs(args, session.KubeImpersonationArgs())
+	}
+
+	c, err := tool.Command(session, args)
+	if err != nil {
+		return false, errorsutil.New(fmt.Sprintf("Failed to run command [%s]", fullCmd), err)
+	}
+
+	util.Logger.Infof("Running: [%s]\n\n", fullCmd)
+	start := time.Now()
+	err = runChildCommand(c, fullCmd, session.Done())
+	if afterRun != nil {
+		afterRun(cmdConfig, args, start, err)
+	}
+	return isClosed(session.Done()), err
+}
+
+// runChildCommand runs a command until it exits or stop is closed. If the command
+// exits with a non-zero status, the errorsutil.ExitError that is returned makes eiam
+// exit with the same status.
+func runChildCommand(c *exec.Cmd, fullCmd string, stop <-chan struct{}) error {
+	if err := wrapper.Run(c, stop); err != nil {
+		var exitErr errorsutil.ExitError
+		if errors.As(err, &exitErr) {
+			return err
+		}
+		return errorsutil.New(fmt.Sprintf("Failed to run command [%s]", fullCmd), err)
+	}
+	return nil
+}
+
+// addConfiguredWrappers adds a command for each tool in the "wrappers" configuration
+// field. Tools that are misconfigured or that have the name of another command are
+// skipped, so that they don't prevent eiam from running.
+func addConfiguredWrappers(rc *eiam.RootCommand) {
+	tools, err := wrapper.Configured()
+	if err != nil {
+		util.Logger.WithError(err).Error("Failed to load the configured wrappers")
+		return
+	}
+
+	for _, tool := range tools {
+		if err := tool.Validate(); err != nil {
+			util.Logger.WithError(err).Errorf("Failed to load the %s wrapper", tool.Name)
+			continue
+		}
+		if hasCommand(&rc.Command, tool.Name) {
+			util.Logger.Warnf("Not loading the %s wrapper because there is already an eiam %s command", tool.Name, tool.Name)
+			continue
+		}
+		rc.AddCommand(newCmdWrapper(tool, wrapperOptions{}))
+	}
+}
+
+func hasCommand(cmd *cobra.Command, name string) bool {
+	for _, c := range cmd.Commands() {
+		if c.Name() == name || c.HasAlias(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionLimitExitCode is the exit status of eiam when a command is stopped because
+// the session limit was reached, like the exit status of timeout(1).
+const sessionLimitExitCode = 124
+
+// sessionLimitReached logs that the session limit was reached and returns the error
+// that eiam exits with when the command isn't restarted with a new session. If the
+// command that was stopped exited cleanly, eiam exits with sessionLimitExitCode so
+// that scripts don't mistake the stopped command for a successful one.
+func sessionLimitReached(limit time.Duration, err error) error {
+	util.Logger.Warnf("The session limit of %s was reached. Run the command again to start a new session", limit)
+	if err != nil {
+		return err
+	}
+	return errorsutil.ExitError{Code: sessionLimitExitCode}
+}
+
+// isClosed reports whether the channel is closed. A nil channel is never closed.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// addKubeImpersonation adds the Kubernetes user and groups to impersonate, if any, to
+// the confirmation prompt of a command.
+func addKubeImpersonation(confirmation map[string]string, user string, groups []string) {
+	if user == "" {
+		return
+	}
+	confirmation["Kubernetes User"] = user
+	if len(groups) > 0 {
+		confirmation["Kubernetes Groups"] = strings.Join(groups, ", ")
+	}
+}
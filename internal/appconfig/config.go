@@ -17,9 +17,11 @@ package appconfig
 import (
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/spf13/viper"
@@ -37,16 +39,32 @@ const (
 	AuthProxyLogDir        = "authproxy.logdir"
 	AuthProxyCertFile      = "authproxy.certfile"
 	AuthProxyKeyFile       = "authproxy.keyfile"
+	AuthProxyHTTP2         = "authproxy.http2"
+	AuthProxyMetrics       = "authproxy.metrics"
+	AuthProxyUpstreamURL   = "authproxy.upstream.url"
+	AuthProxyNoProxy       = "authproxy.upstream.noproxy"
 	DefaultServiceAccounts = "serviceaccounts"
+	CacheDir               = "cache.dir"
+	CacheTTL               = "cache.ttl"
 	CloudSQLProxyPath      = "binarypaths.cloudsqlproxy"
 	GcloudPath             = "binarypaths.gcloud"
 	KubectlPath            = "binarypaths.kubectl"
+	TerraformPath          = "binarypaths.terraform"
 	GithubAuth             = "github.auth"
 	GithubTokens           = "github.tokens" //nolint:gosec // Not hardcoded credentials
 	LoggingFormat          = "logging.format"
 	LoggingLevel           = "logging.level"
 	LoggingLevelTruncation = "logging.disableleveltruncation"
 	LoggingPadLevelText    = "logging.padleveltext"
+	MetadataServerAddress  = "metadataserver.address"
+	MetadataServerPort     = "metadataserver.port"
+	MetadataSessionLimit   = "metadataserver.sessionlimit"
+	SessionCommandLog      = "session.commandlog"
+	SessionRecord          = "session.record"
+	SessionRecordingDir    = "session.recordingdir"
+	SessionCompressRecords = "session.compressrecordings"
+	TerraformTicketPattern = "terraform.ticketpattern"
+	Wrappers               = "wrappers"
 )
 
 var (
@@ -57,6 +75,7 @@ var (
 		CloudSQLProxyPath: "cloud_sql_proxy",
 		GcloudPath:        "gcloud",
 		KubectlPath:       "kubectl",
+		TerraformPath:     "terraform",
 	}
 )
 
@@ -66,6 +85,7 @@ func InitConfig() error {
 	viper.AddConfigPath(GetConfigDir())
 	viper.AutomaticEnv()
 	viper.SetConfigType("yml")
+	setDefaults()
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
@@ -77,6 +97,8 @@ func InitConfig() error {
 	// Instantiate logger now that the config is loaded.
 	util.Logger = util.NewLogger()
 
+	setUpstreamProxyEnv()
+
 	// Find the paths to gcloud, kubectl, and cloud_sql_proxy and write them to the config.
 	if err := getBinPaths(); err != nil {
 		return err
@@ -85,19 +107,38 @@ func InitConfig() error {
 	return nil
 }
 
-func initConfig() {
+// setDefaults registers the default value of each config key. Defaults are
+// registered on every run so that keys added in newer versions of eiam are
+// populated for users with an existing configuration file.
+func setDefaults() {
 	viper.SetDefault(AuthProxyAddress, "127.0.0.1")
 	viper.SetDefault(AuthProxyPort, "8084")
 	viper.SetDefault(AuthProxyVerbose, false)
 	viper.SetDefault(AuthProxyLogDir, filepath.Join(GetConfigDir(), "log"))
 	viper.SetDefault(AuthProxyCertFile, filepath.Join(GetConfigDir(), "server.pem"))
 	viper.SetDefault(AuthProxyKeyFile, filepath.Join(GetConfigDir(), "server.key"))
+	viper.SetDefault(AuthProxyHTTP2, false)
+	viper.SetDefault(AuthProxyMetrics, false)
+	viper.SetDefault(AuthProxyUpstreamURL, "")
+	viper.SetDefault(AuthProxyNoProxy, "")
+	viper.SetDefault(CacheDir, filepath.Join(GetConfigDir(), "cache"))
+	viper.SetDefault(CacheTTL, "24h")
 	viper.SetDefault(GithubAuth, false)
 	viper.SetDefault(LoggingFormat, "text")
 	viper.SetDefault(LoggingLevel, "info")
 	viper.SetDefault(LoggingLevelTruncation, true)
 	viper.SetDefault(LoggingPadLevelText, true)
+	viper.SetDefault(MetadataServerAddress, "127.0.0.1")
+	viper.SetDefault(MetadataServerPort, "8085")
+	viper.SetDefault(MetadataSessionLimit, "12h")
+	viper.SetDefault(SessionCommandLog, false)
+	viper.SetDefault(SessionRecord, false)
+	viper.SetDefault(SessionRecordingDir, filepath.Join(GetConfigDir(), "recordings"))
+	viper.SetDefault(SessionCompressRecords, false)
+	viper.SetDefault(TerraformTicketPattern, `[A-Z][A-Z0-9]+-[0-9]+`)
+}
 
+func initConfig() {
 	if err := viper.SafeWriteConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileAlreadyExistsError); !ok {
 			log.Fatalf("failed to write config file %s/config.yml: %v", GetConfigDir(), err)
@@ -105,18 +146,68 @@ func initConfig() {
 	}
 }
 
+// loopbackHosts are never sent through the upstream proxy so that the auth proxy
+// and metadata server that eiam runs locally stay reachable from clients that
+// don't bypass loopback addresses on their own.
+const loopbackHosts = "localhost,127.0.0.1,::1"
+
+// setUpstreamProxyEnv exports the configured upstream proxy as the standard proxy
+// environment variables. The Google Cloud client libraries and the commands run
+// by eiam read these variables to determine which proxy to use. The hosts in
+// 'authproxy.upstream.noproxy' are added to the existing NO_PROXY hosts.
+func setUpstreamProxyEnv() {
+	proxyURL := viper.GetString(AuthProxyUpstreamURL)
+	if proxyURL == "" {
+		return
+	}
+	if u, err := url.Parse(proxyURL); err == nil {
+		util.Logger.Debugf("Using upstream proxy %s", u.Redacted())
+	}
+	noProxy := mergeNoProxy(viper.GetString(AuthProxyNoProxy), os.Getenv("NO_PROXY"), os.Getenv("no_proxy"), loopbackHosts)
+	util.SetUpstreamProxy(proxyURL, noProxy)
+	for _, env := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		os.Setenv(env, proxyURL)
+	}
+	for _, env := range []string{"NO_PROXY", "no_proxy"} {
+		os.Setenv(env, noProxy)
+	}
+}
+
+// mergeNoProxy joins comma-separated lists of NO_PROXY hosts, dropping duplicates.
+func mergeNoProxy(lists ...string) string {
+	seen := map[string]bool{}
+	var hosts []string
+	for _, list := range lists {
+		for _, host := range strings.Split(list, ",") {
+			if host = strings.TrimSpace(host); host != "" && !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return strings.Join(hosts, ",")
+}
+
 func getBinPaths() error {
 	updated := false
 	for configKey, binName := range binPaths {
 		if viper.GetString(configKey) == "" {
 			updated = true
 			binPath, err := CheckCommandExists(binName)
+			if err != nil && configKey == CloudSQLProxyPath {
+				// The binary of version 2 of the Cloud SQL Auth Proxy is named cloud-sql-proxy.
+				binPath, err = CheckCommandExists("cloud-sql-proxy")
+			}
 			if err != nil {
-				if configKey != CloudSQLProxyPath {
-					// Exit if kubectl or gcloud aren't installed, but continue if cloud_sql_proxy isn't.
+				switch configKey {
+				case CloudSQLProxyPath:
+					util.Logger.Debug("Could not find path to cloud_sql_proxy binary, use `eiam sql proxy` instead")
+				case TerraformPath:
+					util.Logger.Debug("Could not find path to terraform binary")
+				default:
+					// Exit if kubectl or gcloud aren't installed, but continue if the other tools aren't.
 					return err
 				}
-				util.Logger.Debug("Could not find path to cloud_sql_proxy binary")
 			}
 			viper.Set(configKey, binPath)
 		}
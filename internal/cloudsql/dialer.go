@@ -0,0 +1,141 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloudsql connects to Cloud SQL instances as an impersonated service
+// account without the Cloud SQL Auth Proxy binary. Connections are opened with the
+// Cloud SQL Go connector, which signs ephemeral client certificates with the Cloud
+// SQL Admin API and verifies the server certificates of the instances.
+package cloudsql
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"golang.org/x/oauth2"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients"
+)
+
+// Options configures a Dialer.
+type Options struct {
+	// PrivateIP connects to the private IP address of the instances instead of their
+	// public IP address.
+	PrivateIP bool
+	// IAMAuthn includes an access token in the client certificates so that the
+	// service account can log in to the database with IAM database authentication.
+	IAMAuthn bool
+}
+
+// Dialer opens connections to Cloud SQL instances.
+type Dialer struct {
+	dialer *cloudsqlconn.Dialer
+}
+
+// New returns a Dialer that connects to instances as the service account. The Cloud
+// SQL Admin API is called with the reason, and the access tokens for IAM database
+// authentication are generated for the service account.
+func New(serviceAccount, reason string, opts Options) (*Dialer, error) {
+	ctx := context.Background()
+	client, err := clients.Default().HTTP(ctx, clients.Options{
+		ServiceAccount: serviceAccount,
+		Reason:         reason,
+	})
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Cloud SQL Admin", serviceAccount, err)
+	}
+	tokens := &accessTokenSource{serviceAccount: serviceAccount, reason: reason}
+	return newDialer(ctx, opts, tokens, cloudsqlconn.WithHTTPClient(client))
+}
+
+// newDialer returns a Dialer that gets the access tokens for IAM database
+// authentication from tokens. The connector options are applied last, e.g. to
+// override the endpoint of the Cloud SQL Admin API.
+func newDialer(
+	ctx context.Context,
+	opts Options,
+	tokens oauth2.TokenSource,
+	connectorOpts ...cloudsqlconn.Option,
+) (*Dialer, error) {
+	dialOpts := []cloudsqlconn.DialOption{cloudsqlconn.WithDialIAMAuthN(opts.IAMAuthn)}
+	if opts.PrivateIP {
+		dialOpts = append(dialOpts, cloudsqlconn.WithPrivateIP())
+	}
+	// The connector only accepts a token source for IAM database authentication if
+	// it is enabled for the dialer, so it is enabled there and left to the dial
+	// options instead. Without it, the connector would look for application default
+	// credentials.
+	connectorOpts = append([]cloudsqlconn.Option{
+		cloudsqlconn.WithIAMAuthN(),
+		cloudsqlconn.WithIAMAuthNTokenSources(tokens, tokens),
+		cloudsqlconn.WithDefaultDialOptions(dialOpts...),
+	}, connectorOpts...)
+
+	d, err := cloudsqlconn.NewDialer(ctx, connectorOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Dialer{dialer: d}, nil
+}
+
+// ParseConnectionName splits an instance connection name, project:region:instance,
+// into its parts. Projects in a domain, e.g. example.com:project, are supported.
+func ParseConnectionName(name string) (project, region, instance string, err error) {
+	parts := strings.Split(name, ":")
+	if len(parts) < 3 || len(parts) > 4 {
+		return "", "", "", fmt.Errorf("invalid instance connection name %q: expected project:region:instance", name)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", "", "", fmt.Errorf("invalid instance connection name %q: expected project:region:instance", name)
+		}
+	}
+	n := len(parts)
+	return strings.Join(parts[:n-2], ":"), parts[n-2], parts[n-1], nil
+}
+
+// Dial opens a connection to the instance.
+func (d *Dialer) Dial(ctx context.Context, connName string) (net.Conn, error) {
+	return d.dialer.Dial(ctx, connName)
+}
+
+// DatabaseVersion returns the database version of the instance, e.g. POSTGRES_13.
+func (d *Dialer) DatabaseVersion(ctx context.Context, connName string) (string, error) {
+	return d.dialer.EngineVersion(ctx, connName)
+}
+
+// Close stops refreshing the client certificates of the instances.
+func (d *Dialer) Close() error {
+	return d.dialer.Close()
+}
+
+// accessTokenSource generates access tokens for a service account. The connector
+// asks for a new token each time that it refreshes a client certificate, so the
+// tokens are not cached.
+type accessTokenSource struct {
+	serviceAccount string
+	reason         string
+}
+
+func (s *accessTokenSource) Token() (*oauth2.Token, error) {
+	resp, err := gcpclient.GenerateTemporaryAccessToken(s.serviceAccount, s.reason)
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: resp.GetAccessToken(), Expiry: resp.GetExpireTime().AsTime()}, nil
+}
@@ -0,0 +1,460 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudsql
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+func init() {
+	util.Logger = logrus.New()
+}
+
+const (
+	testConnName = "my-project:us-central1:my-instance"
+	testDNSName  = "my-instance.my-project.us-central1.sql.goog"
+)
+
+// testCA is a certificate authority that issues the certificates of the fake
+// instances and their clients.
+type testCA struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+// newTestCA returns a CA that is signed by parent, or a root CA if parent is nil.
+func newTestCA(t *testing.T, parent *testCA, cn string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{key: key}
+	issuer := parent
+	if issuer == nil {
+		issuer = ca
+	}
+	der := issuer.issue(t, &key.PublicKey, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// issue signs a certificate for the public key from the template. A root CA signs
+// its own certificate before ca.cert is set.
+func (ca *testCA) issue(t *testing.T, pub interface{}, tmpl *x509.Certificate) []byte {
+	t.Helper()
+
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotAfter = time.Now().Add(24 * time.Hour)
+	}
+	parent := ca.cert
+	if parent == nil {
+		parent = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func (ca *testCA) pem() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+}
+
+// fakeAdmin is a Cloud SQL Admin API with a single instance whose server-side
+// proxy is a TLS echo server.
+type fakeAdmin struct {
+	root *testCA
+	// settings are returned by the connectSettings method.
+	settings sqladmin.ConnectSettings
+	// addr is the address of the server-side proxy.
+	addr string
+
+	mu     sync.Mutex
+	certs  int
+	tokens []string
+}
+
+var adminPathRE = regexp.MustCompile(`^/sql/v1beta4/projects/([^/]+)/instances/([^/:]+)(/connectSettings|:generateEphemeralCert)$`)
+
+func newFakeAdmin(t *testing.T) (*fakeAdmin, *httptest.Server) {
+	t.Helper()
+
+	root := newTestCA(t, nil, "Google Cloud SQL Server CA")
+	a := &fakeAdmin{
+		root: root,
+		settings: sqladmin.ConnectSettings{
+			BackendType:     "SECOND_GEN",
+			DatabaseVersion: "POSTGRES_13",
+			Region:          "us-central1",
+			IpAddresses:     []*sqladmin.IpMapping{{Type: "PRIMARY", IpAddress: "127.0.0.1"}},
+			ServerCaCert:    &sqladmin.SslCert{Cert: root.pem()},
+		},
+	}
+	a.startEchoServer(t, root, &x509.Certificate{Subject: pkix.Name{CommonName: "my-project:my-instance"}})
+
+	srv := httptest.NewServer(http.HandlerFunc(a.serveHTTP))
+	t.Cleanup(srv.Close)
+	return a, srv
+}
+
+// startEchoServer starts a TLS server that presents a certificate issued by the CA
+// from the template, along with the CA's certificate if it is an intermediate CA.
+// It requires a client certificate signed by the root CA and echoes each line back.
+func (a *fakeAdmin) startEchoServer(t *testing.T, ca *testCA, tmpl *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	chain := [][]byte{ca.issue(t, &key.PublicKey, tmpl)}
+	if ca != a.root {
+		chain = append(chain, ca.cert.Raw)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(a.root.cert)
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: chain, PrivateKey: key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					fmt.Fprintf(conn, "echo: %s\n", scanner.Text())
+				}
+			}()
+		}
+	}()
+	a.addr = ln.Addr().String()
+}
+
+func (a *fakeAdmin) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	m := adminPathRE.FindStringSubmatch(r.URL.Path)
+	if m == nil || m[1] != "my-project" || m[2] != "my-instance" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error": {"code": 404, "message": "instance not found"}}`)
+		return
+	}
+
+	var resp interface{}
+	if m[3] == "/connectSettings" {
+		resp = a.settings
+	} else {
+		cert, err := a.generateEphemeralCert(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp = sqladmin.GenerateEphemeralCertResponse{EphemeralCert: &sqladmin.SslCert{Cert: cert}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp) //nolint:errcheck // The client reports bad responses.
+}
+
+// generateEphemeralCert signs a client certificate for the public key in the request.
+func (a *fakeAdmin) generateEphemeralCert(r *http.Request) (string, error) {
+	var req sqladmin.GenerateEphemeralCertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode([]byte(req.PublicKey))
+	if block == nil {
+		return "", fmt.Errorf("the public key is not PEM encoded")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.certs++
+	a.tokens = append(a.tokens, req.AccessToken)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(int64(a.certs)),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, a.root.cert, pub, a.root.key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), nil
+}
+
+// newTestDialer returns a Dialer that calls the fake Cloud SQL Admin API and
+// connects to its echo server.
+func newTestDialer(t *testing.T, admin *fakeAdmin, srv *httptest.Server, opts Options) *Dialer {
+	t.Helper()
+
+	tokens := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-token", Expiry: time.Now().Add(time.Hour)})
+	d, err := newDialer(context.Background(), opts, tokens,
+		cloudsqlconn.WithAdminAPIEndpoint(srv.URL+"/"),
+		cloudsqlconn.WithDialFunc(func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, admin.addr)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// roundTrip sends a line over conn and returns the reply.
+func roundTrip(t *testing.T, conn net.Conn, line string) string {
+	t.Helper()
+
+	if _, err := fmt.Fprintln(conn, line); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(reply)
+}
+
+func TestParseConnectionName(t *testing.T) {
+	tests := []struct {
+		name                      string
+		project, region, instance string
+		wantErr                   bool
+	}{
+		{
+			name:    "my-project:us-central1:my-instance",
+			project: "my-project", region: "us-central1", instance: "my-instance",
+		},
+		{
+			name:    "example.com:my-project:us-central1:db",
+			project: "example.com:my-project", region: "us-central1", instance: "db",
+		},
+		{name: "my-project:my-instance", wantErr: true},
+		{name: "my-project::my-instance", wantErr: true},
+		{name: "a:b:c:d:e", wantErr: true},
+	}
+	for _, tt := range tests {
+		project, region, instance, err := ParseConnectionName(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseConnectionName(%q) error = %v, wantErr %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if project != tt.project || region != tt.region || instance != tt.instance {
+			t.Errorf("ParseConnectionName(%q) = %q, %q, %q, want %q, %q, %q",
+				tt.name, project, region, instance, tt.project, tt.region, tt.instance)
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	admin, srv := newFakeAdmin(t)
+	d := newTestDialer(t, admin, srv, Options{})
+
+	for i := 0; i < 2; i++ {
+		conn, err := d.Dial(context.Background(), testConnName)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		if got := roundTrip(t, conn, "select 1"); got != "echo: select 1" {
+			t.Errorf("reply = %q, want %q", got, "echo: select 1")
+		}
+		conn.Close()
+	}
+	admin.mu.Lock()
+	defer admin.mu.Unlock()
+	if admin.certs != 1 {
+		t.Errorf("created %d client certificates, want 1", admin.certs)
+	}
+	if admin.tokens[0] != "" {
+		t.Errorf("access token = %q, want none without IAM authentication", admin.tokens[0])
+	}
+
+	version, err := d.DatabaseVersion(context.Background(), testConnName)
+	if err != nil || version != "POSTGRES_13" {
+		t.Errorf("DatabaseVersion() = %q, %v, want POSTGRES_13", version, err)
+	}
+}
+
+func TestDialIAMAuthn(t *testing.T) {
+	admin, srv := newFakeAdmin(t)
+	d := newTestDialer(t, admin, srv, Options{IAMAuthn: true})
+
+	conn, err := d.Dial(context.Background(), testConnName)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	conn.Close()
+	admin.mu.Lock()
+	defer admin.mu.Unlock()
+	if admin.tokens[0] != "test-token" {
+		t.Errorf("access token = %q, want %q", admin.tokens[0], "test-token")
+	}
+}
+
+func TestDialErrors(t *testing.T) {
+	tests := []struct {
+		desc     string
+		connName string
+		opts     Options
+		wantErr  string
+	}{
+		{desc: "invalid name", connName: "my-instance", wantErr: "invalid instance connection name"},
+		{desc: "unknown instance", connName: "my-project:us-central1:other", wantErr: "instance not found"},
+		{desc: "wrong region", connName: "my-project:europe-west1:my-instance", wantErr: "region was mismatched"},
+		{desc: "no private IP", connName: testConnName, opts: Options{PrivateIP: true}, wantErr: `"PRIVATE"`},
+	}
+	admin, srv := newFakeAdmin(t)
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			d := newTestDialer(t, admin, srv, tt.opts)
+			_, err := d.Dial(context.Background(), tt.connName)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Dial() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDialRejectsWrongServer(t *testing.T) {
+	admin, srv := newFakeAdmin(t)
+	// The server-side proxy presents a certificate issued to another instance.
+	admin.startEchoServer(t, admin.root, &x509.Certificate{Subject: pkix.Name{CommonName: "my-project:other-instance"}})
+	d := newTestDialer(t, admin, srv, Options{})
+
+	_, err := d.Dial(context.Background(), testConnName)
+	if err == nil || !strings.Contains(err.Error(), "other-instance") {
+		t.Errorf("Dial() error = %v, want the server certificate to be rejected", err)
+	}
+}
+
+func TestDialCASInstance(t *testing.T) {
+	admin, srv := newFakeAdmin(t)
+	// Instances with a CA Service CA present a chain with an intermediate CA and are
+	// identified by their DNS name.
+	admin.settings.ServerCaMode = "GOOGLE_MANAGED_CAS_CA"
+	admin.settings.DnsName = testDNSName
+	intermediate := newTestCA(t, admin.root, "Google Cloud SQL Intermediate CA")
+	admin.startEchoServer(t, intermediate, &x509.Certificate{DNSNames: []string{testDNSName}})
+	d := newTestDialer(t, admin, srv, Options{})
+
+	conn, err := d.Dial(context.Background(), testConnName)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if got := roundTrip(t, conn, "select 1"); got != "echo: select 1" {
+		t.Errorf("reply = %q, want %q", got, "echo: select 1")
+	}
+}
+
+func TestServe(t *testing.T) {
+	admin, srv := newFakeAdmin(t)
+	d := newTestDialer(t, admin, srv, Options{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- d.Serve(ctx, ln, testConnName) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := roundTrip(t, conn, "select 1"); got != "echo: select 1" {
+		t.Errorf("reply = %q, want %q", got, "echo: select 1")
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve() error = %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Serve() did not return after the context was cancelled")
+	}
+	conn.Close()
+}
+
+func TestDefaultPort(t *testing.T) {
+	for version, want := range map[string]int{"POSTGRES_13": 5432, "MYSQL_8_0": 3306, "SQLSERVER_2019_STANDARD": 1433} {
+		if got := DefaultPort(version); got != want {
+			t.Errorf("DefaultPort(%q) = %d, want %d", version, got, want)
+		}
+	}
+}
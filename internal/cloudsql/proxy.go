@@ -0,0 +1,95 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudsql
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+// DefaultPort returns the port that clients of the database version connect to
+// by default, e.g. 5432 for POSTGRES_13.
+func DefaultPort(databaseVersion string) int {
+	switch {
+	case strings.HasPrefix(databaseVersion, "POSTGRES"):
+		return 5432
+	case strings.HasPrefix(databaseVersion, "SQLSERVER"):
+		return 1433
+	default:
+		return 3306
+	}
+}
+
+// Serve accepts connections on ln and proxies each of them to the instance until
+// ctx is done or ln is closed.
+func (d *Dialer) Serve(ctx context.Context, ln net.Listener, connName string) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.proxy(ctx, conn, connName)
+		}()
+	}
+}
+
+// proxy copies data between the client connection and a new connection to the
+// instance until either side closes its connection.
+func (d *Dialer) proxy(ctx context.Context, client net.Conn, connName string) {
+	defer client.Close()
+
+	server, err := d.Dial(ctx, connName)
+	if err != nil {
+		util.Logger.Errorf("Failed to connect to %s: %v", connName, err)
+		return
+	}
+	defer server.Close()
+	util.Logger.Debugf("New connection to %s from %s", connName, client.RemoteAddr())
+
+	done := make(chan struct{}, 2)
+	copyConn := func(dst, src net.Conn) {
+		if _, err := io.Copy(dst, src); err != nil && !errors.Is(err, net.ErrClosed) {
+			util.Logger.Debugf("Connection to %s closed: %v", connName, err)
+		}
+		done <- struct{}{}
+	}
+	go copyConn(server, client)
+	go copyConn(client, server)
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	util.Logger.Debugf("Closed connection to %s from %s", connName, client.RemoteAddr())
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package completion
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// completionCacheDir is the subdirectory of the cache directory that completion
+// candidates are written to.
+const completionCacheDir = "completion"
+
+type cacheEntry struct {
+	Key       string    `json:"key"`
+	FetchedAt time.Time `json:"fetched_at"`
+	Values    []string  `json:"values"`
+}
+
+func cachePath(key string) string {
+	filename := strings.NewReplacer("/", "_", ".", "-").Replace(key) + ".json"
+	return filepath.Join(viper.GetString(appconfig.CacheDir), completionCacheDir, filename)
+}
+
+// readCache returns the cached candidates for key if they were fetched within the
+// configured TTL.
+func readCache(key string, ttl time.Duration) ([]string, bool) {
+	data, err := ioutil.ReadFile(cachePath(key))
+	if err != nil {
+		return nil, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		util.Logger.Debugf("Ignoring corrupt completion cache entry for %s: %v", key, err)
+		return nil, false
+	}
+	if entry.Key != key || time.Since(entry.FetchedAt) > ttl {
+		return nil, false
+	}
+	return entry.Values, true
+}
+
+// writeCache writes the candidates for key to the cache. The entry is written to a
+// temporary file and renamed so a concurrent completion never reads a partially
+// written entry.
+func writeCache(key string, values []string) error {
+	path := cachePath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(cacheEntry{Key: key, FetchedAt: time.Now(), Values: values})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ClearCache removes every cached completion candidate.
+func ClearCache() error {
+	dir := filepath.Join(viper.GetString(appconfig.CacheDir), completionCacheDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return errorsutil.New("Failed to clear the completion cache", err)
+	}
+	util.Logger.Debugf("Cleared the completion cache in %s", dir)
+	return nil
+}
+
+// cached returns the candidates for key from the cache, calling fetch and caching
+// the result on a miss.
+func cached(key string, fetch func() ([]string, error)) ([]string, error) {
+	ttl := viper.GetDuration(appconfig.CacheTTL)
+	if ttl <= 0 || viper.GetString(appconfig.CacheDir) == "" {
+		return fetch()
+	}
+
+	if values, ok := readCache(key, ttl); ok {
+		return values, nil
+	}
+
+	values, err := fetch()
+	if err != nil {
+		return values, err
+	}
+	if err := writeCache(key, values); err != nil {
+		util.Logger.Debugf("Failed to cache completion candidates for %s: %v", key, err)
+	}
+	return values, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package completion provides the candidates that eiam's shell completion suggests
+// for the flags that take the name of a Google Cloud resource. Candidates that are
+// listed from Google Cloud APIs are cached in the cache directory for the duration
+// set in the cache.ttl config field so that tab-completion stays fast.
+package completion
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+)
+
+// ServiceAccounts returns the configured default service accounts and the service
+// accounts in the project that the user can impersonate. If the available service
+// accounts can't be listed, the default service accounts are returned with the error.
+func ServiceAccounts(project string) ([]string, error) {
+	var emails []string
+	for _, email := range viper.GetStringMapString(appconfig.DefaultServiceAccounts) {
+		emails = append(emails, email)
+	}
+	if project == "" {
+		return unique(emails), nil
+	}
+
+	available, err := cached("service_accounts/"+project, func() ([]string, error) {
+		serviceAccounts, err := gcpclient.FetchAvailableServiceAccounts(project)
+		if err != nil {
+			return nil, err
+		}
+		emails := []string{}
+		for _, sa := range serviceAccounts {
+			emails = append(emails, sa.Email)
+		}
+		return emails, nil
+	})
+	return unique(append(emails, available...)), err
+}
+
+// Projects returns the projects that are set in the gcloud configurations and the
+// projects that the user can see. If the projects can't be listed, the projects in
+// the gcloud configurations are returned with the error.
+func Projects() ([]string, error) {
+	configured, err := gcpclient.GetConfiguredProjects()
+	if err != nil {
+		util.Logger.Debugf("Failed to read the projects in the gcloud configurations: %v", err)
+	}
+	projects, err := cached("projects", func() ([]string, error) {
+		return gcpclient.ListProjects("")
+	})
+	return unique(append(configured, projects...)), err
+}
+
+// Zones returns the zones available to the project.
+func Zones(project string) ([]string, error) {
+	return cached("zones/"+project, func() ([]string, error) {
+		return gcpclient.ListZones(project)
+	})
+}
+
+// Regions returns the regions available to the project.
+func Regions(project string) ([]string, error) {
+	return cached("regions/"+project, func() ([]string, error) {
+		return gcpclient.ListRegions(project)
+	})
+}
+
+// Instances returns the Compute Engine instances in the zone, or in every zone of
+// the project if zone is empty.
+func Instances(project, zone string) ([]string, error) {
+	key := "instances/" + project
+	if zone != "" {
+		key += "/" + zone
+	}
+	return cached(key, func() ([]string, error) {
+		return gcpclient.ListInstances(project, zone)
+	})
+}
+
+// Topics returns the IDs of the Pub/Sub topics in the project.
+func Topics(project string) ([]string, error) {
+	return cached("topics/"+project, func() ([]string, error) {
+		return gcpclient.ListTopics(project)
+	})
+}
+
+// Buckets returns the Cloud Storage buckets in the project.
+func Buckets(project string) ([]string, error) {
+	return cached("buckets/"+project, func() ([]string, error) {
+		return gcpclient.ListBuckets(project)
+	})
+}
+
+// Clusters returns the names of the GKE clusters in the location, or in every
+// location of the project if location is empty.
+func Clusters(project, location string) ([]string, error) {
+	clusters, err := gkeClusters(project)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, cl := range clusters {
+		clLocation, name := splitCluster(cl)
+		if location == "" || clLocation == location {
+			names = append(names, name)
+		}
+	}
+	return unique(names), nil
+}
+
+// ClusterLocations returns the locations of the GKE clusters in the project.
+func ClusterLocations(project string) ([]string, error) {
+	clusters, err := gkeClusters(project)
+	if err != nil {
+		return nil, err
+	}
+	var locations []string
+	for _, cl := range clusters {
+		location, _ := splitCluster(cl)
+		locations = append(locations, location)
+	}
+	return unique(locations), nil
+}
+
+// gkeClusters returns the GKE clusters in the project as location/name pairs.
+func gkeClusters(project string) ([]string, error) {
+	return cached("clusters/"+project, func() ([]string, error) {
+		clusters, err := gcpclient.GetClusters(project, "")
+		if err != nil {
+			return nil, err
+		}
+		pairs := []string{}
+		for _, cl := range clusters {
+			pairs = append(pairs, cl["location"]+"/"+cl["name"])
+		}
+		return pairs, nil
+	})
+}
+
+func splitCluster(pair string) (location, name string) {
+	parts := strings.SplitN(pair, "/", 2)
+	if len(parts) != 2 {
+		return "", pair
+	}
+	return parts[0], parts[1]
+}
+
+// unique returns the sorted, non-empty values without duplicates.
+func unique(values []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, v := range values {
+		if v != "" && !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,216 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package completion
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/api/iam/v1"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients/clientstest"
+)
+
+func init() {
+	util.Logger = logrus.New()
+}
+
+func setUpCache(t *testing.T, ttl string) {
+	t.Helper()
+	viper.Set(appconfig.CacheTTL, ttl)
+	clientstest.TempCache(t, func(dir string) { viper.Set(appconfig.CacheDir, dir) })
+}
+
+func TestCached(t *testing.T) {
+	setUpCache(t, "1h")
+
+	calls := 0
+	fetch := func() ([]string, error) {
+		calls++
+		return []string{"a", "b"}, nil
+	}
+	for i := 0; i < 3; i++ {
+		values, err := cached("zones/p", fetch)
+		if err != nil || !reflect.DeepEqual(values, []string{"a", "b"}) {
+			t.Fatalf("unexpected result: %v, %v", values, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 fetch, got %d", calls)
+	}
+
+	if _, err := cached("zones/other", fetch); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected a different key to be fetched, got %d fetches", calls)
+	}
+
+	if err := ClearCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cached("zones/p", fetch); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("expected the cleared entry to be fetched again, got %d fetches", calls)
+	}
+}
+
+func TestCachedErrorsAndExpiry(t *testing.T) {
+	setUpCache(t, "1h")
+
+	fetchErr := errors.New("fetch failed")
+	if _, err := cached("topics/p", func() ([]string, error) { return nil, fetchErr }); err != fetchErr {
+		t.Errorf("expected fetch error, got %v", err)
+	}
+	if _, ok := readCache("topics/p", time.Hour); ok {
+		t.Error("expected a failed fetch not to be cached")
+	}
+
+	if err := writeCache("topics/p", []string{"t"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readCache("topics/p", time.Hour); !ok {
+		t.Error("expected a fresh entry to be read from the cache")
+	}
+	if _, ok := readCache("topics/p", time.Nanosecond); ok {
+		t.Error("expected an expired entry to be ignored")
+	}
+}
+
+func TestCachedDisabled(t *testing.T) {
+	setUpCache(t, "0")
+
+	calls := 0
+	fetch := func() ([]string, error) {
+		calls++
+		return []string{"a"}, nil
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cached("zones/p", fetch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected every lookup to be fetched when the cache is disabled, got %d fetches", calls)
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	setUpCache(t, "1h")
+	srv := clientstest.Start(t)
+	srv.Parents["projects/b"] = "organizations/1"
+	srv.Parents["projects/a"] = "organizations/1"
+	srv.Zones["p"] = []string{"us-central1-a", "europe-west1-b"}
+	srv.Instances["projects/p/zones/us-central1-a"] = []string{"vm-1"}
+	srv.Instances["projects/p/zones/europe-west1-b"] = []string{"vm-2"}
+	srv.Topics["p"] = []string{"topic"}
+	srv.Buckets["p"] = []string{"bucket"}
+	srv.Clusters["p"] = []*containerpb.Cluster{
+		{Name: "prod", Location: "us-central1"},
+		{Name: "prod", Location: "europe-west1"},
+		{Name: "staging", Location: "us-central1"},
+	}
+
+	// The projects in the user's gcloud configurations are always suggested.
+	configured, err := gcpclient.GetConfiguredProjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		list func() ([]string, error)
+		want []string
+	}{
+		{"projects", Projects, unique(append(configured, "a", "b"))},
+		{"zones", func() ([]string, error) { return Zones("p") }, []string{"europe-west1-b", "us-central1-a"}},
+		{"regions", func() ([]string, error) { return Regions("p") }, []string{"europe-west1", "us-central1"}},
+		{"instances", func() ([]string, error) { return Instances("p", "") }, []string{"vm-1", "vm-2"}},
+		{"zone instances", func() ([]string, error) { return Instances("p", "europe-west1-b") }, []string{"vm-2"}},
+		{"topics", func() ([]string, error) { return Topics("p") }, []string{"topic"}},
+		{"buckets", func() ([]string, error) { return Buckets("p") }, []string{"bucket"}},
+		{"clusters", func() ([]string, error) { return Clusters("p", "") }, []string{"prod", "staging"}},
+		{"location clusters", func() ([]string, error) { return Clusters("p", "europe-west1") }, []string{"prod"}},
+		{"cluster locations", func() ([]string, error) { return ClusterLocations("p") },
+			[]string{"europe-west1", "us-central1"}},
+	}
+	for _, tt := range tests {
+		got, err := tt.list()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// The candidates are read from the cache until it is cleared.
+	srv.Topics["p"] = []string{"topic", "new-topic"}
+	if topics, _ := Topics("p"); !reflect.DeepEqual(topics, []string{"topic"}) {
+		t.Errorf("expected the cached topics, got %v", topics)
+	}
+	if err := ClearCache(); err != nil {
+		t.Fatal(err)
+	}
+	if topics, _ := Topics("p"); !reflect.DeepEqual(topics, []string{"new-topic", "topic"}) {
+		t.Errorf("expected the topics to be listed again, got %v", topics)
+	}
+}
+
+func TestServiceAccounts(t *testing.T) {
+	setUpCache(t, "1h")
+	srv := clientstest.Start(t)
+	perms := []string{"iam.serviceAccounts.get", "iam.serviceAccounts.getAccessToken"}
+	for _, name := range []string{"allowed", "denied"} {
+		email := name + "@p.iam.gserviceaccount.com"
+		srv.ServiceAccounts["p"] = append(srv.ServiceAccounts["p"], &iam.ServiceAccount{Email: email})
+		srv.TestablePermissions["//iam.googleapis.com/projects/p/serviceAccounts/"+email] = perms
+	}
+	srv.Granted["projects/p/serviceAccounts/allowed@p.iam.gserviceaccount.com"] = perms
+	viper.Set(appconfig.DefaultServiceAccounts, map[string]string{
+		"p": "default@p.iam.gserviceaccount.com",
+		"q": "default@q.iam.gserviceaccount.com",
+	})
+	t.Cleanup(func() { viper.Set(appconfig.DefaultServiceAccounts, map[string]string{}) })
+
+	emails, err := ServiceAccounts("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"default@p.iam.gserviceaccount.com", "default@q.iam.gserviceaccount.com"}
+	if !reflect.DeepEqual(emails, want) {
+		t.Errorf("got %v, want %v", emails, want)
+	}
+
+	emails, err = ServiceAccounts("p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append([]string{"allowed@p.iam.gserviceaccount.com"}, want...)
+	if !reflect.DeepEqual(emails, want) {
+		t.Errorf("got %v, want %v", emails, want)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package credentials writes an impersonated access token to a temporary file that
+// is passed to a child process. Only the short-lived token is written, never the
+// user's own credentials.
+package credentials
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Env is the temporary credential files for a child process.
+type Env struct {
+	dir string
+	// TokenFile contains the access token.
+	TokenFile string
+}
+
+// New writes the access token to a file in a temporary directory that only the user
+// can read. Call Remove once the child process exits.
+func New(accessToken string) (*Env, error) {
+	dir, err := ioutil.TempDir("", "eiam-credentials-")
+	if err != nil {
+		return nil, err
+	}
+	e := &Env{dir: dir, TokenFile: filepath.Join(dir, "access_token")}
+	if err := ioutil.WriteFile(e.TokenFile, []byte(accessToken), 0o600); err != nil {
+		e.Remove()
+		return nil, err
+	}
+	return e, nil
+}
+
+// Remove deletes the credential files.
+func (e *Env) Remove() error {
+	return os.RemoveAll(e.dir)
+}
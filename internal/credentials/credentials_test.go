@@ -0,0 +1,48 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credentials
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	e, err := New("token")
+	if err != nil {
+		t.Fatalf("failed to write credentials: %v", err)
+	}
+
+	token, err := ioutil.ReadFile(e.TokenFile)
+	if err != nil || string(token) != "token" {
+		t.Errorf("expected the token file to contain the access token, got %q, %v", token, err)
+	}
+	info, err := os.Stat(e.TokenFile)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expected the token file to only be readable by the user: %v, %v", info.Mode(), err)
+	}
+	entries, err := ioutil.ReadDir(e.dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("expected only the token file to be written, got %v, %v", entries, err)
+	}
+
+	if err := e.Remove(); err != nil {
+		t.Fatalf("failed to remove credentials: %v", err)
+	}
+	if _, err := os.Stat(e.TokenFile); !os.IsNotExist(err) {
+		t.Errorf("expected the credential files to be removed, got %v", err)
+	}
+}
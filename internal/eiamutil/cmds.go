@@ -28,6 +28,8 @@ import (
 	"github.com/spf13/pflag"
 )
 
+const reasonPrefix = "ephemeral-iam "
+
 // FormatReason formats the reason field for logging visibility.
 func FormatReason(reason *string) error {
 	randomID, err := sessionID()
@@ -35,10 +37,23 @@ func FormatReason(reason *string) error {
 		return err
 	}
 
-	*reason = fmt.Sprintf("ephemeral-iam %s: %s", randomID, *reason)
+	*reason = fmt.Sprintf("%s%s: %s", reasonPrefix, randomID, *reason)
 	return nil
 }
 
+// SessionIDFromReason returns the session ID from a reason formatted by
+// FormatReason, or an empty string if the reason wasn't formatted.
+func SessionIDFromReason(reason string) string {
+	if !strings.HasPrefix(reason, reasonPrefix) {
+		return ""
+	}
+	id := strings.SplitN(strings.TrimPrefix(reason, reasonPrefix), ":", 2)
+	if len(id) != 2 {
+		return ""
+	}
+	return id[0]
+}
+
 func sessionID() (string, error) {
 	idBytes := make([]byte, 8)
 	if _, err := rand.Read(idBytes); err != nil {
@@ -137,7 +152,7 @@ func ExtractUnknownArgs(flags *pflag.FlagSet, args []string) []string {
 		// If the current flag is known and it accepts an argument, skip the next loop.
 		if currFlag != nil {
 			if currFlag.NoOptDefVal == "" {
-				if i+1 < len(trimmed) && currFlag.Value.String() == trimmed[i+1] {
+				if i+1 < len(trimmed) && flagHasValue(currFlag, trimmed[i+1]) {
 					i++
 				}
 			}
@@ -148,6 +163,15 @@ func ExtractUnknownArgs(flags *pflag.FlagSet, args []string) []string {
 	return unknownArgs
 }
 
+// flagHasValue checks if val is the value of the flag, or one of its values if the
+// flag can be repeated.
+func flagHasValue(flag *pflag.Flag, val string) bool {
+	if slice, ok := flag.Value.(pflag.SliceValue); ok {
+		return Contains(slice.GetSlice(), val)
+	}
+	return flag.Value.String() == val
+}
+
 // Contains checks if val is an item in the values slice.
 func Contains(values []string, val string) bool {
 	for _, i := range values {
@@ -0,0 +1,44 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestExtractUnknownArgs(t *testing.T) {
+	fs := pflag.NewFlagSet("kubectl", pflag.ContinueOnError)
+	fs.ParseErrorsWhitelist.UnknownFlags = true
+	fs.StringP("service-account-email", "s", "", "")
+	fs.String("as", "", "")
+	fs.StringArray("as-group", nil, "")
+	fs.BoolP("yes", "y", false, "")
+
+	args := []string{
+		"eiam", "kubectl", "get", "pods", "-s", "sa@p.iam.gserviceaccount.com", "-n", "default",
+		"--as", "jane", "--as-group", "developers", "--as-group=viewers", "-y", "-o", "json",
+	}
+	if err := fs.Parse(args[2:]); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+
+	want := []string{"get", "pods", "-n", "default", "-o", "json"}
+	if got := ExtractUnknownArgs(fs, args); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -48,7 +48,7 @@ func DownloadAndExtract(url, tmpDir, token string) error {
 		"Authorization": {fmt.Sprintf("token %s", token)},
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := NewHTTPClient().Do(req)
 	if err != nil {
 		return err
 	}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net/http"
 	"strings"
 
 	"github.com/google/go-github/v33/github"
@@ -14,12 +13,13 @@ import (
 )
 
 func GetLatestRelease(repoOwner, repoName, token string) (*github.RepositoryRelease, error) {
-	httpClient := http.Client{}
+	httpClient := NewHTTPClient()
 	if token != "" {
 		ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
-		httpClient = *oauth2.NewClient(context.Background(), ts)
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, httpClient)
+		httpClient = oauth2.NewClient(ctx, ts)
 	}
-	githubClient := github.NewClient(&httpClient)
+	githubClient := github.NewClient(httpClient)
 
 	release, _, err := githubClient.Repositories.GetLatestRelease(context.Background(), repoOwner, repoName)
 	if err != nil {
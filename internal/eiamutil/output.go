@@ -0,0 +1,70 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The machine-readable output formats.
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+	OutputYAML  = "yaml"
+	OutputCSV   = "csv"
+)
+
+// OutputFormats is the list of supported values for the --output flag.
+var OutputFormats = []string{OutputTable, OutputJSON, OutputYAML, OutputCSV}
+
+// CSVWriter is implemented by values that can be written as CSV.
+type CSVWriter interface {
+	// CSVRecords returns the records to write, starting with the header.
+	CSVRecords() [][]string
+}
+
+// WriteOutput writes v to w in a machine-readable format. Values written as CSV
+// must implement CSVWriter.
+func WriteOutput(w io.Writer, format string, v interface{}) error {
+	switch format {
+	case OutputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case OutputYAML:
+		out, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(out)
+		return err
+	case OutputCSV:
+		records, ok := v.(CSVWriter)
+		if !ok {
+			return fmt.Errorf("%T can't be written as CSV", v)
+		}
+		cw := csv.NewWriter(w)
+		if err := cw.WriteAll(records.CSVRecords()); err != nil {
+			return err
+		}
+		return cw.Error()
+	}
+	return fmt.Errorf("unsupported output format %q", format)
+}
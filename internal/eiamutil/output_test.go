@@ -0,0 +1,62 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"bytes"
+	"testing"
+)
+
+type testRecord struct {
+	Name    string   `json:"name" yaml:"name"`
+	Granted []string `json:"granted" yaml:"granted"`
+}
+
+func (r testRecord) CSVRecords() [][]string {
+	records := [][]string{{"name", "granted"}}
+	for _, g := range r.Granted {
+		records = append(records, []string{r.Name, g})
+	}
+	return records
+}
+
+func TestWriteOutput(t *testing.T) {
+	record := testRecord{Name: "a,b", Granted: []string{"x", "y"}}
+	testCases := []struct {
+		format string
+		want   string
+	}{
+		{OutputJSON, "{\n  \"name\": \"a,b\",\n  \"granted\": [\n    \"x\",\n    \"y\"\n  ]\n}\n"},
+		{OutputYAML, "name: a,b\ngranted:\n- x\n- \"y\"\n"},
+		{OutputCSV, "name,granted\n\"a,b\",x\n\"a,b\",y\n"},
+	}
+	for _, tc := range testCases {
+		var buf bytes.Buffer
+		if err := WriteOutput(&buf, tc.format, record); err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.format, err)
+			continue
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("%s: unexpected output:\ngot:\n%s\nwant:\n%s", tc.format, got, tc.want)
+		}
+	}
+
+	if err := WriteOutput(&bytes.Buffer{}, OutputCSV, struct{}{}); err == nil {
+		t.Error("expected an error when writing a value that doesn't support CSV")
+	}
+	if err := WriteOutput(&bytes.Buffer{}, "xml", record); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// upstreamProxy selects the upstream proxy set with SetUpstreamProxy, or is nil
+// if none is set.
+var upstreamProxy func(*url.URL) (*url.URL, error)
+
+// SetUpstreamProxy sets the proxy that outgoing requests are sent through to
+// proxyURL for every request to a host that isn't in noProxy. The environment
+// is used again if proxyURL is empty.
+func SetUpstreamProxy(proxyURL, noProxy string) {
+	if proxyURL == "" {
+		upstreamProxy = nil
+		return
+	}
+	proxyConfig := &httpproxy.Config{
+		HTTPProxy:  proxyURL,
+		HTTPSProxy: proxyURL,
+		NoProxy:    noProxy,
+	}
+	upstreamProxy = proxyConfig.ProxyFunc()
+}
+
+// UpstreamProxy selects the proxy that outgoing requests should be sent through.
+// If an upstream proxy is set with SetUpstreamProxy, it is used. Otherwise, the
+// HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables are used.
+func UpstreamProxy(r *http.Request) (*url.URL, error) {
+	if upstreamProxy == nil {
+		return http.ProxyFromEnvironment(r)
+	}
+	return upstreamProxy(r.URL)
+}
+
+// NewHTTPClient creates an HTTP client that sends requests through the
+// configured upstream proxy.
+func NewHTTPClient() *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = UpstreamProxy
+	return &http.Client{Transport: tr}
+}
+
+// ProxyAuthorization returns the value of the Proxy-Authorization header for
+// the credentials in the proxy URL, or an empty string if it has none.
+func ProxyAuthorization(proxyURL *url.URL) string {
+	if proxyURL.User == nil {
+		return ""
+	}
+	password, _ := proxyURL.User.Password()
+	auth := proxyURL.User.Username() + ":" + password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
+}
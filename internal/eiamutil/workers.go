@@ -0,0 +1,201 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MaxWorkers is the maximum number of concurrent requests that eiam makes to a
+// Google Cloud API for a single operation.
+const MaxWorkers = 8
+
+// maxRetries is the number of times a rate limited request is retried.
+const maxRetries = 5
+
+var (
+	// retryBaseDelay is the delay before the first retry of a rate limited request.
+	// The delay doubles with each retry up to retryMaxDelay.
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 16 * time.Second
+)
+
+// RunWorkers calls fn with each index in [0, n) from at most workers goroutines,
+// and returns the error from each call at its index. Once ctx is done no more
+// calls are started, and the remaining indexes are set to the context's error.
+func RunWorkers(ctx context.Context, n, workers int, fn func(ctx context.Context, i int) error) []error {
+	errs := make([]error, n)
+	if workers < 1 {
+		workers = 1
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = fn(ctx, i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		if ctx.Err() != nil {
+			errs[i] = ctx.Err()
+			continue
+		}
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	return errs
+}
+
+// MultiError is a collection of errors from concurrent operations.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	if len(m) == 1 {
+		return m[0].Error()
+	}
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors occurred: %s", len(m), strings.Join(msgs, "; "))
+}
+
+// CollectErrors returns a MultiError with the non-nil errors in errs, or nil if
+// there are none.
+func CollectErrors(errs []error) error {
+	var collected MultiError
+	for _, err := range errs {
+		if err != nil {
+			collected = append(collected, err)
+		}
+	}
+	if len(collected) == 0 {
+		return nil
+	}
+	return collected
+}
+
+// IsRateLimitError reports whether err is a Google Cloud API error caused by
+// exceeding a rate limit or quota.
+func IsRateLimitError(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusTooManyRequests
+	}
+	if s, ok := status.FromError(err); ok {
+		return s.Code() == codes.ResourceExhausted
+	}
+	return false
+}
+
+// RetryOnRateLimit calls fn until it returns an error that is not a rate limit
+// error, ctx is done, or it has been retried maxRetries times. The delay between
+// attempts grows exponentially with random jitter so that concurrent workers do
+// not retry in lockstep.
+func RetryOnRateLimit(ctx context.Context, fn func() error) error {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !IsRateLimitError(err) || attempt == maxRetries {
+			return err
+		}
+
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)) //nolint:gosec // Jitter does not need crypto/rand
+		Logger.Debugf("Rate limited, retrying in %s: %v", wait, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		if delay *= 2; delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// Progress prints the progress of a long running operation to stderr. Nothing
+// is printed if stderr is not a terminal or the Progress is nil.
+type Progress struct {
+	mu      sync.Mutex
+	out     io.Writer
+	label   string
+	total   int
+	done    int
+	enabled bool
+}
+
+// NewProgress returns a Progress for an operation with total steps.
+func NewProgress(label string, total int) *Progress {
+	return &Progress{
+		out:     os.Stderr,
+		label:   label,
+		total:   total,
+		enabled: term.IsTerminal(int(os.Stderr.Fd())),
+	}
+}
+
+// Increment marks a step as finished and updates the progress indicator.
+func (p *Progress) Increment() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if p.enabled {
+		fmt.Fprintf(p.out, "\r%s: %d/%d", p.label, p.done, p.total)
+	}
+}
+
+// Done clears the progress indicator.
+func (p *Progress) Done() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.enabled {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+}
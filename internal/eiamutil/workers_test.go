@@ -0,0 +1,157 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eiamutil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	Logger = logrus.New()
+	retryBaseDelay = time.Millisecond
+	retryMaxDelay = 4 * time.Millisecond
+}
+
+func TestRunWorkers(t *testing.T) {
+	var running, maxRunning int32
+	results := make([]int, 100)
+	errs := RunWorkers(context.Background(), len(results), 4, func(ctx context.Context, i int) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		results[i] = i * 2
+		if i%10 == 0 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	if maxRunning > 4 {
+		t.Errorf("expected at most 4 concurrent workers, got %d", maxRunning)
+	}
+	for i, err := range errs {
+		if (i%10 == 0) != (err != nil) {
+			t.Errorf("unexpected error at index %d: %v", i, err)
+		}
+		if results[i] != i*2 {
+			t.Errorf("index %d was not processed", i)
+		}
+	}
+	if err := CollectErrors(errs); err == nil || len(err.(MultiError)) != 10 {
+		t.Errorf("expected 10 collected errors, got %v", err)
+	}
+	if err := CollectErrors(make([]error, 3)); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestRunWorkersCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls int32
+	errs := RunWorkers(ctx, 50, 2, func(ctx context.Context, i int) error {
+		if atomic.AddInt32(&calls, 1) == 5 {
+			cancel()
+		}
+		return nil
+	})
+
+	cancelled := 0
+	for _, err := range errs {
+		if errors.Is(err, context.Canceled) {
+			cancelled++
+		}
+	}
+	if int(calls)+cancelled != 50 {
+		t.Errorf("expected every index to be processed or cancelled, got %d calls and %d cancelled", calls, cancelled)
+	}
+	if cancelled == 0 {
+		t.Error("expected the remaining indexes to be cancelled")
+	}
+}
+
+func TestIsRateLimitError(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, true},
+		{&googleapi.Error{Code: http.StatusForbidden}, false},
+		{status.Error(codes.ResourceExhausted, "quota exceeded"), true},
+		{status.Error(codes.PermissionDenied, "denied"), false},
+		{errors.New("failed"), false},
+	}
+	for _, tc := range testCases {
+		if got := IsRateLimitError(tc.err); got != tc.want {
+			t.Errorf("IsRateLimitError(%v) = %t, want %t", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRetryOnRateLimit(t *testing.T) {
+	rateLimited := &googleapi.Error{Code: http.StatusTooManyRequests}
+
+	calls := 0
+	err := RetryOnRateLimit(context.Background(), func() error {
+		if calls++; calls < 3 {
+			return rateLimited
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expected success after 3 calls, got %d calls and %v", calls, err)
+	}
+
+	calls = 0
+	err = RetryOnRateLimit(context.Background(), func() error {
+		calls++
+		return rateLimited
+	})
+	if err != rateLimited || calls != maxRetries+1 {
+		t.Errorf("expected to give up after %d calls, got %d calls and %v", maxRetries+1, calls, err)
+	}
+
+	calls = 0
+	failed := errors.New("failed")
+	if err := RetryOnRateLimit(context.Background(), func() error {
+		calls++
+		return failed
+	}); err != failed || calls != 1 {
+		t.Errorf("expected other errors not to be retried, got %d calls and %v", calls, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := RetryOnRateLimit(ctx, func() error { return rateLimited }); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the retry to be cancelled, got %v", err)
+	}
+}
@@ -15,6 +15,7 @@
 package errors
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/sirupsen/logrus"
@@ -45,9 +46,29 @@ func (e EiamError) Error() string {
 	return errStr
 }
 
+// Unwrap returns the error that caused e so that it can be inspected with
+// errors.Is and errors.As.
+func (e EiamError) Unwrap() error {
+	return e.Err
+}
+
+// ExitError is returned when a command run by eiam exits with a non-zero status.
+// CheckError exits with the same status without logging an error.
+type ExitError struct {
+	Code int
+}
+
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
 // CheckError is the top-level error handler.
 func CheckError(err error) {
 	if err != nil {
+		var exitErr ExitError
+		if errors.As(err, &exitErr) {
+			util.Logger.Exit(exitErr.Code)
+		}
 		if googleErr := checkGoogleAPIError(err); (googleErr != EiamError{}) {
 			err = googleErr
 		} else if grpcError := checkGoogleRPCError(err); (grpcError != EiamError{}) {
@@ -43,3 +43,8 @@ func (e SDKClientCreateError) Error() string {
 	}
 	return fmt.Sprintf("failed to create %s SDK client: %v", e.ResourceType, e.Err)
 }
+
+// Unwrap returns the error that caused e.
+func (e SDKClientCreateError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,514 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	container "cloud.google.com/go/container/apiv1"
+	credentials "cloud.google.com/go/iam/credentials/apiv1"
+	cloudidentity "google.golang.org/api/cloudidentity/v1"
+	crm "google.golang.org/api/cloudresourcemanager/v1"
+	crmv2 "google.golang.org/api/cloudresourcemanager/v2"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
+	"google.golang.org/api/pubsub/v1"
+	"google.golang.org/api/storage/v1"
+	htransport "google.golang.org/api/transport/http"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// Endpoints overrides the endpoint of each API. Empty fields use the default
+// endpoint. The endpoints of the REST APIs (IAM, ResourceManager, Compute, PubSub,
+// Storage and CloudIdentity) are base URLs ending in a slash, e.g. http://127.0.0.1:8080/, and
+// the endpoints of the gRPC APIs (IAMCredentials and Container) are host:port
+// addresses.
+type Endpoints struct {
+	IAM             string
+	IAMCredentials  string
+	ResourceManager string
+	Compute         string
+	PubSub          string
+	Storage         string
+	Container       string
+	CloudIdentity   string
+	// HTTP maps the base URLs of the requests made with the HTTP client to the base
+	// URLs that they are sent to instead, e.g.
+	// "https://compute.googleapis.com/compute/v1/": "http://127.0.0.1:8080/compute/".
+	HTTP map[string]string
+}
+
+// apiFactory is the Factory that creates clients for the Google Cloud APIs.
+type apiFactory struct {
+	endpoints Endpoints
+	opts      []option.ClientOption
+}
+
+// NewFactory returns a Factory that creates clients for the Google Cloud APIs
+// using the given endpoints. The options are passed to every client, e.g.
+// option.WithoutAuthentication() when the endpoints are local fakes.
+func NewFactory(endpoints Endpoints, opts ...option.ClientOption) Factory {
+	return &apiFactory{endpoints: endpoints, opts: opts}
+}
+
+func (f *apiFactory) clientOptions(endpoint string, o Options) []option.ClientOption {
+	opts := append([]option.ClientOption{}, f.opts...)
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	if o.ServiceAccount != "" {
+		opts = append(opts, option.ImpersonateCredentials(o.ServiceAccount))
+	}
+	if o.Reason != "" {
+		opts = append(opts, option.WithRequestReason(o.Reason))
+	}
+	return opts
+}
+
+// IAM creates a Cloud IAM client.
+func (f *apiFactory) IAM(ctx context.Context, o Options) (IAMClient, error) {
+	svc, err := iam.NewService(ctx, f.clientOptions(f.endpoints.IAM, o)...)
+	if err != nil {
+		return nil, err
+	}
+	return &iamClient{svc: svc}, nil
+}
+
+// IAMCredentials creates an IAM Service Account Credentials client.
+func (f *apiFactory) IAMCredentials(ctx context.Context, o Options) (IAMCredentialsClient, error) {
+	client, err := credentials.NewIamCredentialsClient(ctx, f.clientOptions(f.endpoints.IAMCredentials, o)...)
+	if err != nil {
+		return nil, err
+	}
+	return &iamCredentialsClient{client: client}, nil
+}
+
+// ResourceManager creates a Cloud Resource Manager client.
+func (f *apiFactory) ResourceManager(ctx context.Context, o Options) (ResourceManagerClient, error) {
+	svc, err := crm.NewService(ctx, f.clientOptions(f.endpoints.ResourceManager, o)...)
+	if err != nil {
+		return nil, err
+	}
+	// Folders are only available in the v2 API.
+	foldersSvc, err := crmv2.NewService(ctx, f.clientOptions(f.endpoints.ResourceManager, o)...)
+	if err != nil {
+		return nil, err
+	}
+	return &resourceManagerClient{svc: svc, foldersSvc: foldersSvc}, nil
+}
+
+// Compute creates a Compute Engine client.
+func (f *apiFactory) Compute(ctx context.Context, o Options) (ComputeClient, error) {
+	svc, err := compute.NewService(ctx, f.clientOptions(f.endpoints.Compute, o)...)
+	if err != nil {
+		return nil, err
+	}
+	return &computeClient{svc: svc}, nil
+}
+
+// PubSub creates a Pub/Sub client.
+func (f *apiFactory) PubSub(ctx context.Context, o Options) (PubSubClient, error) {
+	svc, err := pubsub.NewService(ctx, f.clientOptions(f.endpoints.PubSub, o)...)
+	if err != nil {
+		return nil, err
+	}
+	return &pubsubClient{svc: svc}, nil
+}
+
+// Storage creates a Cloud Storage client.
+func (f *apiFactory) Storage(ctx context.Context, o Options) (StorageClient, error) {
+	svc, err := storage.NewService(ctx, f.clientOptions(f.endpoints.Storage, o)...)
+	if err != nil {
+		return nil, err
+	}
+	return &storageClient{svc: svc}, nil
+}
+
+// Container creates a Kubernetes Engine client.
+func (f *apiFactory) Container(ctx context.Context, o Options) (ContainerClient, error) {
+	client, err := container.NewClusterManagerClient(ctx, f.clientOptions(f.endpoints.Container, o)...)
+	if err != nil {
+		return nil, err
+	}
+	return &containerClient{client: client}, nil
+}
+
+// CloudIdentity creates a Cloud Identity client.
+func (f *apiFactory) CloudIdentity(ctx context.Context, o Options) (CloudIdentityClient, error) {
+	svc, err := cloudidentity.NewService(ctx, f.clientOptions(f.endpoints.CloudIdentity, o)...)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudIdentityClient{svc: svc}, nil
+}
+
+// HTTP creates an HTTP client with the cloud-platform scope.
+func (f *apiFactory) HTTP(ctx context.Context, o Options) (*http.Client, error) {
+	opts := append(f.clientOptions("", o), option.WithScopes(cloudPlatformScope))
+	client, _, err := htransport.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.endpoints.HTTP) != 0 {
+		client.Transport = &rewriteTransport{base: client.Transport, endpoints: f.endpoints.HTTP}
+	}
+	return client, nil
+}
+
+// rewriteTransport sends the requests whose URL starts with one of the keys of
+// endpoints to the base URL that it maps to.
+type rewriteTransport struct {
+	base      http.RoundTripper
+	endpoints map[string]string
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqURL := req.URL.String()
+	for from, to := range t.endpoints {
+		if !strings.HasPrefix(reqURL, from) {
+			continue
+		}
+		u, err := url.Parse(to + strings.TrimPrefix(reqURL, from))
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.URL = u
+		req.Host = u.Host
+		break
+	}
+	return t.base.RoundTrip(req)
+}
+
+type iamClient struct {
+	svc *iam.Service
+}
+
+func (c *iamClient) ListServiceAccounts(ctx context.Context, project string) ([]*iam.ServiceAccount, error) {
+	var serviceAccounts []*iam.ServiceAccount
+	req := c.svc.Projects.ServiceAccounts.List(fmt.Sprintf("projects/%s", project))
+	if err := req.Pages(ctx, func(page *iam.ListServiceAccountsResponse) error {
+		serviceAccounts = append(serviceAccounts, page.Accounts...)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return serviceAccounts, nil
+}
+
+func (c *iamClient) QueryTestablePermissions(ctx context.Context, fullResourceName string) ([]string, error) {
+	var perms []string
+	req := c.svc.Permissions.QueryTestablePermissions(&iam.QueryTestablePermissionsRequest{
+		FullResourceName: fullResourceName,
+		PageSize:         1000,
+	})
+	if err := req.Pages(ctx, func(page *iam.QueryTestablePermissionsResponse) error {
+		for _, perm := range page.Permissions {
+			perms = append(perms, perm.Name)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return perms, nil
+}
+
+func (c *iamClient) GetRolePermissions(ctx context.Context, role string) ([]string, error) {
+	var (
+		r   *iam.Role
+		err error
+	)
+	switch {
+	case strings.HasPrefix(role, "projects/"):
+		r, err = c.svc.Projects.Roles.Get(role).Context(ctx).Do()
+	case strings.HasPrefix(role, "organizations/"):
+		r, err = c.svc.Organizations.Roles.Get(role).Context(ctx).Do()
+	default:
+		r, err = c.svc.Roles.Get(role).Context(ctx).Do()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.IncludedPermissions, nil
+}
+
+type iamCredentialsClient struct {
+	client *credentials.IamCredentialsClient
+}
+
+func (c *iamCredentialsClient) GenerateAccessToken(
+	ctx context.Context,
+	req *credentialspb.GenerateAccessTokenRequest,
+) (*credentialspb.GenerateAccessTokenResponse, error) {
+	return c.client.GenerateAccessToken(ctx, req)
+}
+
+func (c *iamCredentialsClient) GenerateIDToken(
+	ctx context.Context,
+	req *credentialspb.GenerateIdTokenRequest,
+) (*credentialspb.GenerateIdTokenResponse, error) {
+	return c.client.GenerateIdToken(ctx, req)
+}
+
+func (c *iamCredentialsClient) Close() error {
+	return c.client.Close()
+}
+
+type resourceManagerClient struct {
+	svc        *crm.Service
+	foldersSvc *crmv2.Service
+}
+
+func (c *resourceManagerClient) GetAncestry(ctx context.Context, resource string) ([]string, error) {
+	switch {
+	case strings.HasPrefix(resource, "projects/"):
+		project := strings.TrimPrefix(resource, "projects/")
+		resp, err := c.svc.Projects.GetAncestry(project, &crm.GetAncestryRequest{}).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		ancestry := make([]string, 0, len(resp.Ancestor))
+		for _, ancestor := range resp.Ancestor {
+			ancestry = append(ancestry, fmt.Sprintf("%ss/%s", ancestor.ResourceId.Type, ancestor.ResourceId.Id))
+		}
+		return ancestry, nil
+	case strings.HasPrefix(resource, "folders/"):
+		ancestry := []string{resource}
+		for strings.HasPrefix(resource, "folders/") {
+			folder, err := c.foldersSvc.Folders.Get(resource).Context(ctx).Do()
+			if err != nil {
+				return nil, err
+			}
+			resource = folder.Parent
+			ancestry = append(ancestry, resource)
+		}
+		return ancestry, nil
+	case strings.HasPrefix(resource, "organizations/"):
+		return []string{resource}, nil
+	}
+	return nil, fmt.Errorf("%s is not a project, folder or organization", resource)
+}
+
+func (c *resourceManagerClient) GetIamPolicy(ctx context.Context, resource string) ([]PolicyBinding, error) {
+	var policy interface{}
+	var err error
+	switch {
+	case strings.HasPrefix(resource, "projects/"):
+		policy, err = c.svc.Projects.GetIamPolicy(strings.TrimPrefix(resource, "projects/"), &crm.GetIamPolicyRequest{
+			Options: &crm.GetPolicyOptions{RequestedPolicyVersion: 3},
+		}).Context(ctx).Do()
+	case strings.HasPrefix(resource, "folders/"):
+		policy, err = c.foldersSvc.Folders.GetIamPolicy(resource, &crmv2.GetIamPolicyRequest{
+			Options: &crmv2.GetPolicyOptions{RequestedPolicyVersion: 3},
+		}).Context(ctx).Do()
+	case strings.HasPrefix(resource, "organizations/"):
+		policy, err = c.svc.Organizations.GetIamPolicy(resource, &crm.GetIamPolicyRequest{
+			Options: &crm.GetPolicyOptions{RequestedPolicyVersion: 3},
+		}).Context(ctx).Do()
+	default:
+		return nil, fmt.Errorf("%s is not a project, folder or organization", resource)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bindingsOf(policy)
+}
+
+func (c *resourceManagerClient) ListProjects(ctx context.Context, parent string) ([]string, error) {
+	filter := "lifecycleState:ACTIVE"
+	if parent != "" {
+		parts := strings.SplitN(parent, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s is not a folder or organization", parent)
+		}
+		filter = fmt.Sprintf("parent.type:%s parent.id:%s %s", strings.TrimSuffix(parts[0], "s"), parts[1], filter)
+	}
+
+	var projects []string
+	err := c.svc.Projects.List().Filter(filter).Pages(ctx, func(resp *crm.ListProjectsResponse) error {
+		for _, project := range resp.Projects {
+			projects = append(projects, project.ProjectId)
+		}
+		return nil
+	})
+	return projects, err
+}
+
+func (c *resourceManagerClient) ListFolders(ctx context.Context, parent string) ([]string, error) {
+	var folders []string
+	err := c.foldersSvc.Folders.List().Parent(parent).Pages(ctx, func(resp *crmv2.ListFoldersResponse) error {
+		for _, folder := range resp.Folders {
+			if folder.LifecycleState == "ACTIVE" {
+				folders = append(folders, folder.Name)
+			}
+		}
+		return nil
+	})
+	return folders, err
+}
+
+// bindingsOf converts the policy returned by one of the API clients to its bindings.
+func bindingsOf(policy interface{}) ([]PolicyBinding, error) {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	var p struct {
+		Bindings []PolicyBinding `json:"bindings"`
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return p.Bindings, nil
+}
+
+type computeClient struct {
+	svc *compute.Service
+}
+
+func (c *computeClient) ListZones(ctx context.Context, project string) ([]string, error) {
+	var zones []string
+	err := c.svc.Zones.List(project).Fields("items/name", "nextPageToken").Pages(ctx, func(resp *compute.ZoneList) error {
+		for _, zone := range resp.Items {
+			zones = append(zones, zone.Name)
+		}
+		return nil
+	})
+	return zones, err
+}
+
+func (c *computeClient) ListRegions(ctx context.Context, project string) ([]string, error) {
+	var regions []string
+	call := c.svc.Regions.List(project).Fields("items/name", "nextPageToken")
+	err := call.Pages(ctx, func(resp *compute.RegionList) error {
+		for _, region := range resp.Items {
+			regions = append(regions, region.Name)
+		}
+		return nil
+	})
+	return regions, err
+}
+
+func (c *computeClient) ListInstances(ctx context.Context, project, zone string) ([]string, error) {
+	var instances []string
+	if zone != "" {
+		err := c.svc.Instances.List(project, zone).Fields("items/name", "nextPageToken").Pages(ctx,
+			func(resp *compute.InstanceList) error {
+				for _, instance := range resp.Items {
+					instances = append(instances, instance.Name)
+				}
+				return nil
+			})
+		return instances, err
+	}
+
+	err := c.svc.Instances.AggregatedList(project).Fields("items/*/instances/name", "nextPageToken").Pages(ctx,
+		func(resp *compute.InstanceAggregatedList) error {
+			for _, scoped := range resp.Items {
+				for _, instance := range scoped.Instances {
+					instances = append(instances, instance.Name)
+				}
+			}
+			return nil
+		})
+	return instances, err
+}
+
+type pubsubClient struct {
+	svc *pubsub.Service
+}
+
+func (c *pubsubClient) ListTopics(ctx context.Context, project string) ([]string, error) {
+	var topics []string
+	err := c.svc.Projects.Topics.List("projects/"+project).Pages(ctx, func(resp *pubsub.ListTopicsResponse) error {
+		for _, topic := range resp.Topics {
+			topics = append(topics, path.Base(topic.Name))
+		}
+		return nil
+	})
+	return topics, err
+}
+
+type storageClient struct {
+	svc *storage.Service
+}
+
+func (c *storageClient) GetBucketProject(ctx context.Context, bucket string) (string, error) {
+	b, err := c.svc.Buckets.Get(bucket).Fields("projectNumber").Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(b.ProjectNumber, 10), nil
+}
+
+func (c *storageClient) ListBuckets(ctx context.Context, project string) ([]string, error) {
+	var buckets []string
+	call := c.svc.Buckets.List(project).Fields("items/name", "nextPageToken")
+	err := call.Pages(ctx, func(resp *storage.Buckets) error {
+		for _, bucket := range resp.Items {
+			buckets = append(buckets, bucket.Name)
+		}
+		return nil
+	})
+	return buckets, err
+}
+
+type containerClient struct {
+	client *container.ClusterManagerClient
+}
+
+func (c *containerClient) ListClusters(ctx context.Context, project string) ([]*containerpb.Cluster, error) {
+	resp, err := c.client.ListClusters(ctx, &containerpb.ListClustersRequest{
+		Parent: fmt.Sprintf("projects/%s/locations/-", project),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Clusters, nil
+}
+
+func (c *containerClient) Close() error {
+	return c.client.Close()
+}
+
+type cloudIdentityClient struct {
+	svc *cloudidentity.Service
+}
+
+func (c *cloudIdentityClient) IsTransitiveMember(ctx context.Context, group, member string) (bool, error) {
+	g, err := c.svc.Groups.Lookup().GroupKeyId(group).Context(ctx).Do()
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.svc.Groups.Memberships.CheckTransitiveMembership(g.Name).
+		Query(fmt.Sprintf("member_key_id == '%s'", member)).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return false, err
+	}
+	return resp.HasMembership, nil
+}
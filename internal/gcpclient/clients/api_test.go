@@ -0,0 +1,264 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clients_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/iam/v1"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients/clientstest"
+)
+
+var ctx = context.Background()
+
+func newServer(t *testing.T) *clientstest.Server {
+	t.Helper()
+	srv, err := clientstest.NewServer()
+	if err != nil {
+		t.Fatalf("failed to start fake server: %v", err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestIAMClient(t *testing.T) {
+	srv := newServer(t)
+	for i := 0; i < 5; i++ {
+		srv.ServiceAccounts["p"] = append(srv.ServiceAccounts["p"], &iam.ServiceAccount{
+			Email: fmt.Sprintf("sa-%d@p.iam.gserviceaccount.com", i),
+		})
+	}
+	resource := "//iam.googleapis.com/projects/p/serviceAccounts/sa-0@p.iam.gserviceaccount.com"
+	srv.TestablePermissions[resource] = []string{
+		"iam.serviceAccounts.actAs",
+		"iam.serviceAccounts.get",
+		"iam.serviceAccounts.getAccessToken",
+	}
+
+	client, err := srv.Factory().IAM(ctx, clients.Options{Reason: "testing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err := client.ListServiceAccounts(ctx, "p")
+	if err != nil {
+		t.Fatalf("failed to list service accounts: %v", err)
+	}
+	if len(accounts) != 5 {
+		t.Errorf("expected every page of service accounts, got %d", len(accounts))
+	}
+
+	testable, err := client.QueryTestablePermissions(ctx, resource)
+	if err != nil {
+		t.Fatalf("failed to query testable permissions: %v", err)
+	}
+	if len(testable) != 3 {
+		t.Errorf("expected every page of testable permissions, got %v", testable)
+	}
+
+	for _, req := range srv.Requests() {
+		if req.Reason != "testing" {
+			t.Errorf("expected the request reason to be sent with %s, got %q", req.Method, req.Reason)
+		}
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	srv := newServer(t)
+	srv.Granted["projects/p"] = []string{"compute.instances.list"}
+	srv.Granted["projects/p/zones/z/instances/i"] = []string{"compute.instances.get"}
+	srv.Granted["b/bucket"] = []string{"storage.objects.get"}
+
+	client, err := srv.Factory().HTTP(ctx, clients.Options{Reason: "testing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests for the Google Cloud APIs are sent to the fake server instead.
+	testCases := []struct {
+		method string
+		url    string
+		want   string
+	}{
+		{
+			http.MethodPost,
+			"https://cloudresourcemanager.googleapis.com/v1/projects/p:testIamPermissions",
+			"compute.instances.list",
+		},
+		{
+			http.MethodPost,
+			"https://compute.googleapis.com/compute/v1/projects/p/zones/z/instances/i/testIamPermissions",
+			"compute.instances.get",
+		},
+		{
+			http.MethodGet,
+			"https://storage.googleapis.com/storage/v1/b/bucket/iam/testPermissions?permissions=storage.objects.get",
+			"storage.objects.get",
+		},
+	}
+	for _, tc := range testCases {
+		body := `{"permissions": ["compute.instances.get", "compute.instances.list"]}`
+		req, err := http.NewRequest(tc.method, tc.url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("%s: request failed: %v", tc.url, err)
+			continue
+		}
+		var result struct {
+			Permissions []string `json:"permissions"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("%s: failed to decode response: %v", tc.url, err)
+			continue
+		}
+		if strings.Join(result.Permissions, ",") != tc.want {
+			t.Errorf("%s: got %v, want %s", tc.url, result.Permissions, tc.want)
+		}
+	}
+
+	for _, req := range srv.Requests() {
+		if req.Reason != "testing" {
+			t.Errorf("expected the request reason to be sent with %s, got %q", req.Method, req.Reason)
+		}
+	}
+}
+
+func TestListClients(t *testing.T) {
+	srv := newServer(t)
+	srv.Zones["p"] = []string{"us-central1-a", "us-central1-b", "europe-west1-b"}
+	srv.Instances["projects/p/zones/us-central1-a"] = []string{"vm-1", "vm-2", "vm-3"}
+	srv.Instances["projects/p/zones/europe-west1-b"] = []string{"vm-4"}
+	srv.Instances["projects/other/zones/us-central1-a"] = []string{"vm-5"}
+	srv.Topics["p"] = []string{"topic-1", "topic-2", "topic-3"}
+	srv.Buckets["p"] = []string{"bucket-1", "bucket-2", "bucket-3"}
+	f := srv.Factory()
+
+	compute, err := f.Compute(ctx, clients.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubsub, err := f.PubSub(ctx, clients.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := f.Storage(ctx, clients.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name string
+		list func() ([]string, error)
+		want string
+	}{
+		{"zones", func() ([]string, error) {
+			return compute.ListZones(ctx, "p")
+		}, "europe-west1-b,us-central1-a,us-central1-b"},
+		{"regions", func() ([]string, error) {
+			return compute.ListRegions(ctx, "p")
+		}, "europe-west1,us-central1"},
+		{"instances in a zone", func() ([]string, error) {
+			return compute.ListInstances(ctx, "p", "us-central1-a")
+		}, "vm-1,vm-2,vm-3"},
+		{"instances in every zone", func() ([]string, error) {
+			return compute.ListInstances(ctx, "p", "")
+		}, "vm-1,vm-2,vm-3,vm-4"},
+		{"topics", func() ([]string, error) {
+			return pubsub.ListTopics(ctx, "p")
+		}, "topic-1,topic-2,topic-3"},
+		{"buckets", func() ([]string, error) {
+			return storage.ListBuckets(ctx, "p")
+		}, "bucket-1,bucket-2,bucket-3"},
+	}
+	for _, tc := range testCases {
+		names, err := tc.list()
+		if err != nil {
+			t.Errorf("%s: failed to list: %v", tc.name, err)
+			continue
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != tc.want {
+			t.Errorf("%s: got %v, want %s", tc.name, names, tc.want)
+		}
+	}
+}
+
+func TestGRPCClients(t *testing.T) {
+	srv := newServer(t)
+	srv.Clusters["p"] = []*containerpb.Cluster{{Name: "cluster-1", Location: "us-central1"}}
+	f := srv.Factory()
+
+	creds, err := f.IAMCredentials(ctx, clients.Options{Reason: "testing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer creds.Close()
+	resp, err := creds.GenerateAccessToken(ctx, &credentialspb.GenerateAccessTokenRequest{
+		Name: "projects/-/serviceAccounts/sa@p.iam.gserviceaccount.com",
+	})
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+	if resp.AccessToken != "token-for-sa@p.iam.gserviceaccount.com" {
+		t.Errorf("unexpected access token %s", resp.AccessToken)
+	}
+
+	gke, err := f.Container(ctx, clients.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gke.Close()
+	clusters, err := gke.ListClusters(ctx, "p")
+	if err != nil {
+		t.Fatalf("failed to list clusters: %v", err)
+	}
+	if len(clusters) != 1 || clusters[0].Name != "cluster-1" {
+		t.Errorf("unexpected clusters: %v", clusters)
+	}
+
+	// The gRPC clients send the request reason with their per-RPC credentials, so
+	// it is not sent to the fake server, which is dialed without authentication.
+	if reqs := srv.Requests(); len(reqs) != 2 || reqs[0].API != "iamcredentials" || reqs[1].API != "container" {
+		t.Errorf("unexpected gRPC requests: %+v", reqs)
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	srv := newServer(t)
+	prev := clients.Default()
+	restore := clients.SetDefault(srv.Factory())
+	if clients.Default() == prev {
+		t.Error("expected the default factory to be replaced")
+	}
+	restore()
+	if clients.Default() != prev {
+		t.Error("expected the default factory to be restored")
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package clients defines the interfaces that eiam uses to call Google Cloud APIs
+// and a Factory that creates them. Replacing the default Factory with one that
+// points at local fakes allows the code that calls the APIs to be tested offline.
+package clients
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"google.golang.org/api/iam/v1"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+)
+
+// Options configures a single client.
+type Options struct {
+	// ServiceAccount is the service account to impersonate. If empty, the
+	// client uses the application default credentials.
+	ServiceAccount string
+	// Reason is sent with each request and recorded in the audit logs.
+	Reason string
+}
+
+// PolicyBinding is a binding in an IAM policy. It has the same JSON encoding in
+// every API, so it can decode getIamPolicy responses from any of them.
+type PolicyBinding struct {
+	Role      string           `json:"role"`
+	Members   []string         `json:"members"`
+	Condition *PolicyCondition `json:"condition,omitempty"`
+}
+
+// PolicyCondition is the condition of a conditional IAM policy binding.
+type PolicyCondition struct {
+	Title      string `json:"title,omitempty"`
+	Expression string `json:"expression"`
+}
+
+// IAMClient is the subset of the Cloud IAM API used by eiam.
+type IAMClient interface {
+	ListServiceAccounts(ctx context.Context, project string) ([]*iam.ServiceAccount, error)
+	QueryTestablePermissions(ctx context.Context, fullResourceName string) ([]string, error)
+	// GetRolePermissions returns the permissions in a predefined or custom role.
+	GetRolePermissions(ctx context.Context, role string) ([]string, error)
+}
+
+// IAMCredentialsClient is the subset of the IAM Service Account Credentials API
+// used by eiam.
+type IAMCredentialsClient interface {
+	GenerateAccessToken(
+		ctx context.Context,
+		req *credentialspb.GenerateAccessTokenRequest,
+	) (*credentialspb.GenerateAccessTokenResponse, error)
+	GenerateIDToken(
+		ctx context.Context,
+		req *credentialspb.GenerateIdTokenRequest,
+	) (*credentialspb.GenerateIdTokenResponse, error)
+	Close() error
+}
+
+// ResourceManagerClient is the subset of the Cloud Resource Manager API used by eiam.
+type ResourceManagerClient interface {
+	// GetAncestry returns the project, folder or organization followed by each of
+	// its ancestors, e.g. [projects/p folders/1 organizations/2].
+	GetAncestry(ctx context.Context, resource string) ([]string, error)
+	// GetIamPolicy returns the bindings in the IAM policy of a project, folder or
+	// organization.
+	GetIamPolicy(ctx context.Context, resource string) ([]PolicyBinding, error)
+	// ListProjects returns the IDs of the active projects that are direct children of
+	// the folder or organization, or of every active project if parent is empty.
+	ListProjects(ctx context.Context, parent string) ([]string, error)
+	// ListFolders returns the names of the active folders that are direct children of
+	// the folder or organization, e.g. folders/123.
+	ListFolders(ctx context.Context, parent string) ([]string, error)
+}
+
+// ComputeClient is the subset of the Compute Engine API used by eiam.
+type ComputeClient interface {
+	// ListZones returns the names of the zones available to the project.
+	ListZones(ctx context.Context, project string) ([]string, error)
+	// ListRegions returns the names of the regions available to the project.
+	ListRegions(ctx context.Context, project string) ([]string, error)
+	// ListInstances returns the names of the instances in the zone, or in every
+	// zone if zone is empty.
+	ListInstances(ctx context.Context, project, zone string) ([]string, error)
+}
+
+// PubSubClient is the subset of the Pub/Sub API used by eiam.
+type PubSubClient interface {
+	// ListTopics returns the IDs of the topics in the project, e.g. my-topic.
+	ListTopics(ctx context.Context, project string) ([]string, error)
+}
+
+// StorageClient is the subset of the Cloud Storage API used by eiam.
+type StorageClient interface {
+	// GetBucketProject returns the number of the project that contains the bucket.
+	GetBucketProject(ctx context.Context, bucket string) (string, error)
+	// ListBuckets returns the names of the buckets in the project.
+	ListBuckets(ctx context.Context, project string) ([]string, error)
+}
+
+// CloudIdentityClient is the subset of the Cloud Identity API used by eiam.
+type CloudIdentityClient interface {
+	// IsTransitiveMember reports whether member is a direct or indirect member of
+	// the group. Both are email addresses.
+	IsTransitiveMember(ctx context.Context, group, member string) (bool, error)
+}
+
+// ContainerClient is the subset of the Kubernetes Engine API used by eiam.
+type ContainerClient interface {
+	ListClusters(ctx context.Context, project string) ([]*containerpb.Cluster, error)
+	Close() error
+}
+
+// Factory creates the clients for each of the Google Cloud APIs used by eiam.
+type Factory interface {
+	IAM(ctx context.Context, opts Options) (IAMClient, error)
+	IAMCredentials(ctx context.Context, opts Options) (IAMCredentialsClient, error)
+	ResourceManager(ctx context.Context, opts Options) (ResourceManagerClient, error)
+	Compute(ctx context.Context, opts Options) (ComputeClient, error)
+	PubSub(ctx context.Context, opts Options) (PubSubClient, error)
+	Storage(ctx context.Context, opts Options) (StorageClient, error)
+	Container(ctx context.Context, opts Options) (ContainerClient, error)
+	CloudIdentity(ctx context.Context, opts Options) (CloudIdentityClient, error)
+	// HTTP returns an authenticated HTTP client for the APIs that do not have a
+	// dedicated client.
+	HTTP(ctx context.Context, opts Options) (*http.Client, error)
+}
+
+var (
+	mu             sync.RWMutex
+	defaultFactory = NewFactory(Endpoints{})
+)
+
+// Default returns the Factory used to create clients.
+func Default() Factory {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultFactory
+}
+
+// SetDefault replaces the Factory used to create clients and returns a function
+// that restores the previous one.
+func SetDefault(f Factory) (restore func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	prev := defaultFactory
+	defaultFactory = f
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		defaultFactory = prev
+	}
+}
@@ -12,23 +12,15 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package gcpclient
+package clientstest
 
-import (
-	"context"
+import "testing"
 
-	credentials "cloud.google.com/go/iam/credentials/apiv1"
-	"google.golang.org/api/option"
-
-	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
-)
-
-// ClientWithReason creates a client SDK with the provided reason field.
-func ClientWithReason(reason string) (*credentials.IamCredentialsClient, error) {
-	ctx := context.Background()
-	gcpClientWithReason, err := credentials.NewIamCredentialsClient(ctx, option.WithRequestReason(reason))
-	if err != nil {
-		return nil, errorsutil.NewSDKError("Credentials", "", err)
-	}
-	return gcpClientWithReason, nil
+// TempCache passes a temporary cache directory to configure, for tests of the caches
+// of API responses. configure is called with an empty directory, which disables
+// caching, when the test ends.
+func TempCache(t *testing.T, configure func(dir string)) {
+	t.Helper()
+	configure(t.TempDir())
+	t.Cleanup(func() { configure("") })
 }
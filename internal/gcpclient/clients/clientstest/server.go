@@ -0,0 +1,610 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package clientstest provides an in-memory fake of the Google Cloud APIs used by
+// eiam for use in tests.
+package clientstest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+	credentialspb "google.golang.org/genproto/googleapis/iam/credentials/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients"
+)
+
+// Request is a request received by the fake Server.
+type Request struct {
+	// API is the name of the API, e.g. "iam" or "container".
+	API string
+	// Method is the HTTP method and path of REST requests, or the full method
+	// name of gRPC requests.
+	Method string
+	// Reason is the request reason sent with the request.
+	Reason string
+}
+
+// Server is a fake of the Cloud IAM, IAM Credentials, Resource Manager, Compute,
+// Pub/Sub, Storage, Kubernetes Engine and Cloud Identity APIs. The exported fields may be set
+// before requests are made.
+type Server struct {
+	// ServiceAccounts are the service accounts in each project.
+	ServiceAccounts map[string][]*iam.ServiceAccount
+	// TestablePermissions are the testable permissions on each full resource name.
+	TestablePermissions map[string][]string
+	// Granted are the permissions granted on each resource, keyed by the resource
+	// name used by its API, e.g. projects/p/serviceAccounts/sa@p.iam.gserviceaccount.com
+	// or b/my-bucket. Permissions that are not granted are left out of
+	// testIamPermissions responses.
+	Granted map[string][]string
+	// Clusters are the GKE clusters in each project.
+	Clusters map[string][]*containerpb.Cluster
+	// Parents are the parent folder or organization of each project and folder,
+	// e.g. "projects/p": "folders/1". The projects and folders that are listed are
+	// the keys of Parents.
+	Parents map[string]string
+	// Policies are the IAM policy bindings on each project, folder, organization and
+	// Cloud KMS key ring or key.
+	Policies map[string][]clients.PolicyBinding
+	// Roles are the permissions in each role, e.g. "roles/viewer".
+	Roles map[string][]string
+	// GroupMembers are the direct members of each group. Members may be groups.
+	GroupMembers map[string][]string
+	// BucketProjects are the number of the project that contains each bucket.
+	BucketProjects map[string]string
+	// Zones are the zones available to each project. The regions available to a
+	// project are the regions of its zones.
+	Zones map[string][]string
+	// Instances are the names of the Compute Engine instances in each zone, keyed
+	// by project and zone, e.g. "projects/p/zones/us-central1-a".
+	Instances map[string][]string
+	// Topics are the IDs of the Pub/Sub topics in each project.
+	Topics map[string][]string
+	// Buckets are the names of the Cloud Storage buckets in each project.
+	Buckets map[string][]string
+	// RateLimited are the number of times each REST request, e.g.
+	// "POST /iam/v1/permissions:queryTestablePermissions", is rejected with 429 Too
+	// Many Requests before it is served.
+	RateLimited map[string]int
+	// PageSize is the number of items returned in each page of list responses.
+	PageSize int
+
+	mu       sync.Mutex
+	requests []Request
+
+	http *httptest.Server
+	grpc *grpc.Server
+	addr string
+}
+
+// NewServer starts a fake Server. Call Close when done.
+func NewServer() (*Server, error) {
+	s := &Server{
+		ServiceAccounts:     map[string][]*iam.ServiceAccount{},
+		TestablePermissions: map[string][]string{},
+		Granted:             map[string][]string{},
+		Clusters:            map[string][]*containerpb.Cluster{},
+		Parents:             map[string]string{},
+		Policies:            map[string][]clients.PolicyBinding{},
+		Roles:               map[string][]string{},
+		GroupMembers:        map[string][]string{},
+		BucketProjects:      map[string]string{},
+		Zones:               map[string][]string{},
+		Instances:           map[string][]string{},
+		Topics:              map[string][]string{},
+		Buckets:             map[string][]string{},
+		RateLimited:         map[string]int{},
+		PageSize:            2,
+	}
+	s.http = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.http.Close()
+		return nil, err
+	}
+	s.addr = lis.Addr().String()
+	s.grpc = grpc.NewServer(grpc.UnaryInterceptor(s.recordRPC))
+	credentialspb.RegisterIAMCredentialsServer(s.grpc, &iamCredentialsServer{})
+	containerpb.RegisterClusterManagerServer(s.grpc, &clusterManagerServer{s: s})
+	go s.grpc.Serve(lis) //nolint:errcheck // Serve returns when the server is stopped.
+
+	return s, nil
+}
+
+// Start starts a fake Server and makes it the default clients.Factory until the test
+// ends, when the previous factory is restored and the server is stopped.
+func Start(t *testing.T) *Server {
+	t.Helper()
+	s, err := NewServer()
+	if err != nil {
+		t.Fatalf("failed to start fake server: %v", err)
+	}
+	t.Cleanup(s.Close)
+	t.Cleanup(clients.SetDefault(s.Factory()))
+	return s
+}
+
+// Close stops the fake Server.
+func (s *Server) Close() {
+	s.grpc.Stop()
+	s.http.Close()
+}
+
+// Factory returns a clients.Factory that creates clients for the fake Server.
+func (s *Server) Factory() clients.Factory {
+	base := s.http.URL + "/"
+	return clients.NewFactory(
+		clients.Endpoints{
+			IAM:             base + "iam/",
+			IAMCredentials:  s.addr,
+			ResourceManager: base + "crm/",
+			Compute:         base + "compute/",
+			PubSub:          base + "pubsub/",
+			Storage:         base + "storage/",
+			Container:       s.addr,
+			CloudIdentity:   base + "cloudidentity/",
+			HTTP: map[string]string{
+				"https://iam.googleapis.com/":                  base + "iam/",
+				"https://cloudkms.googleapis.com/":             base + "cloudkms/",
+				"https://cloudresourcemanager.googleapis.com/": base + "crm/",
+				"https://compute.googleapis.com/compute/v1/":   base + "compute/",
+				"https://pubsub.googleapis.com/":               base + "pubsub/",
+				"https://storage.googleapis.com/storage/v1/":   base + "storage/",
+			},
+		},
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	)
+}
+
+// Requests returns the requests received by the Server.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+func (s *Server) record(req Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+}
+
+var (
+	listServiceAccountsPath = regexp.MustCompile(`^/iam/v1/projects/([^/]+)/serviceAccounts$`)
+	testIAMPermissionsPath  = regexp.MustCompile(`^/(iam|crm|pubsub)/v[123]/(.+):testIamPermissions$`)
+	testInstancePermsPath   = regexp.MustCompile(
+		`^/compute/(projects/[^/]+/zones/[^/]+/instances/[^/]+)/testIamPermissions$`,
+	)
+	testBucketPermsPath = regexp.MustCompile(`^/storage/(b/[^/]+)/iam/testPermissions$`)
+	getAncestryPath     = regexp.MustCompile(`^/crm/v1/(projects/[^/]+):getAncestry$`)
+	getIAMPolicyPath    = regexp.MustCompile(`^/crm/v[12]/((?:projects|folders|organizations)/[^/]+):getIamPolicy$`)
+	getKMSPolicyPath    = regexp.MustCompile(`^/cloudkms/v1/(projects/.+):getIamPolicy$`)
+	getFolderPath       = regexp.MustCompile(`^/crm/v2/(folders/[^/]+)$`)
+	getRolePath         = regexp.MustCompile(`^/iam/v1/((?:(?:projects|organizations)/[^/]+/)?roles/[^/]+)$`)
+	getBucketPath       = regexp.MustCompile(`^/storage/b/([^/]+)$`)
+	checkMembershipPath = regexp.MustCompile(
+		`^/cloudidentity/v1/groups/([^/]+)/memberships:checkTransitiveMembership$`,
+	)
+	listZonesPath           = regexp.MustCompile(`^/compute/projects/([^/]+)/zones$`)
+	listRegionsPath         = regexp.MustCompile(`^/compute/projects/([^/]+)/regions$`)
+	listInstancesPath       = regexp.MustCompile(`^/compute/(projects/[^/]+/zones/[^/]+)/instances$`)
+	aggregatedInstancesPath = regexp.MustCompile(`^/compute/projects/([^/]+)/aggregated/instances$`)
+	listTopicsPath          = regexp.MustCompile(`^/pubsub/v1/projects/([^/]+)/topics$`)
+	memberKeyQuery          = regexp.MustCompile(`^member_key_id == '([^']+)'$`)
+	parentFilter            = regexp.MustCompile(`parent\.type:(\w+) parent\.id:(\w+)`)
+)
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	api := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	method := r.Method + " " + r.URL.Path
+	s.record(Request{API: api, Method: method, Reason: r.Header.Get("X-Goog-Request-Reason")})
+	if s.rateLimit(method) {
+		writeError(w, http.StatusTooManyRequests, "quota exceeded for "+method)
+		return
+	}
+
+	var body struct {
+		Permissions      []string `json:"permissions"`
+		FullResourceName string   `json:"fullResourceName"`
+		PageToken        string   `json:"pageToken"`
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && listServiceAccountsPath.MatchString(r.URL.Path):
+		project := listServiceAccountsPath.FindStringSubmatch(r.URL.Path)[1]
+		s.mu.Lock()
+		accounts := s.ServiceAccounts[project]
+		s.mu.Unlock()
+		page, next := s.paginate(len(accounts), r.URL.Query().Get("pageToken"))
+		writeJSON(w, &iam.ListServiceAccountsResponse{Accounts: accounts[page[0]:page[1]], NextPageToken: next})
+
+	case r.Method == http.MethodPost && r.URL.Path == "/iam/v1/permissions:queryTestablePermissions":
+		s.mu.Lock()
+		perms, ok := s.TestablePermissions[body.FullResourceName]
+		s.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "unknown resource "+body.FullResourceName)
+			return
+		}
+		page, next := s.paginate(len(perms), body.PageToken)
+		resp := &iam.QueryTestablePermissionsResponse{NextPageToken: next}
+		for _, perm := range perms[page[0]:page[1]] {
+			resp.Permissions = append(resp.Permissions, &iam.Permission{Name: perm})
+		}
+		writeJSON(w, resp)
+
+	case r.Method == http.MethodPost && testIAMPermissionsPath.MatchString(r.URL.Path):
+		resource := testIAMPermissionsPath.FindStringSubmatch(r.URL.Path)[2]
+		writeJSON(w, map[string][]string{"permissions": s.granted(resource, body.Permissions)})
+
+	case r.Method == http.MethodPost && testInstancePermsPath.MatchString(r.URL.Path):
+		resource := testInstancePermsPath.FindStringSubmatch(r.URL.Path)[1]
+		writeJSON(w, map[string][]string{"permissions": s.granted(resource, body.Permissions)})
+
+	case r.Method == http.MethodGet && testBucketPermsPath.MatchString(r.URL.Path):
+		resource := testBucketPermsPath.FindStringSubmatch(r.URL.Path)[1]
+		writeJSON(w, map[string][]string{"permissions": s.granted(resource, r.URL.Query()["permissions"])})
+
+	default:
+		if !s.serveLists(w, r) {
+			s.serveHierarchy(w, r)
+		}
+	}
+}
+
+// serveLists serves the requests used to list the zones, regions, instances,
+// topics and buckets in a project. It reports whether the request was served.
+func (s *Server) serveLists(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	switch {
+	case r.Method == http.MethodGet && listZonesPath.MatchString(r.URL.Path):
+		names = s.Zones[listZonesPath.FindStringSubmatch(r.URL.Path)[1]]
+
+	case r.Method == http.MethodGet && listRegionsPath.MatchString(r.URL.Path):
+		seen := map[string]bool{}
+		for _, zone := range s.Zones[listRegionsPath.FindStringSubmatch(r.URL.Path)[1]] {
+			region := zone[:strings.LastIndex(zone, "-")]
+			if !seen[region] {
+				seen[region] = true
+				names = append(names, region)
+			}
+		}
+
+	case r.Method == http.MethodGet && listInstancesPath.MatchString(r.URL.Path):
+		names = s.Instances[listInstancesPath.FindStringSubmatch(r.URL.Path)[1]]
+
+	case r.Method == http.MethodGet && aggregatedInstancesPath.MatchString(r.URL.Path):
+		prefix := "projects/" + aggregatedInstancesPath.FindStringSubmatch(r.URL.Path)[1] + "/"
+		items := map[string]map[string][]map[string]string{}
+		for zone, instances := range s.Instances {
+			if !strings.HasPrefix(zone, prefix) {
+				continue
+			}
+			scoped := []map[string]string{}
+			for _, instance := range instances {
+				scoped = append(scoped, map[string]string{"name": instance})
+			}
+			items[strings.TrimPrefix(zone, prefix)] = map[string][]map[string]string{"instances": scoped}
+		}
+		writeJSON(w, map[string]interface{}{"items": items})
+		return true
+
+	case r.Method == http.MethodGet && listTopicsPath.MatchString(r.URL.Path):
+		project := listTopicsPath.FindStringSubmatch(r.URL.Path)[1]
+		topics := []map[string]string{}
+		for _, topic := range s.Topics[project] {
+			topics = append(topics, map[string]string{"name": "projects/" + project + "/topics/" + topic})
+		}
+		page, next := s.paginate(len(topics), r.URL.Query().Get("pageToken"))
+		writeJSON(w, map[string]interface{}{"topics": topics[page[0]:page[1]], "nextPageToken": next})
+		return true
+
+	case r.Method == http.MethodGet && r.URL.Path == "/storage/b":
+		names = s.Buckets[r.URL.Query().Get("project")]
+
+	default:
+		return false
+	}
+
+	items := []map[string]string{}
+	for _, name := range names {
+		items = append(items, map[string]string{"name": name})
+	}
+	page, next := s.paginate(len(items), r.URL.Query().Get("pageToken"))
+	writeJSON(w, map[string]interface{}{"items": items[page[0]:page[1]], "nextPageToken": next})
+	return true
+}
+
+// serveHierarchy serves the requests used to read IAM policies, roles and group
+// memberships.
+func (s *Server) serveHierarchy(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPost && getAncestryPath.MatchString(r.URL.Path):
+		var ancestors []map[string]map[string]string
+		for resource := getAncestryPath.FindStringSubmatch(r.URL.Path)[1]; resource != ""; resource = s.Parents[resource] {
+			parts := strings.SplitN(resource, "/", 2)
+			ancestors = append(ancestors, map[string]map[string]string{
+				"resourceId": {"type": strings.TrimSuffix(parts[0], "s"), "id": parts[1]},
+			})
+		}
+		writeJSON(w, map[string]interface{}{"ancestor": ancestors})
+
+	case r.Method == http.MethodPost && getIAMPolicyPath.MatchString(r.URL.Path):
+		resource := getIAMPolicyPath.FindStringSubmatch(r.URL.Path)[1]
+		writeJSON(w, map[string]interface{}{"version": 3, "bindings": s.Policies[resource]})
+
+	case r.Method == http.MethodGet && getKMSPolicyPath.MatchString(r.URL.Path):
+		resource := getKMSPolicyPath.FindStringSubmatch(r.URL.Path)[1]
+		writeJSON(w, map[string]interface{}{"version": 3, "bindings": s.Policies[resource]})
+
+	case r.Method == http.MethodGet && r.URL.Path == "/crm/v1/projects":
+		parent := ""
+		if m := parentFilter.FindStringSubmatch(r.URL.Query().Get("filter")); m != nil {
+			parent = m[1] + "s/" + m[2]
+		}
+		var projects []map[string]string
+		for _, project := range s.children("projects/", parent) {
+			projects = append(projects, map[string]string{
+				"projectId":      strings.TrimPrefix(project, "projects/"),
+				"lifecycleState": "ACTIVE",
+			})
+		}
+		page, next := s.paginate(len(projects), r.URL.Query().Get("pageToken"))
+		writeJSON(w, map[string]interface{}{"projects": projects[page[0]:page[1]], "nextPageToken": next})
+
+	case r.Method == http.MethodGet && r.URL.Path == "/crm/v2/folders":
+		var folders []map[string]string
+		for _, folder := range s.children("folders/", r.URL.Query().Get("parent")) {
+			folders = append(folders, map[string]string{"name": folder, "lifecycleState": "ACTIVE"})
+		}
+		page, next := s.paginate(len(folders), r.URL.Query().Get("pageToken"))
+		writeJSON(w, map[string]interface{}{"folders": folders[page[0]:page[1]], "nextPageToken": next})
+
+	case r.Method == http.MethodGet && getFolderPath.MatchString(r.URL.Path):
+		folder := getFolderPath.FindStringSubmatch(r.URL.Path)[1]
+		parent, ok := s.Parents[folder]
+		if !ok {
+			writeError(w, http.StatusNotFound, "unknown folder "+folder)
+			return
+		}
+		writeJSON(w, map[string]string{"name": folder, "parent": parent})
+
+	case r.Method == http.MethodGet && getRolePath.MatchString(r.URL.Path):
+		role := getRolePath.FindStringSubmatch(r.URL.Path)[1]
+		perms, ok := s.Roles[role]
+		if !ok {
+			writeError(w, http.StatusNotFound, "unknown role "+role)
+			return
+		}
+		writeJSON(w, &iam.Role{Name: role, IncludedPermissions: perms})
+
+	case r.Method == http.MethodGet && getBucketPath.MatchString(r.URL.Path):
+		bucket := getBucketPath.FindStringSubmatch(r.URL.Path)[1]
+		project, ok := s.BucketProjects[bucket]
+		if !ok {
+			writeError(w, http.StatusNotFound, "unknown bucket "+bucket)
+			return
+		}
+		writeJSON(w, map[string]string{"name": bucket, "projectNumber": project})
+
+	case r.Method == http.MethodGet && r.URL.Path == "/cloudidentity/v1/groups:lookup":
+		group := r.URL.Query().Get("groupKey.id")
+		if _, ok := s.GroupMembers[group]; !ok {
+			writeError(w, http.StatusNotFound, "unknown group "+group)
+			return
+		}
+		writeJSON(w, map[string]string{"name": "groups/" + group})
+
+	case r.Method == http.MethodGet && checkMembershipPath.MatchString(r.URL.Path):
+		group := checkMembershipPath.FindStringSubmatch(r.URL.Path)[1]
+		query := memberKeyQuery.FindStringSubmatch(r.URL.Query().Get("query"))
+		if query == nil {
+			writeError(w, http.StatusBadRequest, "invalid query "+r.URL.Query().Get("query"))
+			return
+		}
+		writeJSON(w, map[string]bool{"hasMembership": s.isMember(group, query[1], map[string]bool{})})
+
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unexpected request %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// children returns the sorted resources with the prefix whose parent is parent, or
+// all of them if parent is empty. s.mu must be held.
+func (s *Server) children(prefix, parent string) []string {
+	var children []string
+	for child, p := range s.Parents {
+		if strings.HasPrefix(child, prefix) && (parent == "" || p == parent) {
+			children = append(children, child)
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+// isMember reports whether member is a direct or indirect member of the group.
+// s.mu must be held.
+func (s *Server) isMember(group, member string, seen map[string]bool) bool {
+	if seen[group] {
+		return false
+	}
+	seen[group] = true
+	for _, m := range s.GroupMembers[group] {
+		if m == member || s.isMember(m, member, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// paginate returns the range of the page starting at pageToken and the token of
+// the next page.
+func (s *Server) paginate(n int, pageToken string) ([2]int, string) {
+	start, _ := strconv.Atoi(pageToken)
+	if start > n {
+		start = n
+	}
+	end := start + s.PageSize
+	if end >= n {
+		return [2]int{start, n}, ""
+	}
+	return [2]int{start, end}, strconv.Itoa(end)
+}
+
+// granted returns the permissions in perms that are granted on the resource.
+func (s *Server) granted(resource string, perms []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	granted := []string{}
+	for _, perm := range perms {
+		for _, g := range s.Granted[resource] {
+			if perm == g {
+				granted = append(granted, perm)
+				break
+			}
+		}
+	}
+	return granted
+}
+
+// rateLimit reports whether the request should be rejected with 429 Too Many
+// Requests and counts it against RateLimited if so.
+func (s *Server) rateLimit(method string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.RateLimited[method] == 0 {
+		return false
+	}
+	s.RateLimited[method]--
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v) //nolint:errcheck // The client handles truncated responses.
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": %q}}`, code, msg)
+}
+
+func (s *Server) recordRPC(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler,
+) (interface{}, error) {
+	api := "iamcredentials"
+	if strings.Contains(info.FullMethod, "container") {
+		api = "container"
+	}
+	var reason string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("x-goog-request-reason"); len(values) > 0 {
+			reason = values[0]
+		}
+	}
+	s.record(Request{API: api, Method: info.FullMethod, Reason: reason})
+	return handler(ctx, req)
+}
+
+// iamCredentialsServer generates access and ID tokens named after the service account.
+type iamCredentialsServer struct {
+	credentialspb.UnimplementedIAMCredentialsServer
+}
+
+func (*iamCredentialsServer) GenerateAccessToken(
+	ctx context.Context,
+	req *credentialspb.GenerateAccessTokenRequest,
+) (*credentialspb.GenerateAccessTokenResponse, error) {
+	if !strings.HasPrefix(req.Name, "projects/-/serviceAccounts/") {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid service account name %s", req.Name)
+	}
+	email := strings.TrimPrefix(req.Name, "projects/-/serviceAccounts/")
+	if !strings.Contains(email, "@") {
+		return nil, status.Errorf(codes.NotFound, "service account %s not found", email)
+	}
+	expiry := time.Now().Add(time.Duration(req.Lifetime.GetSeconds()) * time.Second)
+	return &credentialspb.GenerateAccessTokenResponse{
+		AccessToken: "token-for-" + email,
+		ExpireTime:  &timestamp.Timestamp{Seconds: expiry.Unix()},
+	}, nil
+}
+
+func (*iamCredentialsServer) GenerateIdToken( //nolint:revive,stylecheck // Implements the generated interface
+	ctx context.Context,
+	req *credentialspb.GenerateIdTokenRequest,
+) (*credentialspb.GenerateIdTokenResponse, error) {
+	if !strings.HasPrefix(req.Name, "projects/-/serviceAccounts/") {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid service account name %s", req.Name)
+	}
+	if req.Audience == "" {
+		return nil, status.Error(codes.InvalidArgument, "audience is required")
+	}
+	email := strings.TrimPrefix(req.Name, "projects/-/serviceAccounts/")
+	return &credentialspb.GenerateIdTokenResponse{
+		Token: fmt.Sprintf("id-token-for-%s-aud-%s-email-%t", email, req.Audience, req.IncludeEmail),
+	}, nil
+}
+
+type clusterManagerServer struct {
+	containerpb.UnimplementedClusterManagerServer
+	s *Server
+}
+
+func (c *clusterManagerServer) ListClusters(
+	ctx context.Context,
+	req *containerpb.ListClustersRequest,
+) (*containerpb.ListClustersResponse, error) {
+	project := strings.TrimSuffix(strings.TrimPrefix(req.Parent, "projects/"), "/locations/-")
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	return &containerpb.ListClustersResponse{Clusters: c.s.Clusters[project]}, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+
+	"google.golang.org/api/iam/v1"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	queryiam "github.com/rigup/ephemeral-iam/internal/gcpclient/query_iam"
+)
+
+// ServiceAccountMatch is a service account that is granted the permissions
+// required on a resource.
+type ServiceAccountMatch struct {
+	ServiceAccount     *iam.ServiceAccount
+	GrantedPermissions []string
+}
+
+// FindServiceAccounts finds the service accounts in a project that the user can
+// impersonate and that are granted each of the required permissions on the
+// resource. The matches are ordered from least to most privileged, as measured by
+// the number of permissions they are granted on the resource.
+func FindServiceAccounts(project, resource string, required []string, reason string) ([]ServiceAccountMatch, error) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	testablePerms, err := queryiam.QueryTestablePermissionsOnResource(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	testablePerms = util.Uniq(queryiam.FilterTestablePermissions(resource, testablePerms))
+	for _, perm := range required {
+		if !util.Contains(testablePerms, perm) {
+			err := fmt.Errorf("%s cannot be tested on %s", perm, resource)
+			return nil, errorsutil.New("Invalid permission", err)
+		}
+	}
+
+	availableSAs, err := fetchAvailableServiceAccounts(ctx, iamAPIClient{}, project, util.MaxWorkers)
+	if err != nil {
+		return nil, err
+	}
+	util.Logger.Infof("Testing permissions on %s as %d service accounts", resource, len(availableSAs))
+
+	progress := util.NewProgress("Testing permissions", len(availableSAs))
+	granted := make([][]string, len(availableSAs))
+	errs := util.RunWorkers(ctx, len(availableSAs), util.MaxWorkers, func(ctx context.Context, i int) error {
+		defer progress.Increment()
+		return util.RetryOnRateLimit(ctx, func() (err error) {
+			granted[i], err = queryiam.QueryResourcePermissions(
+				ctx, testablePerms, resource, availableSAs[i].Email, reason,
+			)
+			return err
+		})
+	})
+	progress.Done()
+
+	var matches []ServiceAccountMatch
+	for i, svcAcct := range availableSAs {
+		if errs[i] != nil {
+			util.Logger.Errorf("Failed to test permissions as %s: %v", svcAcct.Email, errs[i])
+			continue
+		}
+		matches = append(matches, ServiceAccountMatch{ServiceAccount: svcAcct, GrantedPermissions: util.Uniq(granted[i])})
+	}
+
+	return rankServiceAccounts(matches, required), nil
+}
+
+// rankServiceAccounts drops the service accounts that are missing any of the
+// required permissions and sorts the rest by the number of permissions they are
+// granted. Ties are broken by email so the order is stable.
+func rankServiceAccounts(matches []ServiceAccountMatch, required []string) []ServiceAccountMatch {
+	var ranked []ServiceAccountMatch
+	for _, match := range matches {
+		hasAll := true
+		for _, perm := range required {
+			if !util.Contains(match.GrantedPermissions, perm) {
+				hasAll = false
+				break
+			}
+		}
+		if hasAll {
+			ranked = append(ranked, match)
+		}
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if len(ranked[i].GrantedPermissions) != len(ranked[j].GrantedPermissions) {
+			return len(ranked[i].GrantedPermissions) < len(ranked[j].GrantedPermissions)
+		}
+		return ranked[i].ServiceAccount.Email < ranked[j].ServiceAccount.Email
+	})
+	return ranked
+}
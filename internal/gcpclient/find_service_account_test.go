@@ -0,0 +1,59 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"testing"
+
+	"google.golang.org/api/iam/v1"
+)
+
+func TestRankServiceAccounts(t *testing.T) {
+	match := func(email string, perms ...string) ServiceAccountMatch {
+		return ServiceAccountMatch{ServiceAccount: &iam.ServiceAccount{Email: email}, GrantedPermissions: perms}
+	}
+	matches := []ServiceAccountMatch{
+		match(
+			"owner@p.iam.gserviceaccount.com",
+			"compute.instances.delete",
+			"compute.instances.get",
+			"compute.instances.list",
+		),
+		match("viewer@p.iam.gserviceaccount.com", "compute.instances.get", "compute.instances.list"),
+		match("deleter@p.iam.gserviceaccount.com", "compute.instances.delete", "compute.instances.get"),
+		match("admin@p.iam.gserviceaccount.com", "compute.instances.delete", "compute.instances.list"),
+		match("none@p.iam.gserviceaccount.com"),
+	}
+
+	ranked := rankServiceAccounts(matches, []string{"compute.instances.delete"})
+	want := []string{
+		"admin@p.iam.gserviceaccount.com",
+		"deleter@p.iam.gserviceaccount.com",
+		"owner@p.iam.gserviceaccount.com",
+	}
+	if len(ranked) != len(want) {
+		t.Fatalf("got %d matches, want %d", len(ranked), len(want))
+	}
+	for i, email := range want {
+		if ranked[i].ServiceAccount.Email != email {
+			t.Errorf("match %d: got %s, want %s", i, ranked[i].ServiceAccount.Email, email)
+		}
+	}
+
+	required := []string{"compute.instances.delete", "compute.instances.list"}
+	if ranked := rankServiceAccounts(matches, required); len(ranked) != 2 {
+		t.Errorf("got %d matches with both permissions, want 2", len(ranked))
+	}
+}
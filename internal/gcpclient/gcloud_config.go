@@ -20,6 +20,8 @@ import (
 	"os"
 	"os/user"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
@@ -39,12 +41,19 @@ var (
 	once           sync.Once
 )
 
-func readGcloudConfigFromFile() error {
+func gcloudConfigDir() (string, error) {
 	usr, err := user.Current()
 	if err != nil {
-		return errorsutil.New("Failed to get current system user", err)
+		return "", errorsutil.New("Failed to get current system user", err)
+	}
+	return path.Join(usr.HomeDir, ".config", "gcloud"), nil
+}
+
+func readGcloudConfigFromFile() error {
+	configDir, err := gcloudConfigDir()
+	if err != nil {
+		return err
 	}
-	configDir := path.Join(usr.HomeDir, ".config", "gcloud")
 
 	activeConfig, err := getActiveConfig(configDir)
 	if err != nil {
@@ -226,3 +235,33 @@ func GetCurrentZone() (string, error) {
 	}
 	return gcloudConfig.Section("compute").Key("zone").String(), nil
 }
+
+// GetConfiguredProjects gets the projects that are set in any of the gcloud
+// configurations, sorted by ID.
+func GetConfiguredProjects() ([]string, error) {
+	configDir, err := gcloudConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	configs, err := filepath.Glob(path.Join(configDir, "configurations", "config_*"))
+	if err != nil {
+		return nil, errorsutil.New("Failed to read gcloud config dir", err)
+	}
+
+	seen := map[string]bool{}
+	projects := []string{}
+	for _, config := range configs {
+		cfg, err := ini.Load(config)
+		if err != nil {
+			util.Logger.Debugf("Skipping gcloud config %s: %v", config, err)
+			continue
+		}
+		project := cfg.Section("core").Key("project").String()
+		if project != "" && !seen[project] {
+			seen[project] = true
+			projects = append(projects, project)
+		}
+	}
+	sort.Strings(projects)
+	return projects, nil
+}
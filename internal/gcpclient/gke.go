@@ -15,36 +15,34 @@
 package gcpclient
 
 import (
-	"context"
-	"fmt"
-
-	container "cloud.google.com/go/container/apiv1"
-	"google.golang.org/api/option"
-	containerpb "google.golang.org/genproto/googleapis/container/v1"
-
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients"
 )
 
-// GetClusters gets the list of clusters in the current project.
+// GetClusters gets the list of clusters in the current project. Each cluster has its
+// "name" and "location", and the "endpoint" and base64 encoded "caCertificate" of its
+// control plane.
 func GetClusters(project, reason string) ([]map[string]string, error) {
-	gkeClient, err := container.NewClusterManagerClient(context.Background(), option.WithRequestReason(reason))
+	gkeClient, err := clients.Default().Container(ctx, clients.Options{Reason: reason})
 	if err != nil {
 		return []map[string]string{}, errorsutil.NewSDKError("Container", "", err)
 	}
+	defer gkeClient.Close()
 
-	listClustersReq := &containerpb.ListClustersRequest{
-		Parent: fmt.Sprintf("projects/%s/locations/-", project),
-	}
-
-	resp, err := gkeClient.ListClusters(ctx, listClustersReq)
+	clusters, err := gkeClient.ListClusters(ctx, project)
 	if err != nil {
 		util.Logger.Error("Failed to list GKE clusters")
 		return []map[string]string{}, err
 	}
 	clusterNames := []map[string]string{}
-	for _, cluster := range resp.Clusters {
-		clusterNames = append(clusterNames, map[string]string{"name": cluster.Name, "location": cluster.Location})
+	for _, cluster := range clusters {
+		clusterNames = append(clusterNames, map[string]string{
+			"name":          cluster.Name,
+			"location":      cluster.Location,
+			"endpoint":      cluster.Endpoint,
+			"caCertificate": cluster.GetMasterAuth().GetClusterCaCertificate(),
+		})
 	}
 	return clusterNames, nil
 }
@@ -17,7 +17,8 @@ package gcpclient
 import (
 	"context"
 	"fmt"
-	"sync"
+	"os"
+	"os/signal"
 
 	"github.com/golang/protobuf/ptypes/duration"
 	"google.golang.org/api/iam/v1"
@@ -25,22 +26,22 @@ import (
 
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients"
 	queryiam "github.com/rigup/ephemeral-iam/internal/gcpclient/query_iam"
 )
 
 var (
 	sessionDuration int64 = 600
 	ctx                   = context.Background()
-
-	wg sync.WaitGroup
 )
 
 // GenerateTemporaryAccessToken generates short-lived credentials for the given service account.
 func GenerateTemporaryAccessToken(svcAcct, reason string) (*credentialspb.GenerateAccessTokenResponse, error) {
-	client, err := ClientWithReason(reason)
+	client, err := clients.Default().IAMCredentials(ctx, clients.Options{Reason: reason})
 	if err != nil {
-		return nil, err
+		return nil, errorsutil.NewSDKError("Credentials", "", err)
 	}
+	defer client.Close()
 
 	sessionDuration := &duration.Duration{
 		Seconds: sessionDuration, // Expire after 10 minutes.
@@ -63,16 +64,43 @@ func GenerateTemporaryAccessToken(svcAcct, reason string) (*credentialspb.Genera
 	return resp, nil
 }
 
+// GenerateIDToken generates an OpenID Connect ID token for the given service account
+// that is intended for the given audience.
+func GenerateIDToken(svcAcct, audience, reason string, includeEmail bool) (string, error) {
+	client, err := clients.Default().IAMCredentials(ctx, clients.Options{Reason: reason})
+	if err != nil {
+		return "", errorsutil.NewSDKError("Credentials", "", err)
+	}
+	defer client.Close()
+
+	req := credentialspb.GenerateIdTokenRequest{
+		Name:         fmt.Sprintf("projects/-/serviceAccounts/%s", svcAcct),
+		Audience:     audience,
+		IncludeEmail: includeEmail,
+	}
+
+	resp, err := client.GenerateIDToken(ctx, &req)
+	if err != nil {
+		util.Logger.Errorf("Failed to generate ID token for service account %s", svcAcct)
+		return "", err
+	}
+	return resp.GetToken(), nil
+}
+
 // CanImpersonate checks if a given service account can be impersonated by the
 // authenticated user.
 func CanImpersonate(project, serviceAccountEmail string) (bool, error) {
+	return canImpersonate(ctx, project, serviceAccountEmail)
+}
+
+func canImpersonate(ctx context.Context, project, serviceAccountEmail string) (bool, error) {
 	resource := fmt.Sprintf("//iam.googleapis.com/projects/%s/serviceAccounts/%s", project, serviceAccountEmail)
-	testablePerms, err := queryiam.QueryTestablePermissionsOnResource(resource)
+	testablePerms, err := queryiam.QueryTestablePermissionsOnResource(ctx, resource)
 	if err != nil {
 		return false, err
 	}
 
-	perms, err := queryiam.QueryServiceAccountPermissions(testablePerms, project, serviceAccountEmail)
+	perms, err := queryiam.QueryResourcePermissions(ctx, testablePerms, resource, "", "")
 	if err != nil {
 		return false, err
 	}
@@ -85,53 +113,100 @@ func CanImpersonate(project, serviceAccountEmail string) (bool, error) {
 	return false, nil
 }
 
-// FetchAvailableServiceAccounts gets a list of service accounts that the user can impersonate.
-func FetchAvailableServiceAccounts(project string) ([]*iam.ServiceAccount, error) {
-	util.Logger.Infof("Using current project: %s", project)
+// serviceAccountsClient is the subset of the Cloud IAM API used to find the
+// service accounts that the user can impersonate.
+type serviceAccountsClient interface {
+	listServiceAccounts(ctx context.Context, project string) ([]*iam.ServiceAccount, error)
+	canImpersonate(ctx context.Context, project, serviceAccountEmail string) (bool, error)
+}
 
-	serviceAccounts, err := getServiceAccounts(project)
+// iamAPIClient is the serviceAccountsClient that calls the Cloud IAM API.
+type iamAPIClient struct{}
+
+func (iamAPIClient) listServiceAccounts(ctx context.Context, project string) ([]*iam.ServiceAccount, error) {
+	iamClient, err := clients.Default().IAM(ctx, clients.Options{})
 	if err != nil {
-		return nil, err
+		return nil, errorsutil.NewSDKError("Cloud IAM", "", err)
 	}
-	util.Logger.Infof("Checking %d service accounts in %s", len(serviceAccounts), project)
+	return iamClient.ListServiceAccounts(ctx, project)
+}
 
-	wg.Add(len(serviceAccounts))
+func (iamAPIClient) canImpersonate(ctx context.Context, project, serviceAccountEmail string) (bool, error) {
+	return canImpersonate(ctx, project, serviceAccountEmail)
+}
 
-	var availableSAs []*iam.ServiceAccount
-	for _, svcAcct := range serviceAccounts {
-		go func(serviceAccount *iam.ServiceAccount) {
-			hasAccess, err := CanImpersonate(project, serviceAccount.Email)
-			if err != nil {
-				util.Logger.Errorf("error checking IAM permissions: %v", err)
-			} else if hasAccess {
-				availableSAs = append(availableSAs, serviceAccount)
-			}
-			wg.Done()
-		}(svcAcct)
-	}
-	wg.Wait()
+// FetchAvailableServiceAccounts gets a list of service accounts that the user can impersonate.
+func FetchAvailableServiceAccounts(project string) ([]*iam.ServiceAccount, error) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	return fetchAvailableServiceAccounts(ctx, iamAPIClient{}, project, util.MaxWorkers)
+}
 
-	return availableSAs, nil
+// fetchAvailableServiceAccounts checks each service account in the project on a
+// pool of workers and retries rate limited requests with backoff. The service
+// accounts that could not be checked are logged and skipped; an error is only
+// returned if none of them could be checked or ctx is cancelled.
+func fetchAvailableServiceAccounts(
+	ctx context.Context,
+	client serviceAccountsClient,
+	project string,
+	workers int,
+) ([]*iam.ServiceAccount, error) {
+	util.Logger.Infof("Using current project: %s", project)
+	return scanServiceAccounts(ctx, client, project, workers, true)
 }
 
-func getServiceAccounts(project string) ([]*iam.ServiceAccount, error) {
-	iamService, err := iam.NewService(context.Background())
-	if err != nil {
-		return nil, errorsutil.NewSDKError("Cloud IAM", "", err)
+// scanServiceAccounts does the work of fetchAvailableServiceAccounts. The progress of
+// the checks is printed if showProgress is set.
+func scanServiceAccounts(
+	ctx context.Context,
+	client serviceAccountsClient,
+	project string,
+	workers int,
+	showProgress bool,
+) ([]*iam.ServiceAccount, error) {
+	var serviceAccounts []*iam.ServiceAccount
+	if err := util.RetryOnRateLimit(ctx, func() (err error) {
+		serviceAccounts, err = client.listServiceAccounts(ctx, project)
+		return err
+	}); err != nil {
+		if showProgress {
+			util.Logger.Error("Failed to list service accounts")
+		}
+		return nil, err
+	}
+	var progress *util.Progress
+	if showProgress {
+		util.Logger.Infof("Checking %d service accounts in %s", len(serviceAccounts), project)
+		progress = util.NewProgress("Checking service accounts", len(serviceAccounts))
+	}
+	hasAccess := make([]bool, len(serviceAccounts))
+	errs := util.RunWorkers(ctx, len(serviceAccounts), workers, func(ctx context.Context, i int) error {
+		defer progress.Increment()
+		return util.RetryOnRateLimit(ctx, func() (err error) {
+			hasAccess[i], err = client.canImpersonate(ctx, project, serviceAccounts[i].Email)
+			return err
+		})
+	})
+	progress.Done()
+
+	if ctx.Err() != nil {
+		return nil, errorsutil.New("Cancelled checking service accounts", ctx.Err())
 	}
-	svcAcctClient := iam.NewProjectsServiceAccountsService(iamService)
-
-	projectResource := fmt.Sprintf("projects/%s", project)
-	req := svcAcctClient.List(projectResource)
 
-	var serviceAccounts []*iam.ServiceAccount
+	var availableSAs []*iam.ServiceAccount
+	failed := 0
+	for i, svcAcct := range serviceAccounts {
+		if errs[i] != nil {
+			failed++
+			util.Logger.Warnf("Failed to check IAM permissions on %s: %v", svcAcct.Email, errs[i])
+		} else if hasAccess[i] {
+			availableSAs = append(availableSAs, svcAcct)
+		}
+	}
 
-	if err := req.Pages(ctx, func(page *iam.ListServiceAccountsResponse) error {
-		serviceAccounts = append(serviceAccounts, page.Accounts...)
-		return nil
-	}); err != nil {
-		util.Logger.Error("Failed to list service accounts")
-		return []*iam.ServiceAccount{}, err
+	if failed > 0 && failed == len(serviceAccounts) {
+		return nil, errorsutil.New("Failed to check IAM permissions on every service account", util.CollectErrors(errs))
 	}
-	return serviceAccounts, nil
+	return availableSAs, nil
 }
@@ -0,0 +1,279 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iam/v1"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients/clientstest"
+)
+
+func init() {
+	util.Logger = logrus.New()
+}
+
+// fakeIAMClient is a serviceAccountsClient that grants access to every third
+// service account, rate limits the first request for every 50th, and fails every
+// request for the service accounts in failing and the projects in failingProjects.
+type fakeIAMClient struct {
+	serviceAccounts []*iam.ServiceAccount
+	failing         map[string]bool
+	failingProjects map[string]bool
+
+	mu          sync.Mutex
+	rateLimited map[string]bool
+
+	running, maxRunning int32
+	checks              int32
+}
+
+func newFakeIAMClient(n int) *fakeIAMClient {
+	client := &fakeIAMClient{
+		failing:         map[string]bool{},
+		failingProjects: map[string]bool{},
+		rateLimited:     map[string]bool{},
+	}
+	for i := 0; i < n; i++ {
+		client.serviceAccounts = append(client.serviceAccounts, &iam.ServiceAccount{
+			Email: fmt.Sprintf("sa-%03d@p.iam.gserviceaccount.com", i),
+		})
+	}
+	return client
+}
+
+func (c *fakeIAMClient) listServiceAccounts(ctx context.Context, project string) ([]*iam.ServiceAccount, error) {
+	if c.failingProjects[project] {
+		return nil, &googleapi.Error{Code: http.StatusForbidden, Message: "Cloud IAM API has not been used"}
+	}
+	return c.serviceAccounts, nil
+}
+
+func (c *fakeIAMClient) canImpersonate(ctx context.Context, project, email string) (bool, error) {
+	atomic.AddInt32(&c.checks, 1)
+	n := atomic.AddInt32(&c.running, 1)
+	defer atomic.AddInt32(&c.running, -1)
+	for {
+		m := atomic.LoadInt32(&c.maxRunning)
+		if n <= m || atomic.CompareAndSwapInt32(&c.maxRunning, m, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+
+	var i int
+	fmt.Sscanf(email, "sa-%03d@", &i)
+	if c.failing[email] {
+		return false, errors.New("permission denied")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i%50 == 0 && !c.rateLimited[email] {
+		c.rateLimited[email] = true
+		return false, &googleapi.Error{Code: http.StatusTooManyRequests}
+	}
+	return i%3 == 0, nil
+}
+
+func TestFetchAvailableServiceAccounts(t *testing.T) {
+	client := newFakeIAMClient(200)
+	client.failing["sa-001@p.iam.gserviceaccount.com"] = true
+
+	availableSAs, err := fetchAvailableServiceAccounts(context.Background(), client, "p", 8)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.maxRunning > 8 {
+		t.Errorf("expected at most 8 concurrent checks, got %d", client.maxRunning)
+	}
+	if len(availableSAs) != 67 {
+		t.Fatalf("expected 67 available service accounts, got %d", len(availableSAs))
+	}
+	for i, sa := range availableSAs {
+		if want := fmt.Sprintf("sa-%03d@p.iam.gserviceaccount.com", i*3); sa.Email != want {
+			t.Errorf("expected service accounts in listed order: got %s at %d, want %s", sa.Email, i, want)
+		}
+	}
+	if len(client.rateLimited) != 4 {
+		t.Errorf("expected 4 rate limited service accounts to be retried, got %d", len(client.rateLimited))
+	}
+}
+
+func TestFetchAvailableServiceAccountsAllFail(t *testing.T) {
+	client := newFakeIAMClient(10)
+	for _, sa := range client.serviceAccounts {
+		client.failing[sa.Email] = true
+	}
+	if _, err := fetchAvailableServiceAccounts(context.Background(), client, "p", 4); err == nil {
+		t.Error("expected an error when no service accounts could be checked")
+	}
+}
+
+func TestFetchAvailableServiceAccountsCancelled(t *testing.T) {
+	client := newFakeIAMClient(100)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for atomic.LoadInt32(&client.checks) < 10 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+
+	if _, err := fetchAvailableServiceAccounts(ctx, client, "p", 2); err == nil {
+		t.Error("expected an error when cancelled")
+	}
+	if checks := atomic.LoadInt32(&client.checks); checks == 100 {
+		t.Error("expected the remaining service accounts not to be checked after cancellation")
+	}
+}
+
+func TestGenerateTemporaryAccessToken(t *testing.T) {
+	clientstest.Start(t)
+
+	resp, err := GenerateTemporaryAccessToken("sa@p.iam.gserviceaccount.com", "testing")
+	if err != nil {
+		t.Fatalf("failed to generate access token: %v", err)
+	}
+	if resp.AccessToken != "token-for-sa@p.iam.gserviceaccount.com" {
+		t.Errorf("unexpected access token %s", resp.AccessToken)
+	}
+	if lifetime := time.Until(resp.ExpireTime.AsTime()); lifetime < 9*time.Minute || lifetime > 10*time.Minute {
+		t.Errorf("expected the token to expire in 10 minutes, got %s", lifetime)
+	}
+}
+
+func TestGenerateIDToken(t *testing.T) {
+	clientstest.Start(t)
+
+	token, err := GenerateIDToken("sa@p.iam.gserviceaccount.com", "https://example.com", "testing", true)
+	if err != nil {
+		t.Fatalf("failed to generate ID token: %v", err)
+	}
+	if want := "id-token-for-sa@p.iam.gserviceaccount.com-aud-https://example.com-email-true"; token != want {
+		t.Errorf("expected ID token %s, got %s", want, token)
+	}
+
+	if _, err := GenerateIDToken("sa@p.iam.gserviceaccount.com", "", "testing", false); err == nil {
+		t.Error("expected an error when no audience is given")
+	}
+}
+
+func TestFetchAvailableServiceAccountsFromAPI(t *testing.T) {
+	srv := clientstest.Start(t)
+	perms := []string{"iam.serviceAccounts.actAs", "iam.serviceAccounts.get", "iam.serviceAccounts.getAccessToken"}
+	for i := 0; i < 5; i++ {
+		email := fmt.Sprintf("sa-%d@p.iam.gserviceaccount.com", i)
+		srv.ServiceAccounts["p"] = append(srv.ServiceAccounts["p"], &iam.ServiceAccount{Email: email})
+		srv.TestablePermissions["//iam.googleapis.com/projects/p/serviceAccounts/"+email] = perms
+		if i%2 == 0 {
+			srv.Granted["projects/p/serviceAccounts/"+email] = []string{"iam.serviceAccounts.getAccessToken"}
+		} else {
+			srv.Granted["projects/p/serviceAccounts/"+email] = []string{"iam.serviceAccounts.get"}
+		}
+	}
+
+	availableSAs, err := FetchAvailableServiceAccounts("p")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var emails []string
+	for _, sa := range availableSAs {
+		emails = append(emails, sa.Email)
+	}
+	want := "sa-0@p.iam.gserviceaccount.com,sa-2@p.iam.gserviceaccount.com,sa-4@p.iam.gserviceaccount.com"
+	if got := strings.Join(emails, ","); got != want {
+		t.Errorf("unexpected service accounts: got %s, want %s", got, want)
+	}
+}
+
+func TestFetchAvailableServiceAccountsRetriesRateLimits(t *testing.T) {
+	srv := clientstest.Start(t)
+	perms := []string{"iam.serviceAccounts.get", "iam.serviceAccounts.getAccessToken"}
+	for i := 0; i < 3; i++ {
+		email := fmt.Sprintf("sa-%d@p.iam.gserviceaccount.com", i)
+		srv.ServiceAccounts["p"] = append(srv.ServiceAccounts["p"], &iam.ServiceAccount{Email: email})
+		srv.TestablePermissions["//iam.googleapis.com/projects/p/serviceAccounts/"+email] = perms
+		srv.Granted["projects/p/serviceAccounts/"+email] = []string{"iam.serviceAccounts.getAccessToken"}
+	}
+	const queryTestable = "POST /iam/v1/permissions:queryTestablePermissions"
+	srv.RateLimited[queryTestable] = 2
+
+	availableSAs, err := FetchAvailableServiceAccounts("p")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(availableSAs) != 3 {
+		t.Errorf("expected the rate limited service accounts to be retried, got %d of 3", len(availableSAs))
+	}
+	queries := 0
+	for _, req := range srv.Requests() {
+		if req.Method == queryTestable {
+			queries++
+		}
+	}
+	if queries != 5 {
+		t.Errorf("expected 5 testable permissions queries, got %d", queries)
+	}
+}
+
+func TestCanImpersonateCancelled(t *testing.T) {
+	srv := clientstest.Start(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := (iamAPIClient{}).canImpersonate(ctx, "p", "sa@p.iam.gserviceaccount.com"); err == nil {
+		t.Error("expected an error when cancelled")
+	}
+	if reqs := srv.Requests(); len(reqs) != 0 {
+		t.Errorf("expected no requests after cancellation, got %v", reqs)
+	}
+}
+
+func TestGetClusters(t *testing.T) {
+	srv := clientstest.Start(t)
+	srv.Clusters["p"] = []*containerpb.Cluster{
+		{Name: "cluster-1", Location: "us-central1"},
+		{
+			Name:       "cluster-2",
+			Location:   "us-east1-b",
+			Endpoint:   "10.0.0.2",
+			MasterAuth: &containerpb.MasterAuth{ClusterCaCertificate: "Y2EtY2VydA=="},
+		},
+	}
+
+	clusters, err := GetClusters("p", "testing")
+	if err != nil {
+		t.Fatalf("failed to get clusters: %v", err)
+	}
+	if len(clusters) != 2 || clusters[1]["name"] != "cluster-2" || clusters[1]["location"] != "us-east1-b" {
+		t.Errorf("unexpected clusters: %v", clusters)
+	}
+	if clusters[1]["endpoint"] != "10.0.0.2" || clusters[1]["caCertificate"] != "Y2EtY2VydA==" {
+		t.Errorf("unexpected control plane of cluster-2: %v", clusters[1])
+	}
+}
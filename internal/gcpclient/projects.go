@@ -0,0 +1,131 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sort"
+
+	"google.golang.org/api/iam/v1"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients"
+)
+
+// ListProjects gets the IDs of the active projects that the user can see, sorted by
+// ID. If parent is a folder or organization, e.g. folders/123, only the projects
+// under it, including the projects in its sub-folders, are listed.
+func ListProjects(parent string) ([]string, error) {
+	crmClient, err := clients.Default().ResourceManager(ctx, clients.Options{})
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Cloud Resource Manager", "", err)
+	}
+
+	if parent == "" {
+		projects, err := crmClient.ListProjects(ctx, "")
+		if err != nil {
+			return nil, errorsutil.New("Failed to list projects", err)
+		}
+		sort.Strings(projects)
+		return projects, nil
+	}
+
+	var projects []string
+	for parents := []string{parent}; len(parents) > 0; parents = parents[1:] {
+		children, err := crmClient.ListProjects(ctx, parents[0])
+		if err != nil {
+			return nil, errorsutil.New("Failed to list the projects in "+parents[0], err)
+		}
+		projects = append(projects, children...)
+
+		folders, err := crmClient.ListFolders(ctx, parents[0])
+		if err != nil {
+			return nil, errorsutil.New("Failed to list the folders in "+parents[0], err)
+		}
+		parents = append(parents, folders...)
+	}
+	sort.Strings(projects)
+	return projects, nil
+}
+
+// FetchAvailableServiceAccountsInProjects gets the service accounts that the user can
+// impersonate in each of the projects. See fetchAvailableServiceAccountsInProjects.
+func FetchAvailableServiceAccountsInProjects(projects []string) (map[string][]*iam.ServiceAccount, error) {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	return fetchAvailableServiceAccountsInProjects(ctx, iamAPIClient{}, projects, util.MaxWorkers)
+}
+
+// fetchAvailableServiceAccountsInProjects scans several projects at once. The workers
+// are split between the projects so that at most workers service accounts are checked
+// at the same time. The projects that could not be scanned, e.g. because the IAM API
+// is disabled in them, are logged and left out of the result; an error is only
+// returned if none of them could be scanned or ctx is cancelled.
+func fetchAvailableServiceAccountsInProjects(
+	ctx context.Context,
+	client serviceAccountsClient,
+	projects []string,
+	workers int,
+) (map[string][]*iam.ServiceAccount, error) {
+	projectWorkers := workers / 2
+	if projectWorkers < 1 {
+		projectWorkers = 1
+	}
+	workersPerProject := workers / projectWorkers
+
+	util.Logger.Infof("Checking the service accounts in %d projects", len(projects))
+	progress := util.NewProgress("Scanning projects", len(projects))
+	results := make([][]*iam.ServiceAccount, len(projects))
+	errs := util.RunWorkers(ctx, len(projects), projectWorkers, func(ctx context.Context, i int) (err error) {
+		defer progress.Increment()
+		results[i], err = scanServiceAccounts(ctx, client, projects[i], workersPerProject, false)
+		return err
+	})
+	progress.Done()
+
+	if ctx.Err() != nil {
+		return nil, errorsutil.New("Cancelled checking service accounts", ctx.Err())
+	}
+
+	availableSAs := make(map[string][]*iam.ServiceAccount, len(projects))
+	failed := 0
+	for i, project := range projects {
+		if errs[i] != nil {
+			failed++
+			util.Logger.Warnf("Failed to check the service accounts in %s: %v", project, errorMessage(errs[i]))
+			continue
+		}
+		availableSAs[project] = results[i]
+	}
+
+	if failed > 0 && failed == len(projects) {
+		return nil, errorsutil.New("Failed to check the service accounts in every project", util.CollectErrors(errs))
+	}
+	return availableSAs, nil
+}
+
+// errorMessage returns the message of an EiamError, which formats itself as a log
+// entry, or the error string of other errors.
+func errorMessage(err error) string {
+	var eiamErr errorsutil.EiamError
+	if errors.As(err, &eiamErr) {
+		return eiamErr.Msg + ": " + eiamErr.Err.Error()
+	}
+	return err.Error()
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients/clientstest"
+)
+
+func TestListProjects(t *testing.T) {
+	srv := clientstest.Start(t)
+	srv.Parents["projects/a"] = "organizations/1"
+	srv.Parents["projects/b"] = "folders/10"
+	srv.Parents["projects/c"] = "folders/11"
+	srv.Parents["projects/d"] = "folders/20"
+	srv.Parents["projects/e"] = "folders/10"
+	srv.Parents["folders/10"] = "organizations/1"
+	srv.Parents["folders/11"] = "folders/10"
+	srv.Parents["folders/20"] = "organizations/2"
+
+	tests := []struct {
+		parent string
+		want   []string
+	}{
+		{"", []string{"a", "b", "c", "d", "e"}},
+		{"organizations/1", []string{"a", "b", "c", "e"}},
+		{"folders/10", []string{"b", "c", "e"}},
+		{"folders/11", []string{"c"}},
+		{"organizations/3", nil},
+	}
+	for _, tt := range tests {
+		projects, err := ListProjects(tt.parent)
+		if err != nil {
+			t.Fatalf("failed to list projects in %q: %v", tt.parent, err)
+		}
+		if !reflect.DeepEqual(projects, tt.want) {
+			t.Errorf("ListProjects(%q) = %v, want %v", tt.parent, projects, tt.want)
+		}
+	}
+}
+
+func TestFetchAvailableServiceAccountsInProjects(t *testing.T) {
+	client := newFakeIAMClient(30)
+	client.failingProjects["disabled"] = true
+
+	projects := []string{"a", "b", "disabled", "c", "d", "e"}
+	availableSAs, err := fetchAvailableServiceAccountsInProjects(context.Background(), client, projects, 8)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.maxRunning > 8 {
+		t.Errorf("expected at most 8 concurrent checks, got %d", client.maxRunning)
+	}
+	if len(availableSAs) != 5 {
+		t.Errorf("expected results for the 5 projects that could be scanned, got %d", len(availableSAs))
+	}
+	if _, ok := availableSAs["disabled"]; ok {
+		t.Error("expected the project that could not be scanned to be left out")
+	}
+	for project, serviceAccounts := range availableSAs {
+		if len(serviceAccounts) != 10 {
+			t.Errorf("expected 10 available service accounts in %s, got %d", project, len(serviceAccounts))
+		}
+	}
+}
+
+func TestFetchAvailableServiceAccountsInProjectsAllFail(t *testing.T) {
+	client := newFakeIAMClient(3)
+	client.failingProjects["a"] = true
+	client.failingProjects["b"] = true
+	if _, err := fetchAvailableServiceAccountsInProjects(context.Background(), client, []string{"a", "b"}, 8); err == nil {
+		t.Error("expected an error when no projects could be scanned")
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// testablePermsCacheDir is the subdirectory of the cache directory that the
+// testable permissions of each resource type are written to.
+const testablePermsCacheDir = "testable_permissions"
+
+// cacheDir and cacheTTL are the directory that the testable permissions are cached
+// in and how long they are used for. They are set with ConfigureCache.
+var (
+	cacheDir string
+	cacheTTL time.Duration
+)
+
+// cacheLocks holds a mutex for each resource type so concurrent lookups of the
+// same resource type only query the IAM API once.
+var cacheLocks sync.Map
+
+type testablePermsCacheEntry struct {
+	ResourceType string    `json:"resource_type"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	Permissions  []string  `json:"permissions"`
+}
+
+// resourceTypeKey strips the resource IDs from a full resource name so that all
+// resources of the same type share a cache entry, e.g.
+// //compute.googleapis.com/projects/p/zones/z/instances/i becomes
+// compute.googleapis.com/projects/zones/instances.
+func resourceTypeKey(fullResourceName string) string {
+	parts := strings.Split(strings.TrimPrefix(fullResourceName, "//"), "/")
+	key := []string{parts[0]}
+	for i := 1; i < len(parts); i += 2 {
+		key = append(key, parts[i])
+	}
+	return strings.Join(key, "/")
+}
+
+// ConfigureCache sets the directory that the testable permissions of each resource
+// type are cached in and how long the cached permissions are used for, i.e. the
+// 'cache.dir' and 'cache.ttl' config fields. Caching is disabled if dir is empty or
+// ttl is not positive.
+func ConfigureCache(dir string, ttl time.Duration) {
+	cacheDir, cacheTTL = dir, ttl
+}
+
+func testablePermsCachePath(key string) string {
+	filename := strings.NewReplacer("/", "_", ".", "-").Replace(key) + ".json"
+	return filepath.Join(cacheDir, testablePermsCacheDir, filename)
+}
+
+// readTestablePermsCache returns the cached testable permissions for a resource
+// type if they were fetched within the configured TTL.
+func readTestablePermsCache(key string, ttl time.Duration) ([]string, bool) {
+	data, err := ioutil.ReadFile(testablePermsCachePath(key))
+	if err != nil {
+		return nil, false
+	}
+	var entry testablePermsCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		util.Logger.Debugf("Ignoring corrupt cache entry for %s: %v", key, err)
+		return nil, false
+	}
+	if entry.ResourceType != key || time.Since(entry.FetchedAt) > ttl || len(entry.Permissions) == 0 {
+		return nil, false
+	}
+	return entry.Permissions, true
+}
+
+// writeTestablePermsCache writes the testable permissions of a resource type to
+// the cache. The entry is written to a temporary file and renamed so concurrent
+// eiam processes never read a partially written entry.
+func writeTestablePermsCache(key string, perms []string) error {
+	path := testablePermsCachePath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(testablePermsCacheEntry{
+		ResourceType: key,
+		FetchedAt:    time.Now(),
+		Permissions:  perms,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ClearTestablePermissionsCache removes the cached testable permissions of every
+// resource type.
+func ClearTestablePermissionsCache() error {
+	dir := filepath.Join(cacheDir, testablePermsCacheDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return errorsutil.New("Failed to clear the testable permissions cache", err)
+	}
+	util.Logger.Debugf("Cleared the testable permissions cache in %s", dir)
+	return nil
+}
+
+// cachedTestablePermissions returns the testable permissions on a resource from
+// the cache, calling fetch and caching the result on a miss.
+func cachedTestablePermissions(resource string, fetch func(string) ([]string, error)) ([]string, error) {
+	if cacheTTL <= 0 || cacheDir == "" {
+		return fetch(resource)
+	}
+
+	key := resourceTypeKey(resource)
+	lock, _ := cacheLocks.LoadOrStore(key, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	if perms, ok := readTestablePermsCache(key, cacheTTL); ok {
+		util.Logger.Debugf("Using cached testable permissions for %s", key)
+		return perms, nil
+	}
+
+	perms, err := fetch(resource)
+	if err != nil {
+		return perms, err
+	}
+	if err := writeTestablePermsCache(key, perms); err != nil {
+		util.Logger.Debugf("Failed to cache testable permissions for %s: %v", key, err)
+	}
+	return perms, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients/clientstest"
+)
+
+func TestResourceTypeKey(t *testing.T) {
+	testCases := []struct {
+		resource string
+		key      string
+	}{
+		{"//cloudresourcemanager.googleapis.com/projects/my-project", "cloudresourcemanager.googleapis.com/projects"},
+		{"//compute.googleapis.com/projects/p/zones/z/instances/i", "compute.googleapis.com/projects/zones/instances"},
+		{"//iam.googleapis.com/projects/p/serviceAccounts/sa@p.iam", "iam.googleapis.com/projects/serviceAccounts"},
+		{"//storage.googleapis.com/projects/_/buckets/b", "storage.googleapis.com/projects/buckets"},
+	}
+	for _, tc := range testCases {
+		if got := resourceTypeKey(tc.resource); got != tc.key {
+			t.Errorf("resourceTypeKey(%s) = %s, want %s", tc.resource, got, tc.key)
+		}
+	}
+}
+
+func setUpCache(t *testing.T, ttl time.Duration) {
+	t.Helper()
+	clientstest.TempCache(t, func(dir string) { ConfigureCache(dir, ttl) })
+}
+
+func TestCachedTestablePermissions(t *testing.T) {
+	setUpCache(t, time.Hour)
+
+	var calls int32
+	fetch := func(resource string) ([]string, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return []string{"pubsub.topics.get", "pubsub.topics.publish"}, nil
+	}
+
+	// Concurrent lookups of resources of the same type only fetch once.
+	var wg sync.WaitGroup
+	for _, topic := range []string{"a", "b", "c", "d"} {
+		wg.Add(1)
+		go func(topic string) {
+			defer wg.Done()
+			perms, err := cachedTestablePermissions("//pubsub.googleapis.com/projects/p/topics/"+topic, fetch)
+			if err != nil || len(perms) != 2 {
+				t.Errorf("unexpected result for %s: %v, %v", topic, perms, err)
+			}
+		}(topic)
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("expected 1 fetch, got %d", calls)
+	}
+
+	if _, err := cachedTestablePermissions("//pubsub.googleapis.com/projects/p/subscriptions/s", fetch); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected a different resource type to be fetched, got %d fetches", calls)
+	}
+
+	if err := ClearTestablePermissionsCache(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cachedTestablePermissions("//pubsub.googleapis.com/projects/p/topics/a", fetch); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("expected the cleared entry to be fetched again, got %d fetches", calls)
+	}
+}
+
+func TestCachedTestablePermissionsExpired(t *testing.T) {
+	setUpCache(t, time.Hour)
+
+	key := resourceTypeKey("//pubsub.googleapis.com/projects/p/topics/t")
+	if err := writeTestablePermsCache(key, []string{"pubsub.topics.get"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readTestablePermsCache(key, time.Hour); !ok {
+		t.Error("expected a fresh entry to be read from the cache")
+	}
+	if _, ok := readTestablePermsCache(key, time.Nanosecond); ok {
+		t.Error("expected an expired entry to be ignored")
+	}
+}
+
+func TestCachedTestablePermissionsErrors(t *testing.T) {
+	setUpCache(t, time.Hour)
+
+	fetchErr := errors.New("fetch failed")
+	fetch := func(resource string) ([]string, error) { return nil, fetchErr }
+	if _, err := cachedTestablePermissions("//pubsub.googleapis.com/projects/p/topics/t", fetch); err != fetchErr {
+		t.Errorf("expected fetch error, got %v", err)
+	}
+	key := resourceTypeKey("//pubsub.googleapis.com/projects/p/topics/t")
+	if _, ok := readTestablePermsCache(key, time.Hour); ok {
+		t.Error("expected a failed fetch not to be cached")
+	}
+}
+
+func TestCachedTestablePermissionsDisabled(t *testing.T) {
+	setUpCache(t, 0)
+
+	var calls int
+	fetch := func(resource string) ([]string, error) {
+		calls++
+		return []string{"pubsub.topics.get"}, nil
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cachedTestablePermissions("//pubsub.googleapis.com/projects/p/topics/t", fetch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected caching to be disabled, got %d fetches", calls)
+	}
+}
@@ -0,0 +1,452 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients"
+)
+
+// policyGetter calls a getIamPolicy method for the resource and returns the
+// bindings in its policy.
+type policyGetter func(ctx context.Context, client *http.Client, resource string) ([]clients.PolicyBinding, error)
+
+// policyOptions is the request body of getIamPolicy methods that take their options
+// in the body. Version 3 policies include conditional role bindings.
+var policyOptions = map[string]interface{}{"options": map[string]int{"requestedPolicyVersion": 3}}
+
+var projectPrefix = regexp.MustCompile(`^projects/([^/]+)/`)
+
+// Grant is a role binding in an IAM policy that grants a permission to a principal.
+type Grant struct {
+	// Resource is the resource whose policy contains the binding.
+	Resource string `json:"resource" yaml:"resource"`
+	Role     string `json:"role" yaml:"role"`
+	// Member is the member of the binding that matches the principal, e.g. a group
+	// that the principal belongs to.
+	Member string `json:"member" yaml:"member"`
+	// Condition is the expression of the binding's condition, if it has one.
+	Condition string `json:"condition,omitempty" yaml:"condition,omitempty"`
+	// Unverified is set when Member is a group whose membership couldn't be checked.
+	Unverified bool `json:"unverified,omitempty" yaml:"unverified,omitempty"`
+}
+
+// resourcePolicy is the IAM policy bindings on a resource.
+type resourcePolicy struct {
+	resource string
+	bindings []clients.PolicyBinding
+}
+
+// explainer matches the bindings in IAM policies against a principal.
+type explainer struct {
+	principal string
+	opts      clients.Options
+
+	crm      clients.ResourceManagerClient
+	iam      clients.IAMClient
+	identity clients.CloudIdentityClient
+
+	rolePerms map[string]map[string]bool
+	groups    map[string]bool
+}
+
+// ExplainPermissions finds the role bindings that grant each of perms to the principal
+// on the resource identified by its full resource name. The policies of the resource,
+// of its parents within its service, and of its project, folders and organization are
+// read with the authenticated user's credentials, and policies that can't be read are
+// skipped with a warning. Group
+// memberships are checked with the Cloud Identity API when possible. The returned map
+// only has entries for the permissions that were explained.
+func ExplainPermissions(fullResourceName, principal string, perms []string, reason string) (map[string][]Grant, error) {
+	resType, resource, err := lookupResourceType(fullResourceName)
+	if err != nil {
+		return nil, errorsutil.New("Invalid resource name", err)
+	}
+	e, err := newExplainer(principal, clients.Options{Reason: reason})
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []resourcePolicy
+	if resType.policy != nil {
+		if bindings, err := e.resourcePolicy(resType, resource); err != nil {
+			util.Logger.Warnf("Failed to read the IAM policy of %s: %v", resource, err)
+		} else {
+			policies = append(policies, resourcePolicy{resource: resource, bindings: bindings})
+		}
+	}
+	policies = append(policies, e.hierarchyPolicies(resType, resource)...)
+
+	return e.explain(policies, perms), nil
+}
+
+func newExplainer(principal string, opts clients.Options) (*explainer, error) {
+	crmClient, err := clients.Default().ResourceManager(ctx, opts)
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Cloud Resource Manager", "", err)
+	}
+	iamClient, err := clients.Default().IAM(ctx, opts)
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Cloud IAM", "", err)
+	}
+	identityClient, err := clients.Default().CloudIdentity(ctx, opts)
+	if err != nil {
+		// Bindings to groups are reported as unverified without a client.
+		util.Logger.Debugf("Failed to create Cloud Identity client: %v", err)
+	}
+	return &explainer{
+		principal: principal,
+		opts:      opts,
+		crm:       crmClient,
+		iam:       iamClient,
+		identity:  identityClient,
+		rolePerms: map[string]map[string]bool{},
+		groups:    map[string]bool{},
+	}, nil
+}
+
+func (e *explainer) resourcePolicy(resType *ResourceType, resource string) ([]clients.PolicyBinding, error) {
+	client, err := clients.Default().HTTP(ctx, e.opts)
+	if err != nil {
+		return nil, err
+	}
+	return resType.policy(ctx, client, resource)
+}
+
+// hierarchyPolicies reads the policies of the resources that the resource inherits
+// from, closest first: its parents within its service, e.g. the key ring of a key,
+// and then the project, folders and organization that contain it.
+func (e *explainer) hierarchyPolicies(resType *ResourceType, resource string) []resourcePolicy {
+	policies := e.parentPolicies(resType, resource)
+
+	root, err := e.hierarchyRoot(resType, resource)
+	if err != nil {
+		util.Logger.Warnf("Failed to find the project of %s: %v", resource, err)
+		return policies
+	}
+
+	ancestry, err := e.crm.GetAncestry(ctx, root)
+	if err != nil {
+		util.Logger.Warnf("Failed to read the ancestry of %s: %v", root, err)
+		ancestry = []string{root}
+	}
+
+	for _, ancestor := range ancestry {
+		bindings, err := e.crm.GetIamPolicy(ctx, ancestor)
+		if err != nil {
+			util.Logger.Warnf("Failed to read the IAM policy of %s: %v", ancestor, err)
+			continue
+		}
+		policies = append(policies, resourcePolicy{resource: ancestor, bindings: bindings})
+	}
+	return policies
+}
+
+// parentPolicies reads the policies of the parents of the resource within its
+// service, closest first.
+func (e *explainer) parentPolicies(resType *ResourceType, resource string) []resourcePolicy {
+	var policies []resourcePolicy
+	for resType.parent != nil {
+		var err error
+		resource = resType.parent(resource)
+		if resType, err = lookupParentType(resType.Service, resource); err != nil {
+			util.Logger.Warnf("Failed to read the IAM policy of %s: %v", resource, err)
+			break
+		}
+		bindings, err := e.resourcePolicy(resType, resource)
+		if err != nil {
+			util.Logger.Warnf("Failed to read the IAM policy of %s: %v", resource, err)
+			continue
+		}
+		policies = append(policies, resourcePolicy{resource: resource, bindings: bindings})
+	}
+	return policies
+}
+
+// hierarchyRoot returns the project, folder or organization that is the closest
+// ancestor of the resource in the resource hierarchy.
+func (e *explainer) hierarchyRoot(resType *ResourceType, resource string) (string, error) {
+	if resType.Service == "cloudresourcemanager.googleapis.com" {
+		return resource, nil
+	}
+	if m := projectPrefix.FindStringSubmatch(resource); m != nil && m[1] != "_" {
+		return "projects/" + m[1], nil
+	}
+	if resType.Service == "storage.googleapis.com" {
+		storageClient, err := clients.Default().Storage(ctx, e.opts)
+		if err != nil {
+			return "", err
+		}
+		project, err := storageClient.GetBucketProject(ctx, resource[strings.LastIndex(resource, "/")+1:])
+		if err != nil {
+			return "", err
+		}
+		return "projects/" + project, nil
+	}
+	return "", fmt.Errorf("%s is not in a project", resource)
+}
+
+// explain returns the grants in the policies for each of perms.
+func (e *explainer) explain(policies []resourcePolicy, perms []string) map[string][]Grant {
+	wanted := make(map[string]bool, len(perms))
+	for _, perm := range perms {
+		wanted[perm] = true
+	}
+
+	grants := map[string][]Grant{}
+	for _, policy := range policies {
+		for _, binding := range policy.bindings {
+			member, unverified, ok := e.matchMember(binding.Members)
+			if !ok {
+				continue
+			}
+			rolePerms, err := e.roleIncludedPermissions(binding.Role)
+			if err != nil {
+				util.Logger.Warnf("Failed to read the permissions in %s: %v", binding.Role, err)
+				continue
+			}
+			grant := Grant{Resource: policy.resource, Role: binding.Role, Member: member, Unverified: unverified}
+			if binding.Condition != nil {
+				grant.Condition = binding.Condition.Expression
+			}
+			for _, perm := range perms {
+				if rolePerms[perm] && wanted[perm] {
+					grants[perm] = append(grants[perm], grant)
+				}
+			}
+		}
+	}
+	return grants
+}
+
+// matchMember returns the first member of a binding that includes the principal.
+// Members that are verified to include the principal are preferred over groups
+// whose membership couldn't be checked.
+func (e *explainer) matchMember(members []string) (member string, unverified, ok bool) {
+	var unverifiedMember string
+	for _, m := range members {
+		kind, id := m, ""
+		if i := strings.Index(m, ":"); i >= 0 {
+			kind, id = m[:i], m[i+1:]
+		}
+		switch kind {
+		case "allUsers", "allAuthenticatedUsers":
+			return m, false, true
+		case "user", "serviceAccount":
+			if strings.EqualFold(id, e.principal) {
+				return m, false, true
+			}
+		case "domain":
+			if strings.HasSuffix(strings.ToLower(e.principal), "@"+strings.ToLower(id)) {
+				return m, false, true
+			}
+		case "group":
+			isMember, verified := e.isGroupMember(id)
+			if isMember && verified {
+				return m, false, true
+			}
+			if !verified && unverifiedMember == "" {
+				unverifiedMember = m
+			}
+		}
+	}
+	if unverifiedMember != "" {
+		return unverifiedMember, true, true
+	}
+	return "", false, false
+}
+
+// isGroupMember reports whether the principal is a transitive member of the group.
+// verified is false if the membership couldn't be checked.
+func (e *explainer) isGroupMember(group string) (isMember, verified bool) {
+	if isMember, ok := e.groups[group]; ok {
+		return isMember, true
+	}
+	if e.identity == nil {
+		return false, false
+	}
+	isMember, err := e.identity.IsTransitiveMember(ctx, group, e.principal)
+	if err != nil {
+		util.Logger.Debugf("Failed to check the membership of %s: %v", group, err)
+		return false, false
+	}
+	e.groups[group] = isMember
+	return isMember, true
+}
+
+func (e *explainer) roleIncludedPermissions(role string) (map[string]bool, error) {
+	if perms, ok := e.rolePerms[role]; ok {
+		return perms, nil
+	}
+	included, err := e.iam.GetRolePermissions(ctx, role)
+	if err != nil {
+		return nil, err
+	}
+	perms := make(map[string]bool, len(included))
+	for _, perm := range included {
+		perms[perm] = true
+	}
+	e.rolePerms[role] = perms
+	return perms, nil
+}
+
+// getPolicyGetter reads the policy with a GET request. urlTemplate is formatted with
+// the resource name relative to the service.
+func getPolicyGetter(urlTemplate string) policyGetter {
+	return func(ctx context.Context, client *http.Client, resource string) ([]clients.PolicyBinding, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(urlTemplate, resource), nil)
+		if err != nil {
+			return nil, err
+		}
+		return doGetPolicy(client, req)
+	}
+}
+
+// postPolicyGetter reads the policy with a POST request. The body is encoded as JSON,
+// and an empty object is sent if it is nil.
+func postPolicyGetter(urlTemplate string, body interface{}) policyGetter {
+	if body == nil {
+		body = struct{}{}
+	}
+	return func(ctx context.Context, client *http.Client, resource string) ([]clients.PolicyBinding, error) {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqURL := fmt.Sprintf(urlTemplate, resource)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return doGetPolicy(client, req)
+	}
+}
+
+// storagePolicyGetter reads the policy of a bucket with the Cloud Storage JSON API,
+// which takes the bucket name.
+func storagePolicyGetter(urlTemplate string) policyGetter {
+	return func(ctx context.Context, client *http.Client, resource string) ([]clients.PolicyBinding, error) {
+		bucket := resource[strings.LastIndex(resource, "/")+1:]
+		reqURL := fmt.Sprintf(urlTemplate, url.PathEscape(bucket))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		return doGetPolicy(client, req)
+	}
+}
+
+// datasetLegacyRoles are the IAM roles that the basic roles in the access list of a
+// BigQuery dataset are equivalent to.
+var datasetLegacyRoles = map[string]string{
+	"OWNER":  "roles/bigquery.dataOwner",
+	"WRITER": "roles/bigquery.dataEditor",
+	"READER": "roles/bigquery.dataViewer",
+}
+
+// datasetPolicyGetter reads the access list of a BigQuery dataset, which takes the
+// place of its IAM policy, and converts it to policy bindings. Entries that grant
+// access to views, routines or other datasets, and to the holders of the basic
+// roles on the project, are skipped since they don't name a principal.
+func datasetPolicyGetter(urlTemplate string) policyGetter {
+	return func(ctx context.Context, client *http.Client, resource string) ([]clients.PolicyBinding, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(urlTemplate, resource), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if err := googleapi.CheckResponse(resp); err != nil {
+			return nil, err
+		}
+		var dataset struct {
+			Access []struct {
+				Role         string                   `json:"role"`
+				UserByEmail  string                   `json:"userByEmail"`
+				GroupByEmail string                   `json:"groupByEmail"`
+				Domain       string                   `json:"domain"`
+				SpecialGroup string                   `json:"specialGroup"`
+				IAMMember    string                   `json:"iamMember"`
+				Condition    *clients.PolicyCondition `json:"condition"`
+			} `json:"access"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&dataset); err != nil {
+			return nil, err
+		}
+
+		var bindings []clients.PolicyBinding
+		for _, entry := range dataset.Access {
+			var member string
+			switch {
+			case entry.UserByEmail != "":
+				member = "user:" + entry.UserByEmail
+			case entry.GroupByEmail != "":
+				member = "group:" + entry.GroupByEmail
+			case entry.Domain != "":
+				member = "domain:" + entry.Domain
+			case entry.IAMMember != "":
+				member = entry.IAMMember
+			case entry.SpecialGroup == "allAuthenticatedUsers":
+				member = entry.SpecialGroup
+			default:
+				continue
+			}
+			role := entry.Role
+			if legacy, ok := datasetLegacyRoles[role]; ok {
+				role = legacy
+			}
+			bindings = append(bindings, clients.PolicyBinding{
+				Role:      role,
+				Members:   []string{member},
+				Condition: entry.Condition,
+			})
+		}
+		return bindings, nil
+	}
+}
+
+func doGetPolicy(client *http.Client, req *http.Request) ([]clients.PolicyBinding, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	var policy struct {
+		Bindings []clients.PolicyBinding `json:"bindings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&policy); err != nil {
+		return nil, err
+	}
+	return policy.Bindings, nil
+}
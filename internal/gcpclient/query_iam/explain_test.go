@@ -0,0 +1,209 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients/clientstest"
+)
+
+func TestExplainPermissions(t *testing.T) {
+	srv := clientstest.Start(t)
+	srv.Parents["projects/p"] = "folders/1"
+	srv.Parents["folders/1"] = "organizations/2"
+	srv.Roles["roles/viewer"] = []string{"compute.instances.get", "compute.instances.list"}
+	srv.Roles["roles/compute.admin"] = []string{"compute.instances.delete", "compute.instances.get"}
+	srv.Roles["organizations/2/roles/deleter"] = []string{"compute.instances.delete"}
+	srv.Roles["roles/editor"] = []string{"compute.instances.list"}
+	srv.GroupMembers["admins@example.com"] = []string{"oncall@example.com"}
+	srv.GroupMembers["oncall@example.com"] = []string{"user@example.com"}
+	srv.GroupMembers["others@example.com"] = []string{"other@example.com"}
+	srv.Policies["projects/p"] = []clients.PolicyBinding{
+		{Role: "roles/viewer", Members: []string{"user:other@example.com", "user:user@example.com"}},
+		{Role: "roles/editor", Members: []string{"group:others@example.com"}},
+	}
+	srv.Policies["folders/1"] = []clients.PolicyBinding{
+		{Role: "roles/compute.admin", Members: []string{"group:admins@example.com"}},
+		{Role: "roles/editor", Members: []string{"group:external@example.org"}},
+	}
+	srv.Policies["organizations/2"] = []clients.PolicyBinding{
+		{
+			Role:      "organizations/2/roles/deleter",
+			Members:   []string{"domain:example.com"},
+			Condition: &clients.PolicyCondition{Title: "weekdays", Expression: "request.time.getDayOfWeek() < 5"},
+		},
+	}
+
+	grants, err := ExplainPermissions(
+		"//cloudresourcemanager.googleapis.com/projects/p",
+		"user@example.com",
+		[]string{"compute.instances.delete", "compute.instances.get", "compute.instances.list"},
+		"",
+	)
+	if err != nil {
+		t.Fatalf("failed to explain permissions: %v", err)
+	}
+
+	want := map[string][]Grant{
+		"compute.instances.delete": {
+			{Resource: "folders/1", Role: "roles/compute.admin", Member: "group:admins@example.com"},
+			{
+				Resource:  "organizations/2",
+				Role:      "organizations/2/roles/deleter",
+				Member:    "domain:example.com",
+				Condition: "request.time.getDayOfWeek() < 5",
+			},
+		},
+		"compute.instances.get": {
+			{Resource: "projects/p", Role: "roles/viewer", Member: "user:user@example.com"},
+			{Resource: "folders/1", Role: "roles/compute.admin", Member: "group:admins@example.com"},
+		},
+		// The fake Cloud Identity API doesn't know the external group, so its
+		// membership can't be verified.
+		"compute.instances.list": {
+			{Resource: "projects/p", Role: "roles/viewer", Member: "user:user@example.com"},
+			{Resource: "folders/1", Role: "roles/editor", Member: "group:external@example.org", Unverified: true},
+		},
+	}
+	if !reflect.DeepEqual(grants, want) {
+		t.Errorf("unexpected grants:\n got: %+v\nwant: %+v", grants, want)
+	}
+}
+
+func TestExplainPermissionsBucket(t *testing.T) {
+	srv := clientstest.Start(t)
+	srv.BucketProjects["bucket"] = "123"
+	srv.Roles["roles/storage.admin"] = []string{"storage.buckets.get"}
+	srv.Policies["projects/123"] = []clients.PolicyBinding{
+		{Role: "roles/storage.admin", Members: []string{"serviceAccount:sa@p.iam.gserviceaccount.com"}},
+	}
+
+	e, err := newExplainer("sa@p.iam.gserviceaccount.com", clients.Options{})
+	if err != nil {
+		t.Fatalf("failed to create explainer: %v", err)
+	}
+	resType, resource, err := lookupResourceType("//storage.googleapis.com/projects/_/buckets/bucket")
+	if err != nil {
+		t.Fatalf("failed to look up resource type: %v", err)
+	}
+	grants := e.explain(e.hierarchyPolicies(resType, resource), []string{"storage.buckets.get"})
+
+	want := []Grant{
+		{Resource: "projects/123", Role: "roles/storage.admin", Member: "serviceAccount:sa@p.iam.gserviceaccount.com"},
+	}
+	if !reflect.DeepEqual(grants["storage.buckets.get"], want) {
+		t.Errorf("unexpected grants: %+v", grants)
+	}
+}
+
+func TestExplainPermissionsKeyRing(t *testing.T) {
+	srv := clientstest.Start(t)
+	srv.Roles["roles/cloudkms.cryptoKeyDecrypter"] = []string{"cloudkms.cryptoKeyVersions.useToDecrypt"}
+	srv.Roles["roles/cloudkms.admin"] = []string{"cloudkms.cryptoKeys.get"}
+	srv.Policies["projects/p/locations/global/keyRings/k"] = []clients.PolicyBinding{
+		{Role: "roles/cloudkms.cryptoKeyDecrypter", Members: []string{"user:user@example.com"}},
+	}
+	srv.Policies["projects/p"] = []clients.PolicyBinding{
+		{Role: "roles/cloudkms.admin", Members: []string{"user:user@example.com"}},
+	}
+
+	grants, err := ExplainPermissions(
+		"//cloudkms.googleapis.com/projects/p/locations/global/keyRings/k/cryptoKeys/c",
+		"user@example.com",
+		[]string{"cloudkms.cryptoKeyVersions.useToDecrypt", "cloudkms.cryptoKeys.get"},
+		"",
+	)
+	if err != nil {
+		t.Fatalf("failed to explain permissions: %v", err)
+	}
+
+	want := map[string][]Grant{
+		"cloudkms.cryptoKeyVersions.useToDecrypt": {{
+			Resource: "projects/p/locations/global/keyRings/k",
+			Role:     "roles/cloudkms.cryptoKeyDecrypter",
+			Member:   "user:user@example.com",
+		}},
+		"cloudkms.cryptoKeys.get": {
+			{Resource: "projects/p", Role: "roles/cloudkms.admin", Member: "user:user@example.com"},
+		},
+	}
+	if !reflect.DeepEqual(grants, want) {
+		t.Errorf("unexpected grants:\n got: %+v\nwant: %+v", grants, want)
+	}
+}
+
+func TestDatasetPolicyGetter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/projects/p/datasets/d" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		fmt.Fprint(w, `{"access": [
+			{"role": "OWNER", "specialGroup": "projectOwners"},
+			{"role": "READER", "groupByEmail": "readers@example.com"},
+			{"role": "roles/bigquery.dataEditor", "userByEmail": "user@example.com",
+			 "condition": {"expression": "request.time < timestamp('2030-01-01T00:00:00Z')"}},
+			{"view": {"projectId": "p", "datasetId": "other", "tableId": "v"}}
+		]}`)
+	}))
+	defer srv.Close()
+
+	bindings, err := datasetPolicyGetter(srv.URL+"/%s")(ctx, srv.Client(), "projects/p/datasets/d")
+	if err != nil {
+		t.Fatalf("failed to read the dataset policy: %v", err)
+	}
+	want := []clients.PolicyBinding{
+		{Role: "roles/bigquery.dataViewer", Members: []string{"group:readers@example.com"}},
+		{
+			Role:      "roles/bigquery.dataEditor",
+			Members:   []string{"user:user@example.com"},
+			Condition: &clients.PolicyCondition{Expression: "request.time < timestamp('2030-01-01T00:00:00Z')"},
+		},
+	}
+	if !reflect.DeepEqual(bindings, want) {
+		t.Errorf("unexpected bindings:\n got: %+v\nwant: %+v", bindings, want)
+	}
+}
+
+func TestMatchMember(t *testing.T) {
+	e := &explainer{principal: "User@Example.com", groups: map[string]bool{"member@example.com": true}}
+	tests := []struct {
+		members    []string
+		member     string
+		unverified bool
+		ok         bool
+	}{
+		{[]string{"user:user@example.com"}, "user:user@example.com", false, true},
+		{[]string{"serviceAccount:user@example.com"}, "serviceAccount:user@example.com", false, true},
+		{[]string{"allAuthenticatedUsers"}, "allAuthenticatedUsers", false, true},
+		{[]string{"domain:EXAMPLE.com"}, "domain:EXAMPLE.com", false, true},
+		{[]string{"domain:ample.com"}, "", false, false},
+		{[]string{"deleted:user:user@example.com?uid=1"}, "", false, false},
+		{[]string{"group:unknown@example.com", "group:member@example.com"}, "group:member@example.com", false, true},
+		{[]string{"group:unknown@example.com"}, "group:unknown@example.com", true, true},
+	}
+	for _, tt := range tests {
+		member, unverified, ok := e.matchMember(tt.members)
+		if member != tt.member || unverified != tt.unverified || ok != tt.ok {
+			t.Errorf("matchMember(%v) = %q, %v, %v; want %q, %v, %v",
+				tt.members, member, unverified, ok, tt.member, tt.unverified, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients"
+)
+
+// maxPermsPerRequest is the largest number of permissions that every
+// testIamPermissions method accepts in a single request.
+const maxPermsPerRequest = 100
+
+// tagBindingPerms can't be tested on resources that predate the Resource Manager tags API.
+var tagBindingPerms = []string{
+	"resourcemanager.resourceTagBindings.create",
+	"resourcemanager.resourceTagBindings.delete",
+	"resourcemanager.resourceTagBindings.list",
+}
+
+// permissionsTester calls a testIamPermissions method for the resource and returns
+// the permissions that are granted to the caller.
+type permissionsTester func(ctx context.Context, client *http.Client, resource string, perms []string) ([]string, error)
+
+// ResourceType describes how to test the permissions on a type of resource.
+type ResourceType struct {
+	// Name is the human readable name of the resource type.
+	Name string
+	// Service is the host of the service in the resource's full resource name.
+	Service string
+	// Pattern matches the resource name relative to the service.
+	Pattern *regexp.Regexp
+	// Example is an example full resource name.
+	Example string
+
+	test     permissionsTester
+	policy   policyGetter
+	excluded []string
+	// parent, if set, returns the name of the resource below the project that the
+	// resource inherits IAM policies from, e.g. the key ring of a key. The parent
+	// must be in resourceTypes or parentResourceTypes with the same service.
+	parent func(resource string) string
+}
+
+// resourceTypes is the registry of resource types that can be queried by their full
+// resource name. To support a new resource type, add an entry that maps its full
+// resource name to the API's testIamPermissions and getIamPolicy methods. The
+// policies of projects, folders and organizations are read by ExplainPermissions
+// when it walks the resource hierarchy, so they don't set a policy getter. Resource
+// types that inherit policies from another resource of their service set a parent.
+var resourceTypes = []ResourceType{
+	{
+		Name:    "BigQuery table",
+		Service: "bigquery.googleapis.com",
+		Pattern: regexp.MustCompile(`^projects/[^/]+/datasets/[^/]+/tables/[^/]+$`),
+		Example: "//bigquery.googleapis.com/projects/my-project/datasets/my_dataset/tables/my_table",
+		test:    postTester("https://bigquery.googleapis.com/bigquery/v2/%s:testIamPermissions"),
+		policy:  postPolicyGetter("https://bigquery.googleapis.com/bigquery/v2/%s:getIamPolicy", policyOptions),
+		parent:  parentResource,
+	},
+	{
+		Name:    "Compute Engine instance",
+		Service: "compute.googleapis.com",
+		Pattern: regexp.MustCompile(`^projects/[^/]+/zones/[^/]+/instances/[^/]+$`),
+		Example: "//compute.googleapis.com/projects/my-project/zones/us-central1-a/instances/my-instance",
+		test:    postTester("https://compute.googleapis.com/compute/v1/%s/testIamPermissions"),
+		policy: getPolicyGetter(
+			"https://compute.googleapis.com/compute/v1/%s/getIamPolicy?optionsRequestedPolicyVersion=3",
+		),
+		excluded: tagBindingPerms,
+	},
+	{
+		Name:    "Cloud KMS key ring",
+		Service: "cloudkms.googleapis.com",
+		Pattern: regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+$`),
+		Example: "//cloudkms.googleapis.com/projects/my-project/locations/global/keyRings/my-keyring",
+		test:    postTester("https://cloudkms.googleapis.com/v1/%s:testIamPermissions"),
+		policy:  getPolicyGetter("https://cloudkms.googleapis.com/v1/%s:getIamPolicy?options.requestedPolicyVersion=3"),
+	},
+	{
+		Name:    "Cloud KMS key",
+		Service: "cloudkms.googleapis.com",
+		Pattern: regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`),
+		Example: "//cloudkms.googleapis.com/projects/my-project/locations/global/keyRings/my-keyring/cryptoKeys/my-key",
+		test:    postTester("https://cloudkms.googleapis.com/v1/%s:testIamPermissions"),
+		policy:  getPolicyGetter("https://cloudkms.googleapis.com/v1/%s:getIamPolicy?options.requestedPolicyVersion=3"),
+		parent:  parentResource,
+	},
+	{
+		Name:    "Folder",
+		Service: "cloudresourcemanager.googleapis.com",
+		Pattern: regexp.MustCompile(`^folders/[0-9]+$`),
+		Example: "//cloudresourcemanager.googleapis.com/folders/123456789012",
+		test:    postTester("https://cloudresourcemanager.googleapis.com/v2/%s:testIamPermissions"),
+	},
+	{
+		Name:    "Organization",
+		Service: "cloudresourcemanager.googleapis.com",
+		Pattern: regexp.MustCompile(`^organizations/[0-9]+$`),
+		Example: "//cloudresourcemanager.googleapis.com/organizations/123456789012",
+		test:    postTester("https://cloudresourcemanager.googleapis.com/v3/%s:testIamPermissions"),
+	},
+	{
+		Name:    "Project",
+		Service: "cloudresourcemanager.googleapis.com",
+		Pattern: regexp.MustCompile(`^projects/[^/]+$`),
+		Example: "//cloudresourcemanager.googleapis.com/projects/my-project",
+		test:    postTester("https://cloudresourcemanager.googleapis.com/v1/%s:testIamPermissions"),
+	},
+	{
+		Name:    "Service account",
+		Service: "iam.googleapis.com",
+		Pattern: regexp.MustCompile(`^projects/[^/]+/serviceAccounts/[^/]+$`),
+		Example: "//iam.googleapis.com/projects/my-project/serviceAccounts/example@my-project.iam.gserviceaccount.com",
+		test:    postTester("https://iam.googleapis.com/v1/%s:testIamPermissions"),
+		policy:  postPolicyGetter("https://iam.googleapis.com/v1/%s:getIamPolicy?options.requestedPolicyVersion=3", nil),
+	},
+	{
+		Name:    "Pub/Sub topic",
+		Service: "pubsub.googleapis.com",
+		Pattern: regexp.MustCompile(`^projects/[^/]+/topics/[^/]+$`),
+		Example: "//pubsub.googleapis.com/projects/my-project/topics/my-topic",
+		test:    postTester("https://pubsub.googleapis.com/v1/%s:testIamPermissions"),
+		policy:  getPolicyGetter("https://pubsub.googleapis.com/v1/%s:getIamPolicy?options.requestedPolicyVersion=3"),
+	},
+	{
+		Name:    "Pub/Sub subscription",
+		Service: "pubsub.googleapis.com",
+		Pattern: regexp.MustCompile(`^projects/[^/]+/subscriptions/[^/]+$`),
+		Example: "//pubsub.googleapis.com/projects/my-project/subscriptions/my-subscription",
+		test:    postTester("https://pubsub.googleapis.com/v1/%s:testIamPermissions"),
+		policy:  getPolicyGetter("https://pubsub.googleapis.com/v1/%s:getIamPolicy?options.requestedPolicyVersion=3"),
+	},
+	{
+		Name:    "Cloud Run service",
+		Service: "run.googleapis.com",
+		Pattern: regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/services/[^/]+$`),
+		Example: "//run.googleapis.com/projects/my-project/locations/us-central1/services/my-service",
+		test:    postTester("https://run.googleapis.com/v1/%s:testIamPermissions"),
+		policy:  getPolicyGetter("https://run.googleapis.com/v1/%s:getIamPolicy?options.requestedPolicyVersion=3"),
+	},
+	{
+		Name:    "Secret Manager secret",
+		Service: "secretmanager.googleapis.com",
+		Pattern: regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+$`),
+		Example: "//secretmanager.googleapis.com/projects/my-project/secrets/my-secret",
+		test:    postTester("https://secretmanager.googleapis.com/v1/%s:testIamPermissions"),
+		policy:  getPolicyGetter("https://secretmanager.googleapis.com/v1/%s:getIamPolicy?options.requestedPolicyVersion=3"),
+	},
+	{
+		Name:    "Spanner instance",
+		Service: "spanner.googleapis.com",
+		Pattern: regexp.MustCompile(`^projects/[^/]+/instances/[^/]+$`),
+		Example: "//spanner.googleapis.com/projects/my-project/instances/my-instance",
+		test:    postTester("https://spanner.googleapis.com/v1/%s:testIamPermissions"),
+		policy:  postPolicyGetter("https://spanner.googleapis.com/v1/%s:getIamPolicy", policyOptions),
+	},
+	{
+		Name:    "Spanner database",
+		Service: "spanner.googleapis.com",
+		Pattern: regexp.MustCompile(`^projects/[^/]+/instances/[^/]+/databases/[^/]+$`),
+		Example: "//spanner.googleapis.com/projects/my-project/instances/my-instance/databases/my-database",
+		test:    postTester("https://spanner.googleapis.com/v1/%s:testIamPermissions"),
+		policy:  postPolicyGetter("https://spanner.googleapis.com/v1/%s:getIamPolicy", policyOptions),
+		parent:  parentResource,
+	},
+	{
+		Name:     "Storage bucket",
+		Service:  "storage.googleapis.com",
+		Pattern:  regexp.MustCompile(`^projects/_/buckets/[^/]+$`),
+		Example:  "//storage.googleapis.com/projects/_/buckets/my-bucket",
+		test:     storageTester("https://storage.googleapis.com/storage/v1/b/%s/iam/testPermissions"),
+		policy:   storagePolicyGetter("https://storage.googleapis.com/storage/v1/b/%s/iam?optionsRequestedPolicyVersion=3"),
+		excluded: tagBindingPerms,
+	},
+}
+
+// parentResourceTypes are the resource types that resources in resourceTypes inherit
+// IAM policies from but whose permissions can't be tested.
+var parentResourceTypes = []ResourceType{
+	{
+		Name:    "BigQuery dataset",
+		Service: "bigquery.googleapis.com",
+		Pattern: regexp.MustCompile(`^projects/[^/]+/datasets/[^/]+$`),
+		Example: "//bigquery.googleapis.com/projects/my-project/datasets/my_dataset",
+		policy:  datasetPolicyGetter("https://bigquery.googleapis.com/bigquery/v2/%s?accessPolicyVersion=3"),
+	},
+}
+
+// parentResource returns the resource that contains the resource by removing the
+// last collection and ID from its name, e.g. the key ring of a key.
+func parentResource(resource string) string {
+	parts := strings.Split(resource, "/")
+	return strings.Join(parts[:len(parts)-2], "/")
+}
+
+// lookupParentType finds the resource type of a parent that a resource of the
+// service inherits IAM policies from.
+func lookupParentType(service, resource string) (*ResourceType, error) {
+	for _, types := range [][]ResourceType{resourceTypes, parentResourceTypes} {
+		for i := range types {
+			if types[i].Service == service && types[i].Pattern.MatchString(resource) {
+				return &types[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("//%s/%s is not a supported parent resource", service, resource)
+}
+
+// SupportedResourceTypes returns the resource types that can be queried with
+// QueryResourcePermissions.
+func SupportedResourceTypes() []ResourceType {
+	return resourceTypes
+}
+
+// lookupResourceType finds the registered resource type for a full resource name
+// and returns it along with the resource name relative to the service.
+func lookupResourceType(fullResourceName string) (*ResourceType, string, error) {
+	name := strings.TrimPrefix(fullResourceName, "//")
+	parts := strings.SplitN(name, "/", 2)
+	if !strings.HasPrefix(fullResourceName, "//") || len(parts) != 2 {
+		return nil, "", fmt.Errorf("%s is not a full resource name, e.g. %s", fullResourceName, resourceTypes[0].Example)
+	}
+	service, resource := parts[0], parts[1]
+	for i := range resourceTypes {
+		if resourceTypes[i].Service == service && resourceTypes[i].Pattern.MatchString(resource) {
+			return &resourceTypes[i], resource, nil
+		}
+	}
+	return nil, "", fmt.Errorf("querying the permissions on %s is not supported", fullResourceName)
+}
+
+// FilterTestablePermissions removes the permissions that are returned by
+// QueryTestablePermissionsOnResource but are rejected by the resource's
+// testIamPermissions method.
+func FilterTestablePermissions(fullResourceName string, perms []string) []string {
+	resType, _, err := lookupResourceType(fullResourceName)
+	if err != nil {
+		return perms
+	}
+	return remove(perms, resType.excluded)
+}
+
+// QueryResourcePermissions gets the authenticated members permissions on the resource
+// identified by its full resource name. See resourceTypes for the supported types.
+func QueryResourcePermissions(
+	ctx context.Context,
+	permsToTest []string,
+	fullResourceName, svcAcct, reason string,
+) ([]string, error) {
+	resType, resource, err := lookupResourceType(fullResourceName)
+	if err != nil {
+		return []string{}, errorsutil.New("Invalid resource name", err)
+	}
+
+	opts := clients.Options{}
+	if svcAcct != "" {
+		opts = clients.Options{ServiceAccount: svcAcct, Reason: reason}
+	}
+	client, err := clients.Default().HTTP(ctx, opts)
+	if err != nil {
+		return []string{}, errorsutil.NewSDKError(resType.Name, svcAcct, err)
+	}
+
+	util.Logger.Debugf("Testing permissions on %s as a %s", fullResourceName, resType.Name)
+	return testPermissions(ctx, client, resType, resource, permsToTest)
+}
+
+func testPermissions(
+	ctx context.Context,
+	client *http.Client,
+	resType *ResourceType,
+	resource string,
+	permsToTest []string,
+) ([]string, error) {
+	permsToTest = remove(permsToTest, resType.excluded)
+
+	granted, err := testInChunks(ctx, permsToTest, func(ctx context.Context, perms []string) ([]string, error) {
+		return resType.test(ctx, client, resource, perms)
+	})
+	if err != nil {
+		return []string{}, errorsutil.New(fmt.Sprintf("Failed to query permissions on %s", resource), err)
+	}
+	return granted, nil
+}
+
+// testInChunks splits the permissions into chunks of maxPermsPerRequest and tests
+// them concurrently with test on a bounded number of workers. Rate limited requests
+// are retried, and the remaining requests are cancelled if a chunk fails. The
+// granted permissions are returned in the order of permsToTest.
+func testInChunks(
+	ctx context.Context,
+	permsToTest []string,
+	test func(ctx context.Context, perms []string) ([]string, error),
+) ([]string, error) {
+	var chunks [][]string
+	for start := 0; start < len(permsToTest); start += maxPermsPerRequest {
+		end := start + maxPermsPerRequest
+		if end > len(permsToTest) {
+			end = len(permsToTest)
+		}
+		chunks = append(chunks, permsToTest[start:end])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([][]string, len(chunks))
+	errs := util.RunWorkers(ctx, len(chunks), util.MaxWorkers, func(ctx context.Context, i int) error {
+		err := util.RetryOnRateLimit(ctx, func() (err error) {
+			results[i], err = test(ctx, chunks[i])
+			return err
+		})
+		if err != nil {
+			cancel()
+		}
+		return err
+	})
+	for _, err := range errs {
+		// Return the error that caused the cancellation rather than context.Canceled.
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return []string{}, err
+		}
+	}
+	if err := util.CollectErrors(errs); err != nil {
+		return []string{}, err
+	}
+
+	granted := []string{}
+	for _, perms := range results {
+		granted = append(granted, perms...)
+	}
+	return granted, nil
+}
+
+type testPermissionsResponse struct {
+	Permissions []string `json:"permissions"`
+}
+
+// postTester tests permissions with a POST request containing the permissions in a
+// JSON body. This is the form used by most Google Cloud APIs. urlTemplate is
+// formatted with the resource name relative to the service.
+func postTester(urlTemplate string) permissionsTester {
+	return func(ctx context.Context, client *http.Client, resource string, perms []string) ([]string, error) {
+		body, err := json.Marshal(map[string][]string{"permissions": perms})
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(
+			ctx, http.MethodPost, fmt.Sprintf(urlTemplate, resource), bytes.NewReader(body),
+		)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return doTestPermissions(client, req)
+	}
+}
+
+// storageTester tests permissions with the Cloud Storage JSON API, which takes the
+// bucket name and passes the permissions as query parameters.
+func storageTester(urlTemplate string) permissionsTester {
+	return func(ctx context.Context, client *http.Client, resource string, perms []string) ([]string, error) {
+		bucket := resource[strings.LastIndex(resource, "/")+1:]
+		query := url.Values{"permissions": perms}
+		reqURL := fmt.Sprintf(urlTemplate, url.PathEscape(bucket)) + "?" + query.Encode()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		return doTestPermissions(client, req)
+	}
+}
+
+func doTestPermissions(client *http.Client, req *http.Request) ([]string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	var result testPermissionsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Permissions, nil
+}
@@ -0,0 +1,258 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+func init() {
+	util.Logger = logrus.New()
+}
+
+func TestLookupResourceType(t *testing.T) {
+	testCases := []struct {
+		name     string
+		resType  string
+		resource string
+	}{
+		{"//cloudresourcemanager.googleapis.com/projects/my-project", "Project", "projects/my-project"},
+		{"//cloudresourcemanager.googleapis.com/folders/1234", "Folder", "folders/1234"},
+		{"//secretmanager.googleapis.com/projects/p/secrets/s", "Secret Manager secret", "projects/p/secrets/s"},
+		{
+			"//cloudkms.googleapis.com/projects/p/locations/global/keyRings/r/cryptoKeys/k",
+			"Cloud KMS key",
+			"projects/p/locations/global/keyRings/r/cryptoKeys/k",
+		},
+		{"//spanner.googleapis.com/projects/p/instances/i", "Spanner instance", "projects/p/instances/i"},
+		{"//storage.googleapis.com/projects/_/buckets/b", "Storage bucket", "projects/_/buckets/b"},
+	}
+	for _, tc := range testCases {
+		resType, resource, err := lookupResourceType(tc.name)
+		if err != nil {
+			t.Errorf("failed to look up %s: %v", tc.name, err)
+			continue
+		}
+		if resType.Name != tc.resType || resource != tc.resource {
+			t.Errorf("unexpected resource type for %s: got (%s, %s), want (%s, %s)",
+				tc.name, resType.Name, resource, tc.resType, tc.resource)
+		}
+	}
+
+	for _, name := range []string{
+		"projects/my-project",
+		"//cloudresourcemanager.googleapis.com/projects/my-project/extra",
+		"//unknown.googleapis.com/projects/my-project",
+	} {
+		if _, _, err := lookupResourceType(name); err == nil {
+			t.Errorf("expected %s to be rejected", name)
+		}
+	}
+}
+
+func TestResourceTypeExamples(t *testing.T) {
+	for _, resType := range SupportedResourceTypes() {
+		got, _, err := lookupResourceType(resType.Example)
+		if err != nil || got.Name != resType.Name {
+			t.Errorf("example for %s does not match its own pattern: %v", resType.Name, err)
+		}
+	}
+}
+
+func TestTestPermissionsChunksRequests(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests [][]string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/projects/p/secrets/s:testIamPermissions" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		var req testPermissionsResponse
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		mu.Lock()
+		requests = append(requests, req.Permissions)
+		mu.Unlock()
+		// Grant the first permission in each request.
+		json.NewEncoder(w).Encode(testPermissionsResponse{Permissions: req.Permissions[:1]})
+	}))
+	defer srv.Close()
+
+	perms := make([]string, 250)
+	for i := range perms {
+		perms[i] = fmt.Sprintf("secretmanager.perm%03d", i)
+	}
+	perms[0] = "resourcemanager.resourceTagBindings.list"
+	resType := &ResourceType{
+		Name:     "test",
+		test:     postTester(srv.URL + "/%s:testIamPermissions"),
+		excluded: tagBindingPerms,
+	}
+
+	granted, err := testPermissions(ctx, srv.Client(), resType, "projects/p/secrets/s", perms)
+	if err != nil {
+		t.Fatalf("failed to test permissions: %v", err)
+	}
+	// The chunks are tested concurrently, so the requests can arrive in any order.
+	sizes := make([]int, len(requests))
+	for i, req := range requests {
+		sizes[i] = len(req)
+	}
+	sort.Ints(sizes)
+	if fmt.Sprint(sizes) != "[49 100 100]" {
+		t.Errorf("expected permissions to be tested in chunks of 100, got requests of sizes %v", sizes)
+	}
+	want := "secretmanager.perm001,secretmanager.perm101,secretmanager.perm201"
+	if got := strings.Join(granted, ","); got != want {
+		t.Errorf("unexpected granted permissions: got %s, want %s", got, want)
+	}
+	if perms[0] != "resourcemanager.resourceTagBindings.list" {
+		t.Error("expected the caller's permission list to be left intact")
+	}
+}
+
+func TestStorageTester(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/b/my-bucket/iam/testPermissions" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		json.NewEncoder(w).Encode(testPermissionsResponse{Permissions: r.URL.Query()["permissions"]})
+	}))
+	defer srv.Close()
+
+	test := storageTester(srv.URL + "/b/%s/iam/testPermissions")
+	perms := []string{"storage.buckets.get", "storage.objects.list"}
+	granted, err := test(ctx, srv.Client(), "projects/_/buckets/my-bucket", perms)
+	if err != nil {
+		t.Fatalf("failed to test permissions: %v", err)
+	}
+	if len(granted) != 2 {
+		t.Errorf("unexpected granted permissions: %v", granted)
+	}
+}
+
+func TestTestPermissionsAPIError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"code": 403, "message": "denied"}}`, http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	resType := &ResourceType{Name: "test", test: postTester(srv.URL + "/%s:testIamPermissions")}
+	if _, err := testPermissions(ctx, srv.Client(), resType, "projects/p", []string{"a.b.c"}); err == nil {
+		t.Error("expected an error when the API denies the request")
+	}
+}
+
+func TestFilterTestablePermissions(t *testing.T) {
+	perms := []string{"storage.buckets.get", "resourcemanager.resourceTagBindings.create"}
+	got := FilterTestablePermissions("//storage.googleapis.com/projects/_/buckets/b", perms)
+	if len(got) != 1 || got[0] != "storage.buckets.get" {
+		t.Errorf("expected tag binding permissions to be removed, got %v", got)
+	}
+	if got := FilterTestablePermissions("//pubsub.googleapis.com/projects/p/topics/t", perms); len(got) != 2 {
+		t.Errorf("expected permissions to be left as is, got %v", got)
+	}
+}
+
+func TestTestInChunks(t *testing.T) {
+	perms := make([]string, 1000)
+	for i := range perms {
+		perms[i] = fmt.Sprintf("compute.perm%04d", i)
+	}
+
+	var (
+		mu          sync.Mutex
+		rateLimited bool
+	)
+	granted, err := testInChunks(context.Background(), perms, func(ctx context.Context, chunk []string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if chunk[0] == "compute.perm0500" && !rateLimited {
+			rateLimited = true
+			return nil, &googleapi.Error{Code: http.StatusTooManyRequests}
+		}
+		return chunk[len(chunk)-1:], nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !rateLimited {
+		t.Error("expected a chunk to be rate limited")
+	}
+	if len(granted) != 10 {
+		t.Fatalf("expected 10 granted permissions, got %d", len(granted))
+	}
+	for i, perm := range granted {
+		if want := fmt.Sprintf("compute.perm%04d", i*100+99); perm != want {
+			t.Errorf("expected granted permissions in order: got %s at %d, want %s", perm, i, want)
+		}
+	}
+}
+
+func TestTestInChunksError(t *testing.T) {
+	perms := make([]string, 2000)
+	for i := range perms {
+		perms[i] = fmt.Sprintf("compute.perm%04d", i)
+	}
+
+	failed := errors.New("permission denied")
+	var calls int32
+	done := make(chan error)
+	go func() {
+		_, err := testInChunks(context.Background(), perms, func(ctx context.Context, chunk []string) ([]string, error) {
+			atomic.AddInt32(&calls, 1)
+			if chunk[0] == "compute.perm0000" {
+				return nil, failed
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(10 * time.Millisecond):
+				return chunk[:1], nil
+			}
+		})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, failed) {
+			t.Errorf("expected the chunk's error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("testInChunks did not return after a chunk failed")
+	}
+	if n := atomic.LoadInt32(&calls); n == 20 {
+		t.Error("expected the remaining chunks to be cancelled")
+	}
+}
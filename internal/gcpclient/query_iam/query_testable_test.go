@@ -0,0 +1,98 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients/clientstest"
+)
+
+func TestQueryTestablePermissionsOnResource(t *testing.T) {
+	srv := clientstest.Start(t)
+	resource := "//pubsub.googleapis.com/projects/p/topics/t"
+	srv.TestablePermissions[resource] = []string{"pubsub.topics.get", "pubsub.topics.publish", "pubsub.topics.update"}
+
+	perms, err := QueryTestablePermissionsOnResource(ctx, resource)
+	if err != nil {
+		t.Fatalf("failed to query testable permissions: %v", err)
+	}
+	if len(perms) != 3 {
+		t.Errorf("expected every page of testable permissions, got %v", perms)
+	}
+
+	if _, err := QueryTestablePermissionsOnResource(ctx, "//pubsub.googleapis.com/projects/p/topics/unknown"); err == nil {
+		t.Error("expected an error for an unknown resource")
+	}
+}
+
+func TestQueryResourcePermissionsChunks(t *testing.T) {
+	srv := clientstest.Start(t)
+	perms := make([]string, 250)
+	for i := range perms {
+		perms[i] = fmt.Sprintf("compute.perm%03d", i)
+	}
+	srv.Granted["projects/p"] = []string{"compute.perm000", "compute.perm150", "compute.perm249"}
+
+	granted, err := QueryResourcePermissions(ctx, perms, "//cloudresourcemanager.googleapis.com/projects/p", "", "")
+	if err != nil {
+		t.Fatalf("failed to query project permissions: %v", err)
+	}
+	if got := strings.Join(granted, ","); got != "compute.perm000,compute.perm150,compute.perm249" {
+		t.Errorf("unexpected granted permissions: %s", got)
+	}
+	if n := len(srv.Requests()); n != 3 {
+		t.Errorf("expected the permissions to be tested in 3 requests, got %d", n)
+	}
+}
+
+func TestQueryPermissions(t *testing.T) {
+	srv := clientstest.Start(t)
+	srv.Granted["projects/p/zones/z/instances/i"] = []string{"compute.instances.get"}
+	srv.Granted["projects/p/topics/t"] = []string{"pubsub.topics.publish"}
+	srv.Granted["projects/p/serviceAccounts/sa@p.iam.gserviceaccount.com"] = []string{"iam.serviceAccounts.actAs"}
+	srv.Granted["b/bucket"] = []string{"storage.objects.get", "resourcemanager.resourceTagBindings.list"}
+	perms := []string{
+		"compute.instances.get",
+		"iam.serviceAccounts.actAs",
+		"pubsub.topics.publish",
+		"resourcemanager.resourceTagBindings.list",
+		"storage.objects.get",
+	}
+
+	// Each resource type is tested with its own API, and the tag binding permissions
+	// are not tested on buckets.
+	testCases := []struct {
+		resource string
+		want     string
+	}{
+		{"//compute.googleapis.com/projects/p/zones/z/instances/i", "compute.instances.get"},
+		{"//pubsub.googleapis.com/projects/p/topics/t", "pubsub.topics.publish"},
+		{"//iam.googleapis.com/projects/p/serviceAccounts/sa@p.iam.gserviceaccount.com", "iam.serviceAccounts.actAs"},
+		{"//storage.googleapis.com/projects/_/buckets/bucket", "storage.objects.get"},
+	}
+	for _, tc := range testCases {
+		granted, err := QueryResourcePermissions(ctx, perms, tc.resource, "", "")
+		if err != nil {
+			t.Errorf("%s: failed to query permissions: %v", tc.resource, err)
+			continue
+		}
+		if got := strings.Join(granted, ","); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.resource, got, tc.want)
+		}
+	}
+}
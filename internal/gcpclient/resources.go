@@ -0,0 +1,88 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"sort"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients"
+)
+
+// ListZones gets the names of the Compute Engine zones available to the project,
+// sorted by name.
+func ListZones(project string) ([]string, error) {
+	return listCompute(project, "zones", func(c clients.ComputeClient) ([]string, error) {
+		return c.ListZones(ctx, project)
+	})
+}
+
+// ListRegions gets the names of the Compute Engine regions available to the project,
+// sorted by name.
+func ListRegions(project string) ([]string, error) {
+	return listCompute(project, "regions", func(c clients.ComputeClient) ([]string, error) {
+		return c.ListRegions(ctx, project)
+	})
+}
+
+// ListInstances gets the names of the Compute Engine instances in the zone, or in
+// every zone of the project if zone is empty, sorted by name.
+func ListInstances(project, zone string) ([]string, error) {
+	return listCompute(project, "instances", func(c clients.ComputeClient) ([]string, error) {
+		return c.ListInstances(ctx, project, zone)
+	})
+}
+
+func listCompute(project, resource string, list func(clients.ComputeClient) ([]string, error)) ([]string, error) {
+	computeClient, err := clients.Default().Compute(ctx, clients.Options{})
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Compute", "", err)
+	}
+	names, err := list(computeClient)
+	if err != nil {
+		return nil, errorsutil.New("Failed to list the "+resource+" in "+project, err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ListTopics gets the IDs of the Pub/Sub topics in the project, sorted by ID.
+func ListTopics(project string) ([]string, error) {
+	pubsubClient, err := clients.Default().PubSub(ctx, clients.Options{})
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Pub/Sub", "", err)
+	}
+	topics, err := pubsubClient.ListTopics(ctx, project)
+	if err != nil {
+		return nil, errorsutil.New("Failed to list the topics in "+project, err)
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// ListBuckets gets the names of the Cloud Storage buckets in the project, sorted by
+// name.
+func ListBuckets(project string) ([]string, error) {
+	storageClient, err := clients.Default().Storage(ctx, clients.Options{})
+	if err != nil {
+		return nil, errorsutil.NewSDKError("Storage", "", err)
+	}
+	buckets, err := storageClient.ListBuckets(ctx, project)
+	if err != nil {
+		return nil, errorsutil.New("Failed to list the buckets in "+project, err)
+	}
+	sort.Strings(buckets)
+	return buckets, nil
+}
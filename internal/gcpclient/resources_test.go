@@ -0,0 +1,60 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpclient
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients/clientstest"
+)
+
+func TestListResources(t *testing.T) {
+	srv := clientstest.Start(t)
+	srv.Zones["p"] = []string{"us-central1-b", "us-central1-a", "europe-west1-b"}
+	srv.Instances["projects/p/zones/us-central1-a"] = []string{"vm-b", "vm-a"}
+	srv.Instances["projects/p/zones/europe-west1-b"] = []string{"vm-c"}
+	srv.Topics["p"] = []string{"topic-b", "topic-a"}
+	srv.Buckets["p"] = []string{"bucket-b", "bucket-a"}
+
+	tests := []struct {
+		name string
+		list func() ([]string, error)
+		want []string
+	}{
+		{"zones", func() ([]string, error) { return ListZones("p") },
+			[]string{"europe-west1-b", "us-central1-a", "us-central1-b"}},
+		{"regions", func() ([]string, error) { return ListRegions("p") },
+			[]string{"europe-west1", "us-central1"}},
+		{"instances", func() ([]string, error) { return ListInstances("p", "us-central1-a") },
+			[]string{"vm-a", "vm-b"}},
+		{"all instances", func() ([]string, error) { return ListInstances("p", "") },
+			[]string{"vm-a", "vm-b", "vm-c"}},
+		{"topics", func() ([]string, error) { return ListTopics("p") },
+			[]string{"topic-a", "topic-b"}},
+		{"buckets", func() ([]string, error) { return ListBuckets("p") },
+			[]string{"bucket-a", "bucket-b"}},
+	}
+	for _, tt := range tests {
+		got, err := tt.list()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
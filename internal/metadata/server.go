@@ -0,0 +1,345 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metadata emulates the parts of the Compute Engine metadata server that
+// Google Cloud client libraries use to find their credentials, so that programs can
+// run as an impersonated service account without being modified.
+package metadata
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+const (
+	// HostEnv is the environment variable that client libraries read the address of
+	// the metadata server from.
+	HostEnv = "GCE_METADATA_HOST"
+	// IPEnv is the environment variable that some client libraries use instead of
+	// HostEnv to check whether the metadata server is reachable.
+	IPEnv = "GCE_METADATA_IP"
+
+	flavorHeader = "Metadata-Flavor"
+	flavor       = "Google"
+	pathPrefix   = "/computeMetadata/v1/"
+	accountsPath = pathPrefix + "instance/service-accounts/"
+	// tokenPath is the OAuth token endpoint that the credentials file returned by
+	// CredentialsJSON refreshes its access tokens from.
+	tokenPath = "/token"
+
+	// A cached access token is refreshed once it has less than refreshWindow left so
+	// that clients, which refresh shortly before expiry, never receive a token that
+	// they consider expired.
+	refreshWindow = 5 * time.Minute
+)
+
+// scopes are the OAuth scopes of the access tokens that are served.
+var scopes = []string{
+	"https://www.googleapis.com/auth/cloud-platform",
+	"https://www.googleapis.com/auth/userinfo.email",
+}
+
+// TokenSource returns a new access token and the time that it expires.
+type TokenSource func() (token string, expiry time.Time, err error)
+
+// IDTokenSource returns a new ID token for the given audience.
+type IDTokenSource func(audience string, includeEmail bool) (string, error)
+
+// Options configures a Server.
+type Options struct {
+	// ServiceAccount is the email of the service account that tokens are served for.
+	ServiceAccount string
+	// Project is the project ID that is served.
+	Project string
+	// Token generates the access tokens for ServiceAccount.
+	Token TokenSource
+	// IDToken generates the ID tokens for ServiceAccount.
+	IDToken IDTokenSource
+	// SessionLimit is how long the server serves tokens for after it starts. There
+	// is no limit if it is zero.
+	SessionLimit time.Duration
+}
+
+// Server serves the computeMetadata/v1 endpoints for a single service account.
+type Server struct {
+	opts Options
+	srv  *http.Server
+	// secret is a random path prefix that every request must start with, so that only
+	// the processes that were given the host returned by Start can get tokens.
+	secret string
+	// done is closed when the session limit is reached.
+	done chan struct{}
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+	now    func() time.Time
+}
+
+// New returns a Server that serves tokens for the service account in opts.
+func New(opts Options) *Server {
+	return &Server{opts: opts, done: make(chan struct{}), now: time.Now}
+}
+
+// Start fetches the first access token, to fail early if the service account can't
+// be impersonated, and then serves the metadata endpoints on addr in the background.
+// It returns the host that clients must use, which is the address that the server is
+// listening on followed by the secret path prefix, e.g. 127.0.0.1:8085/3f2a...
+func (s *Server) Start(addr string) (string, error) {
+	if _, _, err := s.accessToken(); err != nil {
+		return "", err
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	s.secret = hex.EncodeToString(secret)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	s.srv = &http.Server{Handler: s}
+	if s.opts.SessionLimit > 0 {
+		time.AfterFunc(s.opts.SessionLimit, func() { close(s.done) })
+	}
+	go func() {
+		if err := s.srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			util.Logger.WithError(err).Error("The metadata server stopped unexpectedly")
+		}
+	}()
+	return ln.Addr().String() + "/" + s.secret, nil
+}
+
+// Done returns a channel that is closed when the session limit is reached. The
+// server stops serving tokens then.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// ended reports whether the session limit has been reached.
+func (s *Server) ended() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops the server once the requests that are being served are finished.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Shutdown(ctx)
+}
+
+// accessToken returns the cached access token, refreshing it first if it is about
+// to expire.
+func (s *Server) accessToken() (string, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && s.expiry.Sub(s.now()) > refreshWindow {
+		return s.token, s.expiry, nil
+	}
+	token, expiry, err := s.opts.Token()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if s.token != "" {
+		util.Logger.Infof("Refreshed the access token for %s", s.opts.ServiceAccount)
+	}
+	s.token, s.expiry = token, expiry
+	return s.token, s.expiry, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(flavorHeader, flavor)
+	util.Logger.Debugf("Metadata server request: %s %s", r.Method, r.URL)
+
+	// Like the real metadata server, refuse requests that were sent through a proxy or
+	// that don't ask for the metadata explicitly, so that a web page can't trick a
+	// browser into reading the tokens.
+	path, ok := s.trimSecret(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("X-Forwarded-For") != "" {
+		http.Error(w, "Requests through a proxy are not allowed.", http.StatusForbidden)
+		return
+	}
+	if path == tokenPath {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveToken(w)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if path == "/" {
+		// Client libraries request the root path to detect the metadata server.
+		writeText(w, "computeMetadata/\n")
+		return
+	}
+	if r.Header.Get(flavorHeader) != flavor {
+		http.Error(w, "Missing Metadata-Flavor:Google header.", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case path == pathPrefix+"project/project-id" && s.opts.Project != "":
+		writeText(w, s.opts.Project)
+	case path == accountsPath:
+		writeText(w, fmt.Sprintf("default/\n%s/\n", s.opts.ServiceAccount))
+	case strings.HasPrefix(path, accountsPath):
+		s.serveServiceAccount(w, r, strings.TrimPrefix(path, accountsPath))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// CredentialsJSON returns an application default credentials file for the server at
+// host, which is the value that Start returns. Client libraries that read it refresh
+// their access tokens from the server as if it were an OAuth token endpoint, so the
+// file contains no credentials other than the server's secret.
+func CredentialsJSON(host string) ([]byte, error) {
+	return json.MarshalIndent(map[string]string{
+		"type":          "authorized_user",
+		"client_id":     "ephemeral-iam",
+		"client_secret": "ephemeral-iam",
+		"refresh_token": "ephemeral-iam",
+		"token_uri":     "http://" + host + tokenPath,
+	}, "", "  ")
+}
+
+// trimSecret removes the secret prefix from path. It returns false if path doesn't
+// start with the secret.
+func (s *Server) trimSecret(path string) (string, bool) {
+	prefix := "/" + s.secret
+	if s.secret == "" || len(path) < len(prefix) ||
+		subtle.ConstantTimeCompare([]byte(path[:len(prefix)]), []byte(prefix)) != 1 {
+		return "", false
+	}
+	path = path[len(prefix):]
+	if path == "" {
+		return "/", true
+	}
+	if path[0] != '/' {
+		return "", false
+	}
+	return path, true
+}
+
+// serveServiceAccount serves the instance/service-accounts/{account}/ endpoints.
+func (s *Server) serveServiceAccount(w http.ResponseWriter, r *http.Request, path string) {
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || (parts[0] != "default" && parts[0] != s.opts.ServiceAccount) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch parts[1] {
+	case "":
+		if r.URL.Query().Get("recursive") != "true" {
+			writeText(w, "aliases\nemail\nidentity\nscopes\ntoken\n")
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"aliases": []string{"default"},
+			"email":   s.opts.ServiceAccount,
+			"scopes":  scopes,
+		})
+	case "aliases":
+		writeText(w, "default\n")
+	case "email":
+		writeText(w, s.opts.ServiceAccount)
+	case "scopes":
+		writeText(w, strings.Join(scopes, "\n")+"\n")
+	case "token":
+		s.serveToken(w)
+	case "identity":
+		s.serveIdentity(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveToken(w http.ResponseWriter) {
+	if s.ended() {
+		http.Error(w, "The eiam session has ended.", http.StatusForbidden)
+		return
+	}
+	token, expiry, err := s.accessToken()
+	if err != nil {
+		util.Logger.WithError(err).Errorf("Failed to generate an access token for %s", s.opts.ServiceAccount)
+		http.Error(w, "Failed to generate an access token.", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"access_token": token,
+		"expires_in":   int(expiry.Sub(s.now()).Seconds()),
+		"token_type":   "Bearer",
+	})
+}
+
+func (s *Server) serveIdentity(w http.ResponseWriter, r *http.Request) {
+	if s.ended() {
+		http.Error(w, "The eiam session has ended.", http.StatusForbidden)
+		return
+	}
+	audience := r.URL.Query().Get("audience")
+	if audience == "" {
+		http.Error(w, "The audience parameter is required.", http.StatusBadRequest)
+		return
+	}
+	token, err := s.opts.IDToken(audience, r.URL.Query().Get("format") == "full")
+	if err != nil {
+		util.Logger.WithError(err).Errorf("Failed to generate an ID token for %s", s.opts.ServiceAccount)
+		http.Error(w, "Failed to generate an ID token.", http.StatusInternalServerError)
+		return
+	}
+	writeText(w, token)
+}
+
+func writeText(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/text")
+	fmt.Fprint(w, body)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		util.Logger.WithError(err).Error("Failed to write metadata server response")
+	}
+}
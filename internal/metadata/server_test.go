@@ -0,0 +1,311 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metadata
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2/google"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+const testServiceAccount = "sa@p.iam.gserviceaccount.com"
+
+func init() {
+	util.Logger = logrus.New()
+}
+
+// newTestServer returns a Server whose access tokens are numbered by how many
+// tokens have been generated.
+func newTestServer(lifetime time.Duration) (*Server, *int) {
+	generated := 0
+	s := New(Options{
+		ServiceAccount: testServiceAccount,
+		Project:        "p",
+		Token: func() (string, time.Time, error) {
+			generated++
+			return strings.Repeat("t", generated), time.Now().Add(lifetime), nil
+		},
+		IDToken: func(audience string, includeEmail bool) (string, error) {
+			if includeEmail {
+				return "id-token-with-email-for-" + audience, nil
+			}
+			return "id-token-for-" + audience, nil
+		},
+	})
+	s.secret = "secret"
+	return s, &generated
+}
+
+// get requests path, after the secret prefix, from s.
+func get(t *testing.T, s *Server, path string, header http.Header) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/"+s.secret+path, nil)
+	req.Header = header
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if got := rec.Header().Get(flavorHeader); got != flavor {
+		t.Errorf("%s: expected the %s response header to be %s, got %q", path, flavorHeader, flavor, got)
+	}
+	return rec.Code, rec.Body.String()
+}
+
+func TestServeHTTP(t *testing.T) {
+	s, _ := newTestServer(10 * time.Minute)
+	flavored := http.Header{flavorHeader: []string{flavor}}
+
+	tests := []struct {
+		path   string
+		header http.Header
+		code   int
+		body   string
+	}{
+		{"/", nil, http.StatusOK, "computeMetadata/\n"},
+		{"/computeMetadata/v1/project/project-id", flavored, http.StatusOK, "p"},
+		{"/computeMetadata/v1/project/project-id", nil, http.StatusForbidden, "Missing Metadata-Flavor:Google header.\n"},
+		{
+			"/computeMetadata/v1/project/project-id",
+			http.Header{flavorHeader: []string{flavor}, "X-Forwarded-For": []string{"10.0.0.1"}},
+			http.StatusForbidden,
+			"Requests through a proxy are not allowed.\n",
+		},
+		{accountsPath, flavored, http.StatusOK, "default/\n" + testServiceAccount + "/\n"},
+		{accountsPath + "default/email", flavored, http.StatusOK, testServiceAccount},
+		{accountsPath + testServiceAccount + "/email", flavored, http.StatusOK, testServiceAccount},
+		{accountsPath + "other@p.iam.gserviceaccount.com/email", flavored, http.StatusNotFound, ""},
+		{
+			accountsPath + "default/?recursive=true",
+			flavored,
+			http.StatusOK,
+			`{"aliases":["default"],"email":"` + testServiceAccount + `",` +
+				`"scopes":["` + strings.Join(scopes, `","`) + `"]}` + "\n",
+		},
+		{accountsPath + "default/identity?audience=aud", flavored, http.StatusOK, "id-token-for-aud"},
+		{
+			accountsPath + "default/identity?audience=aud&format=full",
+			flavored,
+			http.StatusOK,
+			"id-token-with-email-for-aud",
+		},
+		{accountsPath + "default/identity", flavored, http.StatusBadRequest, ""},
+		{"/computeMetadata/v1/instance/zone", flavored, http.StatusNotFound, ""},
+		{tokenPath, nil, http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		code, body := get(t, s, tt.path, tt.header)
+		if code != tt.code {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.code, code)
+		}
+		if tt.code == http.StatusOK || tt.body != "" {
+			if body != tt.body {
+				t.Errorf("%s: expected body %q, got %q", tt.path, tt.body, body)
+			}
+		}
+	}
+}
+
+func TestSecret(t *testing.T) {
+	s, _ := newTestServer(10 * time.Minute)
+	flavored := http.Header{flavorHeader: []string{flavor}}
+
+	for _, path := range []string{
+		"/",
+		accountsPath + "default/token",
+		"/secre" + accountsPath + "default/token",
+		"/secrets" + accountsPath + "default/token",
+		"/other" + accountsPath + "default/token",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header = flavored
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status %d without the secret, got %d", path, http.StatusNotFound, rec.Code)
+		}
+	}
+
+	if code, body := get(t, s, "", nil); code != http.StatusOK || body != "computeMetadata/\n" {
+		t.Errorf("expected the secret alone to serve the root path, got %d %q", code, body)
+	}
+}
+
+func TestAccessTokenRefresh(t *testing.T) {
+	s, generated := newTestServer(10 * time.Minute)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if token, _, err := s.accessToken(); err != nil || token != "t" {
+			t.Fatalf("expected the cached token t, got %q (%v)", token, err)
+		}
+	}
+
+	// The token is refreshed once it is within the refresh window of its expiry.
+	now = now.Add(10*time.Minute - refreshWindow + time.Second)
+	if token, _, err := s.accessToken(); err != nil || token != "tt" {
+		t.Fatalf("expected the refreshed token tt, got %q (%v)", token, err)
+	}
+	if *generated != 2 {
+		t.Errorf("expected 2 tokens to be generated, got %d", *generated)
+	}
+}
+
+func TestTokenError(t *testing.T) {
+	s := New(Options{
+		ServiceAccount: testServiceAccount,
+		Token: func() (string, time.Time, error) {
+			return "", time.Time{}, errors.New("permission denied")
+		},
+	})
+	if _, err := s.Start("127.0.0.1:0"); err == nil {
+		t.Error("expected the server not to start when no token can be generated")
+	}
+	s.secret = "secret"
+
+	code, _ := get(t, s, accountsPath+"default/token", http.Header{
+		flavorHeader: []string{flavor},
+	})
+	if code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, code)
+	}
+}
+
+// TestClientLibraries checks that the Google Cloud client libraries for Go find the
+// project and credentials through the server.
+func TestClientLibraries(t *testing.T) {
+	s, _ := newTestServer(10 * time.Minute)
+	addr, err := s.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the metadata server: %v", err)
+	}
+	defer s.Shutdown(context.Background()) //nolint:errcheck // Test cleanup
+
+	prev, ok := os.LookupEnv(HostEnv)
+	os.Setenv(HostEnv, addr)
+	defer func() {
+		if ok {
+			os.Setenv(HostEnv, prev)
+		} else {
+			os.Unsetenv(HostEnv)
+		}
+	}()
+
+	if !metadata.OnGCE() {
+		t.Error("expected the client library to detect the metadata server")
+	}
+	if project, err := metadata.ProjectID(); err != nil || project != "p" {
+		t.Errorf("expected project p, got %q (%v)", project, err)
+	}
+	if email, err := metadata.Email(""); err != nil || email != testServiceAccount {
+		t.Errorf("expected email %s, got %q (%v)", testServiceAccount, email, err)
+	}
+
+	token, err := google.ComputeTokenSource("").Token()
+	if err != nil {
+		t.Fatalf("failed to get a token through the client library: %v", err)
+	}
+	if token.AccessToken != "t" || token.TokenType != "Bearer" {
+		t.Errorf("unexpected token %+v", token)
+	}
+	if lifetime := time.Until(token.Expiry); lifetime < 9*time.Minute || lifetime > 10*time.Minute {
+		t.Errorf("expected the token to expire in 10 minutes, got %s", lifetime)
+	}
+
+	resp, err := http.Get("http://" + addr + "/") //nolint:noctx // Test request
+	if err != nil {
+		t.Fatalf("failed to request the root path: %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "computeMetadata/\n" {
+		t.Errorf("unexpected root response %q", body)
+	}
+
+	if !strings.Contains(addr, "/") {
+		t.Fatalf("expected the host %s to include the secret", addr)
+	}
+	resp, err = http.Get("http://" + addr[:strings.Index(addr, "/")] + "/") //nolint:noctx // Test request
+	if err != nil {
+		t.Fatalf("failed to request the root path: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d without the secret, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+// TestCredentialsJSON checks that the Google Cloud client libraries for Go get access
+// tokens from the server through the credentials file.
+func TestCredentialsJSON(t *testing.T) {
+	s, _ := newTestServer(10 * time.Minute)
+	addr, err := s.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the metadata server: %v", err)
+	}
+	defer s.Shutdown(context.Background()) //nolint:errcheck // Test cleanup
+
+	data, err := CredentialsJSON(addr)
+	if err != nil {
+		t.Fatalf("failed to create the credentials file: %v", err)
+	}
+	creds, err := google.CredentialsFromJSON(context.Background(), data, scopes[0])
+	if err != nil {
+		t.Fatalf("failed to parse the credentials file: %v", err)
+	}
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		t.Fatalf("failed to get a token through the credentials file: %v", err)
+	}
+	if token.AccessToken != "t" {
+		t.Errorf("expected token t, got %q", token.AccessToken)
+	}
+	if lifetime := time.Until(token.Expiry); lifetime < 9*time.Minute || lifetime > 10*time.Minute {
+		t.Errorf("expected the token to expire in 10 minutes, got %s", lifetime)
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	s := New(Options{
+		ServiceAccount: testServiceAccount,
+		Token: func() (string, time.Time, error) {
+			return "t", time.Now().Add(time.Hour), nil
+		},
+		SessionLimit: 10 * time.Millisecond,
+	})
+	if _, err := s.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("failed to start the metadata server: %v", err)
+	}
+	defer s.Shutdown(context.Background()) //nolint:errcheck // Test cleanup
+
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to end")
+	}
+	code, _ := get(t, s, accountsPath+"default/token", http.Header{flavorHeader: []string{flavor}})
+	if code != http.StatusForbidden {
+		t.Errorf("expected no tokens to be served after the session ended, got status %d", code)
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+const (
+	commandLogFileName = "commands.log"
+
+	// maxCommandEntrySize limits the size of a single message from the sub-shell.
+	maxCommandEntrySize = 1 << 20
+)
+
+// commandLogHooks is sourced by the privileged sub-shell after the user's bashrc.
+// Once each command finishes, the PROMPT_COMMAND hook sends the command line,
+// the time it was entered, the working directory, and the exit code to eiam over
+// a TCP connection to localhost. Bash's /dev/tcp redirection is used so that the
+// hook doesn't depend on any other binaries being installed.
+const commandLogHooks = `
+[ -f ~/.bashrc ] && . ~/.bashrc
+
+# Commands must be written to the history for the hook to see them.
+unset HISTCONTROL HISTIGNORE
+
+__eiam_log_command() {
+  local status=$? entry
+  entry=$(HISTTIMEFORMAT='%s ' builtin history 1)
+  if [[ $entry =~ ^[[:space:]]*([0-9]+)[*]?[[:space:]]+([0-9]+)[[:space:]](.*)$ ]] &&
+     [[ ${BASH_REMATCH[1]} != "$__eiam_last_command" ]]; then
+    __eiam_last_command=${BASH_REMATCH[1]}
+    # The hook runs before the first prompt, so the latest history entry is
+    # from a previous session.
+    if [[ -n $__eiam_started ]]; then
+      { builtin printf '%s\0%s\0%s\0%s\0%s\0' "$EIAM_COMMAND_LOG_TOKEN" "${BASH_REMATCH[2]}" "$status" "$PWD" \
+          "${BASH_REMATCH[3]}" >"/dev/tcp/127.0.0.1/$EIAM_COMMAND_LOG_PORT"; } 2>/dev/null
+    fi
+  fi
+  __eiam_started=1
+  return $status
+}
+
+PROMPT_COMMAND="__eiam_log_command${PROMPT_COMMAND:+;$PROMPT_COMMAND}"
+`
+
+// CommandLogEntry is a command that was run with the permissions of a service
+// account, either in the privileged sub-shell or by eiam itself.
+type CommandLogEntry struct {
+	SessionID      string    `json:"session_id"`
+	Reason         string    `json:"reason"`
+	ServiceAccount string    `json:"service_account"`
+	KubeUser       string    `json:"kubernetes_user,omitempty"`
+	KubeGroups     []string  `json:"kubernetes_groups,omitempty"`
+	Command        string    `json:"command"`
+	Directory      string    `json:"directory"`
+	ExitCode       int       `json:"exit_code"`
+	StartTime      time.Time `json:"start_time"`
+	EndTime        time.Time `json:"end_time"`
+}
+
+// commandLogger receives the commands run in the privileged sub-shell and writes
+// them to the command log as JSON entries. Each entry includes the session ID
+// from the reason so that it can be matched with the Cloud Audit Logs entries
+// of the API calls made by the command.
+type commandLogger struct {
+	ln     net.Listener
+	token  string
+	rcFile string
+	entry  CommandLogEntry
+
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+	wg   sync.WaitGroup
+}
+
+// newCommandLogger starts listening for commands from the privileged sub-shell
+// if the command log is enabled.
+func newCommandLogger(svcAcct, reason string, kubeAs KubeImpersonation) (*commandLogger, error) {
+	if !viper.GetBool(appconfig.SessionCommandLog) {
+		return nil, nil
+	}
+	logFilename := filepath.Join(viper.GetString(appconfig.AuthProxyLogDir), commandLogFileName)
+	cl, err := startCommandLogger(logFilename, svcAcct, reason, kubeAs)
+	if err != nil {
+		return nil, err
+	}
+	util.Logger.Infof("Writing the commands run in the privileged session to %s", logFilename)
+	return cl, nil
+}
+
+func startCommandLogger(logFilename, svcAcct, reason string, kubeAs KubeImpersonation) (*commandLogger, error) {
+	sessionID := util.SessionIDFromReason(reason)
+	if sessionID == "" {
+		sessionID = uuid.New().String()
+	}
+
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, errorsutil.New("Failed to generate command log token", err)
+	}
+
+	rcFile, err := ioutil.TempFile("", "eiam-bashrc-")
+	if err != nil {
+		return nil, errorsutil.New("Failed to create shell hooks for the command log", err)
+	}
+	_, err = rcFile.WriteString(commandLogHooks)
+	if cErr := rcFile.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(rcFile.Name())
+		return nil, errorsutil.New("Failed to write shell hooks for the command log", err)
+	}
+
+	file, err := os.OpenFile(logFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		os.Remove(rcFile.Name())
+		return nil, errorsutil.New("Failed to open command log", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		file.Close()
+		os.Remove(rcFile.Name())
+		return nil, errorsutil.New("Failed to start command log listener", err)
+	}
+
+	cl := &commandLogger{
+		ln:     ln,
+		token:  hex.EncodeToString(tokenBytes),
+		rcFile: rcFile.Name(),
+		entry: CommandLogEntry{
+			SessionID:      sessionID,
+			Reason:         reason,
+			ServiceAccount: svcAcct,
+			KubeUser:       kubeAs.User,
+			KubeGroups:     kubeAs.Groups,
+		},
+		file: file,
+		enc:  json.NewEncoder(file),
+	}
+	cl.wg.Add(1)
+	go cl.serve()
+	return cl, nil
+}
+
+// shellArgs returns the arguments that load the command log hooks into bash.
+func (cl *commandLogger) shellArgs() []string {
+	return []string{"--rcfile", cl.rcFile}
+}
+
+// env returns the environment variables that the shell hooks use to reach eiam.
+func (cl *commandLogger) env() []string {
+	return []string{
+		fmt.Sprintf("EIAM_COMMAND_LOG_PORT=%d", cl.ln.Addr().(*net.TCPAddr).Port),
+		fmt.Sprintf("EIAM_COMMAND_LOG_TOKEN=%s", cl.token),
+	}
+}
+
+func (cl *commandLogger) serve() {
+	defer cl.wg.Done()
+	for {
+		conn, err := cl.ln.Accept()
+		if err != nil {
+			return
+		}
+		cl.wg.Add(1)
+		go func() {
+			defer cl.wg.Done()
+			cl.handle(conn)
+		}()
+	}
+}
+
+func (cl *commandLogger) handle(conn net.Conn) {
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(conn, maxCommandEntrySize))
+	if err != nil {
+		return
+	}
+
+	// token, start time, exit code, working directory, command
+	fields := bytes.Split(data, []byte{0})
+	if len(fields) != 6 || subtle.ConstantTimeCompare(fields[0], []byte(cl.token)) != 1 {
+		return
+	}
+	start, err := strconv.ParseInt(string(fields[1]), 10, 64)
+	if err != nil {
+		return
+	}
+	exitCode, err := strconv.Atoi(string(fields[2]))
+	if err != nil {
+		return
+	}
+
+	entry := cl.entry
+	entry.StartTime = time.Unix(start, 0).UTC()
+	entry.EndTime = time.Now().UTC()
+	entry.ExitCode = exitCode
+	entry.Directory = string(fields[3])
+	entry.Command = string(fields[4])
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.file == nil {
+		return
+	}
+	if err := cl.enc.Encode(entry); err != nil {
+		util.Logger.WithError(err).Error("failed to write to the command log")
+	}
+}
+
+// Close stops listening for commands and closes the command log. It is safe to
+// call Close more than once.
+func (cl *commandLogger) Close() error {
+	cl.ln.Close()
+	cl.wg.Wait()
+	os.Remove(cl.rcFile)
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.file == nil {
+		return nil
+	}
+	err := cl.file.Close()
+	cl.file = nil
+	return err
+}
+
+// LogCommand appends an entry to the command log for a command that eiam ran itself,
+// such as a Terraform plan or apply. The session ID is taken from the reason.
+func LogCommand(entry CommandLogEntry) error {
+	if entry.SessionID == "" {
+		entry.SessionID = util.SessionIDFromReason(entry.Reason)
+	}
+	logFilename := filepath.Join(viper.GetString(appconfig.AuthProxyLogDir), commandLogFileName)
+	return appendCommandLog(logFilename, entry)
+}
+
+func appendCommandLog(logFilename string, entry CommandLogEntry) error {
+	file, err := os.OpenFile(logFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return errorsutil.New("Failed to open command log", err)
+	}
+	if err := json.NewEncoder(file).Encode(entry); err != nil {
+		file.Close()
+		return errorsutil.New("Failed to write to the command log", err)
+	}
+	return file.Close()
+}
+
+func closeCommandLogger(cl *commandLogger) {
+	if cl == nil {
+		return
+	}
+	if err := cl.Close(); err != nil {
+		util.Logger.WithError(err).Error("failed to close the command log")
+	}
+}
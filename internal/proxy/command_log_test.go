@@ -0,0 +1,148 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readCommandLog(t *testing.T, logFilename string, want int) []CommandLogEntry {
+	t.Helper()
+	var entries []CommandLogEntry
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		f, err := os.Open(logFilename)
+		if err != nil {
+			t.Fatalf("failed to open command log: %v", err)
+		}
+		entries = nil
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry CommandLogEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatalf("failed to parse command log entry %q: %v", scanner.Text(), err)
+			}
+			entries = append(entries, entry)
+		}
+		f.Close()
+		if len(entries) >= want {
+			break
+		}
+	}
+	return entries
+}
+
+func TestCommandLogShellHooks(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not installed")
+	}
+
+	dir := t.TempDir()
+	logFilename := filepath.Join(dir, commandLogFileName)
+	cl, err := startCommandLogger(logFilename, "test@my-project.iam.gserviceaccount.com", testReason, KubeImpersonation{})
+	if err != nil {
+		t.Fatalf("failed to start command logger: %v", err)
+	}
+	defer cl.Close()
+
+	workDir := t.TempDir()
+	shell := exec.Command(bash, append(cl.shellArgs(), "-i")...)
+	shell.Env = append([]string{"HOME=" + dir, "HISTFILE=" + filepath.Join(dir, ".bash_history")}, cl.env()...)
+	shell.Stdin = strings.NewReader("cd " + workDir + "\nfalse\n\necho 'multiple  spaces'\nexit\n")
+	if out, err := shell.CombinedOutput(); err != nil {
+		t.Fatalf("shell failed: %v\nOUTPUT:\n%s", err, out)
+	}
+
+	entries := readCommandLog(t, logFilename, 3)
+	want := []struct {
+		command  string
+		dir      string
+		exitCode int
+	}{
+		{"cd " + workDir, workDir, 0},
+		{"false", workDir, 1},
+		{"echo 'multiple  spaces'", workDir, 0},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d command log entries, got %d: %+v", len(want), len(entries), entries)
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Command != w.command || e.Directory != w.dir || e.ExitCode != w.exitCode {
+			t.Errorf("unexpected command log entry %d: got %+v, want %+v", i, e, w)
+		}
+		if e.SessionID != "0123456789abcdef" || e.Reason != testReason {
+			t.Errorf("command log entry %d is not tagged with the session: %+v", i, e)
+		}
+		if e.StartTime.IsZero() || e.EndTime.Before(e.StartTime) {
+			t.Errorf("unexpected timestamps in command log entry %d: %+v", i, e)
+		}
+	}
+}
+
+func TestCommandLogRejectsInvalidToken(t *testing.T) {
+	logFilename := filepath.Join(t.TempDir(), commandLogFileName)
+	kubeAs := KubeImpersonation{User: "jane@example.com", Groups: []string{"developers"}}
+	cl, err := startCommandLogger(logFilename, "test@my-project.iam.gserviceaccount.com", testReason, kubeAs)
+	if err != nil {
+		t.Fatalf("failed to start command logger: %v", err)
+	}
+
+	for _, token := range []string{"wrong-token", cl.token} {
+		conn, err := net.Dial("tcp", cl.ln.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect to command logger: %v", err)
+		}
+		conn.Write([]byte(token + "\x001634570000\x000\x00/\x00ls " + token + "\x00"))
+		conn.Close()
+	}
+
+	entries := readCommandLog(t, logFilename, 1)
+	if err := cl.Close(); err != nil {
+		t.Fatalf("failed to close command logger: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Command != "ls "+cl.token {
+		t.Errorf("expected only the command with a valid token to be logged, got %+v", entries)
+	}
+	if len(entries) == 1 && (entries[0].KubeUser != kubeAs.User || len(entries[0].KubeGroups) != 1) {
+		t.Errorf("expected the command to be tagged with the Kubernetes identity, got %+v", entries[0])
+	}
+	if _, err := os.Stat(cl.rcFile); !os.IsNotExist(err) {
+		t.Errorf("expected the shell hooks to be removed, got %v", err)
+	}
+}
+
+func TestAppendCommandLog(t *testing.T) {
+	logFilename := filepath.Join(t.TempDir(), commandLogFileName)
+	for _, command := range []string{"terraform plan", "terraform apply"} {
+		entry := CommandLogEntry{SessionID: "0123456789abcdef", Reason: testReason, Command: command, ExitCode: 1}
+		if err := appendCommandLog(logFilename, entry); err != nil {
+			t.Fatalf("failed to append to the command log: %v", err)
+		}
+	}
+
+	entries := readCommandLog(t, logFilename, 2)
+	if len(entries) != 2 || entries[0].Command != "terraform plan" || entries[1].Command != "terraform apply" {
+		t.Errorf("expected the plan and the apply to be logged, got %+v", entries)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"golang.org/x/net/http2"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+// upstreamTransport is the transport used by the streaming handler to send
+// requests to Google APIs. HTTP/2 is negotiated with the upstream server when
+// it is supported so that gRPC calls are passed through end to end.
+var upstreamTransport http.RoundTripper = newUpstreamTransport()
+
+var errListenerClosed = errors.New("listener closed")
+
+func newUpstreamTransport() *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = util.UpstreamProxy
+	tr.ForceAttemptHTTP2 = true
+	return tr
+}
+
+// newStreamingConnectAction creates a CONNECT action that terminates the client's
+// TLS connection with a certificate signed by the proxy CA and serves the
+// tunneled requests with an HTTP/2 capable server. Unlike the goproxy MITM
+// handler, requests and responses are streamed to and from the upstream server
+// without being buffered, which is required for gRPC and server-streaming APIs.
+func newStreamingConnectAction(
+	ca *tls.Certificate,
+	metrics *proxyMetrics,
+	accessToken,
+	reason string,
+) *goproxy.ConnectAction {
+	tlsConfigForHost := tlsConfigFromCA(ca)
+	return &goproxy.ConnectAction{
+		Action: goproxy.ConnectHijack,
+		Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+			host := req.URL.Host
+			if _, err := client.Write([]byte("HTTP/1.0 200 OK\r\n\r\n")); err != nil {
+				ctx.Warnf("Failed to accept CONNECT request for %s: %v", host, err)
+				client.Close()
+				return
+			}
+
+			tlsConfig, err := tlsConfigForHost(host, ctx)
+			if err != nil {
+				ctx.Warnf("Failed to create TLS config for %s: %v", host, err)
+				client.Close()
+				return
+			}
+			tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+
+			ln := newSingleConnListener(tls.Server(client, tlsConfig))
+			srv := &http.Server{
+				Handler:  newStreamingHandler(host, metrics, accessToken, reason, ctx),
+				ErrorLog: log.New(proxyLogWriter{ctx}, "", 0),
+				ConnState: func(_ net.Conn, state http.ConnState) {
+					if state == http.StateClosed || state == http.StateHijacked {
+						ln.Close()
+					}
+				},
+			}
+			if err := http2.ConfigureServer(srv, &http2.Server{}); err != nil {
+				ctx.Warnf("Failed to configure HTTP/2 server for %s: %v", host, err)
+				client.Close()
+				return
+			}
+
+			// Serve blocks until the client closes the tunneled connection.
+			if err := srv.Serve(ln); err != errListenerClosed {
+				ctx.Warnf("Failed to serve tunneled connection for %s: %v", host, err)
+			}
+		},
+	}
+}
+
+// newStreamingHandler creates a reverse proxy that forwards requests to the
+// upstream host with the service account's credentials. Responses are flushed
+// to the client as soon as they are received.
+func newStreamingHandler(
+	host string,
+	metrics *proxyMetrics,
+	accessToken,
+	reason string,
+	ctx *goproxy.ProxyCtx,
+) http.Handler {
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	rp := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = host
+			setAuthHeaders(r, accessToken, reason)
+			ctx.Logf("Streaming %s request to %s", r.Proto, r.URL.String())
+		},
+		Transport:     upstreamTransport,
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			if start, ok := resp.Request.Context().Value(requestStartKey{}).(time.Time); ok {
+				metrics.observeRequest(hostname, resp.StatusCode, start)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			ctx.Warnf("Failed to proxy request to %s: %v", r.URL.String(), err)
+			if start, ok := r.Context().Value(requestStartKey{}).(time.Time); ok {
+				metrics.observeRequest(hostname, 0, start)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), requestStartKey{}, time.Now()))
+		rp.ServeHTTP(w, r)
+	})
+}
+
+// requestStartKey is the context key for the time a tunneled request was received.
+type requestStartKey struct{}
+
+// proxyLogWriter writes the log output of the tunneled HTTP servers to the
+// auth proxy's log file.
+type proxyLogWriter struct {
+	ctx *goproxy.ProxyCtx
+}
+
+func (w proxyLogWriter) Write(p []byte) (int, error) {
+	w.ctx.Warnf("%s", p)
+	return len(p), nil
+}
+
+// singleConnListener is a net.Listener that yields a single connection. Accept
+// blocks after the connection has been handed out until the listener is closed,
+// so that http.Server.Serve returns once the client is finished with the tunnel.
+type singleConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+	served bool
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if !l.served {
+		l.served = true
+		return l.conn, nil
+	}
+	<-l.closed
+	return nil, errListenerClosed
+}
+
+func (l *singleConnListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,290 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	testToken  = "test-access-token"
+	testReason = "ephemeral-iam 0123456789abcdef: testing"
+)
+
+// startTestProxy starts an auth proxy that trusts the upstream server and returns
+// a client that sends its requests through the proxy.
+func startTestProxy(t *testing.T, upstream *httptest.Server, streaming, clientHTTP2 bool) *http.Client {
+	t.Helper()
+	return startTestProxyWithMetrics(t, upstream, newProxyMetrics(), streaming, clientHTTP2)
+}
+
+func startTestProxyWithMetrics(
+	t *testing.T,
+	upstream *httptest.Server,
+	metrics *proxyMetrics,
+	streaming,
+	clientHTTP2 bool,
+) *http.Client {
+	t.Helper()
+
+	certFile, keyFile := writeTestCA(t)
+	if err := setCa(certFile, keyFile); err != nil {
+		t.Fatalf("failed to set proxy CA: %v", err)
+	}
+
+	origTransport := upstreamTransport
+	upstreamTransport = upstream.Client().Transport
+	t.Cleanup(func() { upstreamTransport = origTransport })
+
+	proxy := goproxy.NewProxyHttpServer()
+	configureProxyHandlers(proxy, metrics, testToken, testReason, streaming)
+	proxySrv := httptest.NewServer(proxy)
+	t.Cleanup(proxySrv.Close)
+
+	proxyURL, err := url.Parse(proxySrv.URL)
+	if err != nil {
+		t.Fatalf("failed to parse proxy URL: %v", err)
+	}
+	caPool := x509.NewCertPool()
+	caPool.AddCert(goproxy.GoproxyCa.Leaf)
+
+	tr := &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{RootCAs: caPool, MinVersion: tls.VersionTLS12},
+		ForceAttemptHTTP2: clientHTTP2,
+	}
+	if !clientHTTP2 {
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr, Timeout: 10 * time.Second}
+}
+
+func startTestUpstream(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewUnstartedServer(handler)
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func writeTestCA(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "eiam test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("failed to create CA cert: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	if err := ioutil.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatalf("failed to write CA cert: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("failed to write CA key: %v", err)
+	}
+
+	// Certificates are cached by host, so clear the cache to avoid serving
+	// certificates signed by a CA from a previous test.
+	certLock.Lock()
+	certCache = make(map[string]*tls.Certificate)
+	certLock.Unlock()
+	return certFile, keyFile
+}
+
+func checkAuthHeaders(t *testing.T, r *http.Request) {
+	t.Helper()
+	if got, want := r.Header.Get("Authorization"), "Bearer "+testToken; got != want {
+		t.Errorf("unexpected authorization header: got %q, want %q", got, want)
+	}
+	if got := r.Header.Get("X-Goog-Request-Reason"); got != testReason {
+		t.Errorf("unexpected reason header: got %q, want %q", got, testReason)
+	}
+}
+
+func TestStreamingProxyHTTP2(t *testing.T) {
+	upstream := startTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("expected upstream request to use HTTP/2, got %s", r.Proto)
+		}
+		checkAuthHeaders(t, r)
+		w.WriteHeader(http.StatusOK)
+	})
+	client := startTestProxy(t, upstream, true, true)
+
+	req, err := http.NewRequest(http.MethodGet, upstream.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer user-token")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected the proxy to negotiate HTTP/2 with the client, got %s", resp.Proto)
+	}
+}
+
+func TestStreamingProxyHTTP1Client(t *testing.T) {
+	upstream := startTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		checkAuthHeaders(t, r)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	client := startTestProxy(t, upstream, true, false)
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if resp.ProtoMajor != 1 {
+		t.Errorf("expected the proxy to fall back to HTTP/1.1, got %s", resp.Proto)
+	}
+}
+
+func TestStreamingProxyFlushesResponses(t *testing.T) {
+	release := make(chan struct{})
+	upstream := startTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte("second\n"))
+	})
+	client := startTestProxy(t, upstream, true, true)
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	select {
+	case line := <-lines:
+		if line != "first" {
+			t.Errorf("unexpected first line: %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("response was buffered by the proxy instead of being streamed")
+	}
+	close(release)
+	if line := <-lines; line != "second" {
+		t.Errorf("unexpected second line: %q", line)
+	}
+}
+
+func TestStreamingProxyTrailers(t *testing.T) {
+	upstream := startTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Te") != "trailers" {
+			t.Errorf("expected the TE header to be passed through, got %q", r.Header.Get("Te"))
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("message"))
+		w.Header().Set("Grpc-Status", "0")
+	})
+	client := startTestProxy(t, upstream, true, true)
+
+	req, err := http.NewRequest(http.MethodPost, upstream.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+	if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+		t.Errorf("expected Grpc-Status trailer to be passed through, got %q", got)
+	}
+}
+
+func TestMitmProxyInjectsHeaders(t *testing.T) {
+	upstream := startTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		checkAuthHeaders(t, r)
+		w.WriteHeader(http.StatusOK)
+	})
+	client := startTestProxy(t, upstream, false, true)
+
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Errorf("expected the MITM proxy to use HTTP/1.1, got %s", resp.Proto)
+	}
+}
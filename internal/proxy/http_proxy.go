@@ -19,12 +19,13 @@ import (
 	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/elazarl/goproxy"
@@ -41,13 +42,19 @@ var (
 	certCache = make(map[string]*tls.Certificate)
 	certLock  = &sync.Mutex{}
 
-	wg sync.WaitGroup
-
 	funcHTTPSHandler = func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
 		return goproxy.MitmConnect, host
 	}
 )
 
+// KubeImpersonation is the Kubernetes identity that kubectl impersonates in the
+// privileged session. The service account's token still authenticates the requests,
+// but RBAC is checked for the impersonated user and groups.
+type KubeImpersonation struct {
+	User   string
+	Groups []string
+}
+
 // StartProxyServer spins up the proxy that replaces the gcloud auth token.
 func StartProxyServer(
 	accessToken,
@@ -56,13 +63,26 @@ func StartProxyServer(
 	project string,
 	expirationDate time.Time,
 	defaultCluster map[string]string,
+	kubeAs KubeImpersonation,
 ) error {
 	if err := checkProxyCertificate(); err != nil {
 		return err
 	}
 
-	srv, err := createProxy(accessToken, reason)
+	metrics := newProxyMetrics()
+	metrics.setTokenExpiry(expirationDate)
+	srv, err := createProxy(accessToken, reason, metrics)
+	if err != nil {
+		return err
+	}
+
+	rec, err := newSessionRecorder(svcAcct, reason)
+	if err != nil {
+		return err
+	}
+	cmdLog, err := newCommandLogger(svcAcct, reason, kubeAs)
 	if err != nil {
+		closeSessionRecorder(rec)
 		return err
 	}
 
@@ -78,6 +98,8 @@ func StartProxyServer(
 			util.Logger.WithError(err).Error("failed to properly shut down proxy server")
 		}
 		close(idleConnsClosed)
+		closeSessionRecorder(rec)
+		closeCommandLogger(cmdLog)
 		util.Logger.Info("Stopping auth proxy and restoring gcloud config")
 		errorsutil.CheckRevertGcloudConfigError(gcpclient.UnsetGcloudProxy())
 		os.Exit(0)
@@ -96,35 +118,50 @@ func StartProxyServer(
 	sessionLength := time.Until(expirationDate)
 	sessionEnd := time.Now().Add(sessionLength).Format(time.RFC1123)
 	util.Logger.Infof("Starting auth proxy. Privileged session will last until %s", sessionEnd)
+	if viper.GetBool(appconfig.AuthProxyMetrics) {
+		util.Logger.Infof("Serving auth proxy metrics at http://%s%s", srv.Addr, metricsPath)
+	}
+	metrics.activeSessions.Inc()
+	defer metrics.activeSessions.Dec()
 
-	wg.Add(1)
 	var oldState *term.State
-	// TODO: Instead of handling errors in the startShell function, handle them here.
-	go startShell(svcAcct, accessToken, expirationDate.Format(time.RFC3339Nano), defaultCluster, &oldState)
-
-	// Shut down the auth proxy when the user exits the sub-shell.
+	shellExit := make(chan error, 1)
 	go func() {
-		wg.Wait()
-		sigint <- syscall.SIGINT
+		shellExit <- startShell(
+			svcAcct, accessToken, expirationDate.Format(time.RFC3339Nano), defaultCluster, kubeAs, rec, cmdLog, &oldState,
+		)
 	}()
 
-	time.Sleep(sessionLength)
-
-	if err := term.Restore(int(os.Stdin.Fd()), oldState); err != nil {
-		return errorsutil.New("Failed to restore original shell", err)
+	// Shut down the auth proxy when the user exits the sub-shell, the sub-shell
+	// fails, or the session expires. The session recording and command log are
+	// closed in every case so that they are complete when the session crashes.
+	var shellErr error
+	select {
+	case shellErr = <-shellExit:
+		util.Logger.Info("Stopping auth proxy and restoring gcloud config")
+	case <-time.After(sessionLength):
+		if oldState != nil {
+			if err := term.Restore(int(os.Stdin.Fd()), oldState); err != nil {
+				util.Logger.WithError(err).Error("failed to restore original shell")
+			}
+		}
+		util.Logger.Info("Privileged session expired, stopping auth proxy and restoring gcloud config")
 	}
+	closeSessionRecorder(rec)
+	closeCommandLogger(cmdLog)
 
-	util.Logger.Info("Privileged session expired, stopping auth proxy and restoring gcloud config")
 	if err := srv.Shutdown(context.Background()); err != nil {
-		return errorsutil.New("Failed to properly shut down proxy server", err)
+		util.Logger.WithError(err).Error("failed to properly shut down proxy server")
 	}
 	errorsutil.CheckRevertGcloudConfigError(gcpclient.UnsetGcloudProxy())
-	return nil
+	return shellErr
 }
 
-func createProxy(accessToken, reason string) (*http.Server, error) {
+func createProxy(accessToken, reason string, metrics *proxyMetrics) (*http.Server, error) {
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Verbose = viper.GetBool(appconfig.AuthProxyVerbose)
+	proxy.Tr.Proxy = util.UpstreamProxy
+	proxy.ConnectDial = newUpstreamConnectDial(proxy)
 
 	// Create log file.
 	timestamp := time.Now().Format("20060102150405")
@@ -145,13 +182,10 @@ func createProxy(accessToken, reason string) (*http.Server, error) {
 		return nil, err
 	}
 
-	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(funcHTTPSHandler))
-
-	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		r.Header.Set("authorization", fmt.Sprintf("Bearer %s", accessToken))
-		r.Header.Set("X-Goog-Request-Reason", reason)
-		return r, nil
-	})
+	configureProxyHandlers(proxy, metrics, accessToken, reason, viper.GetBool(appconfig.AuthProxyHTTP2))
+	if viper.GetBool(appconfig.AuthProxyMetrics) {
+		proxy.NonproxyHandler = metrics.handler(proxy.NonproxyHandler)
+	}
 
 	srv := &http.Server{
 		Addr:    fmt.Sprintf("%s:%s", viper.GetString(appconfig.AuthProxyAddress), viper.GetString(appconfig.AuthProxyPort)),
@@ -159,3 +193,74 @@ func createProxy(accessToken, reason string) (*http.Server, error) {
 	}
 	return srv, nil
 }
+
+// configureProxyHandlers registers the handlers that inject the service account's
+// credentials into requests sent through the proxy. When streaming is enabled,
+// CONNECT requests are served by the HTTP/2 capable streaming handler instead of
+// the goproxy MITM handler.
+func configureProxyHandlers(
+	proxy *goproxy.ProxyHttpServer,
+	metrics *proxyMetrics,
+	accessToken,
+	reason string,
+	streaming bool,
+) {
+	if streaming {
+		connectAction := newStreamingConnectAction(&goproxy.GoproxyCa, metrics, accessToken, reason)
+		proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(
+			func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+				return connectAction, host
+			},
+		))
+	} else {
+		proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(funcHTTPSHandler))
+	}
+
+	proxy.OnRequest().DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		setAuthHeaders(r, accessToken, reason)
+		ctx.UserData = time.Now()
+		return r, nil
+	})
+
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if start, ok := ctx.UserData.(time.Time); ok {
+			statusCode := 0
+			if resp != nil {
+				statusCode = resp.StatusCode
+			}
+			metrics.observeRequest(ctx.Req.URL.Hostname(), statusCode, start)
+		}
+		return resp
+	})
+}
+
+// setAuthHeaders replaces the request's credentials with the service account's
+// access token and attaches the reason used for the audit logs.
+func setAuthHeaders(r *http.Request, accessToken, reason string) {
+	r.Header.Set("authorization", fmt.Sprintf("Bearer %s", accessToken))
+	r.Header.Set("X-Goog-Request-Reason", reason)
+}
+
+// newUpstreamConnectDial creates the function goproxy uses to open tunneled
+// connections. Connections to hosts that should be sent through the upstream
+// proxy are established with an HTTP CONNECT request to that proxy.
+func newUpstreamConnectDial(proxy *goproxy.ProxyHttpServer) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		proxyURL, err := util.UpstreamProxy(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL == nil {
+			return net.Dial(network, addr)
+		}
+		dial := proxy.NewConnectDialToProxyWithHandler(proxyURL.String(), func(req *http.Request) {
+			if auth := util.ProxyAuthorization(proxyURL); auth != "" {
+				req.Header.Set("Proxy-Authorization", auth)
+			}
+		})
+		if dial == nil {
+			return nil, fmt.Errorf("unsupported upstream proxy scheme %q", proxyURL.Scheme)
+		}
+		return dial(network, addr)
+	}
+}
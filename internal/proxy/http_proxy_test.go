@@ -0,0 +1,78 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+func TestUpstreamConnectDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start upstream proxy: %v", err)
+	}
+	defer ln.Close()
+
+	connectReqs := make(chan *http.Request, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		connectReqs <- req
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		// Echo the tunneled data back to the client.
+		io.Copy(conn, conn)
+	}()
+
+	util.SetUpstreamProxy("http://user:secret@"+ln.Addr().String(), "")
+	defer util.SetUpstreamProxy("", "")
+
+	dial := newUpstreamConnectDial(goproxy.NewProxyHttpServer())
+	conn, err := dial("tcp", "iam.googleapis.com:443")
+	if err != nil {
+		t.Fatalf("failed to dial through upstream proxy: %v", err)
+	}
+	defer conn.Close()
+
+	req := <-connectReqs
+	if req.Method != http.MethodConnect || req.Host != "iam.googleapis.com:443" {
+		t.Errorf("unexpected request to upstream proxy: %s %s", req.Method, req.Host)
+	}
+	if got, want := req.Header.Get("Proxy-Authorization"), "Basic dXNlcjpzZWNyZXQ="; got != want {
+		t.Errorf("unexpected Proxy-Authorization header: got %q, want %q", got, want)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write to tunnel: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expected data to be tunneled through the upstream proxy, got %q (%v)", buf, err)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "eiam"
+	metricsSubsystem = "authproxy"
+	metricsPath      = "/metrics"
+)
+
+// proxyMetrics holds the metrics collected by the auth proxy.
+type proxyMetrics struct {
+	registry       *prometheus.Registry
+	requests       *prometheus.CounterVec
+	latency        *prometheus.HistogramVec
+	activeSessions prometheus.Gauge
+	tokenRefreshes prometheus.Counter
+
+	mu          sync.Mutex
+	tokenExpiry time.Time
+}
+
+func newProxyMetrics() *proxyMetrics {
+	m := &proxyMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "requests_total",
+			Help:      "Number of requests sent through the auth proxy by host and response status code.",
+		}, []string{"host", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "request_duration_seconds",
+			Help:      "Time until the response headers were received from the upstream host.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"host"}),
+		activeSessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "active_sessions",
+			Help:      "Number of privileged sessions being served by the auth proxy.",
+		}),
+		// The auth proxy uses the access token that the session started with until it
+		// expires, which ends the session, so nothing increments this yet.
+		tokenRefreshes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "token_refreshes_total",
+			Help: "Number of times the access token used by the auth proxy was refreshed. Always 0: the " +
+				"auth proxy never refreshes its token, and the privileged session ends when the token expires.",
+		}),
+	}
+
+	tokenExpiry := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "token_expiry_seconds",
+		Help:      "Seconds until the access token used by the auth proxy expires.",
+	}, m.secondsUntilTokenExpiry)
+	certCacheSize := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "cert_cache_size",
+		Help:      "Number of host certificates held in the auth proxy's certificate cache.",
+	}, func() float64 {
+		certLock.Lock()
+		defer certLock.Unlock()
+		return float64(len(certCache))
+	})
+
+	m.registry.MustRegister(
+		m.requests,
+		m.latency,
+		m.activeSessions,
+		m.tokenRefreshes,
+		tokenExpiry,
+		certCacheSize,
+	)
+	return m
+}
+
+// observeRequest records the result of a request sent to the upstream host.
+// A status code of 0 indicates that no response was received.
+func (m *proxyMetrics) observeRequest(host string, statusCode int, start time.Time) {
+	code := strconv.Itoa(statusCode)
+	if statusCode == 0 {
+		code = "error"
+	}
+	m.requests.WithLabelValues(host, code).Inc()
+	m.latency.WithLabelValues(host).Observe(time.Since(start).Seconds())
+}
+
+func (m *proxyMetrics) setTokenExpiry(expiry time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokenExpiry = expiry
+}
+
+func (m *proxyMetrics) secondsUntilTokenExpiry() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokenExpiry.IsZero() {
+		return 0
+	}
+	return time.Until(m.tokenExpiry).Seconds()
+}
+
+// handler wraps the proxy's handler for non-proxy requests so that the metrics
+// endpoint is served alongside the proxy.
+func (m *proxyMetrics) handler(nonProxyHandler http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	mux.Handle("/", nonProxyHandler)
+	return mux
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsObserveRequests(t *testing.T) {
+	for _, streaming := range []bool{true, false} {
+		upstream := startTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})
+		metrics := newProxyMetrics()
+		client := startTestProxyWithMetrics(t, upstream, metrics, streaming, true)
+
+		resp, err := client.Get(upstream.URL)
+		if err != nil {
+			t.Fatalf("request through proxy failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if got := testutil.ToFloat64(metrics.requests.WithLabelValues("127.0.0.1", "418")); got != 1 {
+			t.Errorf("streaming=%t: expected 1 request to be recorded, got %v", streaming, got)
+		}
+		if got := testutil.CollectAndCount(metrics.latency); got != 1 {
+			t.Errorf("streaming=%t: expected 1 latency series, got %d", streaming, got)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	metrics := newProxyMetrics()
+	metrics.setTokenExpiry(time.Now().Add(10 * time.Minute))
+	metrics.activeSessions.Inc()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.NonproxyHandler = metrics.handler(proxy.NonproxyHandler)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + metricsPath)
+	if err != nil {
+		t.Fatalf("failed to fetch metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read metrics: %v", err)
+	}
+
+	for _, name := range []string{
+		"eiam_authproxy_active_sessions 1",
+		"eiam_authproxy_token_expiry_seconds",
+		"eiam_authproxy_token_refreshes_total 0",
+		"eiam_authproxy_cert_cache_size",
+	} {
+		if !strings.Contains(string(body), name) {
+			t.Errorf("expected metrics output to contain %q\nOUTPUT:\n%s", name, body)
+		}
+	}
+	if got := metrics.secondsUntilTokenExpiry(); got <= 0 || got > 600 {
+		t.Errorf("unexpected seconds until token expiry: %v", got)
+	}
+}
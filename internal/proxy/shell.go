@@ -28,6 +28,7 @@ import (
 
 	"github.com/creack/pty"
 	"github.com/google/uuid"
+	"github.com/spf13/viper"
 	"golang.org/x/term"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
@@ -36,12 +37,22 @@ import (
 	"github.com/rigup/ephemeral-iam/internal/appconfig"
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
 	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+	"github.com/rigup/ephemeral-iam/internal/recorder"
 )
 
-func startShell(svcAcct, accessToken, expiry string, defaultCluster map[string]string, oldState **term.State) {
+func startShell(
+	svcAcct,
+	accessToken,
+	expiry string,
+	defaultCluster map[string]string,
+	kubeAs KubeImpersonation,
+	rec *recorder.Recorder,
+	cmdLog *commandLogger,
+	oldState **term.State,
+) error {
 	tmpKubeConfig, err := createTempKubeConfig()
 	if err != nil {
-		util.Logger.WithError(err).Fatal("failed to create temp kubeconfig")
+		return errorsutil.New("Failed to create temp kubeconfig", err)
 	}
 	defer os.Remove(tmpKubeConfig.Name()) // Remove tmpKubeConfig after priv session ends.
 
@@ -65,24 +76,33 @@ func startShell(svcAcct, accessToken, expiry string, defaultCluster map[string]s
 		}
 	}
 
-	if err = writeCredsToKubeConfig(tmpKubeConfig, accessToken, expiry); err != nil {
-		util.Logger.WithError(err).Fatal("failed to write credentials to temp kubeconfig")
+	if kubeAs.User != "" && len(defaultCluster) == 0 {
+		util.Logger.Warnf(
+			"No cluster is configured, so kubectl can't impersonate %s. Pass --as to kubectl instead", kubeAs.User,
+		)
+	}
+	if err = writeCredsToKubeConfig(tmpKubeConfig, accessToken, expiry, kubeAs); err != nil {
+		return errorsutil.New("Failed to write credentials to temp kubeconfig", err)
 	}
 
 	// Create the shell command and copy the environment variables from the previous command.
 	shellCmd := exec.Command("bash")
 	shellCmd.Env = cmdEnv
+	if cmdLog != nil {
+		shellCmd.Args = append(shellCmd.Args, cmdLog.shellArgs()...)
+		shellCmd.Env = append(shellCmd.Env, cmdLog.env()...)
+	}
 
 	util.Logger.Warn("Enter `exit` or press CTRL+D to quit privileged session")
 
 	// Start the pty sub-shell.
 	ptmx, err := pty.Start(shellCmd)
 	if err != nil {
-		util.Logger.WithError(err).Fatal("failed to start privileged sub-shell")
+		return errorsutil.New("Failed to start privileged sub-shell", err)
 	}
 	defer func() {
-		if err = ptmx.Close(); err != nil {
-			util.Logger.WithError(err).Fatal("failed to close privileged sub-shell")
+		if err := ptmx.Close(); err != nil {
+			util.Logger.WithError(err).Error("failed to close privileged sub-shell")
 		}
 	}()
 
@@ -91,8 +111,13 @@ func startShell(svcAcct, accessToken, expiry string, defaultCluster map[string]s
 	signal.Notify(ch, syscall.SIGWINCH)
 	go func() {
 		for range ch {
-			if err = pty.InheritSize(os.Stdin, ptmx); err != nil {
-				util.Logger.WithError(err).Fatal("failed to resize pty")
+			if err := pty.InheritSize(os.Stdin, ptmx); err != nil {
+				util.Logger.WithError(err).Error("failed to resize pty")
+			}
+			if rec != nil {
+				if rows, cols, err := pty.Getsize(ptmx); err == nil {
+					rec.Resize(cols, rows)
+				}
 			}
 		}
 	}()
@@ -100,11 +125,11 @@ func startShell(svcAcct, accessToken, expiry string, defaultCluster map[string]s
 
 	// Save the state of the current shell so it can be restored later.
 	if *oldState, err = term.MakeRaw(int(os.Stdin.Fd())); err != nil {
-		util.Logger.WithError(err).Fatal("failed to save state of current shell")
+		return errorsutil.New("Failed to save state of current shell", err)
 	}
 	defer func() {
 		if err := term.Restore(int(os.Stdin.Fd()), *oldState); err != nil {
-			util.Logger.WithError(err).Fatal("failed to restore original shell")
+			util.Logger.WithError(err).Error("failed to restore original shell")
 		}
 	}()
 
@@ -115,19 +140,67 @@ func startShell(svcAcct, accessToken, expiry string, defaultCluster map[string]s
 		}
 	}()
 
-	// Write the output from the sub-shell to stdout.
-	if _, err := io.Copy(os.Stdout, ptmx); err != nil {
+	// Write the output from the sub-shell to stdout and the session recording.
+	var out io.Writer = os.Stdout
+	if rec != nil {
+		out = io.MultiWriter(os.Stdout, rec)
+	}
+	if _, err := io.Copy(out, ptmx); err != nil {
 		// On some linux systems, this error is thrown when CTRL-D is received.
 		if serr, ok := err.(*fs.PathError); ok {
 			if serr.Path == "/dev/ptmx" {
-				wg.Done()
-				return
+				return nil
 			}
 		} else {
 			util.Logger.WithError(err).Error("failed to write the output from the sub-shell to stdout")
 		}
 	}
-	wg.Done()
+	return nil
+}
+
+// newSessionRecorder creates the recording of the privileged sub-shell if session
+// recording is enabled. The recording is named after the session ID in the reason
+// so that it can be matched to the session's audit logs.
+func newSessionRecorder(svcAcct, reason string) (*recorder.Recorder, error) {
+	if !viper.GetBool(appconfig.SessionRecord) {
+		return nil, nil
+	}
+
+	sessionID := util.SessionIDFromReason(reason)
+	if sessionID == "" {
+		sessionID = uuid.New().String()
+	}
+	width, height, err := term.GetSize(int(os.Stdin.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	rec, err := recorder.New(
+		viper.GetString(appconfig.SessionRecordingDir),
+		viper.GetBool(appconfig.SessionCompressRecords),
+		recorder.Header{
+			Width:          width,
+			Height:         height,
+			Title:          reason,
+			Env:            map[string]string{"SHELL": "bash", "TERM": os.Getenv("TERM")},
+			SessionID:      sessionID,
+			Reason:         reason,
+			ServiceAccount: svcAcct,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	util.Logger.Infof("Recording privileged session to %s", rec.Name())
+	return rec, nil
+}
+
+func closeSessionRecorder(rec *recorder.Recorder) {
+	if rec == nil {
+		return
+	}
+	if err := rec.Close(); err != nil {
+		util.Logger.WithError(err).Error("failed to write session recording")
+	}
 }
 
 func buildPrompt(svcAcct string) string {
@@ -147,7 +220,7 @@ func createTempKubeConfig() (*os.File, error) {
 	return tmpKubeConfig, nil
 }
 
-func writeCredsToKubeConfig(tmpKubeConfig *os.File, accessToken, expiry string) error {
+func writeCredsToKubeConfig(tmpKubeConfig *os.File, accessToken, expiry string, kubeAs KubeImpersonation) error {
 	// Read the tmpKubeConfig into a client-go config object.
 	config := clientcmdapi.NewConfig()
 	configBytes, err := ioutil.ReadFile(tmpKubeConfig.Name())
@@ -163,6 +236,10 @@ func writeCredsToKubeConfig(tmpKubeConfig *os.File, accessToken, expiry string)
 		// Write the service account's token to the temp kubeconfig.
 		authInfo.AuthProvider.Config["access-token"] = accessToken
 		authInfo.AuthProvider.Config["expiry"] = expiry
+		// Impersonate the narrower Kubernetes identity, if any, so that RBAC is checked
+		// for it instead of the service account.
+		authInfo.Impersonate = kubeAs.User
+		authInfo.ImpersonateGroups = kubeAs.Groups
 	}
 
 	// Serialize the updated config and write it back to the file.
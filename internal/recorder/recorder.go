@@ -0,0 +1,204 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recorder
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+const (
+	castExt = ".cast"
+	gzipExt = ".gz"
+)
+
+// Header is the first line of an asciicast v2 recording. The session ID, reason,
+// and service account are stored alongside the standard fields so that a
+// recording can be matched to the audit logs of the privileged session.
+type Header struct {
+	Version        int               `json:"version"`
+	Width          int               `json:"width"`
+	Height         int               `json:"height"`
+	Timestamp      int64             `json:"timestamp"`
+	Title          string            `json:"title,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	SessionID      string            `json:"session_id,omitempty"`
+	Reason         string            `json:"reason,omitempty"`
+	ServiceAccount string            `json:"service_account,omitempty"`
+}
+
+// Recorder writes the output of a terminal session to an asciicast v2 file.
+// Recording errors never interrupt the session, the first error encountered is
+// returned when the recorder is closed.
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	gz      *gzip.Writer
+	w       *bufio.Writer
+	start   time.Time
+	partial []byte
+	closed  bool
+	err     error
+}
+
+// New creates a recording for the session in dir. The directory is created if it
+// doesn't exist and the recording is only readable by the current user. If
+// compress is true, the recording is gzip-compressed.
+func New(dir string, compress bool, header Header) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errorsutil.New(fmt.Sprintf("Failed to create recording directory %s", dir), err)
+	}
+	fileName := filepath.Join(dir, header.SessionID+castExt)
+	if compress {
+		fileName += gzipExt
+	}
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, errorsutil.New("Failed to create session recording", err)
+	}
+
+	r := &Recorder{file: f, start: time.Now()}
+	var w io.Writer = f
+	if compress {
+		r.gz = gzip.NewWriter(f)
+		w = r.gz
+	}
+	r.w = bufio.NewWriter(w)
+
+	header.Version = 2
+	header.Timestamp = r.start.Unix()
+	line, err := json.Marshal(header)
+	if err != nil {
+		f.Close()
+		return nil, errorsutil.New("Failed to serialize session recording header", err)
+	}
+	r.writeLine(line)
+	if r.err != nil {
+		f.Close()
+		return nil, errorsutil.New("Failed to write session recording header", r.err)
+	}
+	return r, nil
+}
+
+// Name returns the path to the recording file.
+func (r *Recorder) Name() string {
+	return r.file.Name()
+}
+
+// Write records p as terminal output. It always reports that all of p was
+// written so that it can be used with io.MultiWriter without affecting the
+// session.
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return len(p), nil
+	}
+
+	// The output of the pty can end in the middle of a multi-byte character. The
+	// incomplete character is held back until the rest of it is received since
+	// each event must contain valid UTF-8.
+	data := append(r.partial, p...)
+	n := incompleteSuffixLen(data)
+	r.partial = append([]byte(nil), data[len(data)-n:]...)
+	data = data[:len(data)-n]
+	if len(data) > 0 {
+		r.writeEvent("o", string(data))
+	}
+	return len(p), nil
+}
+
+// Resize records that the terminal was resized.
+func (r *Recorder) Resize(width, height int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.writeEvent("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+// Close flushes the recording to disk. It is safe to call Close more than once.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return r.err
+	}
+	r.closed = true
+
+	if len(r.partial) > 0 {
+		r.writeEvent("o", string(r.partial))
+	}
+	r.setErr(r.w.Flush())
+	if r.gz != nil {
+		r.setErr(r.gz.Close())
+	}
+	r.setErr(r.file.Close())
+	return r.err
+}
+
+func (r *Recorder) writeEvent(eventType, data string) {
+	elapsed := time.Since(r.start).Seconds()
+	line, err := json.Marshal([]interface{}{elapsed, eventType, data})
+	if err != nil {
+		r.setErr(err)
+		return
+	}
+	r.writeLine(line)
+}
+
+func (r *Recorder) writeLine(line []byte) {
+	if r.err != nil {
+		return
+	}
+	if _, err := r.w.Write(line); err != nil {
+		r.setErr(err)
+		return
+	}
+	r.setErr(r.w.WriteByte('\n'))
+}
+
+func (r *Recorder) setErr(err error) {
+	if r.err == nil && err != nil {
+		r.err = err
+	}
+}
+
+// incompleteSuffixLen returns the length of the incomplete UTF-8 character at the
+// end of b, if there is one.
+func incompleteSuffixLen(b []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if !utf8.RuneStart(c) {
+			continue
+		}
+		if !utf8.FullRune(b[len(b)-i:]) {
+			return i
+		}
+		return 0
+	}
+	return 0
+}
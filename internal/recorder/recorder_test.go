@@ -0,0 +1,199 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+)
+
+func init() {
+	util.Logger = logrus.New()
+}
+
+func newTestRecorder(t *testing.T, dir string, compress bool) *Recorder {
+	t.Helper()
+	rec, err := New(dir, compress, Header{
+		Width:          80,
+		Height:         24,
+		Title:          "ephemeral-iam 0123456789abcdef: testing",
+		SessionID:      "0123456789abcdef",
+		Reason:         "ephemeral-iam 0123456789abcdef: testing",
+		ServiceAccount: "test@my-project.iam.gserviceaccount.com",
+	})
+	if err != nil {
+		t.Fatalf("failed to create recorder: %v", err)
+	}
+	return rec
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir := filepath.Join(t.TempDir(), "recordings")
+		rec := newTestRecorder(t, dir, compress)
+		rec.Write([]byte("$ gcloud projects list\r\n"))
+		rec.Resize(120, 40)
+		rec.Write([]byte("my-project\r\n"))
+		if err := rec.Close(); err != nil {
+			t.Fatalf("compress=%t: failed to close recorder: %v", compress, err)
+		}
+
+		info, err := os.Stat(rec.Name())
+		if err != nil {
+			t.Fatalf("compress=%t: recording was not written: %v", compress, err)
+		}
+		if perm := info.Mode().Perm(); perm != 0o600 {
+			t.Errorf("compress=%t: expected recording permissions 0600, got %o", compress, perm)
+		}
+		if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0o700 {
+			t.Errorf("compress=%t: expected recording directory with permissions 0700: %v", compress, err)
+		}
+
+		recording, err := Open(dir, "0123456789abcdef")
+		if err != nil {
+			t.Fatalf("compress=%t: failed to open recording: %v", compress, err)
+		}
+		if recording.Header.Version != 2 || recording.Header.Width != 80 || recording.Header.Height != 24 {
+			t.Errorf("compress=%t: unexpected header: %+v", compress, recording.Header)
+		}
+		if recording.Header.ServiceAccount != "test@my-project.iam.gserviceaccount.com" {
+			t.Errorf("compress=%t: unexpected service account: %q", compress, recording.Header.ServiceAccount)
+		}
+
+		var out bytes.Buffer
+		if err := recording.Replay(&out, 1000, 0); err != nil {
+			t.Fatalf("compress=%t: failed to replay recording: %v", compress, err)
+		}
+		recording.Close()
+		if got, want := out.String(), "$ gcloud projects list\r\nmy-project\r\n"; got != want {
+			t.Errorf("compress=%t: unexpected replay output: got %q, want %q", compress, got, want)
+		}
+	}
+}
+
+func TestRecordResizeEvents(t *testing.T) {
+	rec := newTestRecorder(t, t.TempDir(), false)
+	rec.Resize(120, 40)
+	rec.Close()
+
+	f, err := os.Open(rec.Name())
+	if err != nil {
+		t.Fatalf("failed to open recording: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Skip the header.
+	if !scanner.Scan() {
+		t.Fatal("expected a resize event")
+	}
+	var event []interface{}
+	if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+		t.Fatalf("failed to parse event: %v", err)
+	}
+	if event[1] != "r" || event[2] != "120x40" {
+		t.Errorf("unexpected resize event: %v", event)
+	}
+}
+
+func TestRecordSplitUTF8(t *testing.T) {
+	rec := newTestRecorder(t, t.TempDir(), false)
+	check := []byte("✓ done\r\n")
+	rec.Write(check[:1])
+	rec.Write(check[1:])
+	rec.Close()
+
+	recording, err := OpenFile(rec.Name())
+	if err != nil {
+		t.Fatalf("failed to open recording: %v", err)
+	}
+	defer recording.Close()
+	var out bytes.Buffer
+	if err := recording.Replay(&out, 1000, 0); err != nil {
+		t.Fatalf("failed to replay recording: %v", err)
+	}
+	if got := out.String(); got != string(check) {
+		t.Errorf("multi-byte character was not preserved: got %q, want %q", got, check)
+	}
+}
+
+func TestRecordWriteAfterClose(t *testing.T) {
+	rec := newTestRecorder(t, t.TempDir(), true)
+	if err := rec.Close(); err != nil {
+		t.Fatalf("failed to close recorder: %v", err)
+	}
+	if n, err := rec.Write([]byte("output")); n != 6 || err != nil {
+		t.Errorf("expected writes after close to be discarded, got n=%d err=%v", n, err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Errorf("expected second close to succeed, got %v", err)
+	}
+}
+
+func TestOpenInvalidSessionID(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "recordings")
+	newTestRecorder(t, dir, false).Close()
+	// A recording outside of the recording directory.
+	if err := os.WriteFile(filepath.Join(dir, "..", "outside"+castExt), []byte("{}\n"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	for _, id := range []string{
+		"../outside",
+		"..",
+		"0123456789abcdef/../0123456789abcdef",
+		"0123456789ABCDEF",
+		"0123456789abcde",
+		"",
+	} {
+		if rec, err := Open(dir, id); err == nil {
+			rec.Close()
+			t.Errorf("expected session ID %q to be rejected", id)
+		}
+	}
+
+	rec, err := Open(dir, "0123456789abcdef")
+	if err != nil {
+		t.Fatalf("failed to open recording: %v", err)
+	}
+	rec.Close()
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	newTestRecorder(t, dir, true).Close()
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a recording"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	headers, err := List(dir)
+	if err != nil {
+		t.Fatalf("failed to list recordings: %v", err)
+	}
+	if len(headers) != 1 || headers[0].SessionID != "0123456789abcdef" {
+		t.Errorf("unexpected recordings: %+v", headers)
+	}
+
+	if headers, err := List(filepath.Join(dir, "missing")); err != nil || len(headers) != 0 {
+		t.Errorf("expected no recordings in a missing directory, got %v, %v", headers, err)
+	}
+}
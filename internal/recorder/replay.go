@@ -0,0 +1,184 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recorder
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// Recording is an asciicast v2 recording opened for playback.
+type Recording struct {
+	Header Header
+
+	file    *os.File
+	gz      *gzip.Reader
+	scanner *bufio.Scanner
+}
+
+// sessionIDPattern matches the IDs that recordings are named after: the random ID in
+// the session's reason, or a UUID if the reason doesn't have one.
+var sessionIDPattern = regexp.MustCompile(
+	`^(?:[0-9a-f]{16}|[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})$`,
+)
+
+// Open opens the recording of the session with the given ID in dir. IDs that don't
+// have the format of the generated IDs are rejected, so that they can't refer to
+// files outside of dir.
+func Open(dir, sessionID string) (*Recording, error) {
+	if !sessionIDPattern.MatchString(sessionID) {
+		err := fmt.Errorf("%q is not a session ID, e.g. 968be336d4b769e2", sessionID)
+		return nil, errorsutil.New("Invalid session ID", err)
+	}
+	for _, name := range []string{sessionID + castExt, sessionID + castExt + gzipExt} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return OpenFile(path)
+		}
+	}
+	err := fmt.Errorf("no recording found for session %s in %s", sessionID, dir)
+	return nil, errorsutil.New("Failed to find session recording", err)
+}
+
+// OpenFile opens the recording at path and reads its header.
+func OpenFile(path string) (*Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errorsutil.New("Failed to open session recording", err)
+	}
+	rec := &Recording{file: f}
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, gzipExt) {
+		if rec.gz, err = gzip.NewReader(f); err != nil {
+			f.Close()
+			return nil, errorsutil.New("Failed to decompress session recording", err)
+		}
+		r = rec.gz
+	}
+	rec.scanner = bufio.NewScanner(r)
+	rec.scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !rec.scanner.Scan() {
+		rec.Close()
+		return nil, errorsutil.New("Failed to read session recording header", rec.scanErr())
+	}
+	if err := json.Unmarshal(rec.scanner.Bytes(), &rec.Header); err != nil {
+		rec.Close()
+		return nil, errorsutil.New("Failed to parse session recording header", err)
+	}
+	if rec.Header.Version != 2 {
+		rec.Close()
+		err := fmt.Errorf("unsupported asciicast version %d", rec.Header.Version)
+		return nil, errorsutil.New("Failed to parse session recording header", err)
+	}
+	return rec, nil
+}
+
+// Replay writes the output events of the recording to w with their original
+// timing divided by speed. Pauses longer than maxIdle are shortened to maxIdle,
+// a maxIdle of 0 keeps every pause.
+func (rec *Recording) Replay(w io.Writer, speed float64, maxIdle time.Duration) error {
+	if speed <= 0 {
+		speed = 1
+	}
+	var last, elapsed time.Duration
+	start := time.Now()
+	for rec.scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(rec.scanner.Bytes(), &event); err != nil {
+			return errorsutil.New("Failed to parse session recording event", err)
+		}
+		if len(event) != 3 {
+			continue
+		}
+		ts, ok := event[0].(float64)
+		eventType, _ := event[1].(string)
+		data, _ := event[2].(string)
+		if !ok || eventType != "o" {
+			continue
+		}
+
+		delay := time.Duration(ts * float64(time.Second))
+		pause := delay - last
+		last = delay
+		if maxIdle > 0 && pause > maxIdle {
+			pause = maxIdle
+		}
+		elapsed += time.Duration(float64(pause) / speed)
+		time.Sleep(time.Until(start.Add(elapsed)))
+
+		if _, err := io.WriteString(w, data); err != nil {
+			return errorsutil.New("Failed to write session recording output", err)
+		}
+	}
+	if err := rec.scanner.Err(); err != nil {
+		return errorsutil.New("Failed to read session recording", err)
+	}
+	return nil
+}
+
+// Close closes the recording file.
+func (rec *Recording) Close() error {
+	if rec.gz != nil {
+		rec.gz.Close()
+	}
+	return rec.file.Close()
+}
+
+// scanErr returns the reason the scanner stopped before a line was read.
+func (rec *Recording) scanErr() error {
+	if err := rec.scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// List returns the headers of the recordings in dir ordered from oldest to newest.
+func List(dir string) ([]Header, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errorsutil.New("Failed to read recording directory", err)
+	}
+	headers := []Header{}
+	for _, f := range files {
+		if f.IsDir() || !(strings.HasSuffix(f.Name(), castExt) || strings.HasSuffix(f.Name(), castExt+gzipExt)) {
+			continue
+		}
+		rec, err := OpenFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, rec.Header)
+		rec.Close()
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Timestamp < headers[j].Timestamp })
+	return headers, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wrapper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// IsolatedHome returns a temporary home directory that links to everything in the
+// user's home directory except their gcloud configuration. Tools keep their own
+// configuration, but the Google Cloud client libraries don't find the user's
+// application default credentials in it, which they would use instead of the
+// service account's credentials from the metadata server.
+func (s *Session) IsolatedHome() (string, error) {
+	if s.home != "" {
+		return s.home, nil
+	}
+
+	userHome, err := os.UserHomeDir()
+	if err != nil {
+		s.err = err
+		return "", err
+	}
+	dir, err := s.TempDir()
+	if err != nil {
+		return "", err
+	}
+	home := filepath.Join(dir, "home")
+	if err := linkEntries(userHome, home, ".config"); err != nil {
+		s.err = err
+		return "", err
+	}
+	if err := linkEntries(filepath.Join(userHome, ".config"), filepath.Join(home, ".config"), "gcloud"); err != nil {
+		s.err = err
+		return "", err
+	}
+	s.home = home
+	return s.home, nil
+}
+
+// linkEntries creates dst and a symlink in it to each entry in src except skip. src
+// doesn't need to exist.
+func linkEntries(src, dst, skip string) error {
+	if err := os.MkdirAll(dst, 0o700); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(src)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == skip {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wrapper
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	clientcmdapiv1 "k8s.io/client-go/tools/clientcmd/api/v1"
+)
+
+// Cluster is the GKE cluster that the kubeconfig of a session connects to.
+type Cluster struct {
+	Name     string
+	Location string
+	// Endpoint is the IP address of the cluster's control plane.
+	Endpoint string
+	// CACertificate is the base64 encoded certificate of the cluster's CA.
+	CACertificate string
+}
+
+// Kubeconfig returns the path to a kubeconfig whose current context is the cluster of
+// the session and that authenticates with an access token for the service account.
+// If the session has a Kubernetes user, the kubeconfig impersonates it, so that RBAC
+// is checked for the user while the service account's token still authenticates.
+// If the session has no cluster, the user's own kubeconfig is returned.
+func (s *Session) Kubeconfig() (string, error) {
+	if s.Cluster == nil {
+		return os.Getenv("KUBECONFIG"), nil
+	}
+	if s.kubeconfig != "" {
+		return s.kubeconfig, nil
+	}
+
+	caCert, err := base64.StdEncoding.DecodeString(s.Cluster.CACertificate)
+	if err != nil {
+		s.err = fmt.Errorf("failed to decode the CA certificate of cluster %s: %w", s.Cluster.Name, err)
+		return "", s.err
+	}
+	token, err := s.AccessToken()
+	if err != nil {
+		return "", err
+	}
+	dir, err := s.TempDir()
+	if err != nil {
+		return "", err
+	}
+
+	// Name the context like gcloud does, so that it is familiar to the user.
+	name := fmt.Sprintf("gke_%s_%s_%s", s.Project, s.Cluster.Location, s.Cluster.Name)
+	config := clientcmdapiv1.Config{
+		APIVersion: "v1",
+		Kind:       "Config",
+		Clusters: []clientcmdapiv1.NamedCluster{{
+			Name: name,
+			Cluster: clientcmdapiv1.Cluster{
+				Server:                   "https://" + s.Cluster.Endpoint,
+				CertificateAuthorityData: caCert,
+			},
+		}},
+		AuthInfos: []clientcmdapiv1.NamedAuthInfo{{
+			Name: name,
+			AuthInfo: clientcmdapiv1.AuthInfo{
+				Token:             token,
+				Impersonate:       s.KubeUser,
+				ImpersonateGroups: s.KubeGroups,
+			},
+		}},
+		Contexts: []clientcmdapiv1.NamedContext{{
+			Name:    name,
+			Context: clientcmdapiv1.Context{Cluster: name, AuthInfo: name},
+		}},
+		CurrentContext: name,
+	}
+
+	// kubectl reads kubeconfigs as YAML, which JSON is a subset of.
+	data, err := json.Marshal(config)
+	if err != nil {
+		s.err = fmt.Errorf("failed to serialize the kubeconfig: %w", err)
+		return "", s.err
+	}
+	path := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		s.err = fmt.Errorf("failed to write the kubeconfig: %w", err)
+		return "", s.err
+	}
+	s.kubeconfig = path
+	return s.kubeconfig, nil
+}
+
+// KubeImpersonationArgs returns the kubectl flags that impersonate the Kubernetes
+// user and groups of the session.
+func (s *Session) KubeImpersonationArgs() []string {
+	if s.KubeUser == "" {
+		return nil
+	}
+	args := []string{"--as", s.KubeUser}
+	for _, group := range s.KubeGroups {
+		args = append(args, "--as-group", group)
+	}
+	return args
+}
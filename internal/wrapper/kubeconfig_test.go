@@ -0,0 +1,115 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wrapper
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	clientcmdapiv1 "k8s.io/client-go/tools/clientcmd/api/v1"
+
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients/clientstest"
+)
+
+func TestKubeconfig(t *testing.T) {
+	clientstest.Start(t)
+
+	session := newSession()
+	session.Cluster = &Cluster{
+		Name:          "cluster-1",
+		Location:      "us-central1",
+		Endpoint:      "10.0.0.1",
+		CACertificate: "Y2EtY2VydA==",
+	}
+	session.KubeUser = "jane@example.com"
+	session.KubeGroups = []string{"developers", "viewers"}
+	path, err := session.Kubeconfig()
+	if err != nil {
+		t.Fatalf("failed to create the kubeconfig: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the kubeconfig: %v", err)
+	}
+	var config clientcmdapiv1.Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatalf("failed to parse the kubeconfig: %v", err)
+	}
+
+	name := "gke_p_us-central1_cluster-1"
+	if config.CurrentContext != name {
+		t.Errorf("expected current context %s, got %s", name, config.CurrentContext)
+	}
+	if len(config.Clusters) != 1 || config.Clusters[0].Name != name ||
+		config.Clusters[0].Cluster.Server != "https://10.0.0.1" ||
+		string(config.Clusters[0].Cluster.CertificateAuthorityData) != "ca-cert" {
+		t.Errorf("unexpected clusters: %+v", config.Clusters)
+	}
+	if len(config.AuthInfos) != 1 || config.AuthInfos[0].AuthInfo.Token != "token-for-"+testServiceAccount {
+		t.Fatalf("unexpected users: %+v", config.AuthInfos)
+	}
+	auth := config.AuthInfos[0].AuthInfo
+	if auth.Impersonate != "jane@example.com" || !reflect.DeepEqual(auth.ImpersonateGroups, session.KubeGroups) {
+		t.Errorf("expected the user to impersonate jane@example.com in %v, got %s in %v",
+			session.KubeGroups, auth.Impersonate, auth.ImpersonateGroups)
+	}
+	if len(config.Contexts) != 1 || config.Contexts[0].Context.Cluster != name ||
+		config.Contexts[0].Context.AuthInfo != name {
+		t.Errorf("unexpected contexts: %+v", config.Contexts)
+	}
+
+	// The kubeconfig is removed with the session.
+	if err := session.Close(); err != nil {
+		t.Fatalf("failed to close the session: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the kubeconfig to be removed, got %v", err)
+	}
+}
+
+func TestKubeconfigWithoutCluster(t *testing.T) {
+	srv := clientstest.Start(t)
+
+	if err := os.Setenv("KUBECONFIG", "/home/user/.kube/other"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("KUBECONFIG")
+
+	path, err := newSession().Kubeconfig()
+	if err != nil || path != "/home/user/.kube/other" {
+		t.Errorf("expected the user's kubeconfig, got %q, %v", path, err)
+	}
+	if reqs := srv.Requests(); len(reqs) != 0 {
+		t.Errorf("expected no access token to be generated, got requests %v", reqs)
+	}
+}
+
+func TestKubeImpersonationArgs(t *testing.T) {
+	session := newSession()
+	if args := session.KubeImpersonationArgs(); len(args) != 0 {
+		t.Errorf("expected no arguments without a Kubernetes user, got %v", args)
+	}
+
+	session.KubeUser = "jane@example.com"
+	session.KubeGroups = []string{"developers", "viewers"}
+	want := []string{"--as", "jane@example.com", "--as-group", "developers", "--as-group", "viewers"}
+	if args := session.KubeImpersonationArgs(); !reflect.DeepEqual(args, want) {
+		t.Errorf("expected %v, got %v", want, args)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wrapper
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"unsafe"
+
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// forwardedSignals are the signals that are sent to the command's process group
+// when eiam receives them.
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+// Run runs the command until it exits and cleans up after it.
+//
+// The command runs in its own process group, so that signals reach the processes
+// that it starts too. When eiam is in the foreground of a terminal, the command's
+// process group is put in the foreground instead so that it can read from the
+// terminal and receives the signals from the terminal directly. The signals that
+// eiam receives, e.g. SIGTERM from a process manager, are forwarded to the process
+// group.
+//
+// When stop is closed, SIGTERM is sent to the process group so that the command
+// shuts down gracefully. stop may be nil.
+//
+// If the command exits with a non-zero status, an errorsutil.ExitError with the
+// status is returned. A command that is killed by a signal exits with 128 plus the
+// signal number, like in a shell.
+func Run(c *exec.Cmd, stop <-chan struct{}) error {
+	tty, foreground := foregroundTerminal()
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Setpgid = true
+	if foreground {
+		c.SysProcAttr.Foreground = true
+		c.SysProcAttr.Ctty = tty
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer func() {
+		signal.Stop(signals)
+		close(signals)
+	}()
+
+	if err := c.Start(); err != nil {
+		return err
+	}
+	if foreground {
+		defer reclaimTerminal(tty)
+	}
+	go func() {
+		for sig := range signals {
+			// The command is the leader of its process group, so its PID is the ID of
+			// the group. The command may have already exited.
+			syscall.Kill(-c.Process.Pid, sig.(syscall.Signal)) //nolint:errcheck,forcetypeassert // See above
+		}
+	}()
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-stop:
+			syscall.Kill(-c.Process.Pid, syscall.SIGTERM) //nolint:errcheck // The command may have already exited.
+		case <-exited:
+		}
+	}()
+
+	err := c.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			code = 128 + int(status.Signal())
+		}
+		util.Logger.Debugf("%s exited with status %d", c.Path, code)
+		return errorsutil.ExitError{Code: code}
+	}
+	return err
+}
+
+// foregroundTerminal returns the file descriptor of the terminal on stdin and
+// whether eiam's process group is in the foreground of it.
+func foregroundTerminal() (int, bool) {
+	tty := int(os.Stdin.Fd())
+	pgrp, err := terminalProcessGroup(tty)
+	if err != nil {
+		// Stdin isn't a terminal.
+		return tty, false
+	}
+	return tty, pgrp == syscall.Getpgrp()
+}
+
+// reclaimTerminal puts eiam's process group back in the foreground of the terminal
+// after the command's process group exits.
+func reclaimTerminal(tty int) {
+	// A process in a background process group is stopped by SIGTTOU when it changes
+	// the foreground process group, unless it ignores the signal.
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+
+	pgrp := int32(syscall.Getpgrp())
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL, uintptr(tty), uintptr(syscall.TIOCSPGRP), uintptr(unsafe.Pointer(&pgrp)), //nolint:gosec // ioctl
+	)
+	if errno != 0 {
+		util.Logger.WithError(errno).Debug("Failed to put eiam back in the foreground of the terminal")
+	}
+}
+
+func terminalProcessGroup(tty int) (int, error) {
+	var pgrp int32
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL, uintptr(tty), uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp)), //nolint:gosec // ioctl
+	)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(pgrp), nil
+}
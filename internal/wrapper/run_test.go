@@ -0,0 +1,107 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wrapper
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+func TestRunExitStatus(t *testing.T) {
+	tests := []struct {
+		script string
+		code   int
+	}{
+		{"exit 0", 0},
+		{"exit 3", 3},
+		{"kill -TERM $$", 128 + int(syscall.SIGTERM)},
+	}
+	for _, tt := range tests {
+		err := Run(exec.Command("sh", "-c", tt.script), nil)
+		var exitErr errorsutil.ExitError
+		switch {
+		case tt.code == 0 && err != nil:
+			t.Errorf("%s: unexpected error %v", tt.script, err)
+		case tt.code != 0 && (!errors.As(err, &exitErr) || exitErr.Code != tt.code):
+			t.Errorf("%s: expected exit status %d, got %v", tt.script, tt.code, err)
+		}
+	}
+
+	if err := Run(exec.Command("/nonexistent/command"), nil); err == nil || errors.As(err, &errorsutil.ExitError{}) {
+		t.Errorf("expected an error starting the command, got %v", err)
+	}
+}
+
+// TestRunForwardsSignals checks that a signal that eiam receives reaches the
+// processes that the command started.
+func TestRunForwardsSignals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eiam-run-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	started := filepath.Join(dir, "started")
+
+	// The command survives SIGTERM and exits with the status of its child, which only
+	// exits with status 42 if the signal is sent to it as well.
+	child := `trap "exit 42" TERM; touch ` + started + `; while :; do sleep 0.1; done`
+	c := exec.Command("sh", "-c", `trap : TERM; sh -c '`+child+`'`)
+	done := make(chan error, 1)
+	go func() { done <- Run(c, nil) }()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(started); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the command didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		var exitErr errorsutil.ExitError
+		if !errors.As(err, &exitErr) || exitErr.Code != 42 {
+			t.Errorf("expected the command's child to receive SIGTERM and exit with status 42, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		c.Process.Kill() //nolint:errcheck // Test cleanup
+		t.Fatal("the signal wasn't forwarded to the command")
+	}
+}
+
+func TestRunStop(t *testing.T) {
+	stop := make(chan struct{})
+	close(stop)
+
+	err := Run(exec.Command("sleep", "30"), stop)
+	var exitErr errorsutil.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 128+int(syscall.SIGTERM) {
+		t.Errorf("expected the command to be stopped with SIGTERM, got %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wrapper
+
+import "strings"
+
+// terraformCommandGroups are the terraform subcommands that have subcommands of
+// their own, e.g. `terraform state rm`.
+var terraformCommandGroups = map[string]bool{"providers": true, "state": true, "workspace": true}
+
+// TerraformSubcommand returns the subcommand in the arguments of a terraform
+// command, e.g. "apply" for `terraform -chdir=prod apply -auto-approve` or "state rm"
+// for `terraform state rm aws_instance.a`. It returns an empty string if there is
+// none.
+func TerraformSubcommand(args []string) string {
+	for i, arg := range args {
+		// Global options, such as -chdir=DIR, come before the subcommand.
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if terraformCommandGroups[arg] && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			return arg + " " + args[i+1]
+		}
+		return arg
+	}
+	return ""
+}
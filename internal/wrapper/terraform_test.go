@@ -0,0 +1,117 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wrapper
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients/clientstest"
+)
+
+func TestTerraformSubcommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"-version"}, ""},
+		{[]string{"plan", "-out", "tfplan"}, "plan"},
+		{[]string{"-chdir=prod", "apply", "-auto-approve"}, "apply"},
+		{[]string{"state", "rm", "google_project.p"}, "state rm"},
+		{[]string{"-chdir=prod", "state", "list"}, "state list"},
+		{[]string{"state", "-help"}, "state"},
+		{[]string{"import", "google_project.p", "p"}, "import"},
+	}
+	for _, tt := range tests {
+		if got := TerraformSubcommand(tt.args); got != tt.want {
+			t.Errorf("TerraformSubcommand(%v): expected %q, got %q", tt.args, tt.want, got)
+		}
+	}
+}
+
+func TestTerraformHidesUserCredentials(t *testing.T) {
+	clientstest.Start(t)
+
+	home := t.TempDir()
+	for _, dir := range []string{".terraform.d", ".config/gcloud", ".config/other"} {
+		if err := os.MkdirAll(filepath.Join(home, dir), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	if err := os.Setenv("HOME", home); err != nil {
+		t.Fatal(err)
+	}
+	credentialVars := []string{
+		"GOOGLE_APPLICATION_CREDENTIALS",
+		"GOOGLE_CREDENTIALS",
+		"GOOGLE_CLOUD_KEYFILE_JSON",
+		"GCLOUD_KEYFILE_JSON",
+		"GOOGLE_OAUTH_ACCESS_TOKEN",
+		"GOOGLE_IMPERSONATE_SERVICE_ACCOUNT",
+		"GOOGLE_BACKEND_CREDENTIALS",
+		"GOOGLE_BACKEND_IMPERSONATE_SERVICE_ACCOUNT",
+	}
+	for _, name := range credentialVars {
+		defer os.Setenv(name, os.Getenv(name))
+		if err := os.Setenv(name, "user-credentials"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	session := newSession()
+	tool := Terraform()
+	tool.Path = "terraform"
+	c, err := tool.Command(session, []string{"plan"})
+	if err != nil {
+		t.Fatalf("failed to create command: %v", err)
+	}
+
+	// The last value of a variable takes precedence.
+	env := map[string]string{}
+	for _, kv := range c.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	for _, name := range credentialVars {
+		if value, ok := env[name]; ok {
+			t.Errorf("expected the user's %s to be hidden, got %q", name, value)
+		}
+	}
+	if env["GCE_METADATA_HOST"] == "" || env["CLOUDSDK_CORE_REQUEST_REASON"] != "testing" {
+		t.Errorf("expected the metadata server and the reason to be set, got %v", env)
+	}
+
+	isolated := env["HOME"]
+	if _, err := os.Stat(filepath.Join(isolated, ".terraform.d")); err != nil {
+		t.Errorf("expected the terraform configuration to be linked: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(isolated, ".config", "other")); err != nil {
+		t.Errorf("expected the other configuration to be linked: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(isolated, ".config", "gcloud")); !os.IsNotExist(err) {
+		t.Errorf("expected the gcloud configuration to be hidden, got %v", err)
+	}
+
+	if err := session.Close(); err != nil {
+		t.Fatalf("failed to close the session: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".config", "gcloud")); err != nil {
+		t.Errorf("expected the user's home directory to be left alone: %v", err)
+	}
+}
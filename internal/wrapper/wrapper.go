@@ -0,0 +1,492 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wrapper runs command-line tools with the credentials of an impersonated
+// service account. Each tool declares, as templates, the arguments and environment
+// variables that pass the credentials and the reason to it, so that new tools can be
+// wrapped from the eiam configuration without any code.
+package wrapper
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	"github.com/rigup/ephemeral-iam/internal/credentials"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient"
+	"github.com/rigup/ephemeral-iam/internal/metadata"
+)
+
+// Tool is a command-line tool that eiam runs with a service account's credentials.
+type Tool struct {
+	// Name is the name of the eiam command that runs the tool.
+	Name string `mapstructure:"-"`
+	// Path is the path to the tool's binary, or its name to look it up in $PATH.
+	Path string `mapstructure:"path"`
+	// Description is the short description of the eiam command.
+	Description string `mapstructure:"description"`
+	// Args are templates of the arguments that pass the credentials to the tool.
+	// They are added before the first "--" argument, or after all other arguments.
+	Args []string `mapstructure:"args"`
+	// Env are templates of the KEY=VALUE environment variables to run the tool with.
+	// They replace the user's variables of the same name. A variable that is empty
+	// is removed from the environment instead, since some tools treat an empty
+	// variable, e.g. GOOGLE_APPLICATION_CREDENTIALS, as set.
+	Env []string `mapstructure:"env"`
+}
+
+// CloudSQLProxy returns the cloud_sql_proxy tool.
+func CloudSQLProxy() Tool {
+	return Tool{
+		Name:        "cloud_sql_proxy",
+		Path:        viper.GetString(appconfig.CloudSQLProxyPath),
+		Description: "Run cloud_sql_proxy with the permissions of the specified service account",
+		// A token passed with -token expires after 10 minutes, after which the proxy
+		// can't open new connections. Instead, the proxy gets refreshed tokens from a
+		// metadata server, which both versions of the proxy use when they don't find
+		// any other credentials.
+		Env: []string{
+			"GCE_METADATA_HOST={{.MetadataHost}}",
+			"GCE_METADATA_IP={{.MetadataHost}}",
+			"GOOGLE_APPLICATION_CREDENTIALS=",
+			"CLOUDSDK_CONFIG={{.TempDir}}",
+			"HOME={{.TempDir}}",
+		},
+	}
+}
+
+// Gcloud returns the gcloud tool.
+func Gcloud() Tool {
+	return Tool{
+		Name:        "gcloud",
+		Path:        viper.GetString(appconfig.GcloudPath),
+		Description: "Run a gcloud command with the permissions of the specified service account",
+		// gcloud impersonates the service account itself, so that it can refresh the
+		// token for long-running commands.
+		Args: []string{"--impersonate-service-account", "{{.ServiceAccount}}", "--verbosity=error"},
+	}
+}
+
+// Kubectl returns the kubectl tool. kubectl can't send the reason with its requests,
+// since a kubeconfig has no way to add headers such as X-Goog-Request-Reason and the
+// GKE control plane doesn't record them in its audit logs. The reason is recorded when
+// the service account's access token is generated instead.
+func Kubectl() Tool {
+	return Tool{
+		Name:        "kubectl",
+		Path:        viper.GetString(appconfig.KubectlPath),
+		Description: "Run a kubectl command with the permissions of the specified service account",
+		Args:        []string{"--token", "{{.AccessToken}}"},
+		// The kubeconfig selects the cluster when one is specified, instead of the
+		// current context of the user's kubeconfig.
+		Env: []string{"KUBECONFIG={{.Kubeconfig}}"},
+	}
+}
+
+// Terraform returns the terraform tool.
+func Terraform() Tool {
+	return Tool{
+		Name:        "terraform",
+		Path:        viper.GetString(appconfig.TerraformPath),
+		Description: "Run terraform with the permissions of the specified service account",
+		// An access token in GOOGLE_OAUTH_ACCESS_TOKEN would expire during long applies,
+		// so the Google providers get refreshed tokens from a metadata server instead.
+		// They only use it if they don't find any other credentials, so the user's own
+		// credentials are hidden from them. The request reason is read from
+		// CLOUDSDK_CORE_REQUEST_REASON.
+		Env: []string{
+			"GCE_METADATA_HOST={{.MetadataHost}}",
+			"GCE_METADATA_IP={{.MetadataHost}}",
+			"GOOGLE_APPLICATION_CREDENTIALS=",
+			"GOOGLE_CREDENTIALS=",
+			"GOOGLE_CLOUD_KEYFILE_JSON=",
+			"GCLOUD_KEYFILE_JSON=",
+			"GOOGLE_OAUTH_ACCESS_TOKEN=",
+			"GOOGLE_IMPERSONATE_SERVICE_ACCOUNT=",
+			// The gcs backend reads its own credentials before the provider's.
+			"GOOGLE_BACKEND_CREDENTIALS=",
+			"GOOGLE_BACKEND_IMPERSONATE_SERVICE_ACCOUNT=",
+			"CLOUDSDK_CONFIG={{.TempDir}}",
+			"HOME={{.IsolatedHome}}",
+		},
+	}
+}
+
+// Exec returns a tool that runs any command, e.g. gsutil, helm or a script that uses
+// the Google Cloud client libraries. gcloud, gsutil and bq read the access token from
+// CLOUDSDK_AUTH_ACCESS_TOKEN_FILE, and Terraform's Google providers read it from
+// GOOGLE_OAUTH_ACCESS_TOKEN. The client libraries get refreshed tokens from a metadata
+// server instead. They look for application default credentials before they use the
+// metadata server, in GOOGLE_APPLICATION_CREDENTIALS and in the gcloud configuration
+// directory, so both point at a credentials file that also gets its tokens from the
+// metadata server rather than at the user's own credentials.
+func Exec(name, path string) Tool {
+	return Tool{
+		Name:        name,
+		Path:        path,
+		Description: "Run any command with the permissions of the specified service account",
+		Env: []string{
+			"CLOUDSDK_AUTH_ACCESS_TOKEN_FILE={{.TokenFile}}",
+			"GOOGLE_OAUTH_ACCESS_TOKEN={{.AccessToken}}",
+			"GCE_METADATA_HOST={{.MetadataHost}}",
+			"GCE_METADATA_IP={{.MetadataHost}}",
+			"GOOGLE_APPLICATION_CREDENTIALS={{.CredentialsFile}}",
+			"CLOUDSDK_CONFIG={{.TempDir}}",
+			"CLOUDSDK_CORE_PROJECT={{.Project}}",
+			"GOOGLE_CLOUD_PROJECT={{.Project}}",
+			"HOME={{.IsolatedHome}}",
+		},
+	}
+}
+
+// Configured returns the tools that are defined in the "wrappers" configuration
+// field, sorted by name. Call Validate before running them.
+func Configured() ([]Tool, error) {
+	var configured map[string]Tool
+	if err := viper.UnmarshalKey(appconfig.Wrappers, &configured); err != nil {
+		return nil, fmt.Errorf("failed to parse the %s configuration field: %w", appconfig.Wrappers, err)
+	}
+
+	tools := make([]Tool, 0, len(configured))
+	for name, tool := range configured {
+		tool.Name = name
+		if tool.Path == "" {
+			tool.Path = name
+		}
+		if tool.Description == "" {
+			tool.Description = fmt.Sprintf("Run %s with the permissions of the specified service account", name)
+		}
+		tools = append(tools, tool)
+	}
+	sort.Slice(tools, func(i, j int) bool { return tools[i].Name < tools[j].Name })
+	return tools, nil
+}
+
+// Validate checks that the templates of the tool can be parsed.
+func (t *Tool) Validate() error {
+	for _, text := range append(append([]string(nil), t.Args...), t.Env...) {
+		if _, err := newTemplate(text); err != nil {
+			return fmt.Errorf("invalid template in the %s wrapper: %w", t.Name, err)
+		}
+	}
+	for _, env := range t.Env {
+		if !strings.Contains(env, "=") {
+			return fmt.Errorf("invalid environment variable %q in the %s wrapper: expected KEY=VALUE", env, t.Name)
+		}
+	}
+	return nil
+}
+
+// Command returns the command that runs the tool with args and the credentials of
+// the session.
+func (t *Tool) Command(s *Session, args []string) (*exec.Cmd, error) {
+	if t.Path == "" {
+		return nil, fmt.Errorf("%q: executable file not found in $PATH", t.Name)
+	}
+
+	authArgs, err := s.render(t.Args)
+	if err != nil {
+		return nil, err
+	}
+	env, err := s.render(t.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	c := exec.Command(t.Path, InsertArgs(args, authArgs)...) //nolint:gosec // Runs the tool the user asked for
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Stdin = os.Stdin
+	c.Env = os.Environ()
+	if s.Reason != "" {
+		// gcloud, and any tool that calls it, reads the CLOUDSDK_CORE_REQUEST_REASON
+		// environment variable and sets the X-Goog-Request-Reason header in API
+		// requests to its value.
+		c.Env = append(c.Env, "CLOUDSDK_CORE_REQUEST_REASON="+s.Reason)
+	}
+	c.Env = mergeEnv(c.Env, env)
+	return c, nil
+}
+
+// mergeEnv adds env to environ, leaving out every variable whose value in env is
+// empty. exec.Cmd uses the last value of variables that are set more than once.
+func mergeEnv(environ, env []string) []string {
+	unset := map[string]bool{}
+	for _, kv := range env {
+		key := envKey(kv)
+		unset[key] = kv == key+"="
+	}
+
+	merged := make([]string, 0, len(environ)+len(env))
+	for _, kv := range append(environ[:len(environ):len(environ)], env...) {
+		if !unset[envKey(kv)] {
+			merged = append(merged, kv)
+		}
+	}
+	return merged
+}
+
+func envKey(kv string) string {
+	return strings.SplitN(kv, "=", 2)[0]
+}
+
+// InsertArgs adds authArgs to args before the first "--" argument, which ends the
+// flags of most tools, or after all the arguments if there is none.
+func InsertArgs(args, authArgs []string) []string {
+	end := len(args)
+	for i, arg := range args {
+		if arg == "--" {
+			end = i
+			break
+		}
+	}
+
+	cmdArgs := make([]string, 0, len(args)+len(authArgs))
+	cmdArgs = append(cmdArgs, args[:end]...)
+	cmdArgs = append(cmdArgs, authArgs...)
+	return append(cmdArgs, args[end:]...)
+}
+
+// Session holds the values that the templates of a tool can refer to:
+//
+//	{{.ServiceAccount}}  The email of the service account.
+//	{{.Reason}}          The reason for using the service account.
+//	{{.Project}}         The project.
+//	{{.AccessToken}}     An access token for the service account.
+//	{{.TokenFile}}       A temporary file that contains the access token.
+//	{{.MetadataHost}}    The host:port/secret of a local metadata server that
+//	                     serves refreshed tokens for the service account.
+//	{{.CredentialsFile}} An application default credentials file in TempDir
+//	                     that gets refreshed tokens from the metadata server.
+//	{{.TempDir}}         An empty temporary directory.
+//	{{.IsolatedHome}}    A home directory that links to the user's home
+//	                     directory, without their gcloud configuration.
+//	{{.Kubeconfig}}      A kubeconfig for the session's GKE cluster, or the
+//	                     user's own kubeconfig if there is no cluster.
+//
+// The credentials are only generated, and the metadata server is only started, if
+// a template refers to them. Call Close once the tool exits.
+type Session struct {
+	ServiceAccount string
+	Reason         string
+	Project        string
+	// SessionLimit is how long the metadata server serves tokens for. There is no
+	// limit if it is zero.
+	SessionLimit time.Duration
+	// MetadataPort is the port that the metadata server listens on. A random port
+	// is used if it is empty, so that several tools can run at once.
+	MetadataPort string
+	// Cluster is the GKE cluster that the kubeconfig connects to, if any.
+	Cluster *Cluster
+	// KubeUser and KubeGroups are the Kubernetes user and groups that the kubeconfig
+	// impersonates, if any.
+	KubeUser   string
+	KubeGroups []string
+
+	accessToken  string
+	creds        *credentials.Env
+	kubeconfig   string
+	home         string
+	metadata     *metadata.Server
+	metadataHost string
+	credsFile    string
+	tempDir      string
+	// err is the error from generating the credentials, which is reported instead
+	// of the template error that wraps it.
+	err error
+}
+
+// AccessToken returns an access token for the service account.
+func (s *Session) AccessToken() (string, error) {
+	if s.accessToken != "" {
+		return s.accessToken, nil
+	}
+
+	util.Logger.Infof("Fetching access token for %s", s.ServiceAccount)
+	resp, err := gcpclient.GenerateTemporaryAccessToken(s.ServiceAccount, s.Reason)
+	if err != nil {
+		s.err = err
+		return "", err
+	}
+	s.accessToken = resp.GetAccessToken()
+	return s.accessToken, nil
+}
+
+// TokenFile returns the path to a temporary file that only the user can read and
+// that contains an access token for the service account.
+func (s *Session) TokenFile() (string, error) {
+	if s.creds != nil {
+		return s.creds.TokenFile, nil
+	}
+
+	token, err := s.AccessToken()
+	if err != nil {
+		return "", err
+	}
+	creds, err := credentials.New(token)
+	if err != nil {
+		s.err = fmt.Errorf("failed to write temporary credentials: %w", err)
+		return "", s.err
+	}
+	s.creds = creds
+	return s.creds.TokenFile, nil
+}
+
+// Close stops the metadata server and removes the temporary files of the session,
+// including the credentials file.
+func (s *Session) Close() error {
+	var errs []error
+	if s.metadata != nil {
+		errs = append(errs, s.metadata.Shutdown(context.Background()))
+	}
+	if s.creds != nil {
+		errs = append(errs, s.creds.Remove())
+	}
+	if s.tempDir != "" {
+		errs = append(errs, os.RemoveAll(s.tempDir))
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MetadataHost starts a metadata server that serves tokens for the service account
+// and returns its host:port followed by the server's secret path prefix.
+func (s *Session) MetadataHost() (string, error) {
+	if s.metadataHost != "" {
+		return s.metadataHost, nil
+	}
+
+	srv := metadata.New(metadata.Options{
+		ServiceAccount: s.ServiceAccount,
+		Project:        s.Project,
+		Token: func() (string, time.Time, error) {
+			resp, err := gcpclient.GenerateTemporaryAccessToken(s.ServiceAccount, s.Reason)
+			if err != nil {
+				return "", time.Time{}, err
+			}
+			return resp.GetAccessToken(), resp.GetExpireTime().AsTime(), nil
+		},
+		IDToken: func(audience string, includeEmail bool) (string, error) {
+			return gcpclient.GenerateIDToken(s.ServiceAccount, audience, s.Reason, includeEmail)
+		},
+		SessionLimit: s.SessionLimit,
+	})
+	port := s.MetadataPort
+	if port == "" {
+		port = "0"
+	}
+	addr, err := srv.Start(net.JoinHostPort(viper.GetString(appconfig.MetadataServerAddress), port))
+	if err != nil {
+		s.err = fmt.Errorf("failed to start the metadata server: %w", err)
+		return "", s.err
+	}
+	s.metadata, s.metadataHost = srv, addr
+	return s.metadataHost, nil
+}
+
+// CredentialsFile starts a metadata server and writes an application default
+// credentials file that gets access tokens from it to TempDir, named as gcloud names
+// it so that it is also found when TempDir is the gcloud configuration directory.
+// It returns the path to the file.
+func (s *Session) CredentialsFile() (string, error) {
+	if s.credsFile != "" {
+		return s.credsFile, nil
+	}
+
+	host, err := s.MetadataHost()
+	if err != nil {
+		return "", err
+	}
+	dir, err := s.TempDir()
+	if err != nil {
+		return "", err
+	}
+	data, err := metadata.CredentialsJSON(host)
+	if err != nil {
+		s.err = err
+		return "", err
+	}
+	path := filepath.Join(dir, "application_default_credentials.json")
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		s.err = fmt.Errorf("failed to write the credentials file: %w", err)
+		return "", s.err
+	}
+	s.credsFile = path
+	return s.credsFile, nil
+}
+
+// TempDir returns an empty temporary directory, e.g. to use as the home directory of
+// a tool so that it doesn't find the user's own credentials.
+func (s *Session) TempDir() (string, error) {
+	if s.tempDir != "" {
+		return s.tempDir, nil
+	}
+
+	dir, err := ioutil.TempDir("", "eiam-")
+	if err != nil {
+		s.err = err
+		return "", err
+	}
+	s.tempDir = dir
+	return s.tempDir, nil
+}
+
+// Done returns a channel that is closed when the session limit of the metadata
+// server is reached. It returns nil if the metadata server isn't running.
+func (s *Session) Done() <-chan struct{} {
+	if s.metadata == nil {
+		return nil
+	}
+	return s.metadata.Done()
+}
+
+func (s *Session) render(templates []string) ([]string, error) {
+	rendered := make([]string, 0, len(templates))
+	for _, text := range templates {
+		tmpl, err := newTemplate(text)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, s); err != nil {
+			if s.err != nil {
+				return nil, s.err
+			}
+			return nil, err
+		}
+		rendered = append(rendered, buf.String())
+	}
+	return rendered, nil
+}
+
+func newTemplate(text string) (*template.Template, error) {
+	return template.New("").Option("missingkey=error").Parse(text)
+}
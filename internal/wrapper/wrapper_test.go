@@ -0,0 +1,349 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wrapper
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2/google"
+
+	"github.com/rigup/ephemeral-iam/internal/appconfig"
+	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	"github.com/rigup/ephemeral-iam/internal/gcpclient/clients/clientstest"
+)
+
+const testServiceAccount = "sa@p.iam.gserviceaccount.com"
+
+func init() {
+	util.Logger = logrus.New()
+}
+
+func newSession() *Session {
+	return &Session{ServiceAccount: testServiceAccount, Reason: "testing", Project: "p"}
+}
+
+func TestInsertArgs(t *testing.T) {
+	auth := []string{"--token", "t"}
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"--token", "t"}},
+		{[]string{"get", "pods"}, []string{"get", "pods", "--token", "t"}},
+		{
+			[]string{"exec", "-it", "pod", "--", "sh", "--", "x"},
+			[]string{"exec", "-it", "pod", "--token", "t", "--", "sh", "--", "x"},
+		},
+		{[]string{"--", "sh"}, []string{"--token", "t", "--", "sh"}},
+	}
+	for _, tt := range tests {
+		if got := InsertArgs(tt.args, auth); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("InsertArgs(%v): expected %v, got %v", tt.args, tt.want, got)
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	srv := clientstest.Start(t)
+
+	tool := Tool{
+		Name: "helm",
+		Path: "/usr/local/bin/helm",
+		Args: []string{"--kube-token", "{{.AccessToken}}", "--kube-as-user={{.ServiceAccount}}"},
+		Env:  []string{"HELM_PROJECT={{.Project}}", "HELM_TOKEN={{.AccessToken}}"},
+	}
+	c, err := tool.Command(newSession(), []string{"list", "--", "extra"})
+	if err != nil {
+		t.Fatalf("failed to create command: %v", err)
+	}
+
+	token := "token-for-" + testServiceAccount
+	wantArgs := []string{
+		"/usr/local/bin/helm", "list", "--kube-token", token, "--kube-as-user=" + testServiceAccount, "--", "extra",
+	}
+	if !reflect.DeepEqual(c.Args, wantArgs) {
+		t.Errorf("expected args %v, got %v", wantArgs, c.Args)
+	}
+	wantEnv := []string{"CLOUDSDK_CORE_REQUEST_REASON=testing", "HELM_PROJECT=p", "HELM_TOKEN=" + token}
+	if env := c.Env[len(c.Env)-3:]; !reflect.DeepEqual(env, wantEnv) {
+		t.Errorf("expected env %v, got %v", wantEnv, env)
+	}
+
+	// The access token is only generated once.
+	var generated int
+	for _, req := range srv.Requests() {
+		if strings.HasSuffix(req.Method, "/GenerateAccessToken") {
+			generated++
+		}
+	}
+	if generated != 1 {
+		t.Errorf("expected 1 access token to be generated, got %d", generated)
+	}
+}
+
+func TestCommandWithoutToken(t *testing.T) {
+	srv := clientstest.Start(t)
+
+	tool := Tool{Name: "gcloud", Path: "gcloud", Args: Gcloud().Args}
+	c, err := tool.Command(newSession(), []string{"compute", "instances", "list"})
+	if err != nil {
+		t.Fatalf("failed to create command: %v", err)
+	}
+	want := []string{
+		"gcloud", "compute", "instances", "list", "--impersonate-service-account", testServiceAccount, "--verbosity=error",
+	}
+	if !reflect.DeepEqual(c.Args, want) {
+		t.Errorf("expected args %v, got %v", want, c.Args)
+	}
+	if reqs := srv.Requests(); len(reqs) != 0 {
+		t.Errorf("expected no access token to be generated, got requests %v", reqs)
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	clientstest.Start(t)
+
+	if _, err := (&Tool{Name: "missing"}).Command(newSession(), nil); err == nil {
+		t.Error("expected an error for a tool without a path")
+	}
+
+	// Errors from generating the token are reported instead of the template error.
+	tool := Tool{Name: "bad", Path: "bad", Args: []string{"{{.AccessToken}}"}}
+	session := newSession()
+	session.ServiceAccount = "unknown"
+	_, err := tool.Command(session, nil)
+	if err == nil || strings.Contains(err.Error(), "template") {
+		t.Errorf("expected the token generation error, got %v", err)
+	}
+}
+
+func TestTokenFile(t *testing.T) {
+	clientstest.Start(t)
+
+	session := newSession()
+	path, err := session.TokenFile()
+	if err != nil {
+		t.Fatalf("failed to write the token file: %v", err)
+	}
+	if token, err := ioutil.ReadFile(path); err != nil || string(token) != "token-for-"+testServiceAccount {
+		t.Errorf("unexpected token file contents %q (%v)", token, err)
+	}
+	if again, _ := session.TokenFile(); again != path {
+		t.Errorf("expected the token file to be reused, got %s and %s", path, again)
+	}
+
+	if err := session.Close(); err != nil {
+		t.Fatalf("failed to close the session: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the token file to be removed, got %v", err)
+	}
+}
+
+func TestMetadataServer(t *testing.T) {
+	clientstest.Start(t)
+	defer viper.Reset()
+	viper.Set(appconfig.MetadataServerAddress, "127.0.0.1")
+
+	session := newSession()
+	tool := CloudSQLProxy()
+	tool.Path = "cloud-sql-proxy"
+	c, err := tool.Command(session, []string{"p:us-central1:db"})
+	if err != nil {
+		t.Fatalf("failed to create command: %v", err)
+	}
+	if want := []string{"cloud-sql-proxy", "p:us-central1:db"}; !reflect.DeepEqual(c.Args, want) {
+		t.Errorf("expected args %v, got %v", want, c.Args)
+	}
+
+	env := map[string]string{}
+	for _, kv := range c.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	host := env["GCE_METADATA_HOST"]
+	if host == "" || env["GCE_METADATA_IP"] != host {
+		t.Fatalf("expected the metadata server address in the environment, got %q and %q", host, env["GCE_METADATA_IP"])
+	}
+	if env["GOOGLE_APPLICATION_CREDENTIALS"] != "" {
+		t.Errorf("expected GOOGLE_APPLICATION_CREDENTIALS to be cleared, got %q", env["GOOGLE_APPLICATION_CREDENTIALS"])
+	}
+	home := env["HOME"]
+	if home == "" || env["CLOUDSDK_CONFIG"] != home {
+		t.Errorf("expected HOME and CLOUDSDK_CONFIG to be a temporary directory, got %q and %q", home, env["CLOUDSDK_CONFIG"])
+	}
+
+	tokenURL := "http://" + host + "/computeMetadata/v1/instance/service-accounts/default/token"
+	req, err := http.NewRequest(http.MethodGet, tokenURL, nil) //nolint:noctx // Test request
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to request a token from the metadata server: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "token-for-"+testServiceAccount) {
+		t.Errorf("expected a token for the service account, got %s", body)
+	}
+
+	if err := session.Close(); err != nil {
+		t.Fatalf("failed to close the session: %v", err)
+	}
+	if _, err := os.Stat(home); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary directory to be removed, got %v", err)
+	}
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Error("expected the metadata server to be stopped")
+	}
+}
+
+func TestExec(t *testing.T) {
+	clientstest.Start(t)
+	defer viper.Reset()
+	viper.Set(appconfig.MetadataServerAddress, "127.0.0.1")
+	if adc, ok := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); ok {
+		defer os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", adc)
+	} else {
+		defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "/home/user/adc.json")
+
+	session := newSession()
+	defer session.Close()
+	tool := Exec("python", "/usr/bin/python")
+	c, err := tool.Command(session, []string{"backfill.py"})
+	if err != nil {
+		t.Fatalf("failed to create command: %v", err)
+	}
+
+	env := map[string]string{}
+	for _, kv := range c.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		env[parts[0]] = parts[1]
+	}
+	adc := env["GOOGLE_APPLICATION_CREDENTIALS"]
+	if adc == "" || adc == "/home/user/adc.json" {
+		t.Errorf("expected GOOGLE_APPLICATION_CREDENTIALS to be the session's credentials file, got %q", adc)
+	}
+	if want := filepath.Join(env["CLOUDSDK_CONFIG"], "application_default_credentials.json"); adc != want {
+		t.Errorf("expected the credentials file in the gcloud configuration directory %s, got %s", want, adc)
+	}
+	if env["GCE_METADATA_HOST"] == "" || env["GOOGLE_OAUTH_ACCESS_TOKEN"] != "token-for-"+testServiceAccount {
+		t.Errorf("expected the metadata server and access token in the environment, got %v", env)
+	}
+	if env["CLOUDSDK_CORE_PROJECT"] != "p" || env["CLOUDSDK_CORE_REQUEST_REASON"] != "testing" {
+		t.Errorf("expected the project and reason in the environment, got %v", env)
+	}
+	if userHome, _ := os.UserHomeDir(); env["HOME"] == userHome {
+		t.Errorf("expected HOME to be an isolated home directory, got %s", env["HOME"])
+	}
+
+	// Only the access token is written, never the user's own credentials.
+	files, err := ioutil.ReadDir(filepath.Dir(env["CLOUDSDK_AUTH_ACCESS_TOKEN_FILE"]))
+	if err != nil || len(files) != 1 {
+		t.Errorf("expected only the token file to be written, got %v (%v)", files, err)
+	}
+
+	// The credentials file gets its tokens from the metadata server.
+	data, err := ioutil.ReadFile(adc)
+	if err != nil {
+		t.Fatalf("failed to read the credentials file: %v", err)
+	}
+	creds, err := google.CredentialsFromJSON(context.Background(), data)
+	if err != nil {
+		t.Fatalf("failed to parse the credentials file: %v", err)
+	}
+	if token, err := creds.TokenSource.Token(); err != nil || token.AccessToken != "token-for-"+testServiceAccount {
+		t.Errorf("expected a token for the service account through the credentials file, got %v (%v)", token, err)
+	}
+
+	if err := session.Close(); err != nil {
+		t.Fatalf("failed to close the session: %v", err)
+	}
+	if _, err := os.Stat(adc); !os.IsNotExist(err) {
+		t.Errorf("expected the credentials file to be removed, got %v", err)
+	}
+}
+
+func TestConfigured(t *testing.T) {
+	defer viper.Reset()
+	viper.Set(appconfig.Wrappers, map[string]interface{}{
+		"terraform": map[string]interface{}{
+			"env": []string{"GOOGLE_OAUTH_ACCESS_TOKEN={{.AccessToken}}"},
+		},
+		"helm": map[string]interface{}{
+			"path":        "/usr/local/bin/helm",
+			"description": "Run helm",
+			"args":        []string{"--kube-token", "{{.AccessToken}}"},
+		},
+		"broken": map[string]interface{}{
+			"args": []string{"{{.AccessToken"},
+			"env":  []string{"NO_VALUE"},
+		},
+	})
+
+	tools, err := Configured()
+	if err != nil {
+		t.Fatalf("failed to load the configured tools: %v", err)
+	}
+	want := []Tool{
+		{
+			Name:        "broken",
+			Path:        "broken",
+			Description: "Run broken with the permissions of the specified service account",
+			Args:        []string{"{{.AccessToken"},
+			Env:         []string{"NO_VALUE"},
+		},
+		{
+			Name:        "helm",
+			Path:        "/usr/local/bin/helm",
+			Description: "Run helm",
+			Args:        []string{"--kube-token", "{{.AccessToken}}"},
+		},
+		{
+			Name:        "terraform",
+			Path:        "terraform",
+			Description: "Run terraform with the permissions of the specified service account",
+			Env:         []string{"GOOGLE_OAUTH_ACCESS_TOKEN={{.AccessToken}}"},
+		},
+	}
+	if !reflect.DeepEqual(tools, want) {
+		t.Fatalf("expected tools %+v, got %+v", want, tools)
+	}
+
+	if err := tools[0].Validate(); err == nil {
+		t.Error("expected the broken tool to be invalid")
+	}
+	for _, tool := range tools[1:] {
+		if err := tool.Validate(); err != nil {
+			t.Errorf("expected the %s tool to be valid: %v", tool.Name, err)
+		}
+	}
+	if err := (&Tool{Name: "env", Env: []string{"NO_VALUE"}}).Validate(); err == nil {
+		t.Error("expected an environment variable without a value to be invalid")
+	}
+}
@@ -33,13 +33,18 @@ const (
 	RequiredAnnotation = "eiam_required_flag"
 )
 
-// YesOption designates whether to prompt for confirmation or not.
+// YesOption designates whether to prompt for confirmation or not. RefreshOption
+// designates whether to ignore cached API responses or not.
 var (
-	YesOption = false
+	YesOption     = false
+	RefreshOption = false
 )
 
 // Flag names and shorthands.
 var (
+	// AllProjectsFlag selects every project that the user can see.
+	AllProjectsFlag = flagName{"all-projects", ""}
+
 	// FormatFlag controls the output format for a command.
 	FormatFlag = flagName{"format", "f"}
 
@@ -49,6 +54,9 @@ var (
 	// ReasonFlag enforces that a rationale be given for a command.
 	ReasonFlag = flagName{"reason", "R"}
 
+	// RefreshFlag is a boolean that when set to true clears cached API responses.
+	RefreshFlag = flagName{"refresh", ""}
+
 	// RegionFlag sets the GCP region to use for a command.
 	RegionFlag = flagName{"region", "r"}
 
@@ -69,19 +77,43 @@ type flagName struct {
 
 // CmdConfig holds the values passed to a command.
 type CmdConfig struct {
+	Address             string
+	AllProjects         bool
+	AutoIAMAuthn        bool
+	Cluster             string
+	Compare             []string
 	ComputeInstance     string
+	Explain             bool
+	Folder              string
+	KubeAs              string
+	KubeAsGroups        []string
+	Location            string
+	Organization        string
+	Output              string
+	Permissions         []string
+	Port                int
+	PrivateIP           bool
 	Project             string
 	PubSubTopic         string
 	Reason              string
 	Region              string
+	Resource            string
 	ServiceAccountEmail string
 	StorageBucket       string
+	UnixSocket          string
 	Zone                string
 }
 
 // AddPersistentFlags add persistent flags to the root command.
 func AddPersistentFlags(fs *pflag.FlagSet) {
 	fs.BoolVarP(&YesOption, YesFlag.Name, YesFlag.Shorthand, YesOption, "Assume 'yes' to all prompts")
+	fs.BoolVarP(
+		&RefreshOption,
+		RefreshFlag.Name,
+		RefreshFlag.Shorthand,
+		RefreshOption,
+		"Clear cached API responses before running the command",
+	)
 
 	currLogFmt := viper.GetString(appconfig.LoggingFormat)
 	fs.StringP(FormatFlag.Name, FormatFlag.Shorthand, currLogFmt, "Set the output of the current command")
@@ -90,6 +122,17 @@ func AddPersistentFlags(fs *pflag.FlagSet) {
 	}
 }
 
+// AddAllProjectsFlag adds the --all-projects flag to the command.
+func AddAllProjectsFlag(fs *pflag.FlagSet, allProjects *bool) {
+	fs.BoolVarP(
+		allProjects,
+		AllProjectsFlag.Name,
+		AllProjectsFlag.Shorthand,
+		false,
+		"Use every project that you can see instead of a single project",
+	)
+}
+
 // AddProjectFlag adds the --project/-p flag to the command.
 func AddProjectFlag(fs *pflag.FlagSet, project *string, required bool) {
 	defaultVal, err := gcpclient.GetCurrentProject()
@@ -0,0 +1,91 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package options
+
+import (
+	"errors"
+
+	"github.com/spf13/pflag"
+
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
+)
+
+// Flag names and shorthands.
+var (
+	// KubeAsFlag sets the Kubernetes user to impersonate.
+	KubeAsFlag = flagName{"as", ""}
+
+	// KubeAsGroupFlag sets the Kubernetes groups to impersonate.
+	KubeAsGroupFlag = flagName{"as-group", ""}
+
+	// ClusterFlag sets the GKE cluster to use for a command.
+	ClusterFlag = flagName{"cluster", ""}
+
+	// LocationFlag sets the region or zone of the GKE cluster to use for a command.
+	LocationFlag = flagName{"location", ""}
+)
+
+// AddClusterFlag adds the --cluster flag to the command.
+func AddClusterFlag(fs *pflag.FlagSet, cluster *string) {
+	fs.StringVarP(
+		cluster,
+		ClusterFlag.Name,
+		ClusterFlag.Shorthand,
+		"",
+		"The GKE cluster to connect to instead of the current context of your kubeconfig",
+	)
+}
+
+// AddLocationFlag adds the --location flag to the command.
+func AddLocationFlag(fs *pflag.FlagSet, location *string) {
+	fs.StringVarP(
+		location,
+		LocationFlag.Name,
+		LocationFlag.Shorthand,
+		"",
+		"The region or zone of the GKE cluster. Only needed if several clusters have the same name",
+	)
+}
+
+// AddKubeAsFlag adds the --as flag to the command.
+func AddKubeAsFlag(fs *pflag.FlagSet, user *string) {
+	fs.StringVarP(
+		user,
+		KubeAsFlag.Name,
+		KubeAsFlag.Shorthand,
+		"",
+		"The Kubernetes user to impersonate, so that RBAC is checked for it instead of the service account",
+	)
+}
+
+// AddKubeAsGroupFlag adds the --as-group flag to the command.
+func AddKubeAsGroupFlag(fs *pflag.FlagSet, groups *[]string) {
+	fs.StringArrayVarP(
+		groups,
+		KubeAsGroupFlag.Name,
+		KubeAsGroupFlag.Shorthand,
+		[]string{},
+		"A Kubernetes group to impersonate. Can be repeated. Requires --as",
+	)
+}
+
+// CheckKubeImpersonation ensures that a Kubernetes user is impersonated if groups are.
+func CheckKubeImpersonation(user string, groups []string) error {
+	if user == "" && len(groups) > 0 {
+		err := errors.New("--as-group requires --as, because Kubernetes only impersonates groups of a user")
+		return errorsutil.New("Invalid command arguments", err)
+	}
+	return nil
+}
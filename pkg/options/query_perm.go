@@ -15,23 +15,59 @@
 package options
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/spf13/pflag"
 
 	util "github.com/rigup/ephemeral-iam/internal/eiamutil"
+	errorsutil "github.com/rigup/ephemeral-iam/internal/errors"
 )
 
 // Flag names and shorthands.
 var (
+	// CompareFlag sets the principals to compare the permissions of.
+	CompareFlag = flagName{"compare", ""}
+
 	// ComputeInstanceFlag sets the compute instance to use for a command.
 	ComputeInstanceFlag = flagName{"instance", "i"}
 
+	// ExplainFlag explains which role bindings grant each permission.
+	ExplainFlag = flagName{"explain", ""}
+
+	// FolderFlag sets the folder to use for a command.
+	FolderFlag = flagName{"folder", ""}
+
+	// OrganizationFlag sets the organization to use for a command.
+	OrganizationFlag = flagName{"organization", ""}
+
+	// OutputFlag sets the output format of a command.
+	OutputFlag = flagName{"output", "o"}
+
+	// PermissionFlag sets the permissions that a command requires.
+	PermissionFlag = flagName{"permission", ""}
+
 	// PubSubTopicFlag sets the Pub/Sub topic to use for a command.
 	PubSubTopicFlag = flagName{"topic", "t"}
 
+	// ResourceFlag sets the full resource name to use for a command.
+	ResourceFlag = flagName{"resource", ""}
+
 	// StorageBucketFlag sets the GCS bucket to use for a command.
 	StorageBucketFlag = flagName{"bucket", "b"}
 )
 
+// AddCompareFlag adds the --compare flag to the command.
+func AddCompareFlag(fs *pflag.FlagSet, principals *[]string) {
+	fs.StringSliceVarP(
+		principals,
+		CompareFlag.Name,
+		CompareFlag.Shorthand,
+		[]string{},
+		"A comma-separated list of service accounts to compare the permissions of. Use 'me' for your own account",
+	)
+}
+
 // AddComputeInstanceFlag adds the --instance/-i flag to the command.
 func AddComputeInstanceFlag(fs *pflag.FlagSet, instance *string, required bool) {
 	fs.StringVarP(
@@ -48,6 +84,89 @@ func AddComputeInstanceFlag(fs *pflag.FlagSet, instance *string, required bool)
 	}
 }
 
+// AddExplainFlag adds the --explain flag to the command.
+func AddExplainFlag(fs *pflag.FlagSet, explain *bool) {
+	fs.BoolVarP(
+		explain,
+		ExplainFlag.Name,
+		ExplainFlag.Shorthand,
+		false,
+		"Show the role bindings in the resource hierarchy that grant each permission",
+	)
+}
+
+// AddFolderFlag adds the --folder flag to the command.
+func AddFolderFlag(fs *pflag.FlagSet, folder *string, required bool) {
+	fs.StringVarP(folder, FolderFlag.Name, FolderFlag.Shorthand, "", "The numeric ID of the folder")
+	if required {
+		if err := fs.SetAnnotation(FolderFlag.Name, RequiredAnnotation, []string{"true"}); err != nil {
+			util.Logger.Fatalf("failed to set required annotation on flag: %v", err)
+		}
+	}
+}
+
+// AddOrganizationFlag adds the --organization flag to the command.
+func AddOrganizationFlag(fs *pflag.FlagSet, organization *string, required bool) {
+	fs.StringVarP(
+		organization,
+		OrganizationFlag.Name,
+		OrganizationFlag.Shorthand,
+		"",
+		"The numeric ID of the organization",
+	)
+	if required {
+		if err := fs.SetAnnotation(OrganizationFlag.Name, RequiredAnnotation, []string{"true"}); err != nil {
+			util.Logger.Fatalf("failed to set required annotation on flag: %v", err)
+		}
+	}
+}
+
+// AddOutputFlag adds the --output/-o flag to the command.
+func AddOutputFlag(fs *pflag.FlagSet, output *string) {
+	fs.StringVarP(
+		output,
+		OutputFlag.Name,
+		OutputFlag.Shorthand,
+		util.OutputTable,
+		fmt.Sprintf("The output format. One of %v", util.OutputFormats),
+	)
+}
+
+// CheckOutputFormat ensures that the value of the --output flag is supported.
+func CheckOutputFormat(output string) error {
+	if !util.Contains(util.OutputFormats, output) {
+		err := fmt.Errorf("output format must be one of %v", util.OutputFormats)
+		return errorsutil.New("Invalid command arguments", err)
+	}
+	return nil
+}
+
+// AddPermissionFlag adds the --permission flag to the command.
+func AddPermissionFlag(fs *pflag.FlagSet, permissions *[]string) {
+	fs.StringSliceVarP(
+		permissions,
+		PermissionFlag.Name,
+		PermissionFlag.Shorthand,
+		[]string{},
+		"A comma-separated list of the permissions that are required",
+	)
+}
+
+// CheckPermissions ensures that at least one permission was passed to the --permission flag.
+func CheckPermissions(permissions []string) error {
+	if len(permissions) == 0 {
+		err := fmt.Errorf("at least one permission is required")
+		return errorsutil.New("Missing required flag --permission", err)
+	}
+	for _, perm := range permissions {
+		if strings.Count(perm, ".") != 2 {
+			err := fmt.Errorf("%q is not a valid permission, e.g. compute.instances.delete", perm)
+			return errorsutil.New("Invalid command arguments", err)
+		}
+	}
+	return nil
+}
+
 // AddPubSubTopicFlag adds the --topic/-t flag to the command.
 func AddPubSubTopicFlag(fs *pflag.FlagSet, topic *string, required bool) {
 	fs.StringVarP(topic, PubSubTopicFlag.Name, PubSubTopicFlag.Shorthand, "", "The name of the Pub/Sub topic")
@@ -58,6 +177,17 @@ func AddPubSubTopicFlag(fs *pflag.FlagSet, topic *string, required bool) {
 	}
 }
 
+// AddResourceFlag adds the --resource flag to the command.
+func AddResourceFlag(fs *pflag.FlagSet, resource *string) {
+	fs.StringVarP(
+		resource,
+		ResourceFlag.Name,
+		ResourceFlag.Shorthand,
+		"",
+		"The full resource name of the resource. Defaults to the project",
+	)
+}
+
 // AddStorageBucketFlag adds the --bucket/-b flag to the command.
 func AddStorageBucketFlag(fs *pflag.FlagSet, bucket *string, required bool) {
 	fs.StringVarP(
@@ -0,0 +1,87 @@
+// Copyright 2021 Workrise Technologies Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package options
+
+import (
+	"github.com/spf13/pflag"
+)
+
+// Flag names and shorthands.
+var (
+	// AddressFlag sets the local address that a command listens on.
+	AddressFlag = flagName{"address", "a"}
+
+	// AutoIAMAuthnFlag enables IAM database authentication for Cloud SQL instances.
+	AutoIAMAuthnFlag = flagName{"auto-iam-authn", ""}
+
+	// PortFlag sets the first local port that a command listens on.
+	PortFlag = flagName{"port", ""}
+
+	// PrivateIPFlag connects to the private IP address of Cloud SQL instances.
+	PrivateIPFlag = flagName{"private-ip", ""}
+
+	// UnixSocketFlag sets the directory that a command creates Unix sockets in.
+	UnixSocketFlag = flagName{"unix-socket", ""}
+)
+
+// AddAddressFlag adds the --address/-a flag to the command.
+func AddAddressFlag(fs *pflag.FlagSet, address *string) {
+	fs.StringVarP(address, AddressFlag.Name, AddressFlag.Shorthand, "127.0.0.1", "The local address to listen on")
+}
+
+// AddAutoIAMAuthnFlag adds the --auto-iam-authn flag to the command.
+func AddAutoIAMAuthnFlag(fs *pflag.FlagSet, autoIAMAuthn *bool) {
+	fs.BoolVarP(
+		autoIAMAuthn,
+		AutoIAMAuthnFlag.Name,
+		AutoIAMAuthnFlag.Shorthand,
+		false,
+		"Log in to the databases as the service account with IAM database authentication",
+	)
+}
+
+// AddPortFlag adds the --port flag to the command.
+func AddPortFlag(fs *pflag.FlagSet, port *int) {
+	fs.IntVarP(
+		port,
+		PortFlag.Name,
+		PortFlag.Shorthand,
+		0,
+		"The local port to listen on. Each additional instance listens on the next port. "+
+			"Defaults to the standard port of the database engine",
+	)
+}
+
+// AddPrivateIPFlag adds the --private-ip flag to the command.
+func AddPrivateIPFlag(fs *pflag.FlagSet, privateIP *bool) {
+	fs.BoolVarP(
+		privateIP,
+		PrivateIPFlag.Name,
+		PrivateIPFlag.Shorthand,
+		false,
+		"Connect to the private IP address of the instances",
+	)
+}
+
+// AddUnixSocketFlag adds the --unix-socket flag to the command.
+func AddUnixSocketFlag(fs *pflag.FlagSet, dir *string) {
+	fs.StringVarP(
+		dir,
+		UnixSocketFlag.Name,
+		UnixSocketFlag.Shorthand,
+		"",
+		"A directory to create a Unix socket in for each instance instead of listening on TCP ports",
+	)
+}